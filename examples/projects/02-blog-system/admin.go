@@ -0,0 +1,230 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxBulkModeration 单次批量审核的评论数上限
+const maxBulkModeration = 200
+
+// loadTargetUser 加载路径 :id 指定的用户，不允许管理员操作自己，避免误操作后失去管理权限
+func loadTargetUser(c *gin.Context) (User, bool) {
+	var user User
+	if err := db.First(&user, parseID(c)).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
+		return user, false
+	}
+	if user.ID == currentUserID(c) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "不能修改自己的角色或封禁状态"})
+		return user, false
+	}
+	return user, true
+}
+
+// handleListUsers 用户列表，支持按角色、封禁状态和关键词过滤
+func handleListUsers(c *gin.Context) {
+	page, pageSize := pagination(c)
+
+	query := db.Model(&User{})
+	if role := c.Query("role"); role != "" {
+		query = query.Where("role = ?", role)
+	}
+	if banned, err := strconv.ParseBool(c.Query("banned")); err == nil {
+		if banned {
+			query = query.Where("banned_at IS NOT NULL")
+		} else {
+			query = query.Where("banned_at IS NULL")
+		}
+	}
+	if q := c.Query("q"); q != "" {
+		query = query.Where("username LIKE ? OR email LIKE ?", "%"+q+"%", "%"+q+"%")
+	}
+
+	var total int64
+	query.Count(&total)
+
+	var users []User
+	query.Order("id ASC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&users)
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":      users,
+		"page":      page,
+		"page_size": pageSize,
+		"total":     total,
+	})
+}
+
+// handleChangeUserRole 修改用户角色
+func handleChangeUserRole(c *gin.Context) {
+	var req struct {
+		Role string `json:"role" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !validRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "角色只能是 reader、author、editor 或 admin"})
+		return
+	}
+	user, ok := loadTargetUser(c)
+	if !ok {
+		return
+	}
+
+	db.Model(&user).Update("role", req.Role)
+	c.JSON(http.StatusOK, gin.H{"message": "角色已更新", "data": user})
+}
+
+// handleBanUser 封禁用户，被封禁的用户不能发表文章、评论或互动
+func handleBanUser(c *gin.Context) {
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && c.Request.ContentLength > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user, ok := loadTargetUser(c)
+	if !ok {
+		return
+	}
+	if user.Role == RoleAdmin {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "不能封禁管理员，请先修改其角色"})
+		return
+	}
+
+	db.Model(&user).Updates(map[string]interface{}{"banned_at": time.Now(), "ban_reason": req.Reason})
+	c.JSON(http.StatusOK, gin.H{"message": "用户已封禁", "data": user})
+}
+
+// handleUnbanUser 解除封禁
+func handleUnbanUser(c *gin.Context) {
+	user, ok := loadTargetUser(c)
+	if !ok {
+		return
+	}
+	db.Model(&user).Updates(map[string]interface{}{"banned_at": nil, "ban_reason": ""})
+	c.JSON(http.StatusOK, gin.H{"message": "已解除封禁", "data": user})
+}
+
+// handleBulkModerateComments 批量审核评论
+func handleBulkModerateComments(c *gin.Context) {
+	var req struct {
+		IDs    []uint `json:"ids" binding:"required,min=1"`
+		Status string `json:"status" binding:"required,oneof=pending approved spam"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.IDs) > maxBulkModeration {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "单次最多审核 " + strconv.Itoa(maxBulkModeration) + " 条评论"})
+		return
+	}
+
+	result := db.Model(&Comment{}).Where("id IN ?", req.IDs).Update("status", req.Status)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+		return
+	}
+
+	var comments []Comment
+	db.Find(&comments, req.IDs)
+	for _, comment := range comments {
+		syncCommentIndex(comment)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "审核状态已更新", "updated": result.RowsAffected})
+}
+
+// handleSiteStats 站点统计：用户、文章、评论和互动总量，以及最近 days 天（默认 7）的新增数
+func handleSiteStats(c *gin.Context) {
+	days, _ := strconv.Atoi(c.DefaultQuery("days", "7"))
+	if days < 1 || days > 365 {
+		days = 7
+	}
+	since := time.Now().AddDate(0, 0, -days)
+
+	var roles []struct {
+		Role  string
+		Total int64
+	}
+	db.Model(&User{}).Select("role, COUNT(*) AS total").Group("role").Scan(&roles)
+	usersByRole := make(map[string]int64, len(rolePermissions))
+	var totalUsers int64
+	for role := range rolePermissions {
+		usersByRole[role] = 0
+	}
+	for _, row := range roles {
+		usersByRole[row.Role] = row.Total
+		totalUsers += row.Total
+	}
+	var bannedUsers, newUsers int64
+	db.Model(&User{}).Where("banned_at IS NOT NULL").Count(&bannedUsers)
+	db.Model(&User{}).Where("created_at >= ?", since).Count(&newUsers)
+
+	var publishedArticles, draftArticles, newArticles int64
+	db.Model(&Article{}).Scopes(published).Count(&publishedArticles)
+	db.Model(&Article{}).Where("published_at IS NULL").Count(&draftArticles)
+	db.Model(&Article{}).Where("published_at >= ?", since).Count(&newArticles)
+
+	var statuses []struct {
+		Status string
+		Total  int64
+	}
+	db.Model(&Comment{}).Select("status, COUNT(*) AS total").Group("status").Scan(&statuses)
+	commentsByStatus := map[string]int64{CommentPending: 0, CommentApproved: 0, CommentSpam: 0}
+	for _, row := range statuses {
+		commentsByStatus[row.Status] = row.Total
+	}
+	var newComments int64
+	db.Model(&Comment{}).Where("created_at >= ?", since).Count(&newComments)
+
+	var engagement struct {
+		Views     int64 `json:"views"`
+		Likes     int64 `json:"likes"`
+		Bookmarks int64 `json:"bookmarks"`
+	}
+	db.Model(&Article{}).
+		Select("COALESCE(SUM(view_count), 0) AS views, COALESCE(SUM(like_count), 0) AS likes, COALESCE(SUM(bookmark_count), 0) AS bookmarks").
+		Scan(&engagement)
+
+	var topAuthors []struct {
+		ID       uint   `json:"id"`
+		Username string `json:"username"`
+		Articles int64  `json:"articles"`
+		Views    int64  `json:"views"`
+	}
+	db.Model(&Article{}).Scopes(published).
+		Select("users.id, users.username, COUNT(*) AS articles, COALESCE(SUM(articles.view_count), 0) AS views").
+		Joins("JOIN users ON users.id = articles.author_id").
+		Group("users.id, users.username").
+		Order("views DESC, articles DESC").
+		Limit(5).
+		Scan(&topAuthors)
+
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{
+		"users": gin.H{
+			"total":   totalUsers,
+			"by_role": usersByRole,
+			"banned":  bannedUsers,
+		},
+		"articles": gin.H{
+			"published": publishedArticles,
+			"drafts":    draftArticles,
+		},
+		"comments":    commentsByStatus,
+		"engagement":  engagement,
+		"top_authors": topAuthors,
+		"recent": gin.H{
+			"days":     days,
+			"users":    newUsers,
+			"articles": newArticles,
+			"comments": newComments,
+		},
+	}})
+}
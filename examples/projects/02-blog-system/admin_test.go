@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChangeUserRole(t *testing.T) {
+	r := setupBlogTest(t)
+	admin := createUser(t, "admin", RoleAdmin)
+	editor := createUser(t, "editor", RoleEditor)
+	reader := createUser(t, "reader", RoleReader)
+	path := func(u User) string { return fmt.Sprintf("/api/admin/users/%d/role", u.ID) }
+
+	tests := []struct {
+		name   string
+		path   string
+		userID uint
+		body   string
+		want   int
+	}{
+		{"编辑不能管理用户", path(reader), editor.ID, `{"role":"author"}`, http.StatusForbidden},
+		{"无效角色", path(reader), admin.ID, `{"role":"owner"}`, http.StatusBadRequest},
+		{"不能修改自己", path(admin), admin.ID, `{"role":"reader"}`, http.StatusBadRequest},
+		{"用户不存在", "/api/admin/users/999/role", admin.ID, `{"role":"author"}`, http.StatusNotFound},
+		{"非数字 ID", "/api/admin/users/1%20OR%201=1/role", admin.ID, `{"role":"author"}`, http.StatusNotFound},
+		{"提升为作者", path(reader), admin.ID, `{"role":"author"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if w := send(r, http.MethodPatch, tt.path, tt.userID, tt.body); w.Code != tt.want {
+			t.Errorf("%s: %d %s; 期望 %d", tt.name, w.Code, w.Body, tt.want)
+		}
+	}
+
+	var roles []string
+	db.Model(&User{}).Order("id").Pluck("role", &roles)
+	if want := []string{RoleAdmin, RoleEditor, RoleAuthor}; strings.Join(roles, ",") != strings.Join(want, ",") {
+		t.Errorf("角色 = %v; 期望 %v", roles, want)
+	}
+}
+
+func TestBanUser(t *testing.T) {
+	r := setupBlogTest(t)
+	admin := createUser(t, "admin", RoleAdmin)
+	other := createUser(t, "other", RoleAdmin)
+	reader := createUser(t, "reader", RoleReader)
+	now := time.Now()
+	article := Article{Title: "文章", Slug: "wen-zhang", AuthorID: admin.ID, PublishedAt: &now}
+	db.Create(&article)
+	ban := fmt.Sprintf("/api/admin/users/%d/ban", reader.ID)
+	like := fmt.Sprintf("/api/articles/%d/like", article.ID)
+
+	if w := send(r, http.MethodPost, fmt.Sprintf("/api/admin/users/%d/ban", other.ID), admin.ID, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("封禁管理员: %d; 期望 400", w.Code)
+	}
+	if w := send(r, http.MethodPost, ban, admin.ID, `{"reason":"发布垃圾评论"}`); w.Code != http.StatusOK {
+		t.Fatalf("封禁: %d %s", w.Code, w.Body)
+	}
+	w := send(r, http.MethodPost, like, reader.ID, "")
+	var resp struct{ Reason string }
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusForbidden || resp.Reason != "发布垃圾评论" {
+		t.Errorf("封禁后点赞: %d %s; 期望 403 并返回封禁原因", w.Code, w.Body)
+	}
+
+	if w := send(r, http.MethodDelete, ban, admin.ID, ""); w.Code != http.StatusOK {
+		t.Fatalf("解封: %d %s", w.Code, w.Body)
+	}
+	if w := send(r, http.MethodPost, like, reader.ID, ""); w.Code != http.StatusOK {
+		t.Errorf("解封后点赞: %d %s; 期望 200", w.Code, w.Body)
+	}
+}
+
+func TestListUsersFilters(t *testing.T) {
+	r := setupBlogTest(t)
+	admin := createUser(t, "admin", RoleAdmin)
+	createUser(t, "alice", RoleReader)
+	bob := createUser(t, "bob", RoleReader)
+	createUser(t, "carol", RoleAuthor)
+	db.Model(&bob).Update("banned_at", time.Now())
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", "admin,alice,bob,carol"},
+		{"?role=reader", "alice,bob"},
+		{"?role=reader&banned=false", "alice"},
+		{"?banned=true", "bob"},
+		{"?q=car", "carol"},
+	}
+	for _, tt := range tests {
+		w := send(r, http.MethodGet, "/api/admin/users"+tt.query, admin.ID, "")
+		var resp struct{ Data []User }
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		names := make([]string, len(resp.Data))
+		for i, u := range resp.Data {
+			names[i] = u.Username
+		}
+		if got := strings.Join(names, ","); w.Code != http.StatusOK || got != tt.want {
+			t.Errorf("%q: %d %s; 期望 %s", tt.query, w.Code, got, tt.want)
+		}
+	}
+}
+
+func TestBulkModerateComments(t *testing.T) {
+	r := setupBlogTest(t)
+	editor := createUser(t, "editor", RoleEditor)
+	author := createUser(t, "author", RoleAuthor)
+	var ids []uint
+	for i := 0; i < 3; i++ {
+		comment := Comment{Content: fmt.Sprint("评论", i), ArticleID: 1, UserID: author.ID}
+		db.Create(&comment)
+		ids = append(ids, comment.ID)
+	}
+
+	body := fmt.Sprintf(`{"ids":[%d,%d],"status":"approved"}`, ids[0], ids[1])
+	if w := send(r, http.MethodPost, "/api/admin/comments/bulk", author.ID, body); w.Code != http.StatusForbidden {
+		t.Errorf("作者批量审核: %d; 期望 403", w.Code)
+	}
+	w := send(r, http.MethodPost, "/api/admin/comments/bulk", editor.ID, body)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"updated":2`) {
+		t.Fatalf("批量审核: %d %s; 期望更新 2 条", w.Code, w.Body)
+	}
+	var approved int64
+	db.Model(&Comment{}).Where("status = ?", CommentApproved).Count(&approved)
+	if approved != 2 {
+		t.Errorf("已通过 %d 条; 期望 2", approved)
+	}
+
+	tooMany := make([]string, maxBulkModeration+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprint(i + 1)
+	}
+	body = `{"ids":[` + strings.Join(tooMany, ",") + `],"status":"spam"}`
+	if w := send(r, http.MethodPost, "/api/admin/comments/bulk", editor.ID, body); w.Code != http.StatusBadRequest {
+		t.Errorf("超出上限: %d; 期望 400", w.Code)
+	}
+}
+
+func TestSiteStats(t *testing.T) {
+	r := setupBlogTest(t)
+	editor := createUser(t, "editor", RoleEditor)
+	reader := createUser(t, "reader", RoleReader)
+	now := time.Now()
+	db.Model(&reader).Update("banned_at", now)
+	db.Create(&Article{Title: "已发布", Slug: "yi-fa-bu", AuthorID: editor.ID, PublishedAt: &now, ViewCount: 7})
+	db.Create(&Article{Title: "草稿", Slug: "cao-gao", AuthorID: editor.ID})
+	db.Create(&Comment{Content: "评论", ArticleID: 1, UserID: reader.ID, Status: CommentSpam})
+
+	if w := send(r, http.MethodGet, "/api/admin/stats", reader.ID, ""); w.Code != http.StatusForbidden {
+		t.Errorf("读者查看统计: %d; 期望 403", w.Code)
+	}
+	w := send(r, http.MethodGet, "/api/admin/stats?days=30", editor.ID, "")
+	var resp struct {
+		Data struct {
+			Users struct {
+				Total  int64
+				ByRole map[string]int64 `json:"by_role"`
+				Banned int64
+			}
+			Articles struct {
+				Published int64
+				Drafts    int64
+			}
+			Comments   map[string]int64
+			Engagement struct{ Views int64 }
+			Recent     struct{ Days, Users int64 }
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("统计: %d %s", w.Code, w.Body)
+	}
+	d := resp.Data
+	if d.Users.Total != 2 || d.Users.ByRole[RoleEditor] != 1 || d.Users.ByRole[RoleAdmin] != 0 || d.Users.Banned != 1 ||
+		d.Articles.Published != 1 || d.Articles.Drafts != 1 || d.Comments[CommentSpam] != 1 ||
+		d.Engagement.Views != 7 || d.Recent.Days != 30 || d.Recent.Users != 2 {
+		t.Errorf("统计结果 %+v", d)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 评论审核状态
+const (
+	CommentPending  = "pending"
+	CommentApproved = "approved"
+	CommentSpam     = "spam"
+)
+
+// maxCommentDepth 评论最大嵌套深度（顶层评论深度为 0）
+const maxCommentDepth = 3
+
+var (
+	spamKeywords = flag.String("spam-keywords", "casino,viagra,代开发票,加微信", "垃圾评论关键词（逗号分隔）")
+	spamMaxLinks = flag.Int("spam-max-links", 2, "单条评论允许的最大链接数")
+)
+
+// Comment 评论模型
+type Comment struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	Content   string     `json:"content" gorm:"not null"`
+	ArticleID uint       `json:"article_id" gorm:"index"`
+	Article   Article    `json:"-" gorm:"foreignKey:ArticleID"`
+	UserID    uint       `json:"user_id"`
+	User      User       `json:"user" gorm:"foreignKey:UserID"`
+	ParentID  *uint      `json:"parent_id" gorm:"index"`
+	RootID    uint       `json:"root_id" gorm:"index"` // 所属顶层评论，顶层评论为 0
+	Depth     int        `json:"depth" gorm:"default:0"`
+	Status    string     `json:"status" gorm:"default:pending;index"`
+	Replies   []*Comment `json:"replies,omitempty" gorm:"-"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// SpamFilter 基于关键词和链接数的垃圾评论判定
+type SpamFilter struct {
+	Keywords []string
+	MaxLinks int
+}
+
+var (
+	linkPattern = regexp.MustCompile(`(?i)https?://|www\.`)
+
+	// spamFilter 启动时根据 -spam-keywords 和 -spam-max-links 创建
+	spamFilter *SpamFilter
+)
+
+// NewSpamFilter 创建垃圾评论过滤器，keywords 为逗号分隔的关键词列表
+func NewSpamFilter(keywords string, maxLinks int) *SpamFilter {
+	f := &SpamFilter{MaxLinks: maxLinks}
+	for _, kw := range strings.Split(keywords, ",") {
+		if kw = strings.ToLower(strings.TrimSpace(kw)); kw != "" {
+			f.Keywords = append(f.Keywords, kw)
+		}
+	}
+	return f
+}
+
+// IsSpam 判断内容是否为垃圾评论
+func (f *SpamFilter) IsSpam(content string) bool {
+	lower := strings.ToLower(content)
+	for _, kw := range f.Keywords {
+		if strings.Contains(lower, kw) {
+			return true
+		}
+	}
+	return len(linkPattern.FindAllStringIndex(content, -1)) > f.MaxLinks
+}
+
+// buildCommentTree 将顶层评论和回复组装成评论树，父评论不可见的回复会被丢弃
+func buildCommentTree(roots, replies []Comment) []*Comment {
+	nodes := make(map[uint]*Comment, len(roots)+len(replies))
+	tree := make([]*Comment, 0, len(roots))
+	for i := range roots {
+		nodes[roots[i].ID] = &roots[i]
+		tree = append(tree, &roots[i])
+	}
+	// replies 按 ID 升序，父评论总是先于子评论出现
+	for i := range replies {
+		reply := &replies[i]
+		if reply.ParentID == nil {
+			continue
+		}
+		parent, ok := nodes[*reply.ParentID]
+		if !ok {
+			continue
+		}
+		parent.Replies = append(parent.Replies, reply)
+		nodes[reply.ID] = reply
+	}
+	return tree
+}
+
+// canModerate 判断用户是否可以审核该文章下的评论：文章作者或拥有审核权限的编辑、管理员
+func canModerate(user User, article Article) bool {
+	return user.Can(PermModerate) || (user.BannedAt == nil && user.ID == article.AuthorID)
+}
+
+// findCommentArticle 查找评论所属的文章，与文章详情一致：不存在或是草稿（作者本人除外）时返回 404
+func findCommentArticle(c *gin.Context) (Article, bool) {
+	var article Article
+	if err := db.First(&article, parseID(c)).Error; err != nil ||
+		(article.PublishedAt == nil && article.AuthorID != currentUserID(c)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "文章不存在"})
+		return article, false
+	}
+	return article, true
+}
+
+// handleCreateComment 添加评论或回复
+func handleCreateComment(c *gin.Context) {
+	var req struct {
+		Content  string `json:"content" binding:"required"`
+		ParentID *uint  `json:"parent_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	article, ok := findCommentArticle(c)
+	if !ok {
+		return
+	}
+
+	comment := Comment{
+		Content:   req.Content,
+		ArticleID: article.ID,
+		UserID:    currentUserID(c),
+		Status:    CommentPending,
+	}
+
+	if req.ParentID != nil {
+		var parent Comment
+		if err := db.Where("article_id = ?", article.ID).First(&parent, *req.ParentID).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "回复的评论不存在"})
+			return
+		}
+		if parent.Status != CommentApproved {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "不能回复未通过审核的评论"})
+			return
+		}
+		if parent.Depth+1 > maxCommentDepth {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "回复层级过深"})
+			return
+		}
+		comment.ParentID = &parent.ID
+		comment.Depth = parent.Depth + 1
+		comment.RootID = parent.RootID
+		if comment.RootID == 0 {
+			comment.RootID = parent.ID
+		}
+	}
+
+	// 垃圾评论直接进入 spam，文章作者、编辑和管理员的评论免审核
+	if spamFilter.IsSpam(comment.Content) {
+		comment.Status = CommentSpam
+	} else if user, ok := currentUser(c); ok && canModerate(user, article) {
+		comment.Status = CommentApproved
+	}
+
+	if err := db.Create(&comment).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	db.Preload("User").First(&comment, comment.ID)
+	syncCommentIndex(comment)
+	c.JSON(http.StatusCreated, gin.H{"data": comment})
+}
+
+// handleListComments 获取文章评论树，按顶层评论分页
+func handleListComments(c *gin.Context) {
+	article, ok := findCommentArticle(c)
+	if !ok {
+		return
+	}
+	articleID := article.ID
+	page, pageSize := pagination(c)
+
+	var total int64
+	db.Model(&Comment{}).
+		Where("article_id = ? AND parent_id IS NULL AND status = ?", articleID, CommentApproved).
+		Count(&total)
+
+	var roots []Comment
+	db.Preload("User").
+		Where("article_id = ? AND parent_id IS NULL AND status = ?", articleID, CommentApproved).
+		Order("id ASC").Offset((page - 1) * pageSize).Limit(pageSize).
+		Find(&roots)
+
+	var replies []Comment
+	if len(roots) > 0 {
+		rootIDs := make([]uint, len(roots))
+		for i, root := range roots {
+			rootIDs[i] = root.ID
+		}
+		db.Preload("User").
+			Where("root_id IN ? AND status = ?", rootIDs, CommentApproved).
+			Order("id ASC").
+			Find(&replies)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":      buildCommentTree(roots, replies),
+		"page":      page,
+		"page_size": pageSize,
+		"total":     total,
+	})
+}
+
+// handleArticleModerationQueue 文章作者查看待审核评论
+func handleArticleModerationQueue(c *gin.Context) {
+	var article Article
+	if err := db.First(&article, parseID(c)).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "文章不存在"})
+		return
+	}
+	user, ok := currentUser(c)
+	if !ok || !canModerate(user, article) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "无权审核该文章的评论"})
+		return
+	}
+
+	status := c.DefaultQuery("status", CommentPending)
+	var comments []Comment
+	db.Preload("User").
+		Where("article_id = ? AND status = ?", article.ID, status).
+		Order("id ASC").
+		Find(&comments)
+	c.JSON(http.StatusOK, gin.H{"data": comments})
+}
+
+// handleAdminModerationQueue 编辑、管理员查看全站待审核评论
+func handleAdminModerationQueue(c *gin.Context) {
+	status := c.DefaultQuery("status", CommentPending)
+	page, pageSize := pagination(c)
+
+	var total int64
+	db.Model(&Comment{}).Where("status = ?", status).Count(&total)
+
+	var comments []Comment
+	db.Preload("User").
+		Where("status = ?", status).
+		Order("id ASC").Offset((page - 1) * pageSize).Limit(pageSize).
+		Find(&comments)
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":      comments,
+		"page":      page,
+		"page_size": pageSize,
+		"total":     total,
+	})
+}
+
+// handleModerateComment 审核评论（文章作者、编辑或管理员）
+func handleModerateComment(c *gin.Context) {
+	var req struct {
+		Status string `json:"status" binding:"required,oneof=pending approved spam"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var comment Comment
+	if err := db.Preload("Article").Preload("User").First(&comment, parseID(c)).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "评论不存在"})
+		return
+	}
+	user, ok := currentUser(c)
+	if !ok || !canModerate(user, comment.Article) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "无权审核该评论"})
+		return
+	}
+
+	db.Model(&comment).Update("status", req.Status)
+	syncCommentIndex(comment)
+	c.JSON(http.StatusOK, gin.H{"message": "审核状态已更新", "data": comment})
+}
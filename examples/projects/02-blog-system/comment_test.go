@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSpamFilter(t *testing.T) {
+	f := NewSpamFilter(" Casino, ,加微信 ", 2)
+	tests := []struct {
+		content string
+		spam    bool
+	}{
+		{"写得很好", false},
+		{"来 CASINO 玩", true},
+		{"有事加微信", true},
+		{"参考 https://go.dev 和 http://example.com", false},
+		{"https://a.com https://b.com www.c.com", true},
+		{"HTTPS://A.COM HTTP://B.COM WWW.C.COM", true},
+	}
+	for _, tt := range tests {
+		if got := f.IsSpam(tt.content); got != tt.spam {
+			t.Errorf("IsSpam(%q) = %v; 期望 %v", tt.content, got, tt.spam)
+		}
+	}
+	if fmt.Sprint(f.Keywords) != "[casino 加微信]" {
+		t.Errorf("关键词 %q; 期望去掉空白和空项并转小写", f.Keywords)
+	}
+}
+
+func TestBuildCommentTree(t *testing.T) {
+	id := func(n uint) *uint { return &n }
+	roots := []Comment{{ID: 1}, {ID: 2}}
+	replies := []Comment{
+		{ID: 3, ParentID: id(1), RootID: 1},
+		{ID: 4, ParentID: id(3), RootID: 1},
+		{ID: 5, ParentID: id(2), RootID: 2},
+		{ID: 7, ParentID: id(6), RootID: 1}, // 父评论 6 未通过审核，不可见
+		{ID: 8, ParentID: id(7), RootID: 1}, // 祖先不可见，同样丢弃
+		{ID: 9, ParentID: id(4), RootID: 1},
+	}
+
+	var render func(nodes []*Comment) string
+	render = func(nodes []*Comment) string {
+		parts := make([]string, len(nodes))
+		for i, n := range nodes {
+			parts[i] = fmt.Sprint(n.ID)
+			if len(n.Replies) > 0 {
+				parts[i] += "(" + render(n.Replies) + ")"
+			}
+		}
+		return strings.Join(parts, " ")
+	}
+	if got := render(buildCommentTree(roots, replies)); got != "1(3(4(9))) 2(5)" {
+		t.Errorf("评论树 %s; 期望 1(3(4(9))) 2(5)", got)
+	}
+}
+
+// setupCommentTest 创建文章作者、一名读者和一篇已发布的文章
+func setupCommentTest(t *testing.T) (r *gin.Engine, author, reader User, article Article) {
+	r = setupBlogTest(t)
+	author = createUser(t, "author", RoleAuthor)
+	reader = createUser(t, "reader", RoleReader)
+	now := time.Now()
+	article = Article{Title: "文章", Slug: "wen-zhang", AuthorID: author.ID, PublishedAt: &now}
+	db.Create(&article)
+	return r, author, reader, article
+}
+
+// postComment 发表评论，返回状态码和创建的评论
+func postComment(r *gin.Engine, userID, articleID uint, body string) (int, Comment) {
+	w := send(r, http.MethodPost, fmt.Sprintf("/api/articles/%d/comments", articleID), userID, body)
+	var resp struct{ Data Comment }
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w.Code, resp.Data
+}
+
+func TestCommentReplyDepth(t *testing.T) {
+	r, author, reader, article := setupCommentTest(t)
+
+	// 文章作者的评论免审核，可以连续回复到最大深度
+	code, parent := postComment(r, author.ID, article.ID, `{"content":"顶层"}`)
+	if code != http.StatusCreated || parent.Status != CommentApproved || parent.Depth != 0 {
+		t.Fatalf("顶层评论: %d %+v", code, parent)
+	}
+	root := parent.ID
+	for depth := 1; depth <= maxCommentDepth; depth++ {
+		code, reply := postComment(r, author.ID, article.ID, fmt.Sprintf(`{"content":"第 %d 层","parent_id":%d}`, depth, parent.ID))
+		if code != http.StatusCreated || reply.Depth != depth || reply.RootID != root || *reply.ParentID != parent.ID {
+			t.Fatalf("第 %d 层回复: %d %+v", depth, code, reply)
+		}
+		parent = reply
+	}
+	if code, _ := postComment(r, author.ID, article.ID, fmt.Sprintf(`{"content":"过深","parent_id":%d}`, parent.ID)); code != http.StatusBadRequest {
+		t.Errorf("超过最大深度: %d; 期望 400", code)
+	}
+
+	// 读者的评论待审核，不能被回复
+	_, pending := postComment(r, reader.ID, article.ID, `{"content":"待审核"}`)
+	if code, _ := postComment(r, author.ID, article.ID, fmt.Sprintf(`{"content":"回复","parent_id":%d}`, pending.ID)); code != http.StatusBadRequest {
+		t.Errorf("回复待审核评论: %d; 期望 400", code)
+	}
+
+	// 不能跨文章回复
+	other := Article{Title: "另一篇", Slug: "ling-yi-pian", AuthorID: author.ID, PublishedAt: article.PublishedAt}
+	db.Create(&other)
+	if code, _ := postComment(r, author.ID, other.ID, fmt.Sprintf(`{"content":"回复","parent_id":%d}`, root)); code != http.StatusBadRequest {
+		t.Errorf("跨文章回复: %d; 期望 400", code)
+	}
+
+	w := send(r, http.MethodGet, fmt.Sprintf("/api/articles/%d/comments", article.ID), 0, "")
+	var resp struct {
+		Data  []*Comment
+		Total int64
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	depth := 0
+	for node := resp.Data[0]; len(node.Replies) > 0; node = node.Replies[0] {
+		depth++
+	}
+	if resp.Total != 1 || len(resp.Data) != 1 || depth != maxCommentDepth {
+		t.Errorf("评论树: 顶层 %d 条（total %d）、深度 %d; 期望 1 条、深度 %d", len(resp.Data), resp.Total, depth, maxCommentDepth)
+	}
+}
+
+func TestCommentsOnDrafts(t *testing.T) {
+	r, author, reader, _ := setupCommentTest(t)
+	draft := Article{Title: "草稿", Slug: "cao-gao", AuthorID: author.ID}
+	db.Create(&draft)
+	path := fmt.Sprintf("/api/articles/%d/comments", draft.ID)
+
+	// 草稿和不存在的文章与文章详情一样返回 404，只有作者可以查看和评论草稿
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		userID uint
+		code   int
+	}{
+		{"读者查看草稿的评论", http.MethodGet, path, reader.ID, http.StatusNotFound},
+		{"未登录查看草稿的评论", http.MethodGet, path, 0, http.StatusNotFound},
+		{"读者评论草稿", http.MethodPost, path, reader.ID, http.StatusNotFound},
+		{"查看不存在的文章的评论", http.MethodGet, "/api/articles/999/comments", 0, http.StatusNotFound},
+		{"评论不存在的文章", http.MethodPost, "/api/articles/999/comments", reader.ID, http.StatusNotFound},
+		{"作者评论草稿", http.MethodPost, path, author.ID, http.StatusCreated},
+		{"作者查看草稿的评论", http.MethodGet, path, author.ID, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if w := send(r, tt.method, tt.path, tt.userID, `{"content":"好"}`); w.Code != tt.code {
+			t.Errorf("%s: %d %s; 期望 %d", tt.name, w.Code, w.Body, tt.code)
+		}
+	}
+	var count int64
+	db.Model(&Comment{}).Where("article_id = ?", draft.ID).Count(&count)
+	if count != 1 {
+		t.Errorf("草稿下有 %d 条评论; 期望只有作者的 1 条", count)
+	}
+}
+
+func TestCommentModeration(t *testing.T) {
+	r, author, reader, article := setupCommentTest(t)
+	editor := createUser(t, "editor", RoleEditor)
+	stranger := createUser(t, "stranger", RoleReader)
+
+	_, pending := postComment(r, reader.ID, article.ID, `{"content":"数据库选型写得好"}`)
+	_, spam := postComment(r, reader.ID, article.ID, `{"content":"加微信领优惠"}`)
+	_, byEditor := postComment(r, editor.ID, article.ID, `{"content":"编辑的评论"}`)
+	if pending.Status != CommentPending || spam.Status != CommentSpam || byEditor.Status != CommentApproved {
+		t.Fatalf("评论状态 %s/%s/%s; 期望 pending/spam/approved", pending.Status, spam.Status, byEditor.Status)
+	}
+
+	queue := func(path string, userID uint) (int, string) {
+		w := send(r, http.MethodGet, path, userID, "")
+		var resp struct{ Data []Comment }
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		ids := make([]string, len(resp.Data))
+		for i, c := range resp.Data {
+			ids[i] = fmt.Sprint(c.ID)
+		}
+		return w.Code, strings.Join(ids, ",")
+	}
+	articleQueue := fmt.Sprintf("/api/articles/%d/comments/moderation", article.ID)
+	for _, tt := range []struct {
+		name   string
+		path   string
+		userID uint
+		code   int
+		ids    string
+	}{
+		{"作者查看待审核", articleQueue, author.ID, http.StatusOK, fmt.Sprint(pending.ID)},
+		{"作者查看 spam", articleQueue + "?status=spam", author.ID, http.StatusOK, fmt.Sprint(spam.ID)},
+		{"其他读者", articleQueue, stranger.ID, http.StatusForbidden, ""},
+		{"编辑查看全站队列", "/api/admin/comments", editor.ID, http.StatusOK, fmt.Sprint(pending.ID)},
+		{"作者不能查看全站队列", "/api/admin/comments", author.ID, http.StatusForbidden, ""},
+	} {
+		if code, ids := queue(tt.path, tt.userID); code != tt.code || ids != tt.ids {
+			t.Errorf("%s: %d [%s]; 期望 %d [%s]", tt.name, code, ids, tt.code, tt.ids)
+		}
+	}
+
+	moderate := func(id, userID uint, status string) int {
+		return send(r, http.MethodPatch, fmt.Sprintf("/api/comments/%d/status", id), userID, `{"status":"`+status+`"}`).Code
+	}
+	if code := moderate(pending.ID, stranger.ID, CommentApproved); code != http.StatusForbidden {
+		t.Errorf("其他读者审核: %d; 期望 403", code)
+	}
+	if code := moderate(pending.ID, author.ID, "deleted"); code != http.StatusBadRequest {
+		t.Errorf("无效状态: %d; 期望 400", code)
+	}
+	if code := moderate(pending.ID, author.ID, CommentApproved); code != http.StatusOK {
+		t.Fatalf("作者审核通过: %d", code)
+	}
+	if _, ids := queue(articleQueue, author.ID); ids != "" {
+		t.Errorf("审核后待审核队列 [%s]; 期望为空", ids)
+	}
+	if got, _ := searchIDs(search, "数据库", SearchComment, 10, 0); got != fmt.Sprint("c", pending.ID) {
+		t.Errorf("审核通过后搜索 %q; 期望命中评论 %d", got, pending.ID)
+	}
+
+	// 编辑可以审核任意文章的评论，标记为 spam 后从搜索中移除
+	if code := moderate(pending.ID, editor.ID, CommentSpam); code != http.StatusOK {
+		t.Fatalf("编辑标记 spam: %d", code)
+	}
+	if got, _ := searchIDs(search, "数据库", SearchComment, 10, 0); got != "" {
+		t.Errorf("标记 spam 后搜索 %q; 期望无结果", got)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// feedSize 订阅源包含的最新文章数
+const feedSize = 20
+
+var siteURL = flag.String("site-url", "http://localhost:8080", "站点地址，用于生成订阅源和站点地图中的链接")
+
+// RSS 2.0 文档结构
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	Description string   `xml:"description"`
+	Categories  []string `xml:"category"`
+	GUID        rssGUID  `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// Atom 文档结构
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Updated   string      `xml:"updated"`
+	Published string      `xml:"published"`
+	Link      atomLink    `xml:"link"`
+	Author    atomAuthor  `xml:"author"`
+	Summary   atomContent `xml:"summary"`
+	Content   atomContent `xml:"content"`
+}
+
+type atomContent struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+// sitemap 文档结构
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod"`
+}
+
+// articleURL 文章的公开地址
+func articleURL(article Article) string {
+	return strings.TrimRight(*siteURL, "/") + "/api/articles/by-slug/" + article.Slug
+}
+
+// excerpt 截取内容摘要
+func excerpt(content string, n int) string {
+	runes := []rune(strings.TrimSpace(content))
+	if len(runes) <= n {
+		return string(runes)
+	}
+	return string(runes[:n]) + "…"
+}
+
+// feedSource 订阅源的数据来源：全站或某个标签
+type feedSource struct {
+	Title string
+	Link  string
+	Tag   string
+}
+
+// loadFeedArticles 加载订阅源文章，tag 不存在时返回 gorm.ErrRecordNotFound
+func loadFeedArticles(c *gin.Context) (feedSource, []Article, error) {
+	source := feedSource{Title: "博客系统", Link: strings.TrimRight(*siteURL, "/")}
+	query := db.Model(&Article{}).Scopes(published)
+
+	if slug := c.Param("slug"); slug != "" {
+		var tag Tag
+		if err := db.Where("slug = ?", slug).First(&tag).Error; err != nil {
+			return source, nil, err
+		}
+		source.Title += " - " + tag.Name
+		source.Link += "/api/articles?tag=" + tag.Slug
+		source.Tag = tag.Slug
+		query = filterByTaxonomy(query, tag.Slug, "")
+	}
+
+	var articles []Article
+	err := query.Preload("Author").Preload("Tags").
+		Order("articles.published_at DESC").
+		Limit(feedSize).
+		Find(&articles).Error
+	return source, articles, err
+}
+
+// cacheValidators 根据文章列表计算 ETag 与 Last-Modified
+func cacheValidators(kind string, articles []Article) (string, time.Time) {
+	h := sha1.New()
+	fmt.Fprint(h, kind)
+	var lastModified time.Time
+	for _, article := range articles {
+		fmt.Fprintf(h, "|%d:%d", article.ID, article.UpdatedAt.UnixNano())
+		if article.UpdatedAt.After(lastModified) {
+			lastModified = article.UpdatedAt
+		}
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)) + `"`, lastModified.UTC().Truncate(time.Second)
+}
+
+// checkNotModified 设置缓存头，客户端缓存仍有效时返回 304 并返回 true
+func checkNotModified(c *gin.Context, etag string, lastModified time.Time) bool {
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "public, max-age=300")
+	if !lastModified.IsZero() {
+		c.Header("Last-Modified", lastModified.Format(http.TimeFormat))
+	}
+
+	// If-None-Match 优先于 If-Modified-Since
+	if inm := c.GetHeader("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			if tag = strings.TrimSpace(tag); tag == etag || tag == "*" {
+				c.Status(http.StatusNotModified)
+				return true
+			}
+		}
+		return false
+	}
+	if ims, err := http.ParseTime(c.GetHeader("If-Modified-Since")); err == nil && !lastModified.IsZero() {
+		if !lastModified.After(ims) {
+			c.Status(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// renderXML 输出带 XML 声明的文档
+func renderXML(c *gin.Context, contentType string, v interface{}) {
+	body, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Data(http.StatusOK, contentType, append([]byte(xml.Header), body...))
+}
+
+// handleRSSFeed 输出 RSS 2.0 订阅源
+func handleRSSFeed(c *gin.Context) {
+	source, articles, err := loadFeedArticles(c)
+	if err == gorm.ErrRecordNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "标签不存在"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	etag, lastModified := cacheValidators("rss:"+source.Tag, articles)
+	if checkNotModified(c, etag, lastModified) {
+		return
+	}
+
+	feed := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:       source.Title,
+			Link:        source.Link,
+			Description: source.Title + " 最新文章",
+		},
+	}
+	if !lastModified.IsZero() {
+		feed.Channel.LastBuildDate = lastModified.Format(time.RFC1123Z)
+	}
+	for _, article := range articles {
+		item := rssItem{
+			Title:       article.Title,
+			Link:        articleURL(article),
+			Description: excerpt(article.Content, 200),
+			GUID:        rssGUID{IsPermaLink: true, Value: articleURL(article)},
+			PubDate:     article.PublishedAt.UTC().Format(time.RFC1123Z),
+		}
+		for _, tag := range article.Tags {
+			item.Categories = append(item.Categories, tag.Name)
+		}
+		feed.Channel.Items = append(feed.Channel.Items, item)
+	}
+	renderXML(c, "application/rss+xml; charset=utf-8", feed)
+}
+
+// handleAtomFeed 输出 Atom 订阅源
+func handleAtomFeed(c *gin.Context) {
+	source, articles, err := loadFeedArticles(c)
+	if err == gorm.ErrRecordNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "标签不存在"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	etag, lastModified := cacheValidators("atom:"+source.Tag, articles)
+	if checkNotModified(c, etag, lastModified) {
+		return
+	}
+
+	selfURL := strings.TrimRight(*siteURL, "/") + c.Request.URL.Path
+	updated := lastModified
+	if updated.IsZero() {
+		updated = time.Unix(0, 0)
+	}
+	feed := atomFeed{
+		ID:      selfURL,
+		Title:   source.Title,
+		Updated: updated.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "self", Href: selfURL},
+			{Rel: "alternate", Href: source.Link},
+		},
+		Author: atomAuthor{Name: source.Title},
+	}
+	for _, article := range articles {
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:        articleURL(article),
+			Title:     article.Title,
+			Updated:   article.UpdatedAt.UTC().Format(time.RFC3339),
+			Published: article.PublishedAt.UTC().Format(time.RFC3339),
+			Link:      atomLink{Rel: "alternate", Href: articleURL(article)},
+			Author:    atomAuthor{Name: article.Author.Username},
+			Summary:   atomContent{Type: "text", Value: excerpt(article.Content, 200)},
+			Content:   atomContent{Type: "text", Value: article.Content},
+		})
+	}
+	renderXML(c, "application/atom+xml; charset=utf-8", feed)
+}
+
+// handleSitemap 输出所有已发布文章的站点地图
+func handleSitemap(c *gin.Context) {
+	var articles []Article
+	if err := db.Scopes(published).Select("id", "slug", "updated_at").Order("id ASC").Find(&articles).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	etag, lastModified := cacheValidators("sitemap", articles)
+	if checkNotModified(c, etag, lastModified) {
+		return
+	}
+
+	urlset := sitemapURLSet{}
+	for _, article := range articles {
+		urlset.URLs = append(urlset.URLs, sitemapURL{
+			Loc:     articleURL(article),
+			LastMod: article.UpdatedAt.UTC().Format(time.RFC3339),
+		})
+	}
+	renderXML(c, "application/xml; charset=utf-8", urlset)
+}
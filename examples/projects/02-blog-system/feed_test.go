@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setupFeedTest 使用内存数据库准备测试数据：两篇已发布文章（一篇带 go 标签）和一篇草稿
+func setupFeedTest(t *testing.T) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	db = initDatabase("file:" + t.Name() + "?mode=memory&cache=shared")
+
+	author := User{Username: "alice", Email: "alice@example.com", Password: "x"}
+	db.Create(&author)
+	tags, err := findOrCreateTags(db, []string{"Go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	articles := []Article{
+		{Title: "Go 并发编程", Slug: "go-bing-fa-bian-cheng", Content: "goroutine 与 channel", AuthorID: author.ID, Tags: tags, PublishedAt: &now},
+		{Title: "SQLite 入门", Slug: "sqlite-ru-men", Content: "嵌入式数据库", AuthorID: author.ID, PublishedAt: &now},
+		{Title: "未完成的草稿", Slug: "wei-wan-cheng-de-cao-gao", Content: "draft", AuthorID: author.ID},
+	}
+	for i := range articles {
+		if err := db.Create(&articles[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return setupRouter()
+}
+
+func get(r *gin.Engine, path string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestRSSFeedRequiredElements(t *testing.T) {
+	r := setupFeedTest(t)
+	w := get(r, "/feed.rss", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("状态码 = %d; 期望 200", w.Code)
+	}
+
+	var doc struct {
+		XMLName xml.Name `xml:"rss"`
+		Version string   `xml:"version,attr"`
+		Channel *struct {
+			Title       string `xml:"title"`
+			Link        string `xml:"link"`
+			Description string `xml:"description"`
+			Items       []struct {
+				Title       string `xml:"title"`
+				Link        string `xml:"link"`
+				Description string `xml:"description"`
+				GUID        string `xml:"guid"`
+				PubDate     string `xml:"pubDate"`
+			} `xml:"item"`
+		} `xml:"channel"`
+	}
+	if err := xml.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("RSS 解析失败: %v", err)
+	}
+
+	// RSS 2.0：rss@version、channel 及其 title/link/description 必填
+	if doc.Version != "2.0" {
+		t.Errorf("rss version = %q; 期望 2.0", doc.Version)
+	}
+	if doc.Channel == nil {
+		t.Fatal("缺少 channel 元素")
+	}
+	if doc.Channel.Title == "" || doc.Channel.Link == "" || doc.Channel.Description == "" {
+		t.Errorf("channel 缺少必填元素: %+v", doc.Channel)
+	}
+	if len(doc.Channel.Items) != 2 {
+		t.Fatalf("item 数量 = %d; 期望 2（草稿不应出现）", len(doc.Channel.Items))
+	}
+	for _, item := range doc.Channel.Items {
+		// item 至少包含 title 或 description 之一
+		if item.Title == "" && item.Description == "" {
+			t.Errorf("item 缺少 title 和 description: %+v", item)
+		}
+		if item.GUID == "" || !strings.HasPrefix(item.Link, "http") {
+			t.Errorf("item guid/link 无效: %+v", item)
+		}
+		if _, err := time.Parse(time.RFC1123Z, item.PubDate); err != nil {
+			t.Errorf("pubDate %q 不是 RFC 822 格式: %v", item.PubDate, err)
+		}
+	}
+}
+
+func TestAtomFeedRequiredElements(t *testing.T) {
+	r := setupFeedTest(t)
+	w := get(r, "/feed.atom", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("状态码 = %d; 期望 200", w.Code)
+	}
+
+	type author struct {
+		Name string `xml:"name"`
+	}
+	type link struct {
+		Rel  string `xml:"rel,attr"`
+		Href string `xml:"href,attr"`
+	}
+	var doc struct {
+		XMLName xml.Name `xml:"http://www.w3.org/2005/Atom feed"`
+		ID      string   `xml:"id"`
+		Title   string   `xml:"title"`
+		Updated string   `xml:"updated"`
+		Author  *author  `xml:"author"`
+		Links   []link   `xml:"link"`
+		Entries []struct {
+			ID      string  `xml:"id"`
+			Title   string  `xml:"title"`
+			Updated string  `xml:"updated"`
+			Author  *author `xml:"author"`
+			Links   []link  `xml:"link"`
+			Content string  `xml:"content"`
+		} `xml:"entry"`
+	}
+	if err := xml.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("Atom 解析失败（需使用 Atom 命名空间）: %v", err)
+	}
+
+	// Atom：feed 的 id/title/updated 必填
+	if doc.ID == "" || doc.Title == "" {
+		t.Errorf("feed 缺少 id 或 title: id=%q title=%q", doc.ID, doc.Title)
+	}
+	if _, err := time.Parse(time.RFC3339, doc.Updated); err != nil {
+		t.Errorf("feed updated %q 不是 RFC 3339 格式", doc.Updated)
+	}
+	hasSelf := false
+	for _, l := range doc.Links {
+		hasSelf = hasSelf || l.Rel == "self"
+	}
+	if !hasSelf {
+		t.Error("feed 缺少 rel=self 链接")
+	}
+	if len(doc.Entries) != 2 {
+		t.Fatalf("entry 数量 = %d; 期望 2", len(doc.Entries))
+	}
+	for _, entry := range doc.Entries {
+		// entry 的 id/title/updated 必填；feed 没有 author 时每个 entry 必须有 author
+		if entry.ID == "" || entry.Title == "" {
+			t.Errorf("entry 缺少 id 或 title: %+v", entry)
+		}
+		if _, err := time.Parse(time.RFC3339, entry.Updated); err != nil {
+			t.Errorf("entry updated %q 不是 RFC 3339 格式", entry.Updated)
+		}
+		if doc.Author == nil && (entry.Author == nil || entry.Author.Name == "") {
+			t.Errorf("entry 缺少 author: %+v", entry)
+		}
+		// 没有 content 时必须提供 alternate 链接
+		if entry.Content == "" && len(entry.Links) == 0 {
+			t.Errorf("entry 缺少 content 和 alternate 链接: %+v", entry)
+		}
+	}
+}
+
+func TestTagFeed(t *testing.T) {
+	r := setupFeedTest(t)
+
+	w := get(r, "/tags/go/feed.rss", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("状态码 = %d; 期望 200", w.Code)
+	}
+	if n := strings.Count(w.Body.String(), "<item>"); n != 1 {
+		t.Errorf("标签订阅源 item 数量 = %d; 期望 1", n)
+	}
+
+	if w := get(r, "/tags/unknown/feed.atom", nil); w.Code != http.StatusNotFound {
+		t.Errorf("未知标签状态码 = %d; 期望 404", w.Code)
+	}
+}
+
+func TestSitemap(t *testing.T) {
+	r := setupFeedTest(t)
+	w := get(r, "/sitemap.xml", nil)
+
+	var doc struct {
+		XMLName xml.Name `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+		URLs    []struct {
+			Loc string `xml:"loc"`
+		} `xml:"url"`
+	}
+	if err := xml.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("sitemap 解析失败: %v", err)
+	}
+	if len(doc.URLs) != 2 {
+		t.Fatalf("url 数量 = %d; 期望 2", len(doc.URLs))
+	}
+	for _, u := range doc.URLs {
+		if !strings.HasPrefix(u.Loc, "http") {
+			t.Errorf("loc %q 不是绝对地址", u.Loc)
+		}
+	}
+}
+
+func TestFeedConditionalGet(t *testing.T) {
+	r := setupFeedTest(t)
+
+	first := get(r, "/feed.rss", nil)
+	etag := first.Header().Get("ETag")
+	lastModified := first.Header().Get("Last-Modified")
+	if etag == "" || lastModified == "" {
+		t.Fatalf("缺少缓存头: ETag=%q Last-Modified=%q", etag, lastModified)
+	}
+
+	t.Run("If-None-Match", func(t *testing.T) {
+		w := get(r, "/feed.rss", map[string]string{"If-None-Match": etag})
+		if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("状态码 = %d, body = %d 字节; 期望 304 且无 body", w.Code, w.Body.Len())
+		}
+	})
+
+	t.Run("If-Modified-Since", func(t *testing.T) {
+		w := get(r, "/feed.rss", map[string]string{"If-Modified-Since": lastModified})
+		if w.Code != http.StatusNotModified {
+			t.Errorf("状态码 = %d; 期望 304", w.Code)
+		}
+	})
+
+	t.Run("内容变化后重新返回", func(t *testing.T) {
+		db.Model(&Article{}).Where("slug = ?", "sqlite-ru-men").
+			Update("updated_at", time.Now().Add(time.Hour))
+		w := get(r, "/feed.rss", map[string]string{"If-None-Match": etag})
+		if w.Code != http.StatusOK {
+			t.Errorf("状态码 = %d; 期望 200", w.Code)
+		}
+		if w.Header().Get("ETag") == etag {
+			t.Error("内容变化后 ETag 未改变")
+		}
+	})
+}
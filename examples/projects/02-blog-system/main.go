@@ -2,9 +2,15 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -14,143 +20,420 @@ import (
 
 // User 用户模型
 type User struct {
-	ID        uint      `json:"id" gorm:"primaryKey"`
-	Username  string    `json:"username" gorm:"unique;not null"`
-	Email     string    `json:"email" gorm:"unique;not null"`
-	Password  string    `json:"-" gorm:"not null"`
-	CreatedAt time.Time `json:"created_at"`
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	Username  string     `json:"username" gorm:"unique;not null"`
+	Email     string     `json:"email" gorm:"unique;not null"`
+	Password  string     `json:"-" gorm:"not null"`
+	Role      string     `json:"role" gorm:"default:reader;index"`
+	BannedAt  *time.Time `json:"banned_at"` // 为空表示未封禁
+	BanReason string     `json:"ban_reason,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
 }
 
 // Article 文章模型
 type Article struct {
-	ID        uint      `json:"id" gorm:"primaryKey"`
-	Title     string    `json:"title" gorm:"not null"`
-	Content   string    `json:"content" gorm:"type:text"`
-	AuthorID  uint      `json:"author_id"`
-	Author    User      `json:"author" gorm:"foreignKey:AuthorID"`
-	ViewCount int       `json:"view_count" gorm:"default:0"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
-}
-
-// Comment 评论模型
-type Comment struct {
-	ID        uint      `json:"id" gorm:"primaryKey"`
-	Content   string    `json:"content" gorm:"not null"`
-	ArticleID uint      `json:"article_id"`
-	Article   Article   `json:"article" gorm:"foreignKey:ArticleID"`
-	UserID    uint      `json:"user_id"`
-	User      User      `json:"user" gorm:"foreignKey:UserID"`
-	CreatedAt time.Time `json:"created_at"`
-}
-
-var db *gorm.DB
-
-func init() {
-	var err error
-	db, err = gorm.Open(sqlite.Open("blog.db"), &gorm.Config{})
+	ID            uint       `json:"id" gorm:"primaryKey"`
+	Title         string     `json:"title" gorm:"not null"`
+	Slug          string     `json:"slug" gorm:"uniqueIndex;not null;default:''"`
+	Content       string     `json:"content" gorm:"type:text"`
+	AuthorID      uint       `json:"author_id"`
+	Author        User       `json:"author" gorm:"foreignKey:AuthorID"`
+	Tags          []Tag      `json:"tags" gorm:"many2many:article_tags;"`
+	Categories    []Category `json:"categories" gorm:"many2many:article_categories;"`
+	ViewCount     int        `json:"view_count" gorm:"default:0"`
+	LikeCount     int        `json:"like_count" gorm:"default:0"`
+	BookmarkCount int        `json:"bookmark_count" gorm:"default:0"`
+	PublishedAt   *time.Time `json:"published_at" gorm:"index"` // 为空表示草稿
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+var (
+	db     *gorm.DB
+	views  *ViewCounter
+	search SearchIndex
+
+	errCategoryNotFound = errors.New("分类不存在")
+	errCategoryExists   = errors.New("分类已存在")
+
+	dbPath = flag.String("db", "blog.db", "SQLite 数据库文件")
+	addr   = flag.String("addr", ":8080", "监听地址")
+)
+
+// initDatabase 初始化数据库并自动迁移；唯一约束冲突转换为 gorm.ErrDuplicatedKey
+func initDatabase(dsn string) *gorm.DB {
+	conn, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{TranslateError: true})
 	if err != nil {
 		log.Fatal("连接数据库失败:", err)
 	}
 
+	if err := migrateArticleSlugs(conn); err != nil {
+		log.Fatal("补齐文章 slug 失败:", err)
+	}
+	if err := migrateArticlePublishedAt(conn); err != nil {
+		log.Fatal("补齐文章发布时间失败:", err)
+	}
+	if err := migrateUserRoles(conn); err != nil {
+		log.Fatal("迁移用户角色失败:", err)
+	}
+
 	// 自动迁移
-	db.AutoMigrate(&User{}, &Article{}, &Comment{})
+	if err := conn.AutoMigrate(&User{}, &Article{}, &Comment{}, &Tag{}, &Category{}, &ArticleViewStat{},
+		&ArticleLike{}, &Bookmark{}, &Follow{}, &TagFollow{}, &Upload{}); err != nil {
+		log.Fatal("数据库迁移失败:", err)
+	}
+	return conn
 }
 
-func main() {
+// migrateArticlePublishedAt 升级前没有草稿概念，已有文章均视为在创建时发布
+func migrateArticlePublishedAt(conn *gorm.DB) error {
+	m := conn.Migrator()
+	if !m.HasTable(&Article{}) || m.HasColumn(&Article{}, "PublishedAt") {
+		return nil
+	}
+	if err := m.AddColumn(&Article{}, "PublishedAt"); err != nil {
+		return err
+	}
+	return conn.Exec("UPDATE articles SET published_at = created_at").Error
+}
+
+// published 只查询已发布的文章
+func published(tx *gorm.DB) *gorm.DB {
+	return tx.Where("articles.published_at IS NOT NULL")
+}
+
+// currentUserID 获取当前用户 ID，未登录时返回 0
+// 简化处理：从 X-User-ID 请求头读取，任何人都可以冒充其他用户（包括管理员），只适合本地演示；
+// 管理后台接口另外要求 -admin-key 密钥，实际应从 JWT 等可验证的凭证获取
+func currentUserID(c *gin.Context) uint {
+	if id, err := strconv.ParseUint(c.GetHeader("X-User-ID"), 10, 64); err == nil && id > 0 {
+		return uint(id)
+	}
+	return 0
+}
+
+// currentUser 加载当前用户，未登录或用户不存在时返回 false
+func currentUser(c *gin.Context) (User, bool) {
+	var user User
+	id := currentUserID(c)
+	if id == 0 {
+		return user, false
+	}
+	if err := db.First(&user, id).Error; err != nil {
+		return user, false
+	}
+	return user, true
+}
+
+// parseID 解析路径中的 :id 参数，无效时返回 0
+func parseID(c *gin.Context) uint {
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+	return uint(id)
+}
+
+// pagination 解析分页参数
+func pagination(c *gin.Context) (page, pageSize int) {
+	page, _ = strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ = strconv.Atoi(c.DefaultQuery("page_size", "10"))
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 10
+	}
+	return page, pageSize
+}
+
+// setupRouter 注册所有路由
+func setupRouter() *gin.Engine {
 	r := gin.Default()
 
-	// 用户注册
-	r.POST("/api/register", func(c *gin.Context) {
-		var user User
-		if err := c.ShouldBindJSON(&user); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-		// 简单密码处理（实际应使用 bcrypt）
-		user.Password = user.Password // 实际应加密
-		if err := db.Create(&user).Error; err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "用户已存在"})
-			return
+	api := r.Group("/api")
+	{
+		api.POST("/register", handleRegister)
+
+		api.GET("/articles", handleListArticles)
+		api.GET("/articles/popular", handlePopularArticles)
+		api.GET("/articles/:id", handleGetArticle)
+		api.GET("/articles/by-slug/:slug", handleGetArticleBySlug)
+		api.GET("/articles/:id/comments", handleListComments)
+		api.GET("/search", handleSearch)
+		api.GET("/bookmarks", requireLogin, handleListBookmarks)
+		api.GET("/feed", requireLogin, handlePersonalFeed)
+
+		// 标签与分类
+		api.GET("/tags", handleListTags)
+		api.GET("/categories", handleListCategories)
+		api.POST("/categories", requirePermission(PermManageTaxonomy), handleCreateCategory)
+
+		// 作者：发表文章与上传图片
+		author := api.Group("", requirePermission(PermWriteArticle))
+		{
+			author.POST("/articles", handleCreateArticle)
+			author.POST("/articles/:id/publish", handlePublishArticle)
+			author.POST("/uploads/images", handleUploadImage)
 		}
-		c.JSON(http.StatusCreated, gin.H{"message": "注册成功", "user": user})
-	})
 
-	// 创建文章
-	r.POST("/api/articles", func(c *gin.Context) {
-		var article Article
-		if err := c.ShouldBindJSON(&article); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
+		// 已注册且未被封禁的用户：评论、点赞、收藏与关注
+		member := api.Group("", requirePermission(PermInteract))
+		{
+			member.POST("/articles/:id/comments", handleCreateComment)
+			member.GET("/articles/:id/comments/moderation", handleArticleModerationQueue)
+			member.PATCH("/comments/:id/status", handleModerateComment)
+
+			member.POST("/articles/:id/like", handleLikeArticle)
+			member.DELETE("/articles/:id/like", handleUnlikeArticle)
+			member.POST("/articles/:id/bookmark", handleBookmarkArticle)
+			member.DELETE("/articles/:id/bookmark", handleUnbookmarkArticle)
+			member.POST("/users/:id/follow", handleFollowAuthor)
+			member.DELETE("/users/:id/follow", handleUnfollowAuthor)
+			member.POST("/tags/:slug/follow", handleFollowTag)
+			member.DELETE("/tags/:slug/follow", handleUnfollowTag)
 		}
-		article.AuthorID = 1 // 简化处理，实际应从 JWT 获取
-		if err := db.Create(&article).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+
+		// 管理后台：X-User-ID 可以伪造，另外要求管理后台密钥，再按角色校验权限
+		admin := api.Group("/admin", requireAdminKey)
+		{
+			admin.GET("/comments", requirePermission(PermModerate), handleAdminModerationQueue)
+			admin.POST("/comments/bulk", requirePermission(PermModerate), handleBulkModerateComments)
+			admin.GET("/stats", requirePermission(PermViewStats), handleSiteStats)
+
+			users := admin.Group("/users", requirePermission(PermManageUsers))
+			users.GET("", handleListUsers)
+			users.PATCH("/:id/role", handleChangeUserRole)
+			users.POST("/:id/ban", handleBanUser)
+			users.DELETE("/:id/ban", handleUnbanUser)
 		}
-		db.Preload("Author").First(&article, article.ID)
-		c.JSON(http.StatusCreated, gin.H{"data": article})
-	})
+	}
 
-	// 获取文章列表
-	r.GET("/api/articles", func(c *gin.Context) {
-		var articles []Article
-		page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
-		pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "10"))
-		offset := (page - 1) * pageSize
-
-		db.Preload("Author").Offset(offset).Limit(pageSize).Find(&articles)
-		var total int64
-		db.Model(&Article{}).Count(&total)
-
-		c.JSON(http.StatusOK, gin.H{
-			"data": articles,
-			"page": page,
-			"page_size": pageSize,
-			"total": total,
-		})
-	})
+	// 上传的图片
+	r.Static("/uploads", *uploadDir)
+
+	// 订阅源与站点地图
+	r.GET("/feed.rss", handleRSSFeed)
+	r.GET("/feed.atom", handleAtomFeed)
+	r.GET("/tags/:slug/feed.rss", handleRSSFeed)
+	r.GET("/tags/:slug/feed.atom", handleAtomFeed)
+	r.GET("/sitemap.xml", handleSitemap)
+
+	return r
+}
+
+// handleRegister 用户注册
+func handleRegister(c *gin.Context) {
+	var user User
+	if err := c.ShouldBindJSON(&user); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// 简单密码处理（实际应使用 bcrypt）
+	// 角色和封禁状态不允许自行设置
+	user.Role = RoleReader
+	user.BannedAt = nil
+	user.BanReason = ""
+	if err := db.Create(&user).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "用户已存在"})
+		return
+	}
+	// 第一个注册的用户成为管理员：创建后在同一条语句中确认没有更早的用户，并发注册也只会产生一个管理员
+	result := db.Model(&User{}).Where("id = ? AND NOT EXISTS (SELECT 1 FROM users AS earlier WHERE earlier.id < ?)", user.ID, user.ID).
+		Update("role", RoleAdmin)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 1 {
+		user.Role = RoleAdmin
+	}
+	c.JSON(http.StatusCreated, gin.H{"message": "注册成功", "user": user})
+}
+
+// handleCreateArticle 创建文章
+func handleCreateArticle(c *gin.Context) {
+	var req struct {
+		Title       string   `json:"title" binding:"required"`
+		Content     string   `json:"content"`
+		Slug        string   `json:"slug"` // 可选，缺省根据标题生成
+		Tags        []string `json:"tags"`
+		CategoryIDs []uint   `json:"category_ids"`
+		Draft       bool     `json:"draft"` // 草稿不出现在列表和订阅源中
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	// 获取文章详情
-	r.GET("/api/articles/:id", func(c *gin.Context) {
-		var article Article
-		id := c.Param("id")
-		if err := db.Preload("Author").First(&article, id).Error; err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": "文章不存在"})
-			return
+	article := Article{
+		Title:    req.Title,
+		Content:  req.Content,
+		AuthorID: currentUserID(c),
+	}
+	if !req.Draft {
+		now := time.Now()
+		article.PublishedAt = &now
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		source := req.Slug
+		if source == "" {
+			source = req.Title
 		}
-		// 增加阅读量
-		db.Model(&article).Update("view_count", article.ViewCount+1)
-		c.JSON(http.StatusOK, gin.H{"data": article})
-	})
+		slug, err := uniqueSlug(tx, &Article{}, source, 0)
+		if err != nil {
+			return err
+		}
+		article.Slug = slug
 
-	// 添加评论
-	r.POST("/api/articles/:id/comments", func(c *gin.Context) {
-		var comment Comment
-		if err := c.ShouldBindJSON(&comment); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
+		if article.Tags, err = findOrCreateTags(tx, req.Tags); err != nil {
+			return err
 		}
-		articleID, _ := strconv.Atoi(c.Param("id"))
-		comment.ArticleID = uint(articleID)
-		comment.UserID = 1 // 简化处理
-		if err := db.Create(&comment).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+		if len(req.CategoryIDs) > 0 {
+			if err := tx.Find(&article.Categories, req.CategoryIDs).Error; err != nil {
+				return err
+			}
+			if len(article.Categories) != len(req.CategoryIDs) {
+				return errCategoryNotFound
+			}
 		}
-		db.Preload("User").First(&comment, comment.ID)
-		c.JSON(http.StatusCreated, gin.H{"data": comment})
+		if err := tx.Create(&article).Error; err != nil {
+			return err
+		}
+		if article.Slug == "" {
+			article.Slug, err = assignIDSlug(tx, &Article{}, "article", article.ID)
+		}
+		return err
 	})
+	if err == errCategoryNotFound {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	db.Scopes(withArticleRelations).First(&article, article.ID)
+	syncArticleIndex(article)
+	c.JSON(http.StatusCreated, gin.H{"data": article})
+}
 
-	// 获取文章评论
-	r.GET("/api/articles/:id/comments", func(c *gin.Context) {
-		var comments []Comment
-		articleID := c.Param("id")
-		db.Preload("User").Where("article_id = ?", articleID).Find(&comments)
-		c.JSON(http.StatusOK, gin.H{"data": comments})
+// handleListArticles 获取文章列表，支持按 tag、category（slug）过滤
+func handleListArticles(c *gin.Context) {
+	var articles []Article
+	page, pageSize := pagination(c)
+	offset := (page - 1) * pageSize
+
+	query := filterByTaxonomy(db.Model(&Article{}).Scopes(published), c.Query("tag"), c.Query("category"))
+
+	var total int64
+	query.Session(&gorm.Session{}).Count(&total)
+	query.Scopes(withArticleRelations).
+		Order("articles.created_at DESC").
+		Offset(offset).Limit(pageSize).
+		Find(&articles)
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":      articles,
+		"page":      page,
+		"page_size": pageSize,
+		"total":     total,
 	})
+}
+
+// handleGetArticle 获取文章详情
+func handleGetArticle(c *gin.Context) {
+	showArticle(c, db.Where("id = ?", parseID(c)))
+}
+
+// handleGetArticleBySlug 通过 slug 获取文章详情
+func handleGetArticleBySlug(c *gin.Context) {
+	showArticle(c, db.Where("slug = ?", c.Param("slug")))
+}
+
+// showArticle 查询文章、增加阅读量并返回
+func showArticle(c *gin.Context, query *gorm.DB) {
+	var article Article
+	if err := query.Scopes(withArticleRelations).First(&article).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "文章不存在"})
+		return
+	}
+	// 草稿仅作者可见
+	if article.PublishedAt == nil && article.AuthorID != currentUserID(c) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "文章不存在"})
+		return
+	}
+	// 增加阅读量：先记入内存，由计数器定期批量写库
+	views.Record(article.ID, visitorKey(c))
+	article.ViewCount += views.Pending(article.ID)
+	c.JSON(http.StatusOK, gin.H{"data": article})
+}
+
+// handlePublishArticle 发布草稿（仅作者）
+func handlePublishArticle(c *gin.Context) {
+	var article Article
+	if err := db.First(&article, parseID(c)).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "文章不存在"})
+		return
+	}
+	if article.AuthorID != currentUserID(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "只有作者可以发布文章"})
+		return
+	}
+	if article.PublishedAt == nil {
+		db.Model(&article).Update("published_at", time.Now())
+	}
+	db.Scopes(withArticleRelations).First(&article, article.ID)
+	syncArticleIndex(article)
+	c.JSON(http.StatusOK, gin.H{"data": article})
+}
 
-	log.Println("博客系统启动在 :8080")
-	r.Run(":8080")
+// withArticleRelations 预加载文章的作者、标签和分类
+func withArticleRelations(tx *gorm.DB) *gorm.DB {
+	return tx.Preload("Author").Preload("Tags").Preload("Categories")
 }
 
+func main() {
+	flag.Parse()
+	if err := ensureAdminKey(); err != nil {
+		log.Fatal("生成管理后台密钥失败:", err)
+	}
+	spamFilter = NewSpamFilter(*spamKeywords, *spamMaxLinks)
+	db = initDatabase(*dbPath)
+	search = newSearchIndex(db)
+	if *reindex {
+		n, err := rebuildSearchIndex(db, search)
+		if err != nil {
+			log.Fatal("重建搜索索引失败:", err)
+		}
+		log.Printf("搜索索引重建完成，共 %d 篇文档", n)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	views = NewViewCounter(db, *viewWindow)
+	flushed := make(chan struct{})
+	go func() {
+		views.Run(ctx, *viewFlushInterval)
+		close(flushed)
+	}()
+
+	srv := &http.Server{Addr: *addr, Handler: setupRouter()}
+	go func() {
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+		<-sigChan
+
+		log.Println("收到关闭信号，开始优雅关闭...")
+		shutdownCtx, done := context.WithTimeout(context.Background(), 5*time.Second)
+		defer done()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Println("博客系统启动在", *addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+
+	// 写入尚未落库的阅读量
+	cancel()
+	<-flushed
+	log.Println("服务已关闭")
+}
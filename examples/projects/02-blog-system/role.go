@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// 用户角色，权限依次递增
+const (
+	RoleReader = "reader" // 读者：评论、点赞、收藏、关注
+	RoleAuthor = "author" // 作者：发表文章、上传图片
+	RoleEditor = "editor" // 编辑：管理分类、审核全站评论、查看统计
+	RoleAdmin  = "admin"  // 管理员：管理用户
+)
+
+// Permission 权限
+type Permission string
+
+// 权限列表
+const (
+	PermInteract       Permission = "interact"
+	PermWriteArticle   Permission = "article:write"
+	PermManageTaxonomy Permission = "taxonomy:manage"
+	PermModerate       Permission = "comment:moderate"
+	PermViewStats      Permission = "stats:view"
+	PermManageUsers    Permission = "user:manage"
+)
+
+// rolePermissions 各角色拥有的权限
+var rolePermissions = map[string][]Permission{
+	RoleReader: {PermInteract},
+	RoleAuthor: {PermInteract, PermWriteArticle},
+	RoleEditor: {PermInteract, PermWriteArticle, PermManageTaxonomy, PermModerate, PermViewStats},
+	RoleAdmin:  {PermInteract, PermWriteArticle, PermManageTaxonomy, PermModerate, PermViewStats, PermManageUsers},
+}
+
+// validRole 判断角色是否存在
+func validRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// Can 判断用户是否拥有某项权限，被封禁的用户没有任何权限
+func (u User) Can(perm Permission) bool {
+	if u.BannedAt != nil {
+		return false
+	}
+	for _, p := range rolePermissions[u.Role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// adminKey 管理后台密钥：X-User-ID 请求头可以任意伪造，管理后台接口另外校验 X-Admin-Key 请求头
+var adminKey = flag.String("admin-key", "", "管理后台密钥，请求 /api/admin 接口时通过 X-Admin-Key 请求头提供；为空时启动时随机生成并打印到日志")
+
+// ensureAdminKey 未设置管理后台密钥时随机生成一个并打印，重启后失效
+func ensureAdminKey() error {
+	if *adminKey != "" {
+		return nil
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	*adminKey = hex.EncodeToString(buf)
+	log.Printf("未设置 -admin-key，已生成临时管理后台密钥（重启后失效）: %s", *adminKey)
+	return nil
+}
+
+// requireAdminKey 校验管理后台密钥，密钥为空时拒绝所有请求
+func requireAdminKey(c *gin.Context) {
+	key := c.GetHeader("X-Admin-Key")
+	if *adminKey == "" || subtle.ConstantTimeCompare([]byte(key), []byte(*adminKey)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "缺少或错误的管理后台密钥（X-Admin-Key）"})
+		return
+	}
+	c.Next()
+}
+
+// requireLogin 要求已登录，只读的个人数据（收藏、时间线）不校验封禁状态
+func requireLogin(c *gin.Context) {
+	if _, ok := currentUser(c); !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "请先登录"})
+		return
+	}
+	c.Next()
+}
+
+// requirePermission 路由组权限中间件：加载当前用户并校验封禁状态和角色权限
+func requirePermission(perm Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentUser(c)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "请先登录"})
+			return
+		}
+		if user.BannedAt != nil {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "账号已被封禁", "reason": user.BanReason})
+			return
+		}
+		if !user.Can(perm) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "权限不足", "required": perm})
+			return
+		}
+		c.Next()
+	}
+}
+
+// migrateUserRoles 为升级前的用户补充角色
+// 升级前所有用户都可以发表文章，因此已有用户迁移为作者，最早注册的用户成为管理员
+func migrateUserRoles(conn *gorm.DB) error {
+	m := conn.Migrator()
+	if !m.HasTable(&User{}) || m.HasColumn(&User{}, "Role") {
+		return nil
+	}
+	if err := m.AddColumn(&User{}, "Role"); err != nil {
+		return err
+	}
+	if err := conn.Exec("UPDATE users SET role = ?", RoleAuthor).Error; err != nil {
+		return err
+	}
+	return conn.Exec("UPDATE users SET role = ? WHERE id = (SELECT MIN(id) FROM users)", RoleAdmin).Error
+}
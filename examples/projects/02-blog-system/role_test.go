@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// setupBlogTest 使用内存数据库和内存搜索索引初始化全局状态
+func setupBlogTest(t *testing.T) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	db = initDatabase("file:" + t.Name() + "?mode=memory&cache=shared")
+	search = NewMemoryIndex()
+	views = NewViewCounter(db, time.Minute)
+	spamFilter = NewSpamFilter(*spamKeywords, *spamMaxLinks)
+	*adminKey = "test-admin-key"
+	return setupRouter()
+}
+
+// createUser 创建指定角色的用户
+func createUser(t *testing.T, name, role string) User {
+	t.Helper()
+	user := User{Username: name, Email: name + "@example.com", Password: "x", Role: role}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// send 以 userID 身份发送请求，userID 为 0 表示未登录；管理后台请求带上密钥
+func send(r *gin.Engine, method, path string, userID uint, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if userID != 0 {
+		req.Header.Set("X-User-ID", fmt.Sprint(userID))
+	}
+	if strings.HasPrefix(path, "/api/admin") {
+		req.Header.Set("X-Admin-Key", *adminKey)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestUserCan(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		user User
+		perm Permission
+		want bool
+	}{
+		{User{Role: RoleReader}, PermInteract, true},
+		{User{Role: RoleReader}, PermWriteArticle, false},
+		{User{Role: RoleAuthor}, PermWriteArticle, true},
+		{User{Role: RoleAuthor}, PermModerate, false},
+		{User{Role: RoleEditor}, PermModerate, true},
+		{User{Role: RoleEditor}, PermManageUsers, false},
+		{User{Role: RoleAdmin}, PermManageUsers, true},
+		{User{Role: RoleAdmin, BannedAt: &now}, PermInteract, false},
+		{User{Role: "unknown"}, PermInteract, false},
+	}
+	for _, tt := range tests {
+		if got := tt.user.Can(tt.perm); got != tt.want {
+			t.Errorf("%s(封禁=%v).Can(%s) = %v; 期望 %v", tt.user.Role, tt.user.BannedAt != nil, tt.perm, got, tt.want)
+		}
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	r := setupBlogTest(t)
+	reader := createUser(t, "reader", RoleReader)
+	editor := createUser(t, "editor", RoleEditor)
+	banned := createUser(t, "banned", RoleEditor)
+	db.Model(&banned).Update("banned_at", time.Now())
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		userID uint
+		want   int
+	}{
+		{"未登录创建分类", http.MethodPost, "/api/categories", 0, http.StatusUnauthorized},
+		{"用户不存在", http.MethodPost, "/api/categories", 999, http.StatusUnauthorized},
+		{"读者创建分类", http.MethodPost, "/api/categories", reader.ID, http.StatusForbidden},
+		{"封禁的编辑创建分类", http.MethodPost, "/api/categories", banned.ID, http.StatusForbidden},
+		{"编辑创建分类", http.MethodPost, "/api/categories", editor.ID, http.StatusCreated},
+		{"未登录查看收藏", http.MethodGet, "/api/bookmarks", 0, http.StatusUnauthorized},
+		{"未登录查看时间线", http.MethodGet, "/api/feed", 0, http.StatusUnauthorized},
+		{"封禁用户查看收藏", http.MethodGet, "/api/bookmarks", banned.ID, http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := send(r, tt.method, tt.path, tt.userID, `{"name":"后端开发"}`)
+		if w.Code != tt.want {
+			t.Errorf("%s: %d %s; 期望 %d", tt.name, w.Code, w.Body, tt.want)
+		}
+	}
+}
+
+func TestAdminKey(t *testing.T) {
+	r := setupBlogTest(t)
+	admin := createUser(t, "admin", RoleAdmin)
+
+	// X-User-ID 可以伪造，管理后台还需要密钥
+	for _, tt := range []struct {
+		name string
+		key  string
+		want int
+	}{
+		{"没有密钥", "", http.StatusUnauthorized},
+		{"错误的密钥", "wrong", http.StatusUnauthorized},
+		{"正确的密钥", *adminKey, http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/admin/users", nil)
+		req.Header.Set("X-User-ID", fmt.Sprint(admin.ID))
+		if tt.key != "" {
+			req.Header.Set("X-Admin-Key", tt.key)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s: %d; 期望 %d", tt.name, w.Code, tt.want)
+		}
+	}
+
+	// 未配置密钥时生成随机密钥，已配置的密钥保持不变
+	*adminKey = ""
+	if err := ensureAdminKey(); err != nil || len(*adminKey) != 32 {
+		t.Errorf("生成密钥 %q, %v; 期望 16 字节的随机密钥", *adminKey, err)
+	}
+	*adminKey = "custom"
+	if err := ensureAdminKey(); err != nil || *adminKey != "custom" {
+		t.Errorf("已配置的密钥变为 %q", *adminKey)
+	}
+}
+
+func TestFirstUserIsAdmin(t *testing.T) {
+	r := setupBlogTest(t)
+	db = initDatabase("file:" + filepath.Join(t.TempDir(), "blog.db") + "?_busy_timeout=5000")
+
+	// 并发注册时只有最早创建的用户成为管理员
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"username":"u%d","email":"u%d@example.com"}`, i, i)
+			if w := send(r, http.MethodPost, "/api/register", 0, body); w.Code != http.StatusCreated {
+				t.Errorf("注册 u%d: %d %s", i, w.Code, w.Body)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var admins []User
+	db.Where("role = ?", RoleAdmin).Find(&admins)
+	var first User
+	db.Order("id").First(&first)
+	if len(admins) != 1 || admins[0].ID != first.ID {
+		t.Errorf("管理员 %+v; 期望只有最早注册的用户 %d", admins, first.ID)
+	}
+	if w := send(r, http.MethodPost, "/api/register", 0, `{"username":"late","email":"late@example.com"}`); !strings.Contains(w.Body.String(), `"role":"reader"`) {
+		t.Errorf("之后注册的用户: %s; 期望为读者", w.Body)
+	}
+}
+
+func TestMigrateUserRoles(t *testing.T) {
+	conn, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 升级前的 users 表没有 role 列
+	conn.Exec("CREATE TABLE users (id integer PRIMARY KEY, username text, email text, password text, created_at datetime)")
+	for _, id := range []int{3, 5, 8} {
+		conn.Exec("INSERT INTO users (id, username, email, password) VALUES (?, ?, ?, 'x')", id, fmt.Sprint("u", id), fmt.Sprint(id, "@example.com"))
+	}
+
+	if err := migrateUserRoles(conn); err != nil {
+		t.Fatal(err)
+	}
+	roles := func() map[uint]string {
+		var users []User
+		conn.Order("id").Find(&users)
+		m := make(map[uint]string, len(users))
+		for _, u := range users {
+			m[u.ID] = u.Role
+		}
+		return m
+	}
+	want := map[uint]string{3: RoleAdmin, 5: RoleAuthor, 8: RoleAuthor}
+	if got := roles(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("迁移后角色 %v; 期望 %v", got, want)
+	}
+
+	// 已有 role 列时不再迁移，不会覆盖之后调整过的角色
+	conn.Exec("UPDATE users SET role = ? WHERE id = 5", RoleReader)
+	if err := migrateUserRoles(conn); err != nil {
+		t.Fatal(err)
+	}
+	if got := roles(); got[5] != RoleReader {
+		t.Errorf("再次迁移后用户 5 的角色 = %s; 期望保持 reader", got[5])
+	}
+}
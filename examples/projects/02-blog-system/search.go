@@ -0,0 +1,357 @@
+package main
+
+import (
+	"flag"
+	"html"
+	"log"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// 搜索文档类型
+const (
+	SearchArticle = "article"
+	SearchComment = "comment"
+)
+
+var reindex = flag.Bool("reindex", false, "重建搜索索引后退出")
+
+// SearchDocument 待索引的文档
+type SearchDocument struct {
+	Kind  string
+	ID    uint
+	Title string
+	Body  string
+	Tags  []string
+}
+
+// SearchHit 搜索命中结果，Score 越大越相关
+type SearchHit struct {
+	Kind  string
+	ID    uint
+	Score float64
+}
+
+// SearchIndex 全文索引接口，可替换为 FTS5、内存索引或外部搜索引擎
+type SearchIndex interface {
+	// Index 添加或替换文档
+	Index(doc SearchDocument) error
+	// Remove 删除文档，文档不存在时不返回错误
+	Remove(kind string, id uint) error
+	// Search 按相关度返回命中结果和总数，kind 为空表示搜索所有类型
+	Search(query, kind string, limit, offset int) ([]SearchHit, int64, error)
+	// Reset 清空索引
+	Reset() error
+}
+
+// newSearchIndex 优先使用 SQLite FTS5（需以 -tags sqlite_fts5 编译），不可用时退回内存索引
+// FTS5 表首次创建时（新部署或升级前已有文章）自动回填已发布的文章和已审核的评论
+func newSearchIndex(conn *gorm.DB) SearchIndex {
+	fts, created, err := NewFTSIndex(conn)
+	if err == nil {
+		if !created {
+			log.Println("搜索索引: SQLite FTS5")
+			return fts
+		}
+		n, err := rebuildSearchIndex(conn, fts)
+		if err != nil {
+			fts.drop()
+			log.Fatal("回填搜索索引失败:", err)
+		}
+		log.Printf("搜索索引: SQLite FTS5（新建索引，已回填 %d 篇文档）", n)
+		return fts
+	}
+	log.Println("FTS5 不可用，使用内存索引:", err)
+
+	mem := NewMemoryIndex()
+	n, err := rebuildSearchIndex(conn, mem)
+	if err != nil {
+		log.Fatal("构建搜索索引失败:", err)
+	}
+	log.Printf("搜索索引: 内存（已索引 %d 篇文档）", n)
+	return mem
+}
+
+// tokenize 切分查询词：英文和数字按单词切分，中文按相邻两字（bigram）切分，单个汉字保留为一个词
+func tokenize(text string) []string {
+	return splitTokens(text, false)
+}
+
+// indexTokens 切分待索引文本，在 bigram 之外额外保留每个汉字，使单字查询也能命中
+func indexTokens(text string) []string {
+	return splitTokens(text, true)
+}
+
+func splitTokens(text string, unigrams bool) []string {
+	var tokens []string
+	var word, han []rune
+	flushWord := func() {
+		if len(word) > 0 {
+			tokens = append(tokens, string(word))
+			word = word[:0]
+		}
+	}
+	flushHan := func() {
+		if len(han) == 1 {
+			tokens = append(tokens, string(han))
+		} else {
+			for i := 0; i+1 < len(han); i++ {
+				tokens = append(tokens, string(han[i:i+2]))
+			}
+			if unigrams {
+				for _, r := range han {
+					tokens = append(tokens, string(r))
+				}
+			}
+		}
+		han = han[:0]
+	}
+
+	for _, r := range text {
+		r = unicode.ToLower(r)
+		switch {
+		case unicode.Is(unicode.Han, r):
+			flushWord()
+			han = append(han, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			flushHan()
+			word = append(word, r)
+		default:
+			flushWord()
+			flushHan()
+		}
+	}
+	flushWord()
+	flushHan()
+	return tokens
+}
+
+// highlight 截取包含查询词的片段，并用 <mark> 标记命中部分，其余内容做 HTML 转义
+func highlight(text, query string, width int) string {
+	orig := []rune(text)
+	lower := make([]rune, len(orig))
+	for i, r := range orig {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	marked := make([]bool, len(orig))
+	first := -1
+	for _, term := range tokenize(query) {
+		t := []rune(term)
+		for i := 0; i+len(t) <= len(lower); i++ {
+			if string(lower[i:i+len(t)]) != term {
+				continue
+			}
+			for j := i; j < i+len(t); j++ {
+				marked[j] = true
+			}
+			if first == -1 || i < first {
+				first = i
+			}
+		}
+	}
+
+	start, end := 0, len(orig)
+	if width > 0 && len(orig) > width {
+		if first > width/4 {
+			start = first - width/4
+		}
+		if end = start + width; end > len(orig) {
+			end = len(orig)
+			start = end - width
+		}
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	for i := start; i < end; {
+		j := i
+		for j < end && marked[j] == marked[i] {
+			j++
+		}
+		segment := html.EscapeString(string(orig[i:j]))
+		if marked[i] {
+			b.WriteString("<mark>" + segment + "</mark>")
+		} else {
+			b.WriteString(segment)
+		}
+		i = j
+	}
+	if end < len(orig) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// articleDocument 将文章转换为索引文档
+func articleDocument(article Article) SearchDocument {
+	doc := SearchDocument{Kind: SearchArticle, ID: article.ID, Title: article.Title, Body: article.Content}
+	for _, tag := range article.Tags {
+		doc.Tags = append(doc.Tags, tag.Name)
+	}
+	return doc
+}
+
+// commentDocument 将评论转换为索引文档
+func commentDocument(comment Comment) SearchDocument {
+	return SearchDocument{Kind: SearchComment, ID: comment.ID, Body: comment.Content}
+}
+
+// syncArticleIndex 已发布文章写入索引，草稿从索引中移除
+func syncArticleIndex(article Article) {
+	var err error
+	if article.PublishedAt != nil {
+		err = search.Index(articleDocument(article))
+	} else {
+		err = search.Remove(SearchArticle, article.ID)
+	}
+	if err != nil {
+		log.Println("更新搜索索引失败:", err)
+	}
+}
+
+// syncCommentIndex 只有审核通过的评论可被搜索
+func syncCommentIndex(comment Comment) {
+	var err error
+	if comment.Status == CommentApproved {
+		err = search.Index(commentDocument(comment))
+	} else {
+		err = search.Remove(SearchComment, comment.ID)
+	}
+	if err != nil {
+		log.Println("更新搜索索引失败:", err)
+	}
+}
+
+// rebuildSearchIndex 清空并重建索引，返回索引的文档数
+func rebuildSearchIndex(conn *gorm.DB, idx SearchIndex) (int, error) {
+	if err := idx.Reset(); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	var articles []Article
+	err := conn.Scopes(published).Preload("Tags").FindInBatches(&articles, 200, func(tx *gorm.DB, batch int) error {
+		for _, article := range articles {
+			if err := idx.Index(articleDocument(article)); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return count, err
+	}
+
+	var comments []Comment
+	err = conn.Where("status = ?", CommentApproved).FindInBatches(&comments, 500, func(tx *gorm.DB, batch int) error {
+		for _, comment := range comments {
+			if err := idx.Index(commentDocument(comment)); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	}).Error
+	return count, err
+}
+
+// handleSearch 搜索文章和评论，type 可选 article、comment
+func handleSearch(c *gin.Context) {
+	query := strings.TrimSpace(c.Query("q"))
+	if len(tokenize(query)) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请输入搜索关键词"})
+		return
+	}
+	kind := c.Query("type")
+	if kind != "" && kind != SearchArticle && kind != SearchComment {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "type 只能是 article 或 comment"})
+		return
+	}
+	page, pageSize := pagination(c)
+
+	hits, total, err := search.Search(query, kind, pageSize, (page-1)*pageSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var articleIDs, commentIDs []uint
+	for _, hit := range hits {
+		if hit.Kind == SearchArticle {
+			articleIDs = append(articleIDs, hit.ID)
+		} else {
+			commentIDs = append(commentIDs, hit.ID)
+		}
+	}
+	articles := make(map[uint]Article)
+	if len(articleIDs) > 0 {
+		var rows []Article
+		db.Scopes(published).Preload("Tags").Find(&rows, articleIDs)
+		for _, row := range rows {
+			articles[row.ID] = row
+		}
+	}
+	comments := make(map[uint]Comment)
+	if len(commentIDs) > 0 {
+		var rows []Comment
+		db.Preload("Article").Where("status = ?", CommentApproved).Find(&rows, commentIDs)
+		for _, row := range rows {
+			comments[row.ID] = row
+		}
+	}
+
+	results := make([]gin.H, 0, len(hits))
+	for _, hit := range hits {
+		switch hit.Kind {
+		case SearchArticle:
+			article, ok := articles[hit.ID]
+			if !ok {
+				continue
+			}
+			results = append(results, gin.H{
+				"type":       SearchArticle,
+				"id":         article.ID,
+				"article_id": article.ID,
+				"title":      article.Title,
+				"slug":       article.Slug,
+				"tags":       article.Tags,
+				"score":      hit.Score,
+				"highlight": gin.H{
+					"title":   highlight(article.Title, query, 0),
+					"content": highlight(article.Content, query, 120),
+				},
+			})
+		case SearchComment:
+			comment, ok := comments[hit.ID]
+			if !ok {
+				continue
+			}
+			results = append(results, gin.H{
+				"type":       SearchComment,
+				"id":         comment.ID,
+				"article_id": comment.ArticleID,
+				"title":      comment.Article.Title,
+				"slug":       comment.Article.Slug,
+				"score":      hit.Score,
+				"highlight": gin.H{
+					"content": highlight(comment.Content, query, 120),
+				},
+			})
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":      results,
+		"page":      page,
+		"page_size": pageSize,
+		"total":     total,
+	})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// FTSIndex 基于 SQLite FTS5 的全文索引
+// 文本在写入前先切分为 bigram 并以空格连接，FTS5 默认的 unicode61 分词器按空格即可正确切分中文
+type FTSIndex struct {
+	db *gorm.DB
+}
+
+// NewFTSIndex 创建 FTS5 虚拟表，created 表示本次新建了表，需要回填已有数据
+// SQLite 未编译 FTS5 时返回错误
+func NewFTSIndex(conn *gorm.DB) (idx *FTSIndex, created bool, err error) {
+	created = !conn.Migrator().HasTable("search_fts")
+	err = conn.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS search_fts USING fts5(
+		kind UNINDEXED, doc_id UNINDEXED, title, body, tags, tokenize = 'unicode61'
+	)`).Error
+	if err != nil {
+		return nil, false, err
+	}
+	return &FTSIndex{db: conn}, created, nil
+}
+
+// drop 删除 FTS5 虚拟表，回填失败时使用，下次启动会重新建表并回填
+func (idx *FTSIndex) drop() error {
+	return idx.db.Exec("DROP TABLE IF EXISTS search_fts").Error
+}
+
+// ftsRowID 文章和评论共用一张表，用 rowid 的奇偶区分类型，便于按主键删除
+func ftsRowID(kind string, id uint) uint {
+	if kind == SearchComment {
+		return id*2 + 1
+	}
+	return id * 2
+}
+
+// Index 添加或替换文档
+func (idx *FTSIndex) Index(doc SearchDocument) error {
+	rowID := ftsRowID(doc.Kind, doc.ID)
+	return idx.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DELETE FROM search_fts WHERE rowid = ?", rowID).Error; err != nil {
+			return err
+		}
+		return tx.Exec("INSERT INTO search_fts(rowid, kind, doc_id, title, body, tags) VALUES (?, ?, ?, ?, ?, ?)",
+			rowID, doc.Kind, doc.ID,
+			strings.Join(indexTokens(doc.Title), " "),
+			strings.Join(indexTokens(doc.Body), " "),
+			strings.Join(indexTokens(strings.Join(doc.Tags, " ")), " "),
+		).Error
+	})
+}
+
+// Remove 删除文档
+func (idx *FTSIndex) Remove(kind string, id uint) error {
+	return idx.db.Exec("DELETE FROM search_fts WHERE rowid = ?", ftsRowID(kind, id)).Error
+}
+
+// Search 使用 bm25 排序，标题和标签的权重高于正文
+func (idx *FTSIndex) Search(query, kind string, limit, offset int) ([]SearchHit, int64, error) {
+	tokens := tokenize(query)
+	if len(tokens) == 0 {
+		return nil, 0, nil
+	}
+	// 每个词用双引号包裹，多个词之间为 AND 关系
+	match := `"` + strings.Join(tokens, `" "`) + `"`
+
+	where := "search_fts MATCH ?"
+	args := []interface{}{match}
+	if kind != "" {
+		where += " AND kind = ?"
+		args = append(args, kind)
+	}
+
+	var total int64
+	if err := idx.db.Raw("SELECT COUNT(*) FROM search_fts WHERE "+where, args...).Scan(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var rows []struct {
+		Kind  string
+		DocID uint
+		Score float64
+	}
+	// bm25 的权重依次对应 kind、doc_id、title、body、tags 列，值越小越相关
+	err := idx.db.Raw("SELECT kind, doc_id, bm25(search_fts, 0, 0, 10.0, 1.0, 5.0) AS score FROM search_fts WHERE "+where+
+		" ORDER BY score LIMIT ? OFFSET ?", append(args, limit, offset)...).Scan(&rows).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	hits := make([]SearchHit, len(rows))
+	for i, row := range rows {
+		hits[i] = SearchHit{Kind: row.Kind, ID: row.DocID, Score: -row.Score}
+	}
+	return hits, total, nil
+}
+
+// Reset 清空索引
+func (idx *FTSIndex) Reset() error {
+	return idx.db.Exec("DELETE FROM search_fts").Error
+}
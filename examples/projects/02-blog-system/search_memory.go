@@ -0,0 +1,169 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// 内存索引中各字段的词频权重
+const (
+	titleWeight = 10
+	tagWeight   = 5
+	bodyWeight  = 1
+)
+
+// BM25 参数
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+type docKey struct {
+	Kind string
+	ID   uint
+}
+
+// MemoryIndex 纯 Go 实现的倒排索引，使用 BM25 排序
+// 进程重启后需要重建，适合没有编译 FTS5 的环境
+type MemoryIndex struct {
+	mu       sync.RWMutex
+	postings map[string]map[docKey]float64 // 词 -> 文档 -> 加权词频
+	docTerms map[docKey][]string           // 文档包含的词，用于删除
+	docLen   map[docKey]float64
+	totalLen float64
+}
+
+// NewMemoryIndex 创建内存索引
+func NewMemoryIndex() *MemoryIndex {
+	idx := &MemoryIndex{}
+	idx.Reset()
+	return idx
+}
+
+// Index 添加或替换文档
+func (idx *MemoryIndex) Index(doc SearchDocument) error {
+	key := docKey{Kind: doc.Kind, ID: doc.ID}
+	tf := make(map[string]float64)
+	var length float64
+	add := func(tokens []string, weight float64) {
+		for _, token := range tokens {
+			tf[token] += weight
+			length += weight
+		}
+	}
+	add(indexTokens(doc.Title), titleWeight)
+	add(indexTokens(doc.Body), bodyWeight)
+	for _, tag := range doc.Tags {
+		add(indexTokens(tag), tagWeight)
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.remove(key)
+	terms := make([]string, 0, len(tf))
+	for term, freq := range tf {
+		if idx.postings[term] == nil {
+			idx.postings[term] = make(map[docKey]float64)
+		}
+		idx.postings[term][key] = freq
+		terms = append(terms, term)
+	}
+	idx.docTerms[key] = terms
+	idx.docLen[key] = length
+	idx.totalLen += length
+	return nil
+}
+
+// Remove 删除文档
+func (idx *MemoryIndex) Remove(kind string, id uint) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.remove(docKey{Kind: kind, ID: id})
+	return nil
+}
+
+// remove 需持有写锁
+func (idx *MemoryIndex) remove(key docKey) {
+	terms, ok := idx.docTerms[key]
+	if !ok {
+		return
+	}
+	for _, term := range terms {
+		delete(idx.postings[term], key)
+		if len(idx.postings[term]) == 0 {
+			delete(idx.postings, term)
+		}
+	}
+	idx.totalLen -= idx.docLen[key]
+	delete(idx.docTerms, key)
+	delete(idx.docLen, key)
+}
+
+// Search 返回包含所有查询词的文档，按 BM25 分数降序
+func (idx *MemoryIndex) Search(query, kind string, limit, offset int) ([]SearchHit, int64, error) {
+	tokens := tokenize(query)
+	if len(tokens) == 0 {
+		return nil, 0, nil
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	n := float64(len(idx.docLen))
+	avgLen := idx.totalLen / math.Max(n, 1)
+	scores := make(map[docKey]float64)
+	for i, token := range tokens {
+		postings := idx.postings[token]
+		idf := math.Log(1 + (n-float64(len(postings))+0.5)/(float64(len(postings))+0.5))
+		next := make(map[docKey]float64)
+		for key, tf := range postings {
+			if kind != "" && key.Kind != kind {
+				continue
+			}
+			// 多个查询词为 AND 关系，只保留此前每个词都命中的文档
+			prev, ok := scores[key]
+			if i > 0 && !ok {
+				continue
+			}
+			norm := tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*idx.docLen[key]/avgLen))
+			next[key] = prev + idf*norm
+		}
+		scores = next
+	}
+
+	hits := make([]SearchHit, 0, len(scores))
+	for key, score := range scores {
+		hits = append(hits, SearchHit{Kind: key.Kind, ID: key.ID, Score: score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		if hits[i].Kind != hits[j].Kind {
+			return hits[i].Kind < hits[j].Kind
+		}
+		return hits[i].ID > hits[j].ID
+	})
+
+	total := int64(len(hits))
+	if offset >= len(hits) {
+		return nil, total, nil
+	}
+	hits = hits[offset:]
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits, total, nil
+}
+
+// Reset 清空索引
+func (idx *MemoryIndex) Reset() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.postings = make(map[string]map[docKey]float64)
+	idx.docTerms = make(map[docKey][]string)
+	idx.docLen = make(map[docKey]float64)
+	idx.totalLen = 0
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitTokens(t *testing.T) {
+	tests := []struct {
+		text    string
+		query   string // tokenize 结果
+		indexed string // indexTokens 结果
+	}{
+		{"Go 语言", "go 语言", "go 语言 语 言"},
+		{"并发编程", "并发 发编 编程", "并发 发编 编程 并 发 编 程"},
+		{"学", "学", "学"},
+		{"GORM v2，入门！", "gorm v2 入门", "gorm v2 入门 入 门"},
+		{"Hello-World_2024", "hello world 2024", "hello world 2024"},
+		{"Café 咖啡", "café 咖啡", "café 咖啡 咖 啡"},
+		{"  ！？ ", "", ""},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(tokenize(tt.text), " "); got != tt.query {
+			t.Errorf("tokenize(%q) = %q; 期望 %q", tt.text, got, tt.query)
+		}
+		if got := strings.Join(indexTokens(tt.text), " "); got != tt.indexed {
+			t.Errorf("indexTokens(%q) = %q; 期望 %q", tt.text, got, tt.indexed)
+		}
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	tests := []struct {
+		text  string
+		query string
+		width int
+		want  string
+	}{
+		{"Go 语言学习笔记", "语言", 0, "Go <mark>语言</mark>学习笔记"},
+		{"Go 语言学习笔记", "go 笔记", 0, "<mark>Go</mark> 语言学习<mark>笔记</mark>"},
+		{"学习语言学", "语言学", 0, "学习<mark>语言学</mark>"},
+		{"<b>GO</b> & go", "go", 0, "&lt;b&gt;<mark>GO</mark>&lt;/b&gt; &amp; <mark>go</mark>"},
+		{"没有命中", "go", 0, "没有命中"},
+		{"0123456789关键词0123456789", "关键词", 8, "…89<mark>关键词</mark>012…"},
+		{"关键词0123456789", "关键词", 8, "<mark>关键词</mark>01234…"},
+		{"0123456789关键词", "关键词", 8, "…56789<mark>关键词</mark>"},
+	}
+	for _, tt := range tests {
+		if got := highlight(tt.text, tt.query, tt.width); got != tt.want {
+			t.Errorf("highlight(%q, %q, %d) = %q; 期望 %q", tt.text, tt.query, tt.width, got, tt.want)
+		}
+	}
+}
+
+// searchIDs 以 a1、c1（类型首字母 + ID）的形式返回命中结果
+func searchIDs(idx SearchIndex, query, kind string, limit, offset int) (string, int64) {
+	hits, total, _ := idx.Search(query, kind, limit, offset)
+	ids := make([]string, len(hits))
+	for i, hit := range hits {
+		ids[i] = fmt.Sprint(hit.Kind[:1], hit.ID)
+	}
+	return strings.Join(ids, " "), total
+}
+
+func TestMemoryIndexRanking(t *testing.T) {
+	idx := NewMemoryIndex()
+	filler := strings.Repeat("其他内容 ", 20)
+	docs := []SearchDocument{
+		{Kind: SearchArticle, ID: 1, Title: "数据库索引", Body: filler},
+		{Kind: SearchArticle, ID: 2, Title: "随笔", Body: "聊聊索引" + filler, Tags: []string{"数据库"}},
+		{Kind: SearchArticle, ID: 3, Title: "随笔", Body: "数据库" + filler},
+		{Kind: SearchArticle, ID: 4, Title: "随笔", Body: "数据库"},
+		{Kind: SearchComment, ID: 1, Body: "数据库索引写得不错"},
+	}
+	for _, doc := range docs {
+		idx.Index(doc)
+	}
+
+	tests := []struct {
+		name   string
+		query  string
+		kind   string
+		want   string
+		total  int64
+		limit  int
+		offset int
+	}{
+		// 标题权重 > 标签 > 正文；同样在正文中命中时，加权长度越短排名越靠前
+		{"字段权重与长度归一化", "数据库", "", "a1 a2 c1 a4 a3", 5, 10, 0},
+		{"多个词为 AND 关系", "数据库 索引", "", "a1 c1 a2", 3, 10, 0},
+		{"按类型过滤", "数据库", SearchComment, "c1", 1, 10, 0},
+		{"分页", "数据库", "", "c1 a4", 5, 2, 2},
+		{"超出范围", "数据库", "", "", 5, 10, 10},
+		{"未命中", "缓存", "", "", 0, 10, 0},
+		{"单字查询命中 unigram", "库", SearchArticle, "a1 a2 a4 a3", 4, 10, 0},
+	}
+	for _, tt := range tests {
+		if got, total := searchIDs(idx, tt.query, tt.kind, tt.limit, tt.offset); got != tt.want || total != tt.total {
+			t.Errorf("%s: %q（共 %d）; 期望 %q（共 %d）", tt.name, got, total, tt.want, tt.total)
+		}
+	}
+
+	// 稀有词的 IDF 更高：同时命中常见词和稀有词时，稀有词命中的文档得分更高
+	hits, _, _ := idx.Search("索引", "", 10, 0)
+	common, _, _ := idx.Search("数据库", "", 10, 0)
+	if hits[0].Score <= common[0].Score {
+		t.Errorf("稀有词最高分 %.3f 应高于常见词最高分 %.3f", hits[0].Score, common[0].Score)
+	}
+
+	// 替换和删除文档
+	idx.Index(SearchDocument{Kind: SearchArticle, ID: 1, Title: "缓存"})
+	idx.Remove(SearchComment, 1)
+	idx.Remove(SearchComment, 99)
+	if got, _ := searchIDs(idx, "数据库 索引", "", 10, 0); got != "a2" {
+		t.Errorf("替换和删除后: %q; 期望 a2", got)
+	}
+	if got, _ := searchIDs(idx, "缓存", "", 10, 0); got != "a1" {
+		t.Errorf("替换后搜索新标题: %q; 期望 a1", got)
+	}
+}
+
+func TestNewSearchIndexBackfill(t *testing.T) {
+	setupBlogTest(t)
+	now := time.Now()
+	db.Create(&Article{Title: "分布式数据库", Slug: "a", PublishedAt: &now})
+	db.Create(&Article{Title: "数据库草稿", Slug: "b"})
+	db.Create(&Comment{Content: "数据库选型", ArticleID: 1, Status: CommentApproved})
+	db.Create(&Comment{Content: "数据库广告", ArticleID: 1, Status: CommentSpam})
+
+	idx := newSearchIndex(db)
+	if got, total := searchIDs(idx, "数据库", "", 10, 0); got != "a1 c1" || total != 2 {
+		t.Errorf("回填后: %q（共 %d）; 期望 a1 c1", got, total)
+	}
+
+	// FTS5 表已存在时不再回填，直接写库的数据需要 -reindex
+	if _, ok := idx.(*FTSIndex); !ok {
+		return
+	}
+	db.Create(&Article{Title: "数据库迁移", Slug: "c", PublishedAt: &now})
+	if got, _ := searchIDs(newSearchIndex(db), "数据库", SearchArticle, 10, 0); got != "a1" {
+		t.Errorf("表已存在时: %q; 期望只有 a1", got)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/mozillazg/go-pinyin"
+	"gorm.io/gorm"
+)
+
+// maxSlugLength slug 最大长度（不含冲突后缀）
+const maxSlugLength = 80
+
+var pinyinArgs = pinyin.NewArgs()
+
+// slugify 将标题转换为 URL 友好的 slug，中文转为拼音
+// 例如 "Go 语言学习笔记" -> "go-yu-yan-xue-xi-bi-ji"
+func slugify(title string) string {
+	var words []string
+	var word strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			words = append(words, word.String())
+			word.Reset()
+		}
+	}
+
+	for _, r := range title {
+		switch {
+		case unicode.Is(unicode.Han, r):
+			flush()
+			if py := pinyin.LazyPinyin(string(r), pinyinArgs); len(py) > 0 {
+				words = append(words, py[0])
+			}
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			word.WriteRune(unicode.ToLower(r))
+		default:
+			flush()
+		}
+	}
+	flush()
+
+	slug := strings.Join(words, "-")
+	if len(slug) > maxSlugLength {
+		slug = strings.TrimRight(slug[:maxSlugLength], "-")
+	}
+	return slug
+}
+
+// uniqueSlug 生成在 model 对应表中唯一的 slug，冲突时追加 -2、-3 等后缀
+// excludeID 用于更新已有记录时排除自身
+// title 无法生成 slug 时（如希腊文、西里尔文等非中文的非 ASCII 文字）返回空字符串，
+// 由调用方在记录创建后调用 assignIDSlug
+func uniqueSlug(tx *gorm.DB, model interface{}, title string, excludeID uint) (string, error) {
+	base := slugify(title)
+	if base == "" {
+		return "", nil
+	}
+
+	slug := base
+	for n := 2; ; n++ {
+		var count int64
+		if err := tx.Model(model).Where("slug = ? AND id <> ?", slug, excludeID).Count(&count).Error; err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return slug, nil
+		}
+		slug = base + "-" + strconv.Itoa(n)
+	}
+}
+
+// idSlugSource 基于 ID 的 slug 来源，如 "article-12"
+func idSlugSource(prefix string, id uint) string {
+	return prefix + "-" + strconv.FormatUint(uint64(id), 10)
+}
+
+// assignIDSlug 为已创建的记录设置基于 ID 的 slug，需与创建在同一事务中执行
+func assignIDSlug(tx *gorm.DB, model interface{}, prefix string, id uint) (string, error) {
+	slug, err := uniqueSlug(tx, model, idSlugSource(prefix, id), id)
+	if err != nil {
+		return "", err
+	}
+	return slug, tx.Model(model).Where("id = ?", id).UpdateColumn("slug", slug).Error
+}
+
+// migrateArticleSlugs 为升级前的文章补齐 slug
+// 必须在 AutoMigrate 创建唯一索引之前执行，否则已有的空 slug 会违反唯一约束
+func migrateArticleSlugs(conn *gorm.DB) error {
+	m := conn.Migrator()
+	if !m.HasTable(&Article{}) || m.HasColumn(&Article{}, "Slug") {
+		return nil
+	}
+	if err := m.AddColumn(&Article{}, "Slug"); err != nil {
+		return err
+	}
+
+	var articles []Article
+	if err := conn.Select("id", "title").Order("id ASC").Find(&articles).Error; err != nil {
+		return err
+	}
+	for _, article := range articles {
+		source := article.Title
+		if slugify(source) == "" {
+			source = idSlugSource("article", article.ID)
+		}
+		slug, err := uniqueSlug(conn, &Article{}, source, article.ID)
+		if err != nil {
+			return err
+		}
+		if err := conn.Model(&Article{}).Where("id = ?", article.ID).UpdateColumn("slug", slug).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
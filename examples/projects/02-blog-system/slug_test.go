@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func TestSlugify(t *testing.T) {
+	tests := []struct {
+		title string
+		want  string
+	}{
+		{"Hello World", "hello-world"},
+		{"Go 语言学习笔记", "go-yu-yan-xue-xi-bi-ji"},
+		{"  C++/Go：对比!! ", "c-go-dui-bi"},
+		{"GORM v2.0 入门", "gorm-v2-0-ru-men"},
+		{"重庆", "zhong-qing"},
+		{"Café au lait", "caf-au-lait"},
+		{"Ελληνικά", ""},
+		{"Привет мир", ""},
+		{"!!!", ""},
+		{strings.Repeat("abc ", 30), strings.TrimRight(strings.Repeat("abc-", 20), "-")},
+	}
+	for _, tt := range tests {
+		if got := slugify(tt.title); got != tt.want {
+			t.Errorf("slugify(%q) = %q; 期望 %q", tt.title, got, tt.want)
+		}
+	}
+}
+
+func TestUniqueSlug(t *testing.T) {
+	setupBlogTest(t)
+	db.Create(&Category{Name: "Go", Slug: "go"})
+	db.Create(&Category{Name: "Go!", Slug: "go-2"})
+
+	for _, tt := range []struct {
+		title     string
+		excludeID uint
+		want      string
+	}{
+		{"GO", 0, "go-3"},
+		{"GO", 1, "go"},
+		{"Rust", 0, "rust"},
+		{"Ελληνικά", 0, ""},
+	} {
+		got, err := uniqueSlug(db, &Category{}, tt.title, tt.excludeID)
+		if err != nil || got != tt.want {
+			t.Errorf("uniqueSlug(%q, %d) = %q, %v; 期望 %q", tt.title, tt.excludeID, got, err, tt.want)
+		}
+	}
+}
+
+func TestIDSlugFallback(t *testing.T) {
+	r := setupBlogTest(t)
+	author := createUser(t, "author", RoleAuthor)
+	editor := createUser(t, "editor", RoleEditor)
+	// 已有 slug 恰好为 tag-2 的标签，基于 ID 的 slug 冲突时同样追加后缀
+	if _, err := findOrCreateTags(db, []string{"Tag 2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := send(r, http.MethodPost, "/api/articles", author.ID, `{"title":"Привет мир","tags":["Ελληνικά","Go","ελληνικά","Ελληνικά"]}`)
+	var resp struct{ Data Article }
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("创建文章: %d %s", w.Code, w.Body)
+	}
+	if want := idSlugSource("article", resp.Data.ID); resp.Data.Slug != want {
+		t.Errorf("文章 slug = %q; 期望 %q", resp.Data.Slug, want)
+	}
+	var slugs []string
+	for _, tag := range resp.Data.Tags {
+		slugs = append(slugs, tag.Name+"="+tag.Slug)
+	}
+	if got, want := strings.Join(slugs, ","), "Ελληνικά=tag-2-2,Go=go,ελληνικά=tag-4"; got != want {
+		t.Errorf("标签 %s; 期望 %s", got, want)
+	}
+
+	// 同名标签复用已有记录
+	tags, err := findOrCreateTags(db, []string{"Ελληνικά"})
+	if err != nil || len(tags) != 1 || tags[0].Slug != "tag-2-2" {
+		t.Errorf("复用标签 %+v, %v; 期望 tag-2-2", tags, err)
+	}
+
+	w = send(r, http.MethodPost, "/api/categories", editor.ID, `{"name":"Новости"}`)
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"slug":"category-1"`) {
+		t.Errorf("创建分类: %d %s; 期望 slug 为 category-1", w.Code, w.Body)
+	}
+	if w := send(r, http.MethodPost, "/api/categories", editor.ID, `{"name":"Новости"}`); w.Code != http.StatusConflict {
+		t.Errorf("重复分类: %d; 期望 409", w.Code)
+	}
+}
+
+func TestTagsWithSameSlug(t *testing.T) {
+	setupBlogTest(t)
+	// 名称不同、slug 相同的标签互不合并
+	tags, err := findOrCreateTags(db, []string{"C++", "C#", "C", "C++", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, tag := range tags {
+		got = append(got, tag.Name+"="+tag.Slug)
+	}
+	if want := "C++=c,C#=c-2,C=c-3,c=c-4"; strings.Join(got, ",") != want {
+		t.Errorf("标签 %s; 期望 %s", strings.Join(got, ","), want)
+	}
+	if tags, err := findOrCreateTags(db, []string{"C#"}); err != nil || len(tags) != 1 || tags[0].Slug != "c-2" {
+		t.Errorf("复用标签 %+v, %v; 期望 c-2", tags, err)
+	}
+
+	// 生成 slug 之后、插入之前，其他请求抢先创建了同 slug 和同名的标签
+	race := map[string]Tag{"F#": {Name: "F♯", Slug: "f"}, "Rust": {Name: "Rust", Slug: "rust"}}
+	db.Callback().Create().Before("gorm:create").Register("test:race", func(tx *gorm.DB) {
+		tag, ok := tx.Statement.Dest.(*Tag)
+		if !ok {
+			return
+		}
+		if other, ok := race[tag.Name]; ok {
+			delete(race, tag.Name)
+			db.Create(&other)
+		}
+	})
+	tags, err = findOrCreateTags(db, []string{"F#", "Rust"})
+	if err != nil || len(race) != 0 || len(tags) != 2 || tags[0].Slug != "f-2" || tags[1].Slug != "rust" {
+		t.Fatalf("冲突后重试 %+v, %v; 期望 F#=f-2、复用 Rust", tags, err)
+	}
+	var count int64
+	db.Model(&Tag{}).Where("name = ?", "Rust").Count(&count)
+	if count != 1 {
+		t.Errorf("Rust 标签 %d 个; 期望 1", count)
+	}
+}
+
+func TestTaxonomyCountsOnlyPublished(t *testing.T) {
+	r := setupBlogTest(t)
+	author := createUser(t, "author", RoleAuthor)
+	editor := createUser(t, "editor", RoleEditor)
+	send(r, http.MethodPost, "/api/categories", editor.ID, `{"name":"后端"}`)
+	send(r, http.MethodPost, "/api/articles", author.ID, `{"title":"已发布","tags":["Go"],"category_ids":[1]}`)
+	send(r, http.MethodPost, "/api/articles", author.ID, `{"title":"草稿","tags":["Go","草稿标签"],"category_ids":[1],"draft":true}`)
+
+	for _, path := range []string{"/api/tags", "/api/categories"} {
+		w := send(r, http.MethodGet, path, 0, "")
+		var resp struct{ Data []taxonomyCount }
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		var counts []string
+		for _, item := range resp.Data {
+			counts = append(counts, fmt.Sprint(item.Slug, "=", item.ArticleCount))
+		}
+		want := map[string]string{"/api/tags": "go=1,cao-gao-biao-qian=0", "/api/categories": "hou-duan=1"}[path]
+		if got := strings.Join(counts, ","); got != want {
+			t.Errorf("%s: %s; 期望 %s", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// feedWindow 个性化时间线只考虑最近这段时间内发布的文章
+	feedWindow = 30 * 24 * time.Hour
+	// feedCandidates 参与排序的候选文章上限
+	feedCandidates = 500
+)
+
+// ArticleLike 点赞
+type ArticleLike struct {
+	UserID    uint      `json:"user_id" gorm:"primaryKey;autoIncrement:false"`
+	ArticleID uint      `json:"article_id" gorm:"primaryKey;autoIncrement:false;index"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Bookmark 收藏
+type Bookmark struct {
+	UserID    uint      `json:"user_id" gorm:"primaryKey;autoIncrement:false"`
+	ArticleID uint      `json:"article_id" gorm:"primaryKey;autoIncrement:false;index"`
+	Article   Article   `json:"article" gorm:"foreignKey:ArticleID"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Follow 关注作者
+type Follow struct {
+	FollowerID uint      `json:"follower_id" gorm:"primaryKey;autoIncrement:false"`
+	AuthorID   uint      `json:"author_id" gorm:"primaryKey;autoIncrement:false;index"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// TagFollow 关注标签
+type TagFollow struct {
+	UserID    uint      `json:"user_id" gorm:"primaryKey;autoIncrement:false"`
+	TagID     uint      `json:"tag_id" gorm:"primaryKey;autoIncrement:false;index"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// toggleReaction 添加或取消点赞/收藏，并同步更新文章上的计数字段
+// 只有真正插入或删除了记录才修改计数，重复请求是幂等的
+func toggleReaction(c *gin.Context, record interface{}, counter string, add bool) {
+	var article Article
+	if err := db.Scopes(published).First(&article, parseID(c)).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "文章不存在"})
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var result *gorm.DB
+		if add {
+			result = tx.Clauses(clause.OnConflict{DoNothing: true}).Create(record)
+		} else {
+			result = tx.Delete(record)
+		}
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		delta := 1
+		if !add {
+			delta = -1
+		}
+		return tx.Model(&Article{}).Where("id = ?", article.ID).
+			UpdateColumn(counter, gorm.Expr(counter+" + ?", delta)).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	db.Select("id", "like_count", "bookmark_count").First(&article, article.ID)
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{
+		"article_id":     article.ID,
+		"like_count":     article.LikeCount,
+		"bookmark_count": article.BookmarkCount,
+	}})
+}
+
+// handleLikeArticle 点赞
+func handleLikeArticle(c *gin.Context) {
+	toggleReaction(c, &ArticleLike{UserID: currentUserID(c), ArticleID: parseID(c)}, "like_count", true)
+}
+
+// handleUnlikeArticle 取消点赞
+func handleUnlikeArticle(c *gin.Context) {
+	toggleReaction(c, &ArticleLike{UserID: currentUserID(c), ArticleID: parseID(c)}, "like_count", false)
+}
+
+// handleBookmarkArticle 收藏
+func handleBookmarkArticle(c *gin.Context) {
+	toggleReaction(c, &Bookmark{UserID: currentUserID(c), ArticleID: parseID(c)}, "bookmark_count", true)
+}
+
+// handleUnbookmarkArticle 取消收藏
+func handleUnbookmarkArticle(c *gin.Context) {
+	toggleReaction(c, &Bookmark{UserID: currentUserID(c), ArticleID: parseID(c)}, "bookmark_count", false)
+}
+
+// handleListBookmarks 获取当前用户的收藏
+func handleListBookmarks(c *gin.Context) {
+	page, pageSize := pagination(c)
+	userID := currentUserID(c)
+
+	var total int64
+	db.Model(&Bookmark{}).Where("user_id = ?", userID).Count(&total)
+
+	var bookmarks []Bookmark
+	db.Preload("Article", withArticleRelations).
+		Where("user_id = ?", userID).
+		Order("created_at DESC").
+		Offset((page - 1) * pageSize).Limit(pageSize).
+		Find(&bookmarks)
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":      bookmarks,
+		"page":      page,
+		"page_size": pageSize,
+		"total":     total,
+	})
+}
+
+// handleFollowAuthor 关注作者
+func handleFollowAuthor(c *gin.Context) {
+	followerID := currentUserID(c)
+	var author User
+	if err := db.First(&author, parseID(c)).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
+		return
+	}
+	if author.ID == followerID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "不能关注自己"})
+		return
+	}
+	follow := Follow{FollowerID: followerID, AuthorID: author.ID}
+	if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&follow).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "已关注"})
+}
+
+// handleUnfollowAuthor 取消关注作者
+func handleUnfollowAuthor(c *gin.Context) {
+	db.Where("follower_id = ? AND author_id = ?", currentUserID(c), parseID(c)).Delete(&Follow{})
+	c.JSON(http.StatusOK, gin.H{"message": "已取消关注"})
+}
+
+// handleFollowTag 关注标签
+func handleFollowTag(c *gin.Context) {
+	var tag Tag
+	if err := db.Where("slug = ?", c.Param("slug")).First(&tag).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "标签不存在"})
+		return
+	}
+	follow := TagFollow{UserID: currentUserID(c), TagID: tag.ID}
+	if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&follow).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "已关注"})
+}
+
+// handleUnfollowTag 取消关注标签
+func handleUnfollowTag(c *gin.Context) {
+	var tag Tag
+	if err := db.Where("slug = ?", c.Param("slug")).First(&tag).Error; err == nil {
+		db.Where("user_id = ? AND tag_id = ?", currentUserID(c), tag.ID).Delete(&TagFollow{})
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "已取消关注"})
+}
+
+// feedScore 时间线排序分数：互动越多分数越高，随发布时间衰减
+// 与 Hacker News 类似：(1 + 互动数) / (小时数 + 2)^1.5
+func feedScore(likes, bookmarks, comments int, age time.Duration) float64 {
+	engagement := 1 + float64(likes) + 2*float64(bookmarks) + float64(comments)
+	return engagement / math.Pow(age.Hours()+2, 1.5)
+}
+
+// handlePersonalFeed 个性化时间线：关注的作者和标签下的文章，按时间与互动综合排序
+func handlePersonalFeed(c *gin.Context) {
+	userID := currentUserID(c)
+	page, pageSize := pagination(c)
+	now := time.Now()
+
+	followedAuthors := db.Model(&Follow{}).Select("author_id").Where("follower_id = ?", userID)
+	followedTags := db.Table("article_tags").Select("article_tags.article_id").
+		Joins("JOIN tag_follows ON tag_follows.tag_id = article_tags.tag_id").
+		Where("tag_follows.user_id = ?", userID)
+
+	var candidates []Article
+	db.Scopes(published).
+		Where("articles.author_id <> ?", userID).
+		Where("articles.published_at >= ?", now.Add(-feedWindow)).
+		Where(db.Where("articles.author_id IN (?)", followedAuthors).Or("articles.id IN (?)", followedTags)).
+		Order("articles.published_at DESC").
+		Limit(feedCandidates).
+		Find(&candidates)
+
+	// 统计候选文章的已审核评论数
+	comments := make(map[uint]int, len(candidates))
+	if len(candidates) > 0 {
+		ids := make([]uint, len(candidates))
+		for i, article := range candidates {
+			ids[i] = article.ID
+		}
+		var counts []struct {
+			ArticleID uint
+			Total     int
+		}
+		db.Model(&Comment{}).
+			Select("article_id, COUNT(*) AS total").
+			Where("article_id IN ? AND status = ?", ids, CommentApproved).
+			Group("article_id").
+			Scan(&counts)
+		for _, row := range counts {
+			comments[row.ArticleID] = row.Total
+		}
+	}
+
+	scores := make(map[uint]float64, len(candidates))
+	for _, article := range candidates {
+		scores[article.ID] = feedScore(article.LikeCount, article.BookmarkCount, comments[article.ID], now.Sub(*article.PublishedAt))
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return scores[candidates[i].ID] > scores[candidates[j].ID]
+	})
+
+	start := (page - 1) * pageSize
+	if start > len(candidates) {
+		start = len(candidates)
+	}
+	end := start + pageSize
+	if end > len(candidates) {
+		end = len(candidates)
+	}
+	pageArticles := candidates[start:end]
+	if len(pageArticles) > 0 {
+		ids := make([]uint, len(pageArticles))
+		for i, article := range pageArticles {
+			ids[i] = article.ID
+		}
+		var loaded []Article
+		db.Scopes(withArticleRelations).Find(&loaded, ids)
+		byID := make(map[uint]Article, len(loaded))
+		for _, article := range loaded {
+			byID[article.ID] = article
+		}
+		for i, article := range pageArticles {
+			pageArticles[i] = byID[article.ID]
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":      pageArticles,
+		"page":      page,
+		"page_size": pageSize,
+		"total":     len(candidates),
+	})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// reactionCounts 读取点赞/收藏响应中的计数
+func reactionCounts(body []byte) (likes, bookmarks int) {
+	var resp struct {
+		Data struct {
+			LikeCount     int `json:"like_count"`
+			BookmarkCount int `json:"bookmark_count"`
+		}
+	}
+	json.Unmarshal(body, &resp)
+	return resp.Data.LikeCount, resp.Data.BookmarkCount
+}
+
+func TestReactionsAreIdempotent(t *testing.T) {
+	r := setupBlogTest(t)
+	author := createUser(t, "author", RoleAuthor)
+	alice := createUser(t, "alice", RoleReader)
+	bob := createUser(t, "bob", RoleReader)
+	now := time.Now()
+	article := Article{Title: "文章", Slug: "wen-zhang", AuthorID: author.ID, PublishedAt: &now}
+	draft := Article{Title: "草稿", Slug: "cao-gao", AuthorID: author.ID}
+	db.Create(&article)
+	db.Create(&draft)
+	path := fmt.Sprintf("/api/articles/%d/", article.ID)
+
+	steps := []struct {
+		name      string
+		method    string
+		action    string
+		userID    uint
+		likes     int
+		bookmarks int
+	}{
+		{"alice 点赞", http.MethodPost, "like", alice.ID, 1, 0},
+		{"alice 重复点赞", http.MethodPost, "like", alice.ID, 1, 0},
+		{"bob 点赞", http.MethodPost, "like", bob.ID, 2, 0},
+		{"alice 收藏", http.MethodPost, "bookmark", alice.ID, 2, 1},
+		{"alice 重复收藏", http.MethodPost, "bookmark", alice.ID, 2, 1},
+		{"alice 取消点赞", http.MethodDelete, "like", alice.ID, 1, 1},
+		{"alice 重复取消点赞", http.MethodDelete, "like", alice.ID, 1, 1},
+		{"bob 取消未收藏的文章", http.MethodDelete, "bookmark", bob.ID, 1, 1},
+		{"alice 取消收藏", http.MethodDelete, "bookmark", alice.ID, 1, 0},
+	}
+	for _, s := range steps {
+		w := send(r, s.method, path+s.action, s.userID, "")
+		likes, bookmarks := reactionCounts(w.Body.Bytes())
+		if w.Code != http.StatusOK || likes != s.likes || bookmarks != s.bookmarks {
+			t.Errorf("%s: %d 点赞 %d 收藏 %d; 期望 200 点赞 %d 收藏 %d", s.name, w.Code, likes, bookmarks, s.likes, s.bookmarks)
+		}
+	}
+	db.First(&article, article.ID)
+	var likeRows int64
+	db.Model(&ArticleLike{}).Where("article_id = ?", article.ID).Count(&likeRows)
+	if article.LikeCount != 1 || article.BookmarkCount != 0 || likeRows != 1 {
+		t.Errorf("文章计数 %d/%d、点赞记录 %d 条; 期望 1/0、1 条", article.LikeCount, article.BookmarkCount, likeRows)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		path   string
+		userID uint
+		code   int
+	}{
+		{"未登录点赞", path + "like", 0, http.StatusUnauthorized},
+		{"点赞草稿", fmt.Sprintf("/api/articles/%d/like", draft.ID), alice.ID, http.StatusNotFound},
+		{"点赞不存在的文章", "/api/articles/999/like", alice.ID, http.StatusNotFound},
+	} {
+		if w := send(r, http.MethodPost, tt.path, tt.userID, ""); w.Code != tt.code {
+			t.Errorf("%s: %d; 期望 %d", tt.name, w.Code, tt.code)
+		}
+	}
+
+	// 收藏列表只包含当前用户的收藏
+	send(r, http.MethodPost, path+"bookmark", bob.ID, "")
+	w := send(r, http.MethodGet, "/api/bookmarks", bob.ID, "")
+	var list struct {
+		Data  []Bookmark
+		Total int64
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if list.Total != 1 || len(list.Data) != 1 || list.Data[0].Article.Title != "文章" {
+		t.Errorf("bob 的收藏 %+v; 期望一篇文章", list)
+	}
+	if w := send(r, http.MethodGet, "/api/bookmarks", alice.ID, ""); !strings.Contains(w.Body.String(), `"total":0`) {
+		t.Errorf("alice 的收藏 %s; 期望为空", w.Body)
+	}
+}
+
+func TestFollow(t *testing.T) {
+	r := setupBlogTest(t)
+	author := createUser(t, "author", RoleAuthor)
+	alice := createUser(t, "alice", RoleReader)
+	db.Create(&Tag{Name: "Go", Slug: "go"})
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		code   int
+	}{
+		{"关注作者", http.MethodPost, fmt.Sprintf("/api/users/%d/follow", author.ID), http.StatusOK},
+		{"重复关注", http.MethodPost, fmt.Sprintf("/api/users/%d/follow", author.ID), http.StatusOK},
+		{"关注自己", http.MethodPost, fmt.Sprintf("/api/users/%d/follow", alice.ID), http.StatusBadRequest},
+		{"关注不存在的用户", http.MethodPost, "/api/users/999/follow", http.StatusNotFound},
+		{"关注标签", http.MethodPost, "/api/tags/go/follow", http.StatusOK},
+		{"重复关注标签", http.MethodPost, "/api/tags/go/follow", http.StatusOK},
+		{"关注不存在的标签", http.MethodPost, "/api/tags/rust/follow", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if w := send(r, tt.method, tt.path, alice.ID, ""); w.Code != tt.code {
+			t.Errorf("%s: %d %s; 期望 %d", tt.name, w.Code, w.Body, tt.code)
+		}
+	}
+	var follows, tagFollows int64
+	db.Model(&Follow{}).Count(&follows)
+	db.Model(&TagFollow{}).Count(&tagFollows)
+	if follows != 1 || tagFollows != 1 {
+		t.Fatalf("关注 %d 条、关注标签 %d 条; 期望各 1 条", follows, tagFollows)
+	}
+
+	// 取消关注是幂等的
+	for i := 0; i < 2; i++ {
+		send(r, http.MethodDelete, fmt.Sprintf("/api/users/%d/follow", author.ID), alice.ID, "")
+		send(r, http.MethodDelete, "/api/tags/go/follow", alice.ID, "")
+	}
+	db.Model(&Follow{}).Count(&follows)
+	db.Model(&TagFollow{}).Count(&tagFollows)
+	if follows != 0 || tagFollows != 0 {
+		t.Errorf("取消后关注 %d 条、关注标签 %d 条; 期望都为 0", follows, tagFollows)
+	}
+}
+
+func TestPersonalFeed(t *testing.T) {
+	r := setupBlogTest(t)
+	followed := createUser(t, "followed", RoleAuthor)
+	other := createUser(t, "other", RoleAuthor)
+	reader := createUser(t, "reader", RoleAuthor)
+	golang, rust := Tag{Name: "Go", Slug: "go"}, Tag{Name: "Rust", Slug: "rust"}
+	db.Create(&golang)
+	db.Create(&rust)
+	db.Create(&Follow{FollowerID: reader.ID, AuthorID: followed.ID})
+	db.Create(&TagFollow{UserID: reader.ID, TagID: golang.ID})
+
+	now := time.Now()
+	ago := func(d time.Duration) *time.Time { at := now.Add(-d); return &at }
+	articles := []Article{
+		{Title: "关注的作者", AuthorID: followed.ID, PublishedAt: ago(time.Hour)},
+		{Title: "关注的标签", AuthorID: other.ID, PublishedAt: ago(time.Hour), LikeCount: 3, Tags: []Tag{golang}},
+		{Title: "太旧", AuthorID: followed.ID, PublishedAt: ago(feedWindow + time.Hour)},
+		{Title: "未关注", AuthorID: other.ID, PublishedAt: ago(time.Hour), LikeCount: 100, Tags: []Tag{rust}},
+		{Title: "草稿", AuthorID: followed.ID},
+		{Title: "自己的文章", AuthorID: reader.ID, PublishedAt: ago(time.Hour), Tags: []Tag{golang}},
+		{Title: "评论多", AuthorID: followed.ID, PublishedAt: ago(10 * time.Hour)},
+		{Title: "作者和标签都关注", AuthorID: followed.ID, PublishedAt: ago(2 * time.Hour), Tags: []Tag{golang}},
+	}
+	for i := range articles {
+		articles[i].Slug = fmt.Sprint("a", i)
+		db.Create(&articles[i])
+	}
+	// 只统计已审核的评论
+	for i := 0; i < 20; i++ {
+		db.Create(&Comment{ArticleID: articles[6].ID, Content: "好", Status: CommentApproved})
+		db.Create(&Comment{ArticleID: articles[0].ID, Content: "待审", Status: CommentPending})
+	}
+
+	feed := func(query string) (string, int) {
+		w := send(r, http.MethodGet, "/api/feed"+query, reader.ID, "")
+		var resp struct {
+			Data  []Article
+			Total int
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		titles := make([]string, len(resp.Data))
+		for i, a := range resp.Data {
+			titles[i] = a.Title
+		}
+		return strings.Join(titles, ","), resp.Total
+	}
+	// 关注的标签 (1+3)/3^1.5 > 评论多 (1+20)/12^1.5 > 关注的作者 1/3^1.5 > 作者和标签都关注 1/4^1.5
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", "关注的标签,评论多,关注的作者,作者和标签都关注"},
+		{"?page_size=2", "关注的标签,评论多"},
+		{"?page_size=2&page=2", "关注的作者,作者和标签都关注"},
+		{"?page_size=2&page=3", ""},
+	}
+	for _, tt := range tests {
+		if got, total := feed(tt.query); got != tt.want || total != 4 {
+			t.Errorf("%q: %s（共 %d）; 期望 %s（共 4）", tt.query, got, total, tt.want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Tag 标签模型
+type Tag struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	Name      string    `json:"name" gorm:"unique;not null"`
+	Slug      string    `json:"slug" gorm:"uniqueIndex;not null"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Category 分类模型
+type Category struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	Name        string    `json:"name" gorm:"unique;not null"`
+	Slug        string    `json:"slug" gorm:"uniqueIndex;not null"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// taxonomyCount 标签/分类及其文章数
+type taxonomyCount struct {
+	ID           uint   `json:"id"`
+	Name         string `json:"name"`
+	Slug         string `json:"slug"`
+	ArticleCount int64  `json:"article_count"`
+}
+
+// maxTagAttempts 创建标签遇到唯一约束冲突时的最多尝试次数
+const maxTagAttempts = 5
+
+// findOrCreateTags 按名称查找标签，不存在则创建；重复的名称只保留一个
+func findOrCreateTags(tx *gorm.DB, names []string) ([]Tag, error) {
+	tags := make([]Tag, 0, len(names))
+	seen := make(map[string]bool)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		tag, err := findOrCreateTag(tx, name)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// findOrCreateTag 按名称查找或创建单个标签
+// slug 相同的不同名称（如 C++、C#、C 都转写为 c）是不同的标签，后创建的追加 -2、-3 后缀；
+// 无法生成 slug 的名称使用 tag-<ID>。uniqueSlug 与插入之间其他请求可能抢先创建了同名或同 slug 的标签，
+// 遇到唯一约束冲突时重新查找并生成 slug
+func findOrCreateTag(tx *gorm.DB, name string) (Tag, error) {
+	var err error
+	for attempt := 0; attempt < maxTagAttempts; attempt++ {
+		var tag Tag
+		if err = tx.Where(Tag{Name: name}).Limit(1).Find(&tag).Error; err != nil || tag.ID != 0 {
+			return tag, err
+		}
+		if tag.Slug, err = uniqueSlug(tx, &Tag{}, name, 0); err != nil {
+			return tag, err
+		}
+		tag.Name = name
+		if err = tx.Create(&tag).Error; errors.Is(err, gorm.ErrDuplicatedKey) {
+			continue
+		}
+		if err != nil || tag.Slug != "" {
+			return tag, err
+		}
+		tag.Slug, err = assignIDSlug(tx, &Tag{}, "tag", tag.ID)
+		return tag, err
+	}
+	return Tag{}, err
+}
+
+// filterByTaxonomy 按标签/分类 slug 过滤文章查询
+func filterByTaxonomy(query *gorm.DB, tagSlug, categorySlug string) *gorm.DB {
+	if tagSlug != "" {
+		query = query.Where("articles.id IN (?)", db.Table("article_tags").
+			Select("article_tags.article_id").
+			Joins("JOIN tags ON tags.id = article_tags.tag_id").
+			Where("tags.slug = ?", tagSlug))
+	}
+	if categorySlug != "" {
+		query = query.Where("articles.id IN (?)", db.Table("article_categories").
+			Select("article_categories.article_id").
+			Joins("JOIN categories ON categories.id = article_categories.category_id").
+			Where("categories.slug = ?", categorySlug))
+	}
+	return query
+}
+
+// handleListTags 获取标签列表及已发布文章数
+func handleListTags(c *gin.Context) {
+	var tags []taxonomyCount
+	db.Model(&Tag{}).
+		Select("tags.id, tags.name, tags.slug, COUNT(articles.id) AS article_count").
+		Joins("LEFT JOIN article_tags ON article_tags.tag_id = tags.id").
+		Joins("LEFT JOIN articles ON articles.id = article_tags.article_id AND articles.published_at IS NOT NULL").
+		Group("tags.id").
+		Order("article_count DESC, tags.name ASC").
+		Scan(&tags)
+	c.JSON(http.StatusOK, gin.H{"data": tags})
+}
+
+// handleListCategories 获取分类列表及已发布文章数
+func handleListCategories(c *gin.Context) {
+	var categories []taxonomyCount
+	db.Model(&Category{}).
+		Select("categories.id, categories.name, categories.slug, COUNT(articles.id) AS article_count").
+		Joins("LEFT JOIN article_categories ON article_categories.category_id = categories.id").
+		Joins("LEFT JOIN articles ON articles.id = article_categories.article_id AND articles.published_at IS NOT NULL").
+		Group("categories.id").
+		Order("categories.name ASC").
+		Scan(&categories)
+	c.JSON(http.StatusOK, gin.H{"data": categories})
+}
+
+// handleCreateCategory 创建分类
+func handleCreateCategory(c *gin.Context) {
+	var req struct {
+		Name        string `json:"name" binding:"required"`
+		Description string `json:"description"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	category := Category{Name: strings.TrimSpace(req.Name), Description: req.Description}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		slug, err := uniqueSlug(tx, &Category{}, category.Name, 0)
+		if err != nil {
+			return err
+		}
+		category.Slug = slug
+		if err := tx.Create(&category).Error; err != nil {
+			return errCategoryExists
+		}
+		if category.Slug == "" {
+			category.Slug, err = assignIDSlug(tx, &Category{}, "category", category.ID)
+		}
+		return err
+	})
+	if err == errCategoryExists {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"data": category})
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/image/draw"
+)
+
+// thumbnailWidths 生成的缩略图宽度，原图不超过该宽度时不生成
+var thumbnailWidths = []int{320, 1024}
+
+// maxImagePixels 允许的最大像素数，防止解码超大图片耗尽内存
+// 对 GIF 是所有帧的像素总数，每一帧解码后都会单独占用内存
+const maxImagePixels = 40_000_000
+
+// maxGIFFrames GIF 动画允许的最大帧数
+const maxGIFFrames = 300
+
+var (
+	uploadDir   = flag.String("upload-dir", "uploads", "图片存储目录")
+	maxUploadMB = flag.Int64("max-upload-mb", 10, "单张图片最大体积（MB）")
+)
+
+// 支持的图片类型：MIME -> 扩展名
+var imageTypes = map[string]string{
+	"image/jpeg": "jpg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+}
+
+var (
+	errUnsupportedImage = errors.New("仅支持 JPEG、PNG、GIF 图片")
+	errImageTooLarge    = errors.New("图片尺寸过大")
+)
+
+// Upload 上传的图片，按内容哈希去重
+type Upload struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	Hash        string    `json:"hash" gorm:"uniqueIndex;size:64;not null"`
+	UserID      uint      `json:"user_id" gorm:"index"`
+	ContentType string    `json:"content_type"`
+	Ext         string    `json:"-"`
+	VariantExt  string    `json:"-"`
+	Variants    string    `json:"-"` // 已生成的缩略图，逗号分隔，如 w320,w1024
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	Size        int       `json:"size"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// processedImage 处理后待写入磁盘的图片
+type processedImage struct {
+	Hash        string
+	ContentType string
+	Ext         string
+	VariantExt  string
+	Width       int
+	Height      int
+	Files       map[string][]byte // 文件名（不含扩展名）-> 内容
+	Variants    []string
+}
+
+// processImage 校验图片、应用 EXIF 方向后重新编码（丢弃 EXIF 等元数据），并生成缩略图
+func processImage(data []byte) (*processedImage, error) {
+	contentType := http.DetectContentType(data)
+	ext, ok := imageTypes[contentType]
+	if !ok {
+		return nil, errUnsupportedImage
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errUnsupportedImage
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxImagePixels {
+		return nil, errImageTooLarge
+	}
+
+	var img image.Image
+	var original bytes.Buffer
+	variantExt := ext
+	switch contentType {
+	case "image/gif":
+		// DecodeAll 会一次性解码所有帧，先扫描帧数和各帧尺寸
+		if err := checkGIFFrames(data); err != nil {
+			return nil, err
+		}
+		// 保留动画帧；重新编码只写入图像数据，注释和应用扩展被丢弃
+		anim, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, errUnsupportedImage
+		}
+		if err := gif.EncodeAll(&original, &gif.GIF{
+			Image:     anim.Image,
+			Delay:     anim.Delay,
+			LoopCount: anim.LoopCount,
+			Disposal:  anim.Disposal,
+			Config:    anim.Config,
+		}); err != nil {
+			return nil, err
+		}
+		// 缩略图使用第一帧，保存为 PNG
+		canvas := image.NewRGBA(image.Rect(0, 0, anim.Config.Width, anim.Config.Height))
+		draw.Draw(canvas, anim.Image[0].Bounds(), anim.Image[0], anim.Image[0].Bounds().Min, draw.Over)
+		img = canvas
+		variantExt = "png"
+	default:
+		if img, _, err = image.Decode(bytes.NewReader(data)); err != nil {
+			return nil, errUnsupportedImage
+		}
+		if contentType == "image/jpeg" {
+			img = applyOrientation(img, jpegOrientation(data))
+		}
+		if err := encodeImage(&original, img, ext); err != nil {
+			return nil, err
+		}
+	}
+
+	sum := sha256.Sum256(original.Bytes())
+	result := &processedImage{
+		Hash:        hex.EncodeToString(sum[:]),
+		ContentType: contentType,
+		Ext:         ext,
+		VariantExt:  variantExt,
+		Width:       img.Bounds().Dx(),
+		Height:      img.Bounds().Dy(),
+		Files:       map[string][]byte{"original": original.Bytes()},
+	}
+	for _, width := range thumbnailWidths {
+		if result.Width <= width {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := encodeImage(&buf, resizeToWidth(img, width), variantExt); err != nil {
+			return nil, err
+		}
+		name := fmt.Sprintf("w%d", width)
+		result.Files[name] = buf.Bytes()
+		result.Variants = append(result.Variants, name)
+	}
+	return result, nil
+}
+
+// checkGIFFrames 不解码图像数据，只遍历 GIF 的块结构，统计帧数和所有帧的像素总数
+func checkGIFFrames(data []byte) error {
+	if len(data) < 13 {
+		return errUnsupportedImage
+	}
+	i := 13
+	if data[10]&0x80 != 0 { // 全局颜色表
+		i += 3 << (data[10]&0x07 + 1)
+	}
+	// skipSubBlocks 跳过以长度为 0 的块结尾的数据子块
+	skipSubBlocks := func() bool {
+		for i < len(data) {
+			n := int(data[i])
+			i += 1 + n
+			if n == 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	frames, pixels := 0, 0
+	for i < len(data) {
+		switch data[i] {
+		case 0x21: // 扩展块：标签后跟数据子块
+			i += 2
+			if !skipSubBlocks() {
+				return errUnsupportedImage
+			}
+		case 0x2C: // 图像描述符
+			if i+10 > len(data) {
+				return errUnsupportedImage
+			}
+			width := int(binary.LittleEndian.Uint16(data[i+5:]))
+			height := int(binary.LittleEndian.Uint16(data[i+7:]))
+			flags := data[i+9]
+			i += 10
+			if flags&0x80 != 0 { // 局部颜色表
+				i += 3 << (flags&0x07 + 1)
+			}
+			i++ // LZW 最小码长
+			if !skipSubBlocks() {
+				return errUnsupportedImage
+			}
+			frames++
+			pixels += width * height
+			if frames > maxGIFFrames {
+				return fmt.Errorf("%w：GIF 不能超过 %d 帧", errImageTooLarge, maxGIFFrames)
+			}
+			if pixels > maxImagePixels {
+				return fmt.Errorf("%w：GIF 各帧像素总数超过 %d", errImageTooLarge, maxImagePixels)
+			}
+		case 0x3B: // 结束符
+			return nil
+		default:
+			return errUnsupportedImage
+		}
+	}
+	return errUnsupportedImage
+}
+
+// encodeImage 按扩展名编码图片
+func encodeImage(w io.Writer, img image.Image, ext string) error {
+	switch ext {
+	case "jpg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+	case "png":
+		return png.Encode(w, img)
+	}
+	return errUnsupportedImage
+}
+
+// resizeToWidth 等比缩放到指定宽度
+func resizeToWidth(src image.Image, width int) image.Image {
+	b := src.Bounds()
+	height := int(math.Round(float64(b.Dy()) * float64(width) / float64(b.Dx())))
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+	return dst
+}
+
+// jpegOrientation 读取 JPEG EXIF（APP1 段）中的方向标记，没有或无法解析时返回 1（正常方向）
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 { // 已到图像数据，EXIF 只会出现在之前
+			return 1
+		}
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if size < 2 || i+2+size > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+size]
+		if marker == 0xE1 && len(segment) > 6 && string(segment[:6]) == "Exif\x00\x00" {
+			return tiffOrientation(segment[6:])
+		}
+		i += 2 + size
+	}
+	return 1
+}
+
+// tiffOrientation 在 TIFF 结构的 IFD0 中查找 Orientation（0x0112）标签
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for k := 0; k < entries; k++ {
+		entry := ifd + 2 + k*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if v := int(order.Uint16(tiff[entry+8:])); v >= 1 && v <= 8 {
+				return v
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// applyOrientation 按 EXIF 方向旋转/翻转图片，使去除元数据后显示方向不变
+func applyOrientation(src image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 { // 5-8 需要交换宽高
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // 水平翻转
+				dx, dy = w-1-x, y
+			case 3: // 旋转 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // 垂直翻转
+				dx, dy = x, h-1-y
+			case 5: // 沿主对角线翻转
+				dx, dy = y, x
+			case 6: // 顺时针旋转 90°
+				dx, dy = h-1-y, x
+			case 7: // 沿副对角线翻转
+				dx, dy = h-1-y, w-1-x
+			case 8: // 逆时针旋转 90°
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, src.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// imageDir 内容寻址的存储目录：<upload-dir>/<哈希前两位>/<哈希>
+func imageDir(hash string) string {
+	return filepath.Join(*uploadDir, hash[:2], hash)
+}
+
+// saveImage 写入原图和缩略图；目录已存在说明同一内容已上传过，直接复用
+func saveImage(p *processedImage) error {
+	dir := imageDir(p.Hash)
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+
+	// 先写入临时目录再重命名，避免并发上传或中途失败留下不完整的文件
+	parent := filepath.Dir(dir)
+	if err := os.MkdirAll(parent, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(parent, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	for name, data := range p.Files {
+		ext := p.VariantExt
+		if name == "original" {
+			ext = p.Ext
+		}
+		if err := os.WriteFile(filepath.Join(tmp, name+"."+ext), data, 0o644); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(tmp, 0o755); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dir); err != nil && !os.IsExist(err) {
+		// 并发上传同一图片时另一个请求可能已完成写入
+		if _, statErr := os.Stat(dir); statErr != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadURLs 返回原图和各缩略图的访问地址
+func uploadURLs(upload Upload) map[string]string {
+	base := strings.TrimRight(*siteURL, "/") + "/uploads/" + upload.Hash[:2] + "/" + upload.Hash + "/"
+	urls := map[string]string{"original": base + "original." + upload.Ext}
+	if upload.Variants != "" {
+		for _, name := range strings.Split(upload.Variants, ",") {
+			urls[name] = base + name + "." + upload.VariantExt
+		}
+	}
+	return urls
+}
+
+// handleUploadImage 上传图片，表单字段 file，可选 alt 作为 Markdown 替代文本
+func handleUploadImage(c *gin.Context) {
+	limit := *maxUploadMB << 20
+	// 预留 1MB 给 multipart 表单的其他部分
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit+1<<20)
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请通过 file 字段上传图片"})
+		return
+	}
+	if fileHeader.Size > limit {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("图片不能超过 %dMB", *maxUploadMB)})
+		return
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	processed, err := processImage(data)
+	if errors.Is(err, errUnsupportedImage) || errors.Is(err, errImageTooLarge) {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := saveImage(processed); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存图片失败"})
+		return
+	}
+
+	upload := Upload{
+		Hash:        processed.Hash,
+		UserID:      currentUserID(c),
+		ContentType: processed.ContentType,
+		Ext:         processed.Ext,
+		VariantExt:  processed.VariantExt,
+		Variants:    strings.Join(processed.Variants, ","),
+		Width:       processed.Width,
+		Height:      processed.Height,
+		Size:        len(processed.Files["original"]),
+	}
+	if err := db.Where(Upload{Hash: upload.Hash}).Attrs(upload).FirstOrCreate(&upload).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	urls := uploadURLs(upload)
+	// Markdown 中显示最大的缩略图，点击查看原图
+	display := urls["original"]
+	if n := len(thumbnailWidths); n > 0 {
+		if u, ok := urls[fmt.Sprintf("w%d", thumbnailWidths[n-1])]; ok {
+			display = u
+		}
+	}
+	alt := strings.NewReplacer("[", "", "]", "").Replace(c.PostForm("alt"))
+
+	c.JSON(http.StatusCreated, gin.H{"data": gin.H{
+		"upload":   upload,
+		"urls":     urls,
+		"markdown": fmt.Sprintf("[![%s](%s)](%s)", alt, display, urls["original"]),
+	}})
+}
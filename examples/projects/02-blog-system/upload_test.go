@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// exifTIFF 构造只包含 Orientation 标签的 TIFF 结构
+func exifTIFF(order binary.ByteOrder, orientation int) []byte {
+	tiff := make([]byte, 26)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8) // IFD0 偏移
+	order.PutUint16(tiff[8:], 1) // 条目数
+	order.PutUint16(tiff[10:], 0x0112)
+	order.PutUint16(tiff[12:], 3) // SHORT
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], uint16(orientation))
+	return tiff
+}
+
+// withEXIF 在 JPEG 的 SOI 之后插入 APP1 EXIF 段
+func withEXIF(jpg, tiff []byte) []byte {
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	out := append([]byte{}, jpg[:2]...)
+	out = append(out, segment...)
+	out = append(out, payload...)
+	return append(out, jpg[2:]...)
+}
+
+func encodeJPEG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTIFFOrientation(t *testing.T) {
+	tests := []struct {
+		name string
+		tiff []byte
+		want int
+	}{
+		{"小端", exifTIFF(binary.LittleEndian, 6), 6},
+		{"大端", exifTIFF(binary.BigEndian, 8), 8},
+		{"取值越界", exifTIFF(binary.LittleEndian, 9), 1},
+		{"未知字节序", append([]byte("XX"), exifTIFF(binary.LittleEndian, 6)[2:]...), 1},
+		{"截断", exifTIFF(binary.LittleEndian, 6)[:12], 1},
+		{"过短", []byte("II"), 1},
+	}
+	for _, tt := range tests {
+		if got := tiffOrientation(tt.tiff); got != tt.want {
+			t.Errorf("%s: tiffOrientation = %d; 期望 %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	jpg := encodeJPEG(t, 4, 2)
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"没有 EXIF", jpg, 1},
+		{"顺时针 90°", withEXIF(jpg, exifTIFF(binary.BigEndian, 6)), 6},
+		{"旋转 180°", withEXIF(jpg, exifTIFF(binary.LittleEndian, 3)), 3},
+		{"非 JPEG", []byte("\x89PNG\r\n\x1a\n"), 1},
+		{"段长度越界", withEXIF(jpg, exifTIFF(binary.BigEndian, 6))[:10], 1},
+	}
+	for _, tt := range tests {
+		if got := jpegOrientation(tt.data); got != tt.want {
+			t.Errorf("%s: jpegOrientation = %d; 期望 %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// 3×2 的图片，左上角为红色，右上角为蓝色
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	red, blue := color.RGBA{R: 255, A: 255}, color.RGBA{B: 255, A: 255}
+	src.Set(0, 0, red)
+	src.Set(2, 0, blue)
+
+	tests := []struct {
+		orientation int
+		size        image.Point
+		red, blue   image.Point
+	}{
+		{1, image.Pt(3, 2), image.Pt(0, 0), image.Pt(2, 0)},
+		{2, image.Pt(3, 2), image.Pt(2, 0), image.Pt(0, 0)},
+		{3, image.Pt(3, 2), image.Pt(2, 1), image.Pt(0, 1)},
+		{4, image.Pt(3, 2), image.Pt(0, 1), image.Pt(2, 1)},
+		{5, image.Pt(2, 3), image.Pt(0, 0), image.Pt(0, 2)},
+		{6, image.Pt(2, 3), image.Pt(1, 0), image.Pt(1, 2)},
+		{7, image.Pt(2, 3), image.Pt(1, 2), image.Pt(1, 0)},
+		{8, image.Pt(2, 3), image.Pt(0, 2), image.Pt(0, 0)},
+	}
+	for _, tt := range tests {
+		dst := applyOrientation(src, tt.orientation)
+		if got := dst.Bounds().Size(); got != tt.size {
+			t.Errorf("方向 %d: 尺寸 %v; 期望 %v", tt.orientation, got, tt.size)
+			continue
+		}
+		if dst.At(tt.red.X, tt.red.Y) != color.Color(red) || dst.At(tt.blue.X, tt.blue.Y) != color.Color(blue) {
+			t.Errorf("方向 %d: 左上角应在 %v，右上角应在 %v", tt.orientation, tt.red, tt.blue)
+		}
+	}
+}
+
+func TestProcessImageStripsEXIF(t *testing.T) {
+	data := withEXIF(encodeJPEG(t, 40, 20), exifTIFF(binary.BigEndian, 6))
+	p, err := processImage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := p.Files["original"]
+	if bytes.Contains(original, []byte("Exif")) {
+		t.Error("原图仍包含 EXIF")
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(original))
+	if err != nil || cfg.Width != 20 || cfg.Height != 40 || p.Width != 20 || p.Height != 40 {
+		t.Errorf("旋转后尺寸 %dx%d（记录为 %dx%d）; 期望 20x40", cfg.Width, cfg.Height, p.Width, p.Height)
+	}
+}
+
+func TestProcessImageThumbnails(t *testing.T) {
+	var large bytes.Buffer
+	png.Encode(&large, image.NewRGBA(image.Rect(0, 0, 1200, 600)))
+	var small bytes.Buffer
+	png.Encode(&small, image.NewRGBA(image.Rect(0, 0, 300, 100)))
+	frame := image.NewPaletted(image.Rect(0, 0, 400, 100), palette.Plan9)
+	var anim bytes.Buffer
+	gif.EncodeAll(&anim, &gif.GIF{Image: []*image.Paletted{frame, frame}, Delay: []int{10, 10}})
+
+	tests := []struct {
+		name       string
+		data       []byte
+		ext        string
+		variantExt string
+		variants   string
+		heights    []int
+	}{
+		{"大图生成两种缩略图", large.Bytes(), "png", "png", "w320,w1024", []int{160, 512}},
+		{"小图不生成缩略图", small.Bytes(), "png", "png", "", nil},
+		{"GIF 缩略图为 PNG", anim.Bytes(), "gif", "png", "w320", []int{80}},
+	}
+	for _, tt := range tests {
+		p, err := processImage(tt.data)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if p.Ext != tt.ext || p.VariantExt != tt.variantExt || strings.Join(p.Variants, ",") != tt.variants {
+			t.Errorf("%s: %s/%s %v; 期望 %s/%s %s", tt.name, p.Ext, p.VariantExt, p.Variants, tt.ext, tt.variantExt, tt.variants)
+			continue
+		}
+		for i, name := range p.Variants {
+			cfg, err := png.DecodeConfig(bytes.NewReader(p.Files[name]))
+			if want := thumbnailWidths[i]; err != nil || cfg.Width != want || cfg.Height != tt.heights[i] {
+				t.Errorf("%s: %s 为 %dx%d; 期望 %dx%d", tt.name, name, cfg.Width, cfg.Height, want, tt.heights[i])
+			}
+		}
+	}
+
+	// GIF 原图保留动画帧
+	p, _ := processImage(anim.Bytes())
+	if out, err := gif.DecodeAll(bytes.NewReader(p.Files["original"])); err != nil || len(out.Image) != 2 {
+		t.Errorf("GIF 原图应保留 2 帧: %v", err)
+	}
+}
+
+// encodeGIF 编码 n 帧 1×1 的 GIF
+func encodeGIF(t *testing.T, n int) []byte {
+	t.Helper()
+	anim := &gif.GIF{}
+	for i := 0; i < n; i++ {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, 1, 1), palette.Plan9))
+		anim.Delay = append(anim.Delay, 0)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGIFFrameLimits(t *testing.T) {
+	if err := checkGIFFrames(encodeGIF(t, maxGIFFrames)); err != nil {
+		t.Errorf("%d 帧: %v; 期望通过", maxGIFFrames, err)
+	}
+	if _, err := processImage(encodeGIF(t, maxGIFFrames+1)); !errors.Is(err, errImageTooLarge) {
+		t.Errorf("%d 帧: %v; 期望 errImageTooLarge", maxGIFFrames+1, err)
+	}
+
+	// 只有块结构、没有图像数据的 GIF：单帧在限制内，3 帧合计超出，扫描阶段即被拒绝
+	bomb := []byte("GIF89a")
+	bomb = binary.LittleEndian.AppendUint16(bomb, 5000)
+	bomb = binary.LittleEndian.AppendUint16(bomb, 5000)
+	bomb = append(bomb, 0, 0, 0)
+	for i := 0; i < 3; i++ {
+		bomb = append(bomb, 0x2C, 0, 0, 0, 0)
+		bomb = binary.LittleEndian.AppendUint16(bomb, 5000)
+		bomb = binary.LittleEndian.AppendUint16(bomb, 5000)
+		bomb = append(bomb, 0, 2, 0)
+	}
+	bomb = append(bomb, 0x3B)
+	if _, err := processImage(bomb); !errors.Is(err, errImageTooLarge) {
+		t.Errorf("像素总数超限: %v; 期望 errImageTooLarge", err)
+	}
+
+	if _, err := processImage(encodeGIF(t, 2)[:30]); !errors.Is(err, errUnsupportedImage) {
+		t.Errorf("截断的 GIF: %v; 期望 errUnsupportedImage", err)
+	}
+}
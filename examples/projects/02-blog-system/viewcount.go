@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	viewWindow        = flag.Duration("view-window", 30*time.Minute, "同一访客在该时间窗口内重复访问只计一次阅读")
+	viewFlushInterval = flag.Duration("view-flush", 10*time.Second, "阅读量写入数据库的间隔")
+)
+
+// ArticleViewStat 文章每日阅读量，用于计算时间段内的热门文章
+type ArticleViewStat struct {
+	ArticleID uint   `json:"article_id" gorm:"primaryKey;autoIncrement:false"`
+	Day       string `json:"day" gorm:"primaryKey;size:10"` // UTC 日期，格式 2006-01-02
+	Views     int    `json:"views" gorm:"not null;default:0"`
+}
+
+// viewKey 待写入的阅读量按文章和日期聚合
+type viewKey struct {
+	ArticleID uint
+	Day       string
+}
+
+// ViewCounter 阅读量计数器
+// 阅读先在内存中去重和累加，再由 Flush 批量写入数据库，避免每次访问都写库
+type ViewCounter struct {
+	db      *gorm.DB
+	window  time.Duration
+	now     func() time.Time
+	mu      sync.Mutex
+	pending map[viewKey]int
+	seen    map[string]time.Time // 访客+文章 -> 最近一次计数时间
+}
+
+// NewViewCounter 创建阅读量计数器
+func NewViewCounter(db *gorm.DB, window time.Duration) *ViewCounter {
+	return &ViewCounter{
+		db:      db,
+		window:  window,
+		now:     time.Now,
+		pending: make(map[viewKey]int),
+		seen:    make(map[string]time.Time),
+	}
+}
+
+// Record 记录一次阅读，同一访客在时间窗口内重复访问返回 false
+func (vc *ViewCounter) Record(articleID uint, visitor string) bool {
+	now := vc.now()
+	key := visitor + "|" + strconv.FormatUint(uint64(articleID), 10)
+
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	if last, ok := vc.seen[key]; ok && now.Sub(last) < vc.window {
+		return false
+	}
+	vc.seen[key] = now
+	vc.pending[viewKey{ArticleID: articleID, Day: now.UTC().Format("2006-01-02")}]++
+	return true
+}
+
+// Pending 返回文章尚未写入数据库的阅读量
+func (vc *ViewCounter) Pending(articleID uint) int {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	total := 0
+	for key, n := range vc.pending {
+		if key.ArticleID == articleID {
+			total += n
+		}
+	}
+	return total
+}
+
+// Flush 将缓冲的阅读量在一个事务中批量写入，失败时放回缓冲区等待下次重试
+func (vc *ViewCounter) Flush() error {
+	vc.mu.Lock()
+	batch := vc.pending
+	vc.pending = make(map[viewKey]int)
+	// 顺便清理已过去重窗口的访客记录
+	now := vc.now()
+	for key, last := range vc.seen {
+		if now.Sub(last) >= vc.window {
+			delete(vc.seen, key)
+		}
+	}
+	vc.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	totals := make(map[uint]int)
+	for key, n := range batch {
+		totals[key.ArticleID] += n
+	}
+	err := vc.db.Transaction(func(tx *gorm.DB) error {
+		for articleID, n := range totals {
+			if err := tx.Exec("UPDATE articles SET view_count = view_count + ? WHERE id = ?", n, articleID).Error; err != nil {
+				return err
+			}
+		}
+		for key, n := range batch {
+			stat := ArticleViewStat{ArticleID: key.ArticleID, Day: key.Day, Views: n}
+			err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "article_id"}, {Name: "day"}},
+				DoUpdates: clause.Assignments(map[string]interface{}{"views": gorm.Expr("article_view_stats.views + excluded.views")}),
+			}).Create(&stat).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		vc.mu.Lock()
+		for key, n := range batch {
+			vc.pending[key] += n
+		}
+		vc.mu.Unlock()
+	}
+	return err
+}
+
+// Run 定期写入阅读量，ctx 取消时做最后一次写入后返回
+func (vc *ViewCounter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := vc.Flush(); err != nil {
+				log.Println("写入阅读量失败:", err)
+			}
+		case <-ctx.Done():
+			if err := vc.Flush(); err != nil {
+				log.Println("写入阅读量失败:", err)
+			}
+			return
+		}
+	}
+}
+
+// visitorKey 标识访客：登录用户使用用户 ID，否则使用 IP 和 User-Agent
+func visitorKey(c *gin.Context) string {
+	if id := currentUserID(c); id != 0 {
+		return "user:" + strconv.FormatUint(uint64(id), 10)
+	}
+	return "anon:" + c.ClientIP() + "|" + c.Request.UserAgent()
+}
+
+// handlePopularArticles 获取最近 days 天（默认 7 天）阅读量最高的文章
+func handlePopularArticles(c *gin.Context) {
+	days, _ := strconv.Atoi(c.DefaultQuery("days", "7"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if days < 1 || days > 365 {
+		days = 7
+	}
+	if limit < 1 || limit > 50 {
+		limit = 10
+	}
+	// 包含今天在内的最近 days 天
+	since := time.Now().UTC().AddDate(0, 0, -(days - 1)).Format("2006-01-02")
+
+	var ranking []struct {
+		ArticleID uint
+		Views     int
+	}
+	db.Model(&ArticleViewStat{}).
+		Select("article_view_stats.article_id, SUM(article_view_stats.views) AS views").
+		Joins("JOIN articles ON articles.id = article_view_stats.article_id").
+		Where("article_view_stats.day >= ? AND articles.published_at IS NOT NULL", since).
+		Group("article_view_stats.article_id").
+		Order("views DESC, article_view_stats.article_id ASC").
+		Limit(limit).
+		Scan(&ranking)
+
+	ids := make([]uint, len(ranking))
+	for i, r := range ranking {
+		ids[i] = r.ArticleID
+	}
+	var articles []Article
+	if len(ids) > 0 {
+		db.Scopes(withArticleRelations).Find(&articles, ids)
+	}
+	byID := make(map[uint]Article, len(articles))
+	for _, article := range articles {
+		byID[article.ID] = article
+	}
+
+	data := make([]gin.H, 0, len(ranking))
+	for _, r := range ranking {
+		data = append(data, gin.H{"article": byID[r.ArticleID], "views": r.Views})
+	}
+	c.JSON(http.StatusOK, gin.H{"data": data, "days": days})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// fakeClock 可手动推进的时钟
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time      { return c.t }
+func (c *fakeClock) add(d time.Duration) { c.t = c.t.Add(d) }
+
+// newTestViewCounter 创建使用 fakeClock 的计数器和一篇已发布文章
+func newTestViewCounter(t *testing.T) (*ViewCounter, *fakeClock, Article) {
+	setupBlogTest(t)
+	published := time.Date(2024, 3, 1, 23, 50, 0, 0, time.UTC)
+	clock := &fakeClock{published}
+	vc := NewViewCounter(db, 30*time.Minute)
+	vc.now = clock.now
+	article := Article{Title: "文章", Slug: "wen-zhang", PublishedAt: &published}
+	db.Create(&article)
+	return vc, clock, article
+}
+
+func TestViewCounterDedupWindow(t *testing.T) {
+	vc, clock, article := newTestViewCounter(t)
+
+	steps := []struct {
+		after   time.Duration
+		visitor string
+		counted bool
+	}{
+		{0, "user:1", true},
+		{10 * time.Minute, "user:1", false}, // 窗口内重复访问
+		{0, "user:2", true},                 // 其他访客
+		{19 * time.Minute, "user:1", false}, // 距首次计数 29 分钟
+		{time.Minute, "user:1", true},       // 满 30 分钟，重新计数
+		{time.Minute, "user:1", false},      // 窗口从上次计数重新开始
+	}
+	for i, s := range steps {
+		clock.add(s.after)
+		if got := vc.Record(article.ID, s.visitor); got != s.counted {
+			t.Errorf("第 %d 步 %s: Record = %v; 期望 %v", i+1, s.visitor, got, s.counted)
+		}
+	}
+	if got := vc.Pending(article.ID); got != 3 {
+		t.Errorf("Pending = %d; 期望 3", got)
+	}
+	if !vc.Record(article.ID+1, "user:1") {
+		t.Error("同一访客访问其他文章应单独计数")
+	}
+}
+
+func TestViewCounterFlush(t *testing.T) {
+	vc, clock, article := newTestViewCounter(t)
+	other := Article{Title: "另一篇", Slug: "ling-yi-pian", PublishedAt: article.PublishedAt}
+	db.Create(&other)
+
+	// 跨过 UTC 零点的阅读分别记入两天
+	vc.Record(article.ID, "a")
+	vc.Record(article.ID, "b")
+	vc.Record(other.ID, "a")
+	clock.add(20 * time.Minute)
+	vc.Record(article.ID, "c")
+
+	if err := vc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	var articles []Article
+	db.Order("id").Find(&articles)
+	if articles[0].ViewCount != 3 || articles[1].ViewCount != 1 {
+		t.Errorf("view_count = %d, %d; 期望 3, 1", articles[0].ViewCount, articles[1].ViewCount)
+	}
+	var stats []ArticleViewStat
+	db.Order("article_id, day").Find(&stats)
+	if got := fmt.Sprint(stats); got != fmt.Sprintf("[{%d 2024-03-01 2} {%d 2024-03-02 1} {%d 2024-03-01 1}]", article.ID, article.ID, other.ID) {
+		t.Errorf("每日统计 %s", got)
+	}
+	if vc.Pending(article.ID) != 0 {
+		t.Errorf("写入后 Pending = %d; 期望 0", vc.Pending(article.ID))
+	}
+
+	// 再次写入时累加到已有的每日统计上
+	clock.add(time.Hour)
+	vc.Record(article.ID, "a")
+	if err := vc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	var stat ArticleViewStat
+	db.Where("article_id = ? AND day = ?", article.ID, "2024-03-02").First(&stat)
+	if stat.Views != 2 {
+		t.Errorf("2024-03-02 阅读量 = %d; 期望 2", stat.Views)
+	}
+	if len(vc.seen) != 1 {
+		t.Errorf("去重记录 %d 条; 期望清理过期记录后剩 1 条", len(vc.seen))
+	}
+}
+
+func TestViewCounterFlushRetry(t *testing.T) {
+	vc, _, article := newTestViewCounter(t)
+	fail := true
+	db.Callback().Raw().Before("gorm:raw").Register("test:fail", func(tx *gorm.DB) {
+		if fail {
+			tx.AddError(errors.New("数据库不可用"))
+		}
+	})
+
+	vc.Record(article.ID, "a")
+	vc.Record(article.ID, "b")
+	if err := vc.Flush(); err == nil {
+		t.Fatal("Flush 应返回错误")
+	}
+	if got := vc.Pending(article.ID); got != 2 {
+		t.Fatalf("失败后 Pending = %d; 期望放回 2", got)
+	}
+
+	// 失败期间的新阅读与放回的阅读合并写入
+	vc.Record(article.ID, "c")
+	fail = false
+	if err := vc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	db.First(&article, article.ID)
+	var stats int64
+	db.Model(&ArticleViewStat{}).Where("article_id = ? AND views = 3", article.ID).Count(&stats)
+	if article.ViewCount != 3 || stats != 1 || vc.Pending(article.ID) != 0 {
+		t.Errorf("view_count = %d、每日统计 %d 条、Pending = %d; 期望 3、1、0", article.ViewCount, stats, vc.Pending(article.ID))
+	}
+}
+
+func TestPopularArticles(t *testing.T) {
+	r := setupBlogTest(t)
+	now := time.Now()
+	day := func(ago int) string { return now.UTC().AddDate(0, 0, -ago).Format("2006-01-02") }
+	articles := []Article{
+		{Title: "本周热门", Slug: "a", PublishedAt: &now},
+		{Title: "上月热门", Slug: "b", PublishedAt: &now},
+		{Title: "草稿", Slug: "c"},
+		{Title: "本周次之", Slug: "d", PublishedAt: &now},
+	}
+	for i := range articles {
+		db.Create(&articles[i])
+	}
+	db.Create([]ArticleViewStat{
+		{ArticleID: articles[0].ID, Day: day(0), Views: 5},
+		{ArticleID: articles[0].ID, Day: day(6), Views: 5},
+		{ArticleID: articles[1].ID, Day: day(7), Views: 100},
+		{ArticleID: articles[1].ID, Day: day(1), Views: 1},
+		{ArticleID: articles[2].ID, Day: day(0), Views: 50},
+		{ArticleID: articles[3].ID, Day: day(2), Views: 4},
+	})
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", "本周热门=10,本周次之=4,上月热门=1"},
+		{"?limit=1", "本周热门=10"},
+		{"?days=30", "上月热门=101,本周热门=10,本周次之=4"},
+		{"?days=1", "本周热门=5"},
+		{"?days=0&limit=0", "本周热门=10,本周次之=4,上月热门=1"}, // 无效参数使用默认值
+	}
+	for _, tt := range tests {
+		w := send(r, http.MethodGet, "/api/articles/popular"+tt.query, 0, "")
+		var resp struct {
+			Data []struct {
+				Article Article
+				Views   int
+			}
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		var got []string
+		for _, item := range resp.Data {
+			got = append(got, fmt.Sprint(item.Article.Title, "=", item.Views))
+		}
+		if strings.Join(got, ",") != tt.want {
+			t.Errorf("%q: %v; 期望 %s", tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var errNoAddress = errors.New("请先添加收货地址")
+
+// ShippingInfo 收货信息，下单时复制到订单，之后修改地址不影响已有订单
+type ShippingInfo struct {
+	Recipient  string `json:"recipient" binding:"required"`
+	Phone      string `json:"phone" binding:"required"`
+	Country    string `json:"country"`
+	Province   string `json:"province"`
+	City       string `json:"city" binding:"required"`
+	Line1      string `json:"line1" binding:"required"` // 详细地址
+	PostalCode string `json:"postal_code"`
+}
+
+// normalize 去掉首尾空白，国家缺省为 CN
+func (s *ShippingInfo) normalize() {
+	for _, field := range []*string{&s.Recipient, &s.Phone, &s.Country, &s.Province, &s.City, &s.Line1, &s.PostalCode} {
+		*field = strings.TrimSpace(*field)
+	}
+	s.Country = strings.ToUpper(s.Country)
+	if s.Country == "" {
+		s.Country = "CN"
+	}
+}
+
+// Address 用户保存的收货地址
+type Address struct {
+	ID           uint `json:"id" gorm:"primaryKey"`
+	UserID       uint `json:"user_id" gorm:"index"`
+	ShippingInfo `gorm:"embedded"`
+	IsDefault    bool      `json:"is_default"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// findAddress 查找当前用户的地址
+func findAddress(tx *gorm.DB, userID, id uint) (Address, error) {
+	var address Address
+	err := tx.Where("id = ? AND user_id = ?", id, userID).First(&address).Error
+	return address, err
+}
+
+// shippingAddress 下单使用的地址：指定 addressID 时使用该地址，否则使用默认地址
+func shippingAddress(tx *gorm.DB, userID, addressID uint) (ShippingInfo, error) {
+	var address Address
+	var err error
+	if addressID != 0 {
+		address, err = findAddress(tx, userID, addressID)
+	} else {
+		err = tx.Where("user_id = ?", userID).Order("is_default DESC, id DESC").First(&address).Error
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ShippingInfo{}, errNoAddress
+	}
+	return address.ShippingInfo, err
+}
+
+// setDefaultAddress 设为默认地址，同一用户只有一个默认地址
+func setDefaultAddress(tx *gorm.DB, userID, id uint) error {
+	err := tx.Model(&Address{}).Where("user_id = ? AND id <> ?", userID, id).Update("is_default", false).Error
+	if err != nil {
+		return err
+	}
+	return tx.Model(&Address{}).Where("user_id = ? AND id = ?", userID, id).Update("is_default", true).Error
+}
+
+// handleCreateAddress 添加收货地址，第一个地址自动成为默认地址
+func handleCreateAddress(c *gin.Context) {
+	var address Address
+	if err := c.ShouldBindJSON(&address); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	address.ID, address.UserID = 0, currentUserID(c)
+	address.normalize()
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		tx.Model(&Address{}).Where("user_id = ?", address.UserID).Count(&count)
+		makeDefault := address.IsDefault || count == 0
+		address.IsDefault = false
+		if err := tx.Create(&address).Error; err != nil {
+			return err
+		}
+		if makeDefault {
+			address.IsDefault = true
+			return setDefaultAddress(tx, address.UserID, address.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"data": address})
+}
+
+// handleListAddresses 获取收货地址列表，默认地址在前
+func handleListAddresses(c *gin.Context) {
+	var addresses []Address
+	db.Where("user_id = ?", currentUserID(c)).Order("is_default DESC, id DESC").Find(&addresses)
+	c.JSON(http.StatusOK, gin.H{"data": addresses})
+}
+
+// handleUpdateAddress 修改收货地址
+func handleUpdateAddress(c *gin.Context) {
+	address, err := findAddress(db, currentUserID(c), parseID(c))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "地址不存在"})
+		return
+	}
+	var info ShippingInfo
+	if err := c.ShouldBindJSON(&info); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	info.normalize()
+	address.ShippingInfo = info
+	db.Save(&address)
+	c.JSON(http.StatusOK, gin.H{"data": address})
+}
+
+// handleSetDefaultAddress 设为默认地址
+func handleSetDefaultAddress(c *gin.Context) {
+	address, err := findAddress(db, currentUserID(c), parseID(c))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "地址不存在"})
+		return
+	}
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		return setDefaultAddress(tx, address.UserID, address.ID)
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	address.IsDefault = true
+	c.JSON(http.StatusOK, gin.H{"data": address})
+}
+
+// handleDeleteAddress 删除收货地址，删除默认地址时最近添加的地址成为默认地址
+func handleDeleteAddress(c *gin.Context) {
+	address, err := findAddress(db, currentUserID(c), parseID(c))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "地址不存在"})
+		return
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&address).Error; err != nil {
+			return err
+		}
+		if !address.IsDefault {
+			return nil
+		}
+		var next Address
+		if err := tx.Where("user_id = ?", address.UserID).Order("id DESC").First(&next).Error; err != nil {
+			return nil
+		}
+		return setDefaultAddress(tx, address.UserID, next.ID)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "已删除"})
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+var (
+	jwtSecret = flag.String("jwt-secret", "", "JWT 签名密钥，不设置时每次启动随机生成")
+	tokenTTL  = flag.Duration("token-ttl", 24*time.Hour, "登录令牌有效期")
+
+	adminEmail = flag.String("admin-email", "", "启动时将该邮箱的用户设为管理员")
+)
+
+// insecureJWTSecret 旧版本的默认密钥，已随代码公开，任何人都能用它伪造令牌
+const insecureJWTSecret = "change-me-in-production"
+
+// ensureJWTSecret 启动时检查签名密钥：使用公开的旧默认值时拒绝启动；
+// 未设置时生成随机密钥，重启后已签发的令牌全部失效
+func ensureJWTSecret() error {
+	switch *jwtSecret {
+	case insecureJWTSecret:
+		return errors.New("-jwt-secret 不能使用公开的默认值 " + insecureJWTSecret)
+	case "":
+		*jwtSecret = randomHex(32)
+		log.Println("警告: 未设置 -jwt-secret，使用随机生成的密钥，重启后需要重新登录")
+	}
+	return nil
+}
+
+// guestCookie 游客购物车的 Cookie 名称
+const guestCookie = "guest_cart"
+
+// guestTokenPattern 游客令牌为 32 位十六进制字符串，其他值一律忽略
+var guestTokenPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// 用户角色
+const (
+	RoleCustomer = "customer"
+	RoleAdmin    = "admin" // 管理库存等后台操作
+)
+
+// User 用户模型
+type User struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	Email        string    `json:"email" gorm:"uniqueIndex;not null"`
+	Name         string    `json:"name"`
+	Role         string    `json:"role" gorm:"default:customer"`
+	PasswordHash string    `json:"-" gorm:"not null"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// migrateUserRoles 为没有角色的旧数据库添加 role 列，最早注册的用户成为管理员，与新注册规则一致
+// 只在添加列时执行一次，之后管理员被降级或删除不会再自动提升其他用户，需用 -admin-email 指定
+func migrateUserRoles(conn *gorm.DB) error {
+	m := conn.Migrator()
+	if !m.HasTable(&User{}) || m.HasColumn(&User{}, "role") {
+		return nil
+	}
+	if err := m.AddColumn(&User{}, "Role"); err != nil {
+		return err
+	}
+	return conn.Exec("UPDATE users SET role = ? WHERE id = (SELECT MIN(id) FROM users)", RoleAdmin).Error
+}
+
+// promoteAdmin 将指定邮箱的用户设为管理员
+func promoteAdmin(conn *gorm.DB, email string) error {
+	result := conn.Model(&User{}).Where("email = ?", strings.ToLower(strings.TrimSpace(email))).Update("role", RoleAdmin)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("用户不存在: " + email)
+	}
+	return nil
+}
+
+// Claims JWT 声明
+type Claims struct {
+	UserID uint `json:"user_id"`
+	jwt.RegisteredClaims
+}
+
+// generateToken 签发登录令牌
+func generateToken(userID uint, now time.Time) (string, time.Time, error) {
+	expiresAt := now.Add(*tokenTTL)
+	claims := Claims{
+		UserID: userID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(*jwtSecret))
+	return token, expiresAt, err
+}
+
+// verifyToken 校验令牌，只接受 HS256 签名
+func verifyToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(*jwtSecret), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return nil, err
+	}
+	if claims.UserID == 0 {
+		return nil, errors.New("令牌缺少用户")
+	}
+	return claims, nil
+}
+
+// bearerToken 读取 Authorization: Bearer <token>
+func bearerToken(c *gin.Context) string {
+	header := c.GetHeader("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// authenticate 校验令牌并确认用户仍然存在，成功时设置 user_id
+func authenticate(c *gin.Context, token string) bool {
+	claims, err := verifyToken(token)
+	if err != nil || db.Select("id").First(&User{}, claims.UserID).Error != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "无效的 token"})
+		c.Abort()
+		return false
+	}
+	c.Set("user_id", claims.UserID)
+	return true
+}
+
+// authRequired 认证中间件，要求登录
+func authRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := bearerToken(c)
+		if token == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "未授权"})
+			c.Abort()
+			return
+		}
+		if authenticate(c, token) {
+			c.Next()
+		}
+	}
+}
+
+// authOptional 可选认证：带令牌时必须有效，不带令牌时按游客处理
+func authOptional() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token := bearerToken(c); token != "" && !authenticate(c, token) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// adminRequired 要求管理员，需放在 authRequired 之后
+func adminRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var user User
+		if err := db.First(&user, currentUserID(c)).Error; err != nil || user.Role != RoleAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "需要管理员权限"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// currentUserID 获取当前登录用户 ID，游客为 0
+func currentUserID(c *gin.Context) uint {
+	return c.GetUint("user_id")
+}
+
+// cartOwner 购物车的归属：登录用户或游客 Cookie
+type cartOwner struct {
+	UserID uint
+	Guest  string
+}
+
+// currentCartOwner 获取当前请求的购物车归属
+func currentCartOwner(c *gin.Context) cartOwner {
+	if id := currentUserID(c); id != 0 {
+		return cartOwner{UserID: id}
+	}
+	guest, _ := c.Cookie(guestCookie)
+	if !guestTokenPattern.MatchString(guest) {
+		guest = ""
+	}
+	return cartOwner{Guest: guest}
+}
+
+// ensureGuest 游客第一次加购时分配购物车 Cookie
+func (o *cartOwner) ensureGuest(c *gin.Context) {
+	if o.UserID != 0 || o.Guest != "" {
+		return
+	}
+	o.Guest = randomHex(16)
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(guestCookie, o.Guest, int((30 * 24 * time.Hour).Seconds()), "/", "", false, true)
+}
+
+// scope 限定查询到该归属的购物车项，没有购物车的游客匹配不到任何记录
+func (o cartOwner) scope(tx *gorm.DB) *gorm.DB {
+	switch {
+	case o.UserID != 0:
+		return tx.Where("cart_items.user_id = ?", o.UserID)
+	case o.Guest != "":
+		return tx.Where("cart_items.user_id = 0 AND cart_items.guest_token = ?", o.Guest)
+	}
+	return tx.Where("1 = 0")
+}
+
+// mergeGuestCart 登录或注册时把游客购物车合并到用户购物车，相同商品规格累加数量
+func mergeGuestCart(tx *gorm.DB, guest string, userID uint) error {
+	var guestItems []CartItem
+	if err := (cartOwner{Guest: guest}).scope(tx).Find(&guestItems).Error; err != nil {
+		return err
+	}
+	for _, item := range guestItems {
+		var existing CartItem
+		query := tx.Where("user_id = ? AND product_id = ?", userID, item.ProductID)
+		if item.VariantID != nil {
+			query = query.Where("variant_id = ?", *item.VariantID)
+		} else {
+			query = query.Where("variant_id IS NULL")
+		}
+		err := query.First(&existing).Error
+		switch {
+		case err == nil:
+			err = tx.Model(&existing).UpdateColumn("quantity", gorm.Expr("quantity + ?", item.Quantity)).Error
+			if err == nil {
+				err = tx.Delete(&item).Error
+			}
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			err = tx.Model(&item).Updates(map[string]interface{}{"user_id": userID, "guest_token": ""}).Error
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// 游客的加购记录归到用户名下，转化率按用户统计
+	return tx.Model(&CartEvent{}).Where("user_id = 0 AND guest_token = ?", guest).Update("user_id", userID).Error
+}
+
+// respondWithSession 签发令牌、合并游客购物车并清除游客 Cookie
+func respondWithSession(c *gin.Context, status int, user User) {
+	if guest := currentCartOwner(c).Guest; guest != "" {
+		if err := db.Transaction(func(tx *gorm.DB) error { return mergeGuestCart(tx, guest, user.ID) }); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "合并购物车失败"})
+			return
+		}
+		c.SetCookie(guestCookie, "", -1, "/", "", false, true)
+	}
+	token, expiresAt, err := generateToken(user.ID, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "生成 token 失败"})
+		return
+	}
+	c.JSON(status, gin.H{"token": token, "expires_at": expiresAt, "user": user})
+}
+
+// handleSignup 注册
+func handleSignup(c *gin.Context) {
+	var req struct {
+		Email    string `json:"email" binding:"required"`
+		Password string `json:"password" binding:"required"`
+		Name     string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "邮箱格式不正确"})
+		return
+	}
+	// bcrypt 只使用前 72 字节
+	if len(req.Password) < 8 || len(req.Password) > 72 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "密码长度需在 8 到 72 个字符之间"})
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "密码处理失败"})
+		return
+	}
+	// 第一个注册的用户成为管理员
+	user := User{Email: email, Name: strings.TrimSpace(req.Name), PasswordHash: string(hash), Role: RoleCustomer}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		tx.Model(&User{}).Count(&count)
+		if count == 0 {
+			user.Role = RoleAdmin
+		}
+		return tx.Create(&user).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "邮箱已注册"})
+		return
+	}
+	respondWithSession(c, http.StatusCreated, user)
+}
+
+// handleLogin 登录，邮箱不存在和密码错误返回相同的提示
+func handleLogin(c *gin.Context) {
+	var req struct {
+		Email    string `json:"email" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var user User
+	err := db.Where("email = ?", strings.ToLower(strings.TrimSpace(req.Email))).First(&user).Error
+	if err != nil || bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)) != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "邮箱或密码错误"})
+		return
+	}
+	respondWithSession(c, http.StatusOK, user)
+}
+
+// handleGetAccount 获取当前用户信息
+func handleGetAccount(c *gin.Context) {
+	var user User
+	db.First(&user, currentUserID(c))
+	c.JSON(http.StatusOK, gin.H{"data": user})
+}
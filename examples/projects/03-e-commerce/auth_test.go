@@ -0,0 +1,57 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func closeDB(conn *gorm.DB) {
+	if sqlDB, err := conn.DB(); err == nil {
+		sqlDB.Close()
+	}
+}
+
+func userRoles(conn *gorm.DB) []string {
+	var roles []string
+	conn.Model(&User{}).Order("id").Pluck("role", &roles)
+	return roles
+}
+
+func TestMigrateUserRolesRunsOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	legacy, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy.Exec("CREATE TABLE users (id integer PRIMARY KEY AUTOINCREMENT, email text NOT NULL UNIQUE, name text, password_hash text NOT NULL, created_at datetime)")
+	legacy.Exec("INSERT INTO users (email, password_hash) VALUES ('a@example.com', '-'), ('b@example.com', '-')")
+	closeDB(legacy)
+
+	// 添加角色列时最早注册的用户成为管理员
+	conn := initDatabase(path)
+	if roles := userRoles(conn); len(roles) != 2 || roles[0] != RoleAdmin || roles[1] != RoleCustomer {
+		t.Fatalf("迁移后角色 = %v; 期望 [admin customer]", roles)
+	}
+
+	// 之后没有管理员也不会在重启时自动提升
+	conn.Model(&User{}).Where("id = 1").Update("role", RoleCustomer)
+	closeDB(conn)
+	conn = initDatabase(path)
+	defer closeDB(conn)
+	if roles := userRoles(conn); roles[0] != RoleCustomer || roles[1] != RoleCustomer {
+		t.Errorf("重启后角色 = %v; 期望不变", roles)
+	}
+
+	if err := promoteAdmin(conn, " B@example.com "); err != nil {
+		t.Fatal(err)
+	}
+	if roles := userRoles(conn); roles[1] != RoleAdmin {
+		t.Errorf("-admin-email 后角色 = %v; 期望 b 为管理员", roles)
+	}
+	if err := promoteAdmin(conn, "nobody@example.com"); err == nil {
+		t.Error("不存在的邮箱应返回错误")
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Category 商品分类，通过 ParentID 组成树
+type Category struct {
+	ID        uint        `json:"id" gorm:"primaryKey"`
+	Name      string      `json:"name" gorm:"not null"`
+	ParentID  *uint       `json:"parent_id" gorm:"index"`
+	Children  []*Category `json:"children,omitempty" gorm:"-"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// ProductVariant 商品规格（SKU），每个规格有独立的价格和库存
+type ProductVariant struct {
+	ID         uint              `json:"id" gorm:"primaryKey"`
+	ProductID  uint              `json:"product_id" gorm:"index"`
+	SKU        string            `json:"sku" gorm:"uniqueIndex;not null"`
+	Attributes map[string]string `json:"attributes" gorm:"serializer:json"` // 如 {"size":"M","color":"red"}
+	Price      Money             `json:"price" gorm:"embedded;embeddedPrefix:price_"`
+	Stock      int               `json:"stock" gorm:"default:0"`
+	CreatedAt  time.Time         `json:"created_at"`
+}
+
+// attributeKeyPattern 属性名只允许小写字母、数字和下划线，用于拼接 JSON 路径
+var attributeKeyPattern = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+// 商品列表排序方式
+var productSorts = map[string]string{
+	"newest":     "products.created_at DESC, products.id DESC",
+	"price_asc":  "products.price_amount ASC, products.id ASC",
+	"price_desc": "products.price_amount DESC, products.id DESC",
+	"name":       "products.name ASC, products.id ASC",
+	"rating":     "products.rating_average DESC, products.rating_count DESC, products.id DESC",
+}
+
+// normalizeAttributes 属性名转为小写并校验，属性值去掉首尾空白
+func normalizeAttributes(attrs map[string]string) (map[string]string, error) {
+	normalized := make(map[string]string, len(attrs))
+	for key, value := range attrs {
+		key = strings.ToLower(strings.TrimSpace(key))
+		if !attributeKeyPattern.MatchString(key) {
+			return nil, errors.New("属性名只能包含小写字母、数字和下划线: " + key)
+		}
+		normalized[key] = strings.TrimSpace(value)
+	}
+	return normalized, nil
+}
+
+// validateVariant 校验规格参数
+func validateVariant(variant *ProductVariant) error {
+	variant.SKU = strings.ToUpper(strings.TrimSpace(variant.SKU))
+	if variant.SKU == "" {
+		return errors.New("sku 不能为空")
+	}
+	if len(variant.Attributes) == 0 {
+		return errors.New("规格至少需要一个属性，如 size 或 color")
+	}
+	attrs, err := normalizeAttributes(variant.Attributes)
+	if err != nil {
+		return err
+	}
+	variant.Attributes = attrs
+	if variant.Stock < 0 {
+		return errors.New("stock 不能为负数")
+	}
+	return withCurrency(&variant.Price)
+}
+
+// syncFromPrice 有规格的商品以最低规格价作为商品价格（起价），用于列表展示和排序
+func syncFromPrice(tx *gorm.DB, productID uint) error {
+	var variant ProductVariant
+	err := tx.Where("product_id = ?", productID).Order("price_amount ASC").First(&variant).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Model(&Product{}).Where("id = ?", productID).Updates(map[string]interface{}{
+		"price_amount":   variant.Price.Amount,
+		"price_currency": variant.Price.Currency,
+	}).Error
+}
+
+// handleCreateCategory 创建分类，parent_id 为空时创建顶级分类
+func handleCreateCategory(c *gin.Context) {
+	var category Category
+	if err := c.ShouldBindJSON(&category); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	category.Name = strings.TrimSpace(category.Name)
+	if category.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name 不能为空"})
+		return
+	}
+	if category.ParentID != nil {
+		if err := db.First(&Category{}, *category.ParentID).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "上级分类不存在"})
+			return
+		}
+	}
+	category.Children = nil
+	db.Create(&category)
+	c.JSON(http.StatusCreated, gin.H{"data": category})
+}
+
+// handleListCategories 以树形结构返回所有分类
+func handleListCategories(c *gin.Context) {
+	var categories []*Category
+	db.Order("name ASC, id ASC").Find(&categories)
+
+	byID := make(map[uint]*Category, len(categories))
+	for _, category := range categories {
+		byID[category.ID] = category
+	}
+	roots := make([]*Category, 0)
+	for _, category := range categories {
+		if parent, ok := byID[derefID(category.ParentID)]; ok {
+			parent.Children = append(parent.Children, category)
+		} else {
+			roots = append(roots, category)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"data": roots})
+}
+
+func derefID(id *uint) uint {
+	if id == nil {
+		return 0
+	}
+	return *id
+}
+
+// handleCreateVariant 为商品添加规格
+func handleCreateVariant(c *gin.Context) {
+	var product Product
+	if err := db.First(&product, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "商品不存在"})
+		return
+	}
+	var variant ProductVariant
+	if err := c.ShouldBindJSON(&variant); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateVariant(&variant); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	variant.ID, variant.ProductID = 0, product.ID
+	initial := variant.Stock
+	variant.Stock = 0
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&variant).Error; err != nil {
+			return err
+		}
+		if initial > 0 {
+			_, err := adjustStock(tx, stockChange{ProductID: product.ID, VariantID: &variant.ID, Delta: initial,
+				Reason: ReasonRestock, Note: "初始库存", ActorID: currentUserID(c)})
+			if err != nil {
+				return err
+			}
+			variant.Stock = initial
+		}
+		return syncFromPrice(tx, product.ID)
+	})
+	if err != nil {
+		respondCatalogError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"data": variant})
+}
+
+// respondCatalogError 创建商品或规格失败：SKU 唯一约束冲突返回 409，其他错误返回 500
+func respondCatalogError(c *gin.Context, err error) {
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		c.JSON(http.StatusConflict, gin.H{"error": "SKU 已存在"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+// productFilter 商品列表的筛选条件
+type productFilter struct {
+	CategoryID uint
+	Attributes map[string][]string // 同一属性的多个值为“或”，不同属性之间为“与”
+	MinPrice   *Money
+	MaxPrice   *Money
+	InStock    bool
+	Terms      []string // 关键词，每个词都需要出现在名称、描述或 SKU 中
+}
+
+// parseProductFilter 解析查询参数
+//
+//	category=1           分类及其所有子分类
+//	attr[color]=red,blue 商品属性或任一规格属性匹配
+//	min_price / max_price 任一规格（无规格时为商品本身）的价格落在区间内
+//	in_stock=true        有库存
+//	q=关键词             空格分隔的多个关键词
+func parseProductFilter(c *gin.Context) (productFilter, error) {
+	var f productFilter
+	if raw := c.Query("category"); raw != "" {
+		id, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return f, errors.New("无效的 category")
+		}
+		f.CategoryID = uint(id)
+	}
+	f.Attributes = make(map[string][]string)
+	for key, raw := range c.QueryMap("attr") {
+		key = strings.ToLower(key)
+		if !attributeKeyPattern.MatchString(key) {
+			return f, errors.New("无效的属性名: " + key)
+		}
+		for _, value := range strings.Split(raw, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				f.Attributes[key] = append(f.Attributes[key], value)
+			}
+		}
+	}
+	for name, target := range map[string]**Money{"min_price": &f.MinPrice, "max_price": &f.MaxPrice} {
+		if raw := c.Query(name); raw != "" {
+			m, err := ParseMoney(raw, *currency)
+			if err != nil {
+				return f, errors.New("无效的 " + name + ": " + err.Error())
+			}
+			*target = &m
+		}
+	}
+	f.InStock = c.Query("in_stock") == "true"
+	f.Terms = strings.Fields(c.Query("q"))
+	if len(f.Terms) > 5 {
+		f.Terms = f.Terms[:5]
+	}
+	return f, nil
+}
+
+// likePattern 转义 LIKE 通配符，生成 %term% 模式
+func likePattern(term string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + r.Replace(term) + "%"
+}
+
+// apply 将筛选条件应用到商品查询
+func (f productFilter) apply(tx *gorm.DB) *gorm.DB {
+	if f.CategoryID != 0 {
+		tx = tx.Where(`products.category_id IN (
+			WITH RECURSIVE subtree(id) AS (
+				SELECT ? UNION ALL SELECT categories.id FROM categories JOIN subtree ON categories.parent_id = subtree.id
+			) SELECT id FROM subtree)`, f.CategoryID)
+	}
+	for key, values := range f.Attributes {
+		path := "$." + key
+		tx = tx.Where(`(json_extract(products.attributes, ?) IN ? OR EXISTS (
+			SELECT 1 FROM product_variants v WHERE v.product_id = products.id AND json_extract(v.attributes, ?) IN ?))`,
+			path, values, path, values)
+	}
+	if f.MinPrice != nil || f.MaxPrice != nil {
+		low, high := int64(0), int64(1<<62)
+		if f.MinPrice != nil {
+			low = f.MinPrice.Amount
+		}
+		if f.MaxPrice != nil {
+			high = f.MaxPrice.Amount
+		}
+		tx = tx.Where(`((NOT EXISTS (SELECT 1 FROM product_variants v WHERE v.product_id = products.id)
+			AND products.price_amount BETWEEN ? AND ?) OR EXISTS (
+			SELECT 1 FROM product_variants v WHERE v.product_id = products.id AND v.price_amount BETWEEN ? AND ?))`,
+			low, high, low, high)
+	}
+	if f.InStock {
+		tx = tx.Where(`((NOT EXISTS (SELECT 1 FROM product_variants v WHERE v.product_id = products.id)
+			AND products.stock > 0) OR EXISTS (
+			SELECT 1 FROM product_variants v WHERE v.product_id = products.id AND v.stock > 0))`)
+	}
+	for _, term := range f.Terms {
+		pattern := likePattern(term)
+		tx = tx.Where(`(products.name LIKE ? ESCAPE '\' OR products.description LIKE ? ESCAPE '\' OR EXISTS (
+			SELECT 1 FROM product_variants v WHERE v.product_id = products.id AND v.sku LIKE ? ESCAPE '\'))`,
+			pattern, pattern, pattern)
+	}
+	return tx
+}
+
+// relevanceOrder 按相关度排序：名称以关键词开头优先，其次是名称中命中的关键词数量
+func (f productFilter) relevanceOrder() clause.OrderBy {
+	var sql []string
+	var vars []interface{}
+	for i, term := range f.Terms {
+		if i == 0 {
+			sql = append(sql, `(CASE WHEN products.name LIKE ? ESCAPE '\' THEN 2 ELSE 0 END)`)
+			vars = append(vars, strings.TrimPrefix(likePattern(term), "%"))
+		}
+		sql = append(sql, `(CASE WHEN products.name LIKE ? ESCAPE '\' THEN 1 ELSE 0 END)`)
+		vars = append(vars, likePattern(term))
+	}
+	return clause.OrderBy{Expression: clause.Expr{
+		SQL:                strings.Join(sql, " + ") + " DESC, products.id DESC",
+		Vars:               vars,
+		WithoutParentheses: true,
+	}}
+}
+
+// handleListProducts 商品列表，支持分类、属性、价格、库存筛选以及排序和分页
+func handleListProducts(c *gin.Context) {
+	listProducts(c, c.DefaultQuery("sort", "newest"))
+}
+
+// handleSearchProducts 关键词搜索，默认按相关度排序
+func handleSearchProducts(c *gin.Context) {
+	if strings.TrimSpace(c.Query("q")) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "q 不能为空"})
+		return
+	}
+	listProducts(c, c.DefaultQuery("sort", "relevance"))
+}
+
+func listProducts(c *gin.Context, sort string) {
+	filter, err := parseProductFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	page, pageSize := pagination(c)
+
+	query := filter.apply(db.Model(&Product{}))
+	var total int64
+	query.Count(&total)
+
+	switch {
+	case sort == "relevance" && len(filter.Terms) > 0:
+		query = query.Order(filter.relevanceOrder())
+	case productSorts[sort] != "":
+		query = query.Order(productSorts[sort])
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort 只能是 newest、price_asc、price_desc、name、rating 或 relevance（需要 q）"})
+		return
+	}
+
+	var products []Product
+	withCatalogRelations(query).Offset((page - 1) * pageSize).Limit(pageSize).Find(&products)
+	c.JSON(http.StatusOK, gin.H{
+		"data":      products,
+		"page":      page,
+		"page_size": pageSize,
+		"total":     total,
+	})
+}
+
+// pagination 解析分页参数
+func pagination(c *gin.Context) (page, pageSize int) {
+	page, _ = strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ = strconv.Atoi(c.DefaultQuery("page_size", "20"))
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+	return page, pageSize
+}
+
+// withCatalogRelations 预加载商品的分类和规格
+func withCatalogRelations(tx *gorm.DB) *gorm.DB {
+	return tx.Preload("Category").Preload("Variants", func(tx *gorm.DB) *gorm.DB {
+		return tx.Order("product_variants.id ASC")
+	})
+}
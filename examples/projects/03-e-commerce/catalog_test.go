@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestCreateProductErrors(t *testing.T) {
+	r := setupOrderTest(t)
+	_, admin := createAdmin(t, 1)
+	body := `{"name":"T恤","variants":[{"sku":"tee-m","attributes":{"size":"M"},"price":59,"stock":1}]}`
+	if w := sendJSON(r, http.MethodPost, "/api/admin/products", admin, body); w.Code != http.StatusCreated {
+		t.Fatalf("创建商品: %d %s", w.Code, w.Body)
+	}
+	// SKU 统一转为大写后冲突
+	if w := sendJSON(r, http.MethodPost, "/api/admin/products", admin, `{"name":"重复","variants":[{"sku":"TEE-M","attributes":{"size":"M"},"price":59}]}`); w.Code != http.StatusConflict {
+		t.Errorf("重复 SKU: %d %s; 期望 409", w.Code, w.Body)
+	}
+	if w := sendJSON(r, http.MethodPost, "/api/admin/products/1/variants", admin, `{"sku":"TEE-M","attributes":{"size":"L"},"price":59}`); w.Code != http.StatusConflict {
+		t.Errorf("追加重复 SKU: %d %s; 期望 409", w.Code, w.Body)
+	}
+
+	// 其他数据库错误不能被当作 SKU 冲突
+	db.Migrator().DropTable(&InventoryEntry{})
+	if w := sendJSON(r, http.MethodPost, "/api/admin/products", admin, `{"name":"新商品","price":10,"stock":5}`); w.Code != http.StatusInternalServerError {
+		t.Errorf("写库存流水失败: %d %s; 期望 500", w.Code, w.Body)
+	}
+}
+
+// 目录、优惠的写接口和优惠券列表只对管理员开放
+func TestAdminRoutesRequireAdmin(t *testing.T) {
+	r := setupOrderTest(t)
+	_, customer := createBuyer(t, 1)
+	_, admin := createAdmin(t, 2)
+	routes := []struct{ method, path, body string }{
+		{http.MethodPost, "/api/admin/categories", `{"name":"服装"}`},
+		{http.MethodPost, "/api/admin/products", `{"name":"商品","price":10}`},
+		{http.MethodPost, "/api/admin/products/1/variants", `{"sku":"SKU-1","attributes":{"size":"M"},"price":10}`},
+		{http.MethodPost, "/api/admin/coupons", `{"code":"SAVE10","type":"percent","percent_off":10}`},
+		{http.MethodGet, "/api/admin/coupons", ""},
+		{http.MethodPost, "/api/admin/promotions", `{"name":"包邮","type":"free_shipping","threshold":99}`},
+	}
+	for _, route := range routes {
+		if w := sendJSON(r, route.method, route.path, "", route.body); w.Code != http.StatusUnauthorized {
+			t.Errorf("未登录 %s %s: %d; 期望 401", route.method, route.path, w.Code)
+		}
+		if w := sendJSON(r, route.method, route.path, customer, route.body); w.Code != http.StatusForbidden {
+			t.Errorf("顾客 %s %s: %d; 期望 403", route.method, route.path, w.Code)
+		}
+		if w := sendJSON(r, route.method, route.path, admin, route.body); w.Code >= 300 {
+			t.Errorf("管理员 %s %s: %d %s", route.method, route.path, w.Code, w.Body)
+		}
+	}
+	// 商品、分类和优惠活动的查询仍然公开
+	for _, path := range []string{"/api/products", "/api/categories", "/api/promotions"} {
+		if w := sendJSON(r, http.MethodGet, path, "", ""); w.Code != http.StatusOK {
+			t.Errorf("GET %s: %d; 期望 200", path, w.Code)
+		}
+	}
+}
+
+// listProductNames 请求商品列表，返回商品名称
+func listProductNames(t *testing.T, query string) []string {
+	t.Helper()
+	w := sendJSON(setupRouter(), http.MethodGet, "/api/products"+query, "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: %d %s", query, w.Code, w.Body)
+	}
+	var resp struct{ Data []Product }
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	names := make([]string, len(resp.Data))
+	for i, p := range resp.Data {
+		names[i] = p.Name
+	}
+	return names
+}
+
+func TestProductFilters(t *testing.T) {
+	setupOrderTest(t)
+	// 服装 > T恤 > 短袖，另有顶级分类 数码
+	clothing := Category{Name: "服装"}
+	db.Create(&clothing)
+	tees := Category{Name: "T恤", ParentID: &clothing.ID}
+	db.Create(&tees)
+	short := Category{Name: "短袖", ParentID: &tees.ID}
+	db.Create(&short)
+	digital := Category{Name: "数码"}
+	db.Create(&digital)
+
+	products := []Product{
+		{Name: "Phone Case Pro", CategoryID: &digital.ID, Price: cny(3000), Attributes: map[string]string{"brand": "acme"}},
+		{Name: "Phone stand", Description: "case included", CategoryID: &digital.ID, Price: cny(8000)},
+		{Name: "Case for phone", CategoryID: &digital.ID, Price: cny(1000), Attributes: map[string]string{"brand": "other"}},
+		{Name: "大衣", CategoryID: &clothing.ID, Price: cny(50000)},
+		{Name: "纯棉T恤", CategoryID: &tees.ID, Price: cny(1000), Variants: []ProductVariant{
+			{SKU: "TEE-S", Attributes: map[string]string{"color": "red"}, Price: cny(1000)},
+			{SKU: "TEE-L", Attributes: map[string]string{"color": "blue"}, Price: cny(5000)},
+		}},
+		{Name: "短袖衫", CategoryID: &short.ID, Price: cny(2000), Attributes: map[string]string{"color": "red"}},
+	}
+	db.Create(&products)
+
+	tests := []struct {
+		name, query string
+		want        []string
+	}{
+		{"分类包含所有子分类", fmt.Sprintf("?category=%d&sort=name", clothing.ID), []string{"大衣", "短袖衫", "纯棉T恤"}},
+		{"子分类", fmt.Sprintf("?category=%d&sort=name", tees.ID), []string{"短袖衫", "纯棉T恤"}},
+		{"叶子分类", fmt.Sprintf("?category=%d", short.ID), []string{"短袖衫"}},
+		{"商品属性", "?attr[brand]=acme&sort=name", []string{"Phone Case Pro"}},
+		{"规格属性或商品属性，多个值为或", "?attr[color]=red,blue&sort=name", []string{"短袖衫", "纯棉T恤"}},
+		{"只有规格命中", "?attr[color]=blue", []string{"纯棉T恤"}},
+		{"多个属性为与", "?attr[color]=red&attr[brand]=acme", []string{}},
+		{"价格区间按任一规格", "?min_price=40&max_price=60&sort=name", []string{"纯棉T恤"}},
+		{"价格区间，按起价排序", "?min_price=20&max_price=80&sort=price_asc", []string{"纯棉T恤", "短袖衫", "Phone Case Pro", "Phone stand"}},
+		{"只有上限", "?max_price=10&sort=name", []string{"Case for phone", "纯棉T恤"}},
+	}
+	for _, tt := range tests {
+		if got := listProductNames(t, tt.query); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s %s = %v; 期望 %v", tt.name, tt.query, got, tt.want)
+		}
+	}
+
+	// 相关度：名称以第一个词开头 +2，名称中每命中一个词 +1；每个词都需命中名称、描述或 SKU
+	w := sendJSON(setupRouter(), http.MethodGet, "/api/products/search?q=phone+case", "", "")
+	var resp struct{ Data []Product }
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	var got []string
+	for _, p := range resp.Data {
+		got = append(got, p.Name)
+	}
+	if want := []string{"Phone Case Pro", "Phone stand", "Case for phone"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("搜索 phone case = %v; 期望 %v", got, want)
+	}
+}
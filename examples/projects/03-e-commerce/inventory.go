@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var (
+	lowStockThreshold = flag.Int("low-stock-threshold", 5, "库存低于等于该值时发出低库存提醒，商品可单独设置")
+	alertWebhook      = flag.String("alert-webhook", "", "低库存提醒的推送地址（POST JSON），为空时只写日志")
+)
+
+// 库存变动原因
+const (
+	ReasonRestock      = "restock"      // 入库（含商品创建时的初始库存）
+	ReasonSale         = "sale"         // 下单扣减
+	ReasonCancellation = "cancellation" // 订单取消或发货前退款，归还库存
+	ReasonCorrection   = "correction"   // 盘点修正
+	ReasonReturn       = "return"       // 退货入库
+)
+
+var (
+	errInsufficientStock = errors.New("库存不足")
+	errStockUnchanged    = errors.New("库存无变化")
+)
+
+// InventoryEntry 库存流水，每次库存变动记录一条
+// 商品和规格的 stock 列是流水之和的缓存，只通过 adjustStock 修改，启动时按流水重新计算
+type InventoryEntry struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	ProductID uint      `json:"product_id" gorm:"index:idx_inventory_item"`
+	VariantID *uint     `json:"variant_id" gorm:"index:idx_inventory_item"`
+	Delta     int       `json:"delta"`   // 变动数量，入库为正，出库为负
+	Balance   int       `json:"balance"` // 变动后的库存
+	Reason    string    `json:"reason" gorm:"index"`
+	Note      string    `json:"note,omitempty"`
+	ActorID   *uint     `json:"actor_id"` // 操作人，系统自动操作时为空
+	OrderID   *uint     `json:"order_id,omitempty" gorm:"index"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// StockAlert 低库存提醒，库存从阈值以上降到阈值及以下时产生，补货回到阈值以上时关闭
+// 提醒在库存变动的事务中写入，由 runAlertDispatcher 在提交后推送，事务回滚时不会误报
+type StockAlert struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	ProductID  uint       `json:"product_id" gorm:"index"`
+	VariantID  *uint      `json:"variant_id"`
+	Name       string     `json:"name"`
+	Balance    int        `json:"balance"`
+	Threshold  int        `json:"threshold"`
+	NotifiedAt *time.Time `json:"notified_at" gorm:"index"`
+	ResolvedAt *time.Time `json:"resolved_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// stockChange 一次库存变动
+type stockChange struct {
+	ProductID uint
+	VariantID *uint
+	Delta     int
+	Target    *int // 盘点修正的目标库存，设置时忽略 Delta，按事务内读到的当前库存计算差额
+	Reason    string
+	Note      string
+	ActorID   uint // 0 表示系统
+	OrderID   *uint
+}
+
+// adjustStock 在事务中变更库存并记录流水
+// 出库使用 UPDATE ... WHERE stock >= ? 条件扣减，库存不足返回 errInsufficientStock；
+// 变动使库存跨过低库存阈值时打开或关闭提醒
+func adjustStock(tx *gorm.DB, change stockChange) (InventoryEntry, error) {
+	if change.Target != nil {
+		// 数据库连接使用 _txlock=immediate，事务开始即持有写锁，读取到写入之间不会插入其他变动
+		current, err := currentStock(tx, change.ProductID, change.VariantID)
+		if err != nil {
+			return InventoryEntry{}, err
+		}
+		if change.Delta = *change.Target - current; change.Delta == 0 {
+			return InventoryEntry{}, errStockUnchanged
+		}
+	}
+	query := tx.Model(&Product{}).Where("id = ?", change.ProductID)
+	if change.VariantID != nil {
+		query = tx.Model(&ProductVariant{}).Where("id = ? AND product_id = ?", *change.VariantID, change.ProductID)
+	}
+	if change.Delta < 0 {
+		query = query.Where("stock >= ?", -change.Delta)
+	}
+	result := query.UpdateColumn("stock", gorm.Expr("stock + ?", change.Delta))
+	if result.Error != nil {
+		return InventoryEntry{}, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return InventoryEntry{}, errInsufficientStock
+	}
+
+	var product Product
+	if err := tx.First(&product, change.ProductID).Error; err != nil {
+		return InventoryEntry{}, err
+	}
+	balance, name := product.Stock, product.Name
+	if change.VariantID != nil {
+		var variant ProductVariant
+		if err := tx.First(&variant, *change.VariantID).Error; err != nil {
+			return InventoryEntry{}, err
+		}
+		balance, name = variant.Stock, product.Name+" "+variant.SKU
+	}
+
+	entry := InventoryEntry{
+		ProductID: change.ProductID,
+		VariantID: change.VariantID,
+		Delta:     change.Delta,
+		Balance:   balance,
+		Reason:    change.Reason,
+		Note:      change.Note,
+		OrderID:   change.OrderID,
+	}
+	if change.ActorID != 0 {
+		entry.ActorID = &change.ActorID
+	}
+	if err := tx.Create(&entry).Error; err != nil {
+		return entry, err
+	}
+
+	threshold := product.threshold()
+	before := balance - change.Delta
+	switch {
+	case before > threshold && balance <= threshold:
+		alert := StockAlert{ProductID: change.ProductID, VariantID: change.VariantID, Name: name, Balance: balance, Threshold: threshold}
+		return entry, tx.Create(&alert).Error
+	case before <= threshold && balance > threshold:
+		now := time.Now()
+		return entry, stockItemScope(tx.Model(&StockAlert{}), change.ProductID, change.VariantID).
+			Where("resolved_at IS NULL").Update("resolved_at", &now).Error
+	}
+	return entry, nil
+}
+
+// threshold 商品的低库存阈值，未单独设置时使用 -low-stock-threshold
+func (p *Product) threshold() int {
+	if p.LowStockThreshold != nil {
+		return *p.LowStockThreshold
+	}
+	return *lowStockThreshold
+}
+
+// stockItemScope 限定到某个商品（无规格）或某个规格
+func stockItemScope(tx *gorm.DB, productID uint, variantID *uint) *gorm.DB {
+	if variantID != nil {
+		return tx.Where("product_id = ? AND variant_id = ?", productID, *variantID)
+	}
+	return tx.Where("product_id = ? AND variant_id IS NULL", productID)
+}
+
+// reconcileInventory 启动时按流水重新计算库存
+// 没有任何流水的旧数据以当前库存补一条期初修正记录；stock 列与流水之和不一致时以流水为准
+func reconcileInventory(conn *gorm.DB) error {
+	type item struct {
+		ProductID uint
+		VariantID *uint
+		Stock     int
+		Total     int
+		Entries   int
+	}
+	var items []item
+	err := conn.Raw(`
+		SELECT p.id AS product_id, NULL AS variant_id, p.stock AS stock,
+			COALESCE(SUM(e.delta), 0) AS total, COUNT(e.id) AS entries
+		FROM products p LEFT JOIN inventory_entries e ON e.product_id = p.id AND e.variant_id IS NULL
+		GROUP BY p.id
+		UNION ALL
+		SELECT v.product_id, v.id, v.stock, COALESCE(SUM(e.delta), 0), COUNT(e.id)
+		FROM product_variants v LEFT JOIN inventory_entries e ON e.variant_id = v.id
+		GROUP BY v.id`).Scan(&items).Error
+	if err != nil {
+		return err
+	}
+
+	return conn.Transaction(func(tx *gorm.DB) error {
+		for _, it := range items {
+			switch {
+			case it.Entries == 0 && it.Stock != 0:
+				entry := InventoryEntry{ProductID: it.ProductID, VariantID: it.VariantID, Delta: it.Stock,
+					Balance: it.Stock, Reason: ReasonCorrection, Note: "期初库存"}
+				if err := tx.Create(&entry).Error; err != nil {
+					return err
+				}
+			case it.Stock != it.Total:
+				label := fmt.Sprintf("商品 %d", it.ProductID)
+				query := tx.Model(&Product{}).Where("id = ?", it.ProductID)
+				if it.VariantID != nil {
+					label += fmt.Sprintf(" 规格 %d", *it.VariantID)
+					query = tx.Model(&ProductVariant{}).Where("id = ?", *it.VariantID)
+				}
+				log.Printf("%s的库存 %d 与流水之和 %d 不一致，已按流水修正", label, it.Stock, it.Total)
+				if err := query.UpdateColumn("stock", it.Total).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// handleRestock 入库
+func handleRestock(c *gin.Context) {
+	var req struct {
+		ProductID uint   `json:"product_id" binding:"required"`
+		VariantID *uint  `json:"variant_id"`
+		Quantity  int    `json:"quantity" binding:"required"`
+		Note      string `json:"note"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Quantity < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "quantity 必须大于 0"})
+		return
+	}
+	applyStockChange(c, stockChange{
+		ProductID: req.ProductID,
+		VariantID: req.VariantID,
+		Delta:     req.Quantity,
+		Reason:    ReasonRestock,
+		Note:      req.Note,
+		ActorID:   currentUserID(c),
+	})
+}
+
+// handleCorrectStock 盘点修正：将库存设为实际盘点数量 stock 并记录差额，必须填写原因
+func handleCorrectStock(c *gin.Context) {
+	var req struct {
+		ProductID uint   `json:"product_id" binding:"required"`
+		VariantID *uint  `json:"variant_id"`
+		Stock     *int   `json:"stock" binding:"required"`
+		Note      string `json:"note" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if *req.Stock < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "stock 不能为负数"})
+		return
+	}
+	applyStockChange(c, stockChange{
+		ProductID: req.ProductID,
+		VariantID: req.VariantID,
+		Target:    req.Stock,
+		Reason:    ReasonCorrection,
+		Note:      strings.TrimSpace(req.Note),
+		ActorID:   currentUserID(c),
+	})
+}
+
+// currentStock 查询商品或规格的当前库存
+func currentStock(tx *gorm.DB, productID uint, variantID *uint) (int, error) {
+	if variantID != nil {
+		var variant ProductVariant
+		if err := tx.Where("id = ? AND product_id = ?", *variantID, productID).First(&variant).Error; err != nil {
+			return 0, errors.New("规格不存在")
+		}
+		return variant.Stock, nil
+	}
+	var product Product
+	if err := tx.Preload("Variants").First(&product, productID).Error; err != nil {
+		return 0, errors.New("商品不存在")
+	}
+	if len(product.Variants) > 0 {
+		return 0, errors.New("该商品按规格管理库存，请指定 variant_id")
+	}
+	return product.Stock, nil
+}
+
+// applyStockChange 执行库存变动并返回流水
+func applyStockChange(c *gin.Context, change stockChange) {
+	if _, err := currentStock(db, change.ProductID, change.VariantID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	var entry InventoryEntry
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		entry, err = adjustStock(tx, change)
+		return err
+	})
+	switch {
+	case errors.Is(err, errInsufficientStock):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, errStockUnchanged):
+		c.JSON(http.StatusOK, gin.H{"message": err.Error(), "balance": *change.Target})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusCreated, gin.H{"data": entry})
+	}
+}
+
+// handleListInventoryEntries 查询库存流水，可按 product_id、variant_id、reason 筛选
+func handleListInventoryEntries(c *gin.Context) {
+	query := db.Model(&InventoryEntry{})
+	if id, err := strconv.ParseUint(c.Query("product_id"), 10, 64); err == nil {
+		query = query.Where("product_id = ?", id)
+	}
+	if id, err := strconv.ParseUint(c.Query("variant_id"), 10, 64); err == nil {
+		query = query.Where("variant_id = ?", id)
+	}
+	if reason := c.Query("reason"); reason != "" {
+		query = query.Where("reason = ?", reason)
+	}
+	page, pageSize := pagination(c)
+
+	var total int64
+	query.Count(&total)
+	var entries []InventoryEntry
+	query.Order("id DESC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&entries)
+	c.JSON(http.StatusOK, gin.H{
+		"data":      entries,
+		"page":      page,
+		"page_size": pageSize,
+		"total":     total,
+	})
+}
+
+// handleListStockAlerts 低库存提醒列表，默认只返回未关闭的提醒，?all=true 返回全部
+func handleListStockAlerts(c *gin.Context) {
+	query := db.Order("id DESC")
+	if c.Query("all") != "true" {
+		query = query.Where("resolved_at IS NULL")
+	}
+	var alerts []StockAlert
+	query.Limit(200).Find(&alerts)
+	c.JSON(http.StatusOK, gin.H{"data": alerts})
+}
+
+// handleSetStockThreshold 设置商品的低库存阈值，threshold 为 null 时恢复使用全局阈值
+func handleSetStockThreshold(c *gin.Context) {
+	var req struct {
+		Threshold *int `json:"threshold"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Threshold != nil && *req.Threshold < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "threshold 不能为负数"})
+		return
+	}
+	result := db.Model(&Product{}).Where("id = ?", parseID(c)).Update("low_stock_threshold", req.Threshold)
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "商品不存在"})
+		return
+	}
+	var product Product
+	db.First(&product, parseID(c))
+	c.JSON(http.StatusOK, gin.H{"data": product, "threshold": product.threshold()})
+}
+
+// runAlertDispatcher 定期推送尚未发送的低库存提醒，直到 ctx 结束
+// 推送失败的提醒保留为未发送状态，下一轮重试
+func runAlertDispatcher(ctx context.Context, interval time.Duration) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			var alerts []StockAlert
+			db.Where("notified_at IS NULL").Order("id ASC").Limit(100).Find(&alerts)
+			for _, alert := range alerts {
+				if err := notifyStockAlert(ctx, client, alert); err != nil {
+					log.Println("低库存提醒推送失败:", err)
+					break
+				}
+				now := time.Now()
+				db.Model(&alert).Update("notified_at", &now)
+			}
+		}
+	}
+}
+
+// notifyStockAlert 写日志，配置了 -alert-webhook 时同时推送
+func notifyStockAlert(ctx context.Context, client *http.Client, alert StockAlert) error {
+	log.Printf("低库存提醒: %s 库存 %d（阈值 %d）", alert.Name, alert.Balance, alert.Threshold)
+	if *alertWebhook == "" {
+		return nil
+	}
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, *alertWebhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("推送地址返回 %d", resp.StatusCode)
+	}
+	return nil
+}
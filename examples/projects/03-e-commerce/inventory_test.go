@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// changeStock 在单独的事务中执行一次库存变动
+func changeStock(change stockChange) (InventoryEntry, error) {
+	var entry InventoryEntry
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		entry, err = adjustStock(tx, change)
+		return err
+	})
+	return entry, err
+}
+
+// openAlerts 返回未关闭的提醒，格式为 "名称:库存/阈值"
+func openAlerts() []string {
+	var alerts []StockAlert
+	db.Where("resolved_at IS NULL").Order("id").Find(&alerts)
+	got := make([]string, len(alerts))
+	for i, a := range alerts {
+		got[i] = fmt.Sprintf("%s:%d/%d", a.Name, a.Balance, a.Threshold)
+	}
+	return got
+}
+
+func TestStockAlerts(t *testing.T) {
+	setupOrderTest(t)
+	product := Product{Name: "咖啡豆", Price: NewMoney(100, "CNY")}
+	db.Create(&product)
+	changeStock(stockChange{ProductID: product.ID, Delta: 10, Reason: ReasonRestock})
+
+	steps := []struct {
+		delta int
+		want  string
+	}{
+		{-4, "[]"},          // 10 → 6，仍高于阈值 5
+		{-2, "[咖啡豆:4/5]"},   // 跨过阈值，打开提醒
+		{-1, "[咖啡豆:4/5]"},   // 已低于阈值，不重复提醒
+		{+5, "[]"},          // 8，补货回到阈值以上，关闭提醒
+		{-3, "[咖啡豆:5/5]"},   // 等于阈值也算低库存
+		{-6, "[咖啡豆:5/5]"},   // 库存不足，不扣减也不提醒
+		{+1, "[]"},          // 6
+		{-1, "[咖啡豆:5/5]"},   // 再次跨过阈值，产生新提醒
+		{+10, "[]"},         // 15
+		{-2, "[]"},          // 13
+		{-3, "[咖啡豆:10/10]"}, // 阈值改为 10 后跨过
+	}
+	for i, s := range steps {
+		if i == len(steps)-1 {
+			threshold := 10
+			db.Model(&product).Update("low_stock_threshold", &threshold)
+		}
+		changeStock(stockChange{ProductID: product.ID, Delta: s.delta, Reason: ReasonCorrection})
+		if got := fmt.Sprint(openAlerts()); got != s.want {
+			t.Errorf("第 %d 步（%+d）: 提醒 %s; 期望 %s", i+1, s.delta, got, s.want)
+		}
+	}
+	var total int64
+	db.Model(&StockAlert{}).Count(&total)
+	if total != 4 {
+		t.Errorf("共产生 %d 条提醒; 期望 4", total)
+	}
+
+	// 回滚的变动不会留下提醒
+	db.Transaction(func(tx *gorm.DB) error {
+		adjustStock(tx, stockChange{ProductID: product.ID, Delta: -5, Reason: ReasonSale})
+		return errInsufficientStock
+	})
+	if got := fmt.Sprint(openAlerts()); got != "[咖啡豆:10/10]" {
+		t.Errorf("事务回滚后提醒 %s; 期望不变", got)
+	}
+}
+
+func TestAlertDispatcher(t *testing.T) {
+	setupOrderTest(t)
+	var calls, fail atomic.Int32
+	fail.Store(1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var alert StockAlert
+		json.NewDecoder(r.Body).Decode(&alert)
+		if fail.Load() == 1 || alert.Name != "咖啡豆" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	old := *alertWebhook
+	*alertWebhook = srv.URL
+	t.Cleanup(func() { *alertWebhook = old })
+
+	db.Create(&StockAlert{ProductID: 1, Name: "咖啡豆", Balance: 3, Threshold: 5})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runAlertDispatcher(ctx, 20*time.Millisecond)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	notified := func() bool {
+		var alert StockAlert
+		db.First(&alert)
+		return alert.NotifiedAt != nil
+	}
+	// 推送失败时保留为未发送，下一轮重试
+	time.Sleep(100 * time.Millisecond)
+	if calls.Load() < 2 || notified() {
+		t.Fatalf("推送失败: 调用 %d 次、已标记发送 %v; 期望重试且未标记", calls.Load(), notified())
+	}
+	fail.Store(0)
+	deadline := time.Now().Add(2 * time.Second)
+	for !notified() {
+		if time.Now().After(deadline) {
+			t.Fatal("恢复后提醒仍未发送")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	n := calls.Load()
+	time.Sleep(60 * time.Millisecond)
+	if calls.Load() != n {
+		t.Error("已发送的提醒被重复推送")
+	}
+}
+
+func TestReconcileInventory(t *testing.T) {
+	setupOrderTest(t)
+	// 旧数据：只有 stock 列，没有流水
+	legacy := Product{Name: "旧商品", Price: NewMoney(100, "CNY"), Stock: 7}
+	shirt := Product{Name: "T 恤", Price: NewMoney(100, "CNY")}
+	db.Create(&legacy)
+	db.Create(&shirt)
+	variant := ProductVariant{ProductID: shirt.ID, SKU: "TEE-M", Price: NewMoney(100, "CNY"), Stock: 3}
+	db.Create(&variant)
+	empty := Product{Name: "无库存", Price: NewMoney(100, "CNY")}
+	db.Create(&empty)
+
+	if err := reconcileInventory(db); err != nil {
+		t.Fatal(err)
+	}
+	var entries []InventoryEntry
+	db.Order("id").Find(&entries)
+	if len(entries) != 2 || entries[0].Delta != 7 || entries[0].Note != "期初库存" ||
+		entries[1].VariantID == nil || *entries[1].VariantID != variant.ID || entries[1].Delta != 3 {
+		t.Fatalf("期初流水 %+v; 期望商品 7 件、规格 3 件", entries)
+	}
+
+	// stock 列与流水之和不一致时以流水为准，再次校对不会重复补记
+	changeStock(stockChange{ProductID: legacy.ID, Delta: -2, Reason: ReasonSale})
+	db.Model(&legacy).UpdateColumn("stock", 100)
+	db.Model(&variant).UpdateColumn("stock", 0)
+	if err := reconcileInventory(db); err != nil {
+		t.Fatal(err)
+	}
+	db.First(&legacy, legacy.ID)
+	db.First(&variant, variant.ID)
+	var count int64
+	db.Model(&InventoryEntry{}).Count(&count)
+	if legacy.Stock != 5 || variant.Stock != 3 || count != 3 {
+		t.Errorf("校对后库存 %d、%d，流水 %d 条; 期望 5、3、3", legacy.Stock, variant.Stock, count)
+	}
+}
+
+func TestRestockAndCorrection(t *testing.T) {
+	r := setupOrderTest(t)
+	_, admin := createAdmin(t, 1)
+	_, buyer := createBuyer(t, 2)
+	product := Product{Name: "咖啡豆", Price: NewMoney(100, "CNY")}
+	shirt := Product{Name: "T 恤", Price: NewMoney(100, "CNY")}
+	db.Create(&product)
+	db.Create(&shirt)
+	db.Create(&ProductVariant{ProductID: shirt.ID, SKU: "TEE-M", Price: NewMoney(100, "CNY")})
+
+	tests := []struct {
+		name  string
+		path  string
+		token string
+		body  string
+		code  int
+	}{
+		{"普通用户入库", "/api/admin/inventory/restock", buyer, fmt.Sprintf(`{"product_id":%d,"quantity":5}`, product.ID), http.StatusForbidden},
+		{"数量为 0", "/api/admin/inventory/restock", admin, fmt.Sprintf(`{"product_id":%d,"quantity":0}`, product.ID), http.StatusBadRequest},
+		{"商品不存在", "/api/admin/inventory/restock", admin, `{"product_id":999,"quantity":5}`, http.StatusNotFound},
+		{"按规格管理的商品", "/api/admin/inventory/restock", admin, fmt.Sprintf(`{"product_id":%d,"quantity":5}`, shirt.ID), http.StatusNotFound},
+		{"入库", "/api/admin/inventory/restock", admin, fmt.Sprintf(`{"product_id":%d,"quantity":10,"note":"到货"}`, product.ID), http.StatusCreated},
+		{"修正缺少原因", "/api/admin/inventory/corrections", admin, fmt.Sprintf(`{"product_id":%d,"stock":8}`, product.ID), http.StatusBadRequest},
+		{"修正为负数", "/api/admin/inventory/corrections", admin, fmt.Sprintf(`{"product_id":%d,"stock":-1,"note":"盘点"}`, product.ID), http.StatusBadRequest},
+		{"盘点修正", "/api/admin/inventory/corrections", admin, fmt.Sprintf(`{"product_id":%d,"stock":8,"note":"盘点"}`, product.ID), http.StatusCreated},
+		{"库存无变化", "/api/admin/inventory/corrections", admin, fmt.Sprintf(`{"product_id":%d,"stock":8,"note":"盘点"}`, product.ID), http.StatusOK},
+	}
+	for _, tt := range tests {
+		if w := sendJSON(r, http.MethodPost, tt.path, tt.token, tt.body); w.Code != tt.code {
+			t.Errorf("%s: %d %s; 期望 %d", tt.name, w.Code, w.Body, tt.code)
+		}
+	}
+
+	w := sendJSON(r, http.MethodGet, fmt.Sprintf("/api/admin/inventory/ledger?product_id=%d", product.ID), admin, "")
+	var resp struct{ Data []InventoryEntry }
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Data) != 2 || resp.Data[0].Reason != ReasonCorrection || resp.Data[0].Delta != -2 || resp.Data[0].Balance != 8 ||
+		resp.Data[1].Reason != ReasonRestock || resp.Data[1].Delta != 10 || resp.Data[1].ActorID == nil {
+		t.Errorf("流水 %+v; 期望修正 -2（余 8）和入库 10", resp.Data)
+	}
+}
+
+func TestCorrectionDuringSales(t *testing.T) {
+	setupOrderTest(t)
+	product := Product{Name: "咖啡豆", Price: NewMoney(100, "CNY")}
+	db.Create(&product)
+	changeStock(stockChange{ProductID: product.ID, Delta: 100, Reason: ReasonRestock})
+
+	// 盘点修正与销售并发：修正后的余额必须正好是盘点数量，流水之和与库存一致
+	target := 50
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			changeStock(stockChange{ProductID: product.ID, Delta: -1, Reason: ReasonSale})
+		}()
+	}
+	wg.Add(1)
+	var correction InventoryEntry
+	var err error
+	go func() {
+		defer wg.Done()
+		correction, err = changeStock(stockChange{ProductID: product.ID, Target: &target, Reason: ReasonCorrection})
+	}()
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sold, after int64
+	db.Model(&InventoryEntry{}).Where("reason = ?", ReasonSale).Count(&sold)
+	db.Model(&InventoryEntry{}).Where("reason = ? AND id > ?", ReasonSale, correction.ID).Count(&after)
+	var sum int
+	db.Model(&InventoryEntry{}).Select("SUM(delta)").Scan(&sum)
+	db.First(&product, product.ID)
+	if correction.Balance != target || product.Stock != target-int(after) || sum != product.Stock || sold != 20 {
+		t.Errorf("修正后余额 %d、修正后售出 %d、库存 %d、流水之和 %d; 期望修正余额 %d 且库存等于流水之和",
+			correction.Balance, after, product.Stock, sum, target)
+	}
+}
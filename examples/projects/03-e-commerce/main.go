@@ -2,8 +2,16 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -12,222 +20,463 @@ import (
 )
 
 // Product 商品模型
+// 有规格的商品按规格定价和管理库存，Price 为最低规格价，Stock 不再使用
 type Product struct {
-	ID          uint      `json:"id" gorm:"primaryKey"`
-	Name        string    `json:"name" gorm:"not null"`
-	Description string    `json:"description"`
-	Price       float64   `json:"price" gorm:"not null"`
-	Stock       int       `json:"stock" gorm:"default:0"`
-	CreatedAt   time.Time `json:"created_at"`
+	ID                uint              `json:"id" gorm:"primaryKey"`
+	Name              string            `json:"name" gorm:"not null"`
+	Description       string            `json:"description"`
+	CategoryID        *uint             `json:"category_id" gorm:"index"`
+	Category          *Category         `json:"category,omitempty" gorm:"foreignKey:CategoryID"`
+	Attributes        map[string]string `json:"attributes" gorm:"serializer:json"` // 商品级属性，如 {"brand":"acme"}
+	Price             Money             `json:"price" gorm:"embedded;embeddedPrefix:price_"`
+	Stock             int               `json:"stock" gorm:"default:0"` // 库存流水之和，只通过 adjustStock 修改
+	LowStockThreshold *int              `json:"low_stock_threshold"`    // 低库存阈值，为空时使用全局阈值
+	Variants          []ProductVariant  `json:"variants" gorm:"foreignKey:ProductID"`
+	RatingAverage     float64           `json:"rating_average" gorm:"not null;default:0"` // 评分缓存，随评价在同一事务中更新
+	RatingCount       int               `json:"rating_count" gorm:"not null;default:0"`
+	CreatedAt         time.Time         `json:"created_at"`
 }
 
 // CartItem 购物车项
 type CartItem struct {
-	ID        uint      `json:"id" gorm:"primaryKey"`
-	UserID    uint      `json:"user_id"`
-	ProductID uint      `json:"product_id"`
-	Product   Product   `json:"product" gorm:"foreignKey:ProductID"`
-	Quantity  int       `json:"quantity" gorm:"default:1"`
-	CreatedAt time.Time `json:"created_at"`
+	ID         uint            `json:"id" gorm:"primaryKey"`
+	UserID     uint            `json:"user_id" gorm:"index"` // 游客购物车为 0
+	GuestToken string          `json:"-" gorm:"index"`       // 游客购物车的 Cookie 令牌
+	ProductID  uint            `json:"product_id"`
+	Product    Product         `json:"product" gorm:"foreignKey:ProductID"`
+	VariantID  *uint           `json:"variant_id"`
+	Variant    *ProductVariant `json:"variant,omitempty" gorm:"foreignKey:VariantID"`
+	Quantity   int             `json:"quantity" gorm:"default:1"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+// unitPrice 购物车项的单价，有规格时为规格价
+func (item *CartItem) unitPrice() Money {
+	if item.Variant != nil {
+		return item.Variant.Price
+	}
+	return item.Product.Price
 }
 
 // Order 订单模型
 type Order struct {
-	ID         uint        `json:"id" gorm:"primaryKey"`
-	UserID     uint        `json:"user_id"`
-	TotalPrice float64     `json:"total_price"`
-	Status     string      `json:"status" gorm:"default:pending"` // pending, paid, shipped, completed, cancelled
-	Items      []OrderItem `json:"items" gorm:"foreignKey:OrderID"`
-	CreatedAt  time.Time   `json:"created_at"`
+	ID             uint                 `json:"id" gorm:"primaryKey"`
+	UserID         uint                 `json:"user_id" gorm:"index:idx_orders_user_created"`
+	Subtotal       Money                `json:"subtotal" gorm:"embedded;embeddedPrefix:subtotal_"`
+	Discount       Money                `json:"discount" gorm:"embedded;embeddedPrefix:discount_"`
+	Shipping       Money                `json:"shipping" gorm:"embedded;embeddedPrefix:shipping_"`
+	Tax            Money                `json:"tax" gorm:"embedded;embeddedPrefix:tax_"`
+	TotalPrice     Money                `json:"total_price" gorm:"embedded;embeddedPrefix:total_price_"`
+	RefundedAmount Money                `json:"refunded_amount" gorm:"embedded;embeddedPrefix:refunded_"`            // 累计退款（退货与整单退款），含税
+	Status         string               `json:"status" gorm:"default:pending;index;index:idx_orders_status_created"` // 状态流转见 orderTransitions
+	ShipTo         ShippingInfo         `json:"shipping_address" gorm:"embedded;embeddedPrefix:ship_"`
+	Items          []OrderItem          `json:"items" gorm:"foreignKey:OrderID"`
+	Promotions     []OrderPromotion     `json:"promotions" gorm:"foreignKey:OrderID"`
+	History        []OrderStatusHistory `json:"history,omitempty" gorm:"foreignKey:OrderID"`
+	Refunds        []Refund             `json:"refunds,omitempty" gorm:"foreignKey:OrderID"`
+	// 报表按状态和时间范围统计订单，转化率按用户和时间查找订单
+	CreatedAt time.Time `json:"created_at" gorm:"index:idx_orders_status_created;index:idx_orders_user_created"`
 }
 
 // OrderItem 订单项
 type OrderItem struct {
-	ID        uint    `json:"id" gorm:"primaryKey"`
-	OrderID   uint    `json:"order_id"`
-	ProductID uint    `json:"product_id"`
-	Product   Product `json:"product" gorm:"foreignKey:ProductID"`
-	Quantity  int     `json:"quantity"`
-	Price     float64 `json:"price"`
+	ID               uint    `json:"id" gorm:"primaryKey"`
+	OrderID          uint    `json:"order_id" gorm:"index"`
+	ProductID        uint    `json:"product_id" gorm:"index"`
+	Product          Product `json:"product" gorm:"foreignKey:ProductID"`
+	VariantID        *uint   `json:"variant_id"`
+	SKU              string  `json:"sku,omitempty"` // 下单时的规格编码
+	Quantity         int     `json:"quantity"`
+	Price            Money   `json:"price" gorm:"embedded;embeddedPrefix:price_"`       // 下单时的单价
+	Discount         Money   `json:"discount" gorm:"embedded;embeddedPrefix:discount_"` // 分摊到该行的优惠
+	Total            Money   `json:"total" gorm:"embedded;embeddedPrefix:total_"`       // 优惠后金额
+	ReturnedQuantity int     `json:"returned_quantity" gorm:"not null;default:0"`       // 已退货数量
+	Refunded         Money   `json:"refunded" gorm:"embedded;embeddedPrefix:refunded_"` // 已退回的商品金额，不含税
 }
 
-var db *gorm.DB
+var (
+	db *gorm.DB
 
-func init() {
-	var err error
-	db, err = gorm.Open(sqlite.Open("ecommerce.db"), &gorm.Config{})
+	dbPath = flag.String("db", "ecommerce.db", "SQLite 数据库文件")
+	addr   = flag.String("addr", ":8080", "监听地址")
+)
+
+// initDatabase 初始化数据库并自动迁移
+// 写事务以 BEGIN IMMEDIATE 开始，并发下单时在事务开始处排队，而不是在提交时因锁冲突失败；
+// 唯一约束冲突转换为 gorm.ErrDuplicatedKey，与其他数据库错误区分
+func initDatabase(path string) *gorm.DB {
+	conn, err := gorm.Open(sqlite.Open(path+"?_busy_timeout=5000&_txlock=immediate"), &gorm.Config{TranslateError: true})
 	if err != nil {
 		log.Fatal("连接数据库失败:", err)
 	}
 
-	db.AutoMigrate(&Product{}, &CartItem{}, &Order{}, &OrderItem{})
+	if err := migrateMoneyColumns(conn); err != nil {
+		log.Fatal("迁移金额字段失败:", err)
+	}
+	if err := migrateOrderPricing(conn); err != nil {
+		log.Fatal("迁移订单优惠字段失败:", err)
+	}
+	if err := migrateOrderRefunds(conn); err != nil {
+		log.Fatal("迁移订单退款字段失败:", err)
+	}
+	if err := migrateUserRoles(conn); err != nil {
+		log.Fatal("迁移用户角色失败:", err)
+	}
+	if err := conn.AutoMigrate(&Product{}, &CartItem{}, &Order{}, &OrderItem{}, &OrderStatusHistory{},
+		&Coupon{}, &Promotion{}, &OrderPromotion{}, &PaymentIntent{}, &ProcessedWebhook{},
+		&Category{}, &ProductVariant{}, &User{}, &Address{}, &InventoryEntry{}, &StockAlert{},
+		&ReturnRequest{}, &ReturnItem{}, &Refund{}, &CartEvent{}, &Review{}, &ReviewVote{}); err != nil {
+		log.Fatal("数据库迁移失败:", err)
+	}
+	if err := reconcileInventory(conn); err != nil {
+		log.Fatal("校对库存失败:", err)
+	}
+	return conn
 }
 
-func main() {
+// parseID 解析路径中的 :id 参数，无效时返回 0
+func parseID(c *gin.Context) uint {
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+	return uint(id)
+}
+
+// setupRouter 注册所有路由
+func setupRouter() *gin.Engine {
 	r := gin.Default()
 
 	// 商品管理
 	products := r.Group("/api/products")
 	{
-		// 创建商品
-		products.POST("", func(c *gin.Context) {
-			var product Product
-			if err := c.ShouldBindJSON(&product); err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-				return
-			}
-			db.Create(&product)
-			c.JSON(http.StatusCreated, gin.H{"data": product})
-		})
-
-		// 获取商品列表
-		products.GET("", func(c *gin.Context) {
-			var products []Product
-			db.Find(&products)
-			c.JSON(http.StatusOK, gin.H{"data": products})
-		})
-
-		// 获取商品详情
-		products.GET("/:id", func(c *gin.Context) {
-			var product Product
-			if err := db.First(&product, c.Param("id")).Error; err != nil {
-				c.JSON(http.StatusNotFound, gin.H{"error": "商品不存在"})
-				return
-			}
-			c.JSON(http.StatusOK, gin.H{"data": product})
-		})
+		products.GET("", handleListProducts)
+		products.GET("/search", handleSearchProducts)
+		products.GET("/:id", handleGetProduct)
+		products.GET("/:id/reviews", handleListReviews)
+		products.POST("/:id/reviews", authRequired(), handleCreateReview)
 	}
 
-	// 购物车管理
-	cart := r.Group("/api/cart")
+	// 管理后台：商品目录、优惠、库存、订单状态、退货审核与销售报表
+	admin := r.Group("/api/admin", authRequired(), adminRequired())
 	{
-		// 添加到购物车
-		cart.POST("/items", func(c *gin.Context) {
-			var item CartItem
-			if err := c.ShouldBindJSON(&item); err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-				return
-			}
-			item.UserID = 1 // 简化处理
-			// 检查是否已存在
-			var existing CartItem
-			if err := db.Where("user_id = ? AND product_id = ?", item.UserID, item.ProductID).First(&existing).Error; err == nil {
-				existing.Quantity += item.Quantity
-				db.Save(&existing)
-				db.Preload("Product").First(&existing, existing.ID)
-				c.JSON(http.StatusOK, gin.H{"data": existing})
-				return
-			}
-			db.Create(&item)
-			db.Preload("Product").First(&item, item.ID)
-			c.JSON(http.StatusCreated, gin.H{"data": item})
-		})
-
-		// 获取购物车
-		cart.GET("", func(c *gin.Context) {
-			var items []CartItem
-			userID := 1 // 简化处理
-			db.Preload("Product").Where("user_id = ?", userID).Find(&items)
-			var total float64
-			for _, item := range items {
-				total += item.Product.Price * float64(item.Quantity)
-			}
-			c.JSON(http.StatusOK, gin.H{
-				"items": items,
-				"total": total,
-			})
-		})
+		admin.POST("/categories", handleCreateCategory)
+		admin.POST("/products", handleCreateProduct)
+		admin.POST("/products/:id/variants", handleCreateVariant)
+		admin.POST("/coupons", handleCreateCoupon)
+		admin.GET("/coupons", handleListCoupons)
+		admin.POST("/promotions", handleCreatePromotion)
+		admin.POST("/inventory/restock", handleRestock)
+		admin.POST("/inventory/corrections", handleCorrectStock)
+		admin.GET("/inventory/ledger", handleListInventoryEntries)
+		admin.GET("/inventory/alerts", handleListStockAlerts)
+		admin.PUT("/products/:id/low-stock-threshold", handleSetStockThreshold)
+		admin.PATCH("/orders/:id/status", handleUpdateOrderStatus)
+		admin.GET("/returns", handleAdminListReturns)
+		admin.POST("/returns/:id/approve", handleReviewReturn(ReturnApproved))
+		admin.POST("/returns/:id/reject", handleReviewReturn(ReturnRejected))
+		admin.GET("/reports/sales", handleSalesReport)
+		admin.GET("/reports/top-products", handleTopProducts)
+		admin.GET("/reports/conversion", handleConversionReport)
+	}
 
-		// 删除购物车项
-		cart.DELETE("/items/:id", func(c *gin.Context) {
-			db.Delete(&CartItem{}, c.Param("id"))
-			c.JSON(http.StatusOK, gin.H{"message": "已删除"})
-		})
+	// 商品评价
+	reviews := r.Group("/api/reviews", authRequired())
+	{
+		reviews.PUT("/:id", handleUpdateReview)
+		reviews.DELETE("/:id", handleDeleteReview)
+		reviews.POST("/:id/helpful", handleVoteReview)
+		reviews.DELETE("/:id/helpful", handleUnvoteReview)
 	}
 
-	// 订单管理
-	orders := r.Group("/api/orders")
+	// 商品分类
+	r.GET("/api/categories", handleListCategories)
+
+	// 用户与收货地址
+	r.POST("/api/auth/signup", handleSignup)
+	r.POST("/api/auth/login", handleLogin)
+	account := r.Group("/api", authRequired())
 	{
-		// 创建订单
-		orders.POST("", func(c *gin.Context) {
-			userID := uint(1) // 简化处理
-			var cartItems []CartItem
-			db.Preload("Product").Where("user_id = ?", userID).Find(&cartItems)
-
-			if len(cartItems) == 0 {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "购物车为空"})
-				return
-			}
+		account.GET("/account", handleGetAccount)
+		account.POST("/addresses", handleCreateAddress)
+		account.GET("/addresses", handleListAddresses)
+		account.PUT("/addresses/:id", handleUpdateAddress)
+		account.POST("/addresses/:id/default", handleSetDefaultAddress)
+		account.DELETE("/addresses/:id", handleDeleteAddress)
+	}
 
-			var totalPrice float64
-			var orderItems []OrderItem
-			for _, item := range cartItems {
-				// 检查库存
-				if item.Product.Stock < item.Quantity {
-					c.JSON(http.StatusBadRequest, gin.H{"error": "库存不足"})
-					return
-				}
-				totalPrice += item.Product.Price * float64(item.Quantity)
-				orderItems = append(orderItems, OrderItem{
-					ProductID: item.ProductID,
-					Quantity:  item.Quantity,
-					Price:     item.Product.Price,
-				})
-			}
+	// 购物车管理：登录用户使用自己的购物车，游客使用 Cookie 标识的购物车
+	cart := r.Group("/api/cart", authOptional())
+	{
+		cart.POST("/items", handleAddCartItem)
+		cart.GET("", handleGetCart)
+		cart.DELETE("/items/:id", handleDeleteCartItem)
+	}
 
-			order := Order{
-				UserID:     userID,
-				TotalPrice: totalPrice,
-				Status:     "pending",
-				Items:      orderItems,
-			}
-			db.Create(&order)
+	// 进行中的优惠活动
+	r.GET("/api/promotions", handleListPromotions)
 
-			// 扣减库存
-			for _, item := range cartItems {
-				db.Model(&Product{}).Where("id = ?", item.ProductID).
-					Update("stock", gorm.Expr("stock - ?", item.Quantity))
-			}
+	// 订单管理
+	orders := r.Group("/api/orders", authRequired())
+	{
+		orders.POST("", handleCreateOrder)
+		orders.GET("", handleListOrders)
+		orders.GET("/:id", handleGetOrder)
+		orders.POST("/:id/cancel", handleCancelOrder)
+		orders.GET("/:id/history", handleGetOrderHistory)
+		orders.POST("/:id/payment", handleCreatePayment)
+		orders.POST("/:id/payment/confirm", handleConfirmPayment)
+		orders.GET("/:id/payment", handleGetPayment)
+		orders.POST("/:id/returns", handleCreateReturn)
+		orders.GET("/:id/returns", handleListOrderReturns)
+	}
 
-			// 清空购物车
-			db.Where("user_id = ?", userID).Delete(&CartItem{})
-
-			db.Preload("Items.Product").First(&order, order.ID)
-			c.JSON(http.StatusCreated, gin.H{"data": order})
-		})
-
-		// 获取订单列表
-		orders.GET("", func(c *gin.Context) {
-			var orders []Order
-			userID := 1 // 简化处理
-			db.Preload("Items.Product").Where("user_id = ?", userID).Find(&orders)
-			c.JSON(http.StatusOK, gin.H{"data": orders})
-		})
-
-		// 获取订单详情
-		orders.GET("/:id", func(c *gin.Context) {
-			var order Order
-			if err := db.Preload("Items.Product").First(&order, c.Param("id")).Error; err != nil {
-				c.JSON(http.StatusNotFound, gin.H{"error": "订单不存在"})
-				return
-			}
-			c.JSON(http.StatusOK, gin.H{"data": order})
-		})
+	// 支付渠道回调
+	r.POST("/api/payments/webhook", handlePaymentWebhook)
 
-		// 更新订单状态
-		orders.PATCH("/:id/status", func(c *gin.Context) {
-			var req struct {
-				Status string `json:"status"`
+	return r
+}
+
+// handleCreateProduct 创建商品
+func handleCreateProduct(c *gin.Context) {
+	var product Product
+	if err := c.ShouldBindJSON(&product); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateProduct(&product); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// 评分只由评价更新
+	product.RatingAverage, product.RatingCount = 0, 0
+	// 初始库存通过库存流水写入
+	initial := make([]int, len(product.Variants)+1)
+	initial[0], product.Stock = product.Stock, 0
+	for i := range product.Variants {
+		initial[i+1], product.Variants[i].Stock = product.Variants[i].Stock, 0
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&product).Error; err != nil {
+			return err
+		}
+		for i, quantity := range initial {
+			if quantity == 0 {
+				continue
+			}
+			change := stockChange{ProductID: product.ID, Delta: quantity, Reason: ReasonRestock, Note: "初始库存", ActorID: currentUserID(c)}
+			if i > 0 {
+				change.VariantID = &product.Variants[i-1].ID
 			}
-			if err := c.ShouldBindJSON(&req); err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-				return
+			if _, err := adjustStock(tx, change); err != nil {
+				return err
 			}
-			db.Model(&Order{}).Where("id = ?", c.Param("id")).Update("status", req.Status)
-			c.JSON(http.StatusOK, gin.H{"message": "状态已更新"})
-		})
+		}
+		return syncFromPrice(tx, product.ID)
+	})
+	if err != nil {
+		respondCatalogError(c, err)
+		return
+	}
+	withCatalogRelations(db).First(&product, product.ID)
+	c.JSON(http.StatusCreated, gin.H{"data": product})
+}
+
+// validateProduct 校验商品参数，可同时创建规格
+func validateProduct(product *Product) error {
+	if strings.TrimSpace(product.Name) == "" {
+		return errors.New("name 不能为空")
+	}
+	if product.CategoryID != nil {
+		if err := db.First(&Category{}, *product.CategoryID).Error; err != nil {
+			return errors.New("分类不存在")
+		}
+	}
+	product.Category = nil
+	attrs, err := normalizeAttributes(product.Attributes)
+	if err != nil {
+		return err
+	}
+	product.Attributes = attrs
+	if product.Stock < 0 {
+		return errors.New("stock 不能为负数")
+	}
+	if product.LowStockThreshold != nil && *product.LowStockThreshold < 0 {
+		return errors.New("low_stock_threshold 不能为负数")
+	}
+	if err := withCurrency(&product.Price); err != nil {
+		return err
+	}
+	for i := range product.Variants {
+		product.Variants[i].ID = 0
+		if err := validateVariant(&product.Variants[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleGetProduct 获取商品详情
+func handleGetProduct(c *gin.Context) {
+	var product Product
+	if err := withCatalogRelations(db).First(&product, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "商品不存在"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": product})
+}
+
+// handleAddCartItem 添加到购物车，已存在的商品累加数量
+func handleAddCartItem(c *gin.Context) {
+	var item CartItem
+	if err := c.ShouldBindJSON(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if item.Quantity < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "数量必须大于 0"})
+		return
+	}
+	var product Product
+	if err := db.Preload("Variants").First(&product, item.ProductID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "商品不存在"})
+		return
+	}
+	// 有规格的商品必须选择规格
+	switch {
+	case len(product.Variants) > 0 && item.VariantID == nil:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请选择商品规格", "variants": product.Variants})
+		return
+	case len(product.Variants) == 0 && item.VariantID != nil:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "该商品没有规格"})
+		return
+	case item.VariantID != nil:
+		if err := db.Where("id = ? AND product_id = ?", *item.VariantID, product.ID).First(&ProductVariant{}).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "规格不存在"})
+			return
+		}
+	}
+	owner := currentCartOwner(c)
+	owner.ensureGuest(c)
+	recordCartEvent(owner, product.ID)
+	item.UserID, item.GuestToken = owner.UserID, owner.Guest
+	item.Product, item.Variant = Product{}, nil
+	// 检查是否已存在
+	var existing CartItem
+	query := owner.scope(db).Where("product_id = ?", item.ProductID)
+	if item.VariantID != nil {
+		query = query.Where("variant_id = ?", *item.VariantID)
+	} else {
+		query = query.Where("variant_id IS NULL")
+	}
+	if err := query.First(&existing).Error; err == nil {
+		existing.Quantity += item.Quantity
+		db.Save(&existing)
+		db.Preload("Product").Preload("Variant").First(&existing, existing.ID)
+		c.JSON(http.StatusOK, gin.H{"data": existing})
+		return
+	}
+	db.Create(&item)
+	db.Preload("Product").Preload("Variant").First(&item, item.ID)
+	c.JSON(http.StatusCreated, gin.H{"data": item})
+}
+
+// handleGetCart 获取购物车及逐行价格明细，可通过 ?coupon= 试用优惠券
+// 优惠券不可用时返回不含优惠券的报价，并在 coupon_error 中说明原因
+func handleGetCart(c *gin.Context) {
+	var items []CartItem
+	db.Preload("Product").Preload("Variant").Scopes(currentCartOwner(c).scope).Order("product_id, variant_id").Find(&items)
+
+	quote, err := quoteCart(db, items, c.Query("coupon"))
+	var couponErr *CouponError
+	if errors.As(err, &couponErr) {
+		quote, err = quoteCart(db, items, "")
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
-	log.Println("电商系统启动在 :8080")
-	r.Run(":8080")
+	resp := gin.H{
+		"items":      items,
+		"lines":      quote.Lines,
+		"subtotal":   quote.Subtotal,
+		"discount":   quote.Discount,
+		"shipping":   quote.Shipping,
+		"tax":        quote.Tax,
+		"total":      quote.Total,
+		"promotions": quote.Promotions,
+	}
+	if couponErr != nil {
+		resp["coupon_error"] = couponErr.Error()
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// handleDeleteCartItem 删除购物车项
+func handleDeleteCartItem(c *gin.Context) {
+	currentCartOwner(c).scope(db).Delete(&CartItem{}, c.Param("id"))
+	c.JSON(http.StatusOK, gin.H{"message": "已删除"})
+}
+
+// handleListOrders 获取订单列表
+func handleListOrders(c *gin.Context) {
+	var orders []Order
+	db.Preload("Items.Product").Preload("Promotions").Where("user_id = ?", currentUserID(c)).Find(&orders)
+	c.JSON(http.StatusOK, gin.H{"data": orders})
+}
+
+// handleGetOrder 获取订单详情
+func handleGetOrder(c *gin.Context) {
+	var order Order
+	if err := db.Preload("Items.Product").Preload("Promotions").Preload("History", orderHistoryOrder).
+		Where("user_id = ?", currentUserID(c)).First(&order, parseID(c)).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "订单不存在"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": order})
+}
+
+func main() {
+	flag.Parse()
+	if err := ensureJWTSecret(); err != nil {
+		log.Fatal(err)
+	}
+	if err := ensureWebhookSecret(); err != nil {
+		log.Fatal(err)
+	}
+	*currency = strings.ToUpper(*currency)
+	db = initDatabase(*dbPath)
+	if *adminEmail != "" {
+		if err := promoteAdmin(db, *adminEmail); err != nil {
+			log.Fatal("设置管理员失败:", err)
+		}
+	}
+
+	callback := *webhookURL
+	if callback == "" {
+		callback = defaultWebhookURL(*addr)
+	}
+	payments = NewSimulatedProvider(callback, *webhookSecret, *paymentDelay)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go runUnpaidCanceller(ctx, *unpaidTimeout, *cancelInterval)
+	go runAlertDispatcher(ctx, 10*time.Second)
+	go runRefundProcessor(ctx, time.Minute)
+
+	srv := &http.Server{Addr: *addr, Handler: setupRouter()}
+	go func() {
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+		<-sigChan
+
+		log.Println("收到关闭信号，开始优雅关闭...")
+		cancel()
+		shutdownCtx, done := context.WithTimeout(context.Background(), 5*time.Second)
+		defer done()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Println("电商系统启动在", *addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 }
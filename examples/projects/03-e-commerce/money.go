@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+var currency = flag.String("currency", "CNY", "商店使用的货币（ISO 4217 代码）")
+
+// taxRate 税率，以基点（万分之一）表示
+var taxRate BasisPoints
+
+func init() {
+	flag.Var(&taxRate, "tax-rate", "税率百分比，如 13 或 6.5，税额在订单小计上计算")
+}
+
+// currencyExponent 各货币最小单位的小数位数，未列出的货币按 2 位处理
+var currencyExponent = map[string]int{
+	"CNY": 2,
+	"USD": 2,
+	"EUR": 2,
+	"JPY": 0,
+	"KRW": 0,
+}
+
+func exponentOf(code string) int {
+	if exp, ok := currencyExponent[code]; ok {
+		return exp
+	}
+	return 2
+}
+
+func pow10(n int) int64 {
+	p := int64(1)
+	for i := 0; i < n; i++ {
+		p *= 10
+	}
+	return p
+}
+
+// RoundingMode 舍入方式
+type RoundingMode int
+
+// 舍入规则：
+//   - 折扣使用 RoundDown，折扣金额向零舍入，不会多减顾客不应得的那一分
+//   - 税额使用 RoundHalfUp，在订单小计上计算一次，避免逐行舍入累积误差
+//   - RoundHalfEven（银行家舍入）用于需要在大量金额上保持无偏的场景，如按比例分摊
+const (
+	RoundHalfUp RoundingMode = iota
+	RoundHalfEven
+	RoundDown
+)
+
+// Money 金额：以最小货币单位（如分）存储的整数和 ISO 4217 货币代码，避免浮点误差
+// 在模型中以 embedded 方式使用，例如 Price 对应 price_amount、price_currency 两列
+type Money struct {
+	Amount   int64  `json:"amount" gorm:"not null;default:0"`
+	Currency string `json:"currency" gorm:"type:varchar(3);not null;default:''"`
+}
+
+// NewMoney 以最小货币单位创建金额
+func NewMoney(amount int64, code string) Money {
+	return Money{Amount: amount, Currency: code}
+}
+
+// Zero 返回同币种的零金额
+func Zero(code string) Money {
+	return Money{Currency: code}
+}
+
+// ParseMoney 精确解析十进制金额字符串，如 "99.99"，小数位超过货币最小单位时返回错误
+func ParseMoney(s, code string) (Money, error) {
+	amount, err := parseDecimal(s, exponentOf(code))
+	if err != nil {
+		return Money{}, fmt.Errorf("无效的金额 %q（%s 最多 %d 位小数）", s, code, exponentOf(code))
+	}
+	return Money{Amount: amount, Currency: code}, nil
+}
+
+// parseDecimal 将十进制字符串解析为放大 10^exp 倍的整数，不经过浮点数
+func parseDecimal(s string, exp int) (int64, error) {
+	s = strings.TrimSpace(s)
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" || len(frac) > exp || strings.Trim(whole+frac, "0123456789") != "" {
+		return 0, errors.New("格式错误")
+	}
+	frac += strings.Repeat("0", exp-len(frac))
+	n, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if negative {
+		n = -n
+	}
+	return n, nil
+}
+
+// formatDecimal 将放大 10^exp 倍的整数格式化为十进制字符串
+func formatDecimal(n int64, exp int) string {
+	sign := ""
+	if n < 0 {
+		sign, n = "-", -n
+	}
+	if exp == 0 {
+		return sign + strconv.FormatInt(n, 10)
+	}
+	unit := pow10(exp)
+	return fmt.Sprintf("%s%d.%0*d", sign, n/unit, exp, n%unit)
+}
+
+// String 按货币小数位格式化，如 "99.99"
+func (m Money) String() string {
+	return formatDecimal(m.Amount, exponentOf(m.Currency))
+}
+
+// MarshalJSON 输出最小单位金额、货币代码和格式化后的字符串
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Amount   int64  `json:"amount"`
+		Currency string `json:"currency"`
+		Display  string `json:"display"`
+	}{m.Amount, m.Currency, m.String()})
+}
+
+// UnmarshalJSON 接受 {"amount":9999,"currency":"CNY"}，或按商店货币解析的 99.99、"99.99"
+// 数字直接取 JSON 原文解析，不经过 float64
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '{' {
+		var v struct {
+			Amount   int64  `json:"amount"`
+			Currency string `json:"currency"`
+		}
+		if err := json.Unmarshal(data, &v); err != nil {
+			return err
+		}
+		*m = Money{Amount: v.Amount, Currency: strings.ToUpper(v.Currency)}
+		if m.Currency == "" {
+			m.Currency = *currency
+		}
+		return nil
+	}
+	parsed, err := ParseMoney(string(bytes.Trim(data, `"`)), *currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// Cmp 比较两个同币种金额，返回 -1、0 或 1
+func (m Money) Cmp(other Money) int {
+	m.mustMatch(other)
+	switch {
+	case m.Amount < other.Amount:
+		return -1
+	case m.Amount > other.Amount:
+		return 1
+	}
+	return 0
+}
+
+// Min 返回较小的金额
+func (m Money) Min(other Money) Money {
+	if m.Cmp(other) <= 0 {
+		return m
+	}
+	return other
+}
+
+// IsZero 金额是否为零
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+// mustMatch 不同币种的金额不能直接运算，出现时说明调用方漏掉了币种校验
+func (m Money) mustMatch(other Money) {
+	if m.Currency != other.Currency {
+		panic(fmt.Sprintf("货币不一致: %s 与 %s", m.Currency, other.Currency))
+	}
+}
+
+// Add 加法
+func (m Money) Add(other Money) Money {
+	m.mustMatch(other)
+	return Money{Amount: m.Amount + other.Amount, Currency: m.Currency}
+}
+
+// Sub 减法
+func (m Money) Sub(other Money) Money {
+	m.mustMatch(other)
+	return Money{Amount: m.Amount - other.Amount, Currency: m.Currency}
+}
+
+// Mul 乘以数量，结果精确
+func (m Money) Mul(quantity int) Money {
+	return Money{Amount: m.Amount * int64(quantity), Currency: m.Currency}
+}
+
+// MulRatio 乘以 num/den 并按指定方式舍入到最小货币单位
+func (m Money) MulRatio(num, den int64, mode RoundingMode) Money {
+	return Money{Amount: divRound(m.Amount*num, den, mode), Currency: m.Currency}
+}
+
+// Percent 按基点（万分之一）计算比例金额，如 Percent(1300, RoundHalfUp) 为 13% 的税额
+func (m Money) Percent(bp BasisPoints, mode RoundingMode) Money {
+	return m.MulRatio(int64(bp), 10000, mode)
+}
+
+// Allocate 按权重拆分金额，各部分之和严格等于原金额
+// 先向下取整，剩余的最小单位按余数从大到小依次分配（最大余数法）
+func (m Money) Allocate(weights []int64) []Money {
+	parts := make([]Money, len(weights))
+	var totalWeight int64
+	for _, w := range weights {
+		totalWeight += w
+	}
+	if totalWeight == 0 {
+		for i := range parts {
+			parts[i] = Zero(m.Currency)
+		}
+		return parts
+	}
+
+	remainders := make([]int64, len(weights))
+	allocated := int64(0)
+	for i, w := range weights {
+		parts[i] = Money{Amount: m.Amount * w / totalWeight, Currency: m.Currency}
+		remainders[i] = m.Amount * w % totalWeight
+		allocated += parts[i].Amount
+	}
+	step := int64(1)
+	if m.Amount < 0 {
+		step = -1
+	}
+	for left := m.Amount - allocated; left != 0; left -= step {
+		best := 0
+		for i := range remainders {
+			if abs64(remainders[i]) > abs64(remainders[best]) {
+				best = i
+			}
+		}
+		parts[best].Amount += step
+		remainders[best] = 0
+	}
+	return parts
+}
+
+func abs64(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// divRound 整数除法并按舍入方式处理余数，den 必须为正
+func divRound(n, den int64, mode RoundingMode) int64 {
+	q, r := n/den, n%den
+	if r == 0 || mode == RoundDown {
+		return q
+	}
+	sign := int64(1)
+	if n < 0 {
+		sign, r = -1, -r
+	}
+	switch twice := 2 * r; {
+	case twice > den:
+		return q + sign
+	case twice == den && (mode == RoundHalfUp || q%2 != 0):
+		return q + sign
+	}
+	return q
+}
+
+// BasisPoints 基点（万分之一），用于税率和折扣率，避免浮点百分比
+type BasisPoints int64
+
+// ParseBasisPoints 解析百分比字符串，如 "13" 为 1300 基点、"6.5" 为 650 基点
+func ParseBasisPoints(s string) (BasisPoints, error) {
+	n, err := parseDecimal(s, 2)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("无效的百分比 %q（最多 2 位小数）", s)
+	}
+	return BasisPoints(n), nil
+}
+
+// String 实现 flag.Value，输出百分比
+func (bp BasisPoints) String() string {
+	return strings.TrimSuffix(strings.TrimRight(formatDecimal(int64(bp), 2), "0"), ".")
+}
+
+// MarshalJSON 以百分比数字输出，如 6.5
+func (bp BasisPoints) MarshalJSON() ([]byte, error) {
+	return []byte(bp.String()), nil
+}
+
+// UnmarshalJSON 接受百分比数字或字符串，如 6.5、"6.5"
+func (bp *BasisPoints) UnmarshalJSON(data []byte) error {
+	return bp.Set(string(bytes.Trim(bytes.TrimSpace(data), `"`)))
+}
+
+// Set 实现 flag.Value
+func (bp *BasisPoints) Set(s string) error {
+	v, err := ParseBasisPoints(s)
+	if err != nil {
+		return err
+	}
+	*bp = v
+	return nil
+}
+
+// validateCurrency 商店只支持单一货币，不同币种的金额需拒绝
+func validateCurrency(m Money) error {
+	if m.Currency != *currency {
+		return fmt.Errorf("仅支持 %s 计价", *currency)
+	}
+	if m.Amount < 0 {
+		return errors.New("金额不能为负数")
+	}
+	return nil
+}
+
+// moneyColumn 描述一个从 float64 迁移到 Money 的旧列
+type moneyColumn struct {
+	model  interface{}
+	table  string
+	column string // 旧列名，新列为 column_amount、column_currency
+}
+
+// migrateMoneyColumns 将旧版本中以 REAL 存储的价格迁移为最小货币单位整数
+// 旧数据视为商店货币，按 ROUND(price * 10^小数位) 换算后删除旧列
+func migrateMoneyColumns(conn *gorm.DB) error {
+	columns := []moneyColumn{
+		{&Product{}, "products", "price"},
+		{&OrderItem{}, "order_items", "price"},
+		{&Order{}, "orders", "total_price"},
+	}
+	m := conn.Migrator()
+	for _, col := range columns {
+		if !m.HasTable(col.model) || !m.HasColumn(col.model, col.column) || m.HasColumn(col.model, col.column+"_amount") {
+			continue
+		}
+		err := conn.Transaction(func(tx *gorm.DB) error {
+			tm := tx.Migrator()
+			if err := tm.AddColumn(col.model, col.column+"_amount"); err != nil {
+				return err
+			}
+			if err := tm.AddColumn(col.model, col.column+"_currency"); err != nil {
+				return err
+			}
+			sql := fmt.Sprintf("UPDATE %s SET %s_amount = CAST(ROUND(%s * %d) AS INTEGER), %s_currency = ?",
+				col.table, col.column, col.column, pow10(exponentOf(*currency)), col.column)
+			if err := tx.Exec(sql, *currency).Error; err != nil {
+				return err
+			}
+			return tm.DropColumn(col.model, col.column)
+		})
+		if err != nil {
+			return fmt.Errorf("迁移 %s.%s: %w", col.table, col.column, err)
+		}
+		if col.table == "orders" {
+			// 旧订单没有税额，小计即总价
+			if err := migrateOrderSubtotals(conn); err != nil {
+				return fmt.Errorf("迁移订单小计: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// migrateOrderSubtotals 为旧订单补齐小计和税额列
+func migrateOrderSubtotals(conn *gorm.DB) error {
+	m := conn.Migrator()
+	for _, name := range []string{"subtotal_amount", "subtotal_currency", "tax_amount", "tax_currency"} {
+		if err := m.AddColumn(&Order{}, name); err != nil {
+			return err
+		}
+	}
+	return conn.Exec("UPDATE orders SET subtotal_amount = total_price_amount, subtotal_currency = total_price_currency, " +
+		"tax_amount = 0, tax_currency = total_price_currency").Error
+}
@@ -0,0 +1,82 @@
+package main
+
+import "testing"
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in   string
+		code string
+		want int64
+		ok   bool
+	}{
+		{"99.99", "CNY", 9999, true},
+		{"0.1", "CNY", 10, true},
+		{"100", "CNY", 10000, true},
+		{"-1.05", "USD", -105, true},
+		{"1500", "JPY", 1500, true},
+		{"0.001", "CNY", 0, false},
+		{"1.5", "JPY", 0, false},
+		{"1e3", "CNY", 0, false},
+		{"", "CNY", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseMoney(tt.in, tt.code)
+		if (err == nil) != tt.ok || (tt.ok && got.Amount != tt.want) {
+			t.Errorf("ParseMoney(%q, %s) = %v, %v; 期望 %d, ok=%v", tt.in, tt.code, got.Amount, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestFloatDriftIsGone(t *testing.T) {
+	// 0.1 + 0.2 在 float64 下不等于 0.3
+	a, _ := ParseMoney("0.1", "CNY")
+	b, _ := ParseMoney("0.2", "CNY")
+	if got := a.Add(b).String(); got != "0.30" {
+		t.Errorf("0.1 + 0.2 = %s; 期望 0.30", got)
+	}
+	price, _ := ParseMoney("19.99", "CNY")
+	if got := price.Mul(3).String(); got != "59.97" {
+		t.Errorf("19.99 × 3 = %s; 期望 59.97", got)
+	}
+}
+
+func TestRounding(t *testing.T) {
+	tests := []struct {
+		amount int64
+		bp     BasisPoints
+		mode   RoundingMode
+		want   int64
+	}{
+		{1050, 1000, RoundHalfUp, 105},   // 10.50 × 10% = 1.05
+		{1005, 1000, RoundHalfUp, 101},   // 1.005 → 1.01
+		{1005, 1000, RoundHalfEven, 100}, // 1.005 → 1.00
+		{1015, 1000, RoundHalfEven, 102}, // 1.015 → 1.02
+		{1009, 1000, RoundDown, 100},     // 折扣向下舍入
+		{-1005, 1000, RoundHalfUp, -101},
+	}
+	for _, tt := range tests {
+		got := NewMoney(tt.amount, "CNY").Percent(tt.bp, tt.mode).Amount
+		if got != tt.want {
+			t.Errorf("%d × %d bp (mode %d) = %d; 期望 %d", tt.amount, tt.bp, tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	parts := NewMoney(100, "CNY").Allocate([]int64{1, 1, 1})
+	var sum int64
+	for _, p := range parts {
+		sum += p.Amount
+	}
+	if sum != 100 || parts[0].Amount != 34 || parts[1].Amount != 33 {
+		t.Errorf("Allocate(1.00, 1:1:1) = %v; 期望 34, 33, 33", parts)
+	}
+}
+
+func TestParseBasisPoints(t *testing.T) {
+	for in, want := range map[string]BasisPoints{"13": 1300, "6.5": 650, "0": 0, "0.25": 25} {
+		if got, err := ParseBasisPoints(in); err != nil || got != want {
+			t.Errorf("ParseBasisPoints(%q) = %d, %v; 期望 %d", in, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var errEmptyCart = errors.New("购物车为空")
+
+// StockError 下单时某个商品（或规格）库存不足
+type StockError struct {
+	ProductID uint
+	VariantID *uint
+	Name      string
+	Requested int
+}
+
+func (e *StockError) Error() string {
+	return fmt.Sprintf("商品「%s」库存不足", e.Name)
+}
+
+// checkout 在一个事务中完成下单：读取购物车、计算报价、条件扣减库存、占用优惠券、创建订单并清空已结算的购物车项
+// addressID 为 0 时使用默认收货地址
+// 库存扣减由 adjustStock 条件更新并记录流水，由数据库保证并发下不会超卖；
+// 任意商品扣减失败时返回 StockError，整个事务回滚，库存、订单和购物车都保持原样
+func checkout(tx *gorm.DB, userID uint, couponCode string, addressID uint) (Order, error) {
+	var cartItems []CartItem
+	if err := tx.Preload("Product").Preload("Variant").Scopes(cartOwner{UserID: userID}.scope).Order("product_id, variant_id").Find(&cartItems).Error; err != nil {
+		return Order{}, err
+	}
+	if len(cartItems) == 0 {
+		return Order{}, errEmptyCart
+	}
+	shipTo, err := shippingAddress(tx, userID, addressID)
+	if err != nil {
+		return Order{}, err
+	}
+	quote, err := quoteCart(tx, cartItems, couponCode)
+	if err != nil {
+		return Order{}, err
+	}
+
+	order := Order{
+		UserID:     userID,
+		Status:     OrderPending,
+		ShipTo:     shipTo,
+		Subtotal:   quote.Subtotal,
+		Discount:   quote.Discount,
+		Shipping:   quote.Shipping,
+		Tax:        quote.Tax,
+		TotalPrice: quote.Total,
+		// 已退款金额从零开始累计，币种与订单一致
+		RefundedAmount: Zero(quote.Total.Currency),
+	}
+	for _, line := range quote.Lines {
+		order.Items = append(order.Items, OrderItem{
+			ProductID: line.ProductID,
+			VariantID: line.VariantID,
+			SKU:       line.SKU,
+			Quantity:  line.Quantity,
+			Price:     line.UnitPrice,
+			Discount:  line.Discount,
+			Total:     line.Total,
+			Refunded:  Zero(line.Total.Currency),
+		})
+	}
+	// 只保存报价中实际生效的优惠
+	for _, applied := range quote.Promotions {
+		if applied.CouponID != nil {
+			if err := claimCoupon(tx, &Coupon{ID: *applied.CouponID, Code: applied.Code}); err != nil {
+				return Order{}, err
+			}
+		}
+		order.Promotions = append(order.Promotions, OrderPromotion{
+			Source:      applied.Source,
+			PromotionID: applied.PromotionID,
+			CouponID:    applied.CouponID,
+			Code:        applied.Code,
+			Name:        applied.Name,
+			Type:        applied.Type,
+			Amount:      applied.Amount,
+		})
+	}
+
+	if err := tx.Create(&order).Error; err != nil {
+		return Order{}, err
+	}
+	cartItemIDs := make([]uint, 0, len(cartItems))
+	for _, item := range cartItems {
+		_, err := adjustStock(tx, stockChange{
+			ProductID: item.ProductID,
+			VariantID: item.VariantID,
+			Delta:     -item.Quantity,
+			Reason:    ReasonSale,
+			ActorID:   userID,
+			OrderID:   &order.ID,
+		})
+		if errors.Is(err, errInsufficientStock) {
+			return Order{}, &StockError{ProductID: item.ProductID, VariantID: item.VariantID, Name: item.Product.Name, Requested: item.Quantity}
+		}
+		if err != nil {
+			return Order{}, err
+		}
+		cartItemIDs = append(cartItemIDs, item.ID)
+	}
+	if err := tx.Create(&OrderStatusHistory{OrderID: order.ID, ToStatus: OrderPending}).Error; err != nil {
+		return Order{}, err
+	}
+	// 只删除本次结算的购物车项，结算期间新加入的商品保留
+	if err := tx.Delete(&CartItem{}, cartItemIDs).Error; err != nil {
+		return Order{}, err
+	}
+	return order, nil
+}
+
+// handleCreateOrder 根据购物车创建订单，可在请求体中指定优惠券和收货地址 {"coupon":"CODE","address_id":1}
+func handleCreateOrder(c *gin.Context) {
+	var req struct {
+		Coupon    string `json:"coupon"`
+		AddressID uint   `json:"address_id"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	var order Order
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		order, err = checkout(tx, currentUserID(c), req.Coupon, req.AddressID)
+		return err
+	})
+
+	var stockErr *StockError
+	var couponErr *CouponError
+	switch {
+	case errors.Is(err, errEmptyCart), errors.Is(err, errNoAddress), errors.As(err, &couponErr):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errors.As(err, &stockErr):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "product_id": stockErr.ProductID, "variant_id": stockErr.VariantID})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	db.Preload("Items.Product").Preload("Promotions").First(&order, order.ID)
+	c.JSON(http.StatusCreated, gin.H{"data": order})
+}
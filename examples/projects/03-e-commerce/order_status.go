@@ -0,0 +1,273 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// 订单状态
+const (
+	OrderPending   = "pending"   // 待支付
+	OrderPaid      = "paid"      // 已支付
+	OrderShipped   = "shipped"   // 已发货
+	OrderCompleted = "completed" // 已完成
+	OrderCancelled = "cancelled" // 已取消（未支付）
+	OrderRefunded  = "refunded"  // 已退款（发货前退款，或完成后全部退货）
+
+	OrderPartiallyRefunded = "partially_refunded" // 部分退货已退款
+)
+
+// orderTransitions 订单状态机：当前状态 -> 允许转换到的状态
+//
+//	pending ──> paid ──> shipped ──> completed ──> partially_refunded
+//	   │          │                      │                 │
+//	   v          v                      v                 │
+//	cancelled  refunded <────────────────┴─────────────────┘
+//
+// completed 之后的退款只能通过退货申请（见 returns.go）产生
+var orderTransitions = map[string][]string{
+	OrderPending:           {OrderPaid, OrderCancelled},
+	OrderPaid:              {OrderShipped, OrderRefunded},
+	OrderShipped:           {OrderCompleted},
+	OrderCompleted:         {OrderPartiallyRefunded, OrderRefunded},
+	OrderPartiallyRefunded: {OrderRefunded},
+}
+
+// returnOnlyStatuses 这些状态的订单只能通过退货审批变更状态
+var returnOnlyStatuses = map[string]bool{
+	OrderCompleted:         true,
+	OrderPartiallyRefunded: true,
+}
+
+// systemStatuses 这些状态只能由系统设置：paid 只能由支付回调设置，不能手动修改
+var systemStatuses = map[string]bool{
+	OrderPaid: true,
+}
+
+// restockStatuses 从未发货状态转换到这些状态时需要归还全部库存，值为库存流水的备注；
+// 发货后的退货按退货项单独入库
+var restockStatuses = map[string]string{
+	OrderCancelled: "订单取消",
+	OrderRefunded:  "订单退款",
+}
+
+var errOrderNotFound = errors.New("订单不存在")
+
+// TransitionError 非法的状态转换
+type TransitionError struct {
+	From, To string
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("订单状态不能从 %s 变更为 %s", e.From, e.To)
+}
+
+// OrderStatusHistory 订单状态变更记录
+type OrderStatusHistory struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	OrderID    uint      `json:"order_id" gorm:"index"`
+	FromStatus string    `json:"from_status"` // 创建订单时为空
+	ToStatus   string    `json:"to_status"`
+	Note       string    `json:"note,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// validOrderStatus 判断状态是否存在
+func validOrderStatus(status string) bool {
+	switch status {
+	case OrderPending, OrderPaid, OrderShipped, OrderCompleted, OrderCancelled, OrderRefunded, OrderPartiallyRefunded:
+		return true
+	}
+	return false
+}
+
+// canTransition 判断状态转换是否合法
+func canTransition(from, to string) bool {
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// nextStatuses 当前状态允许手动转换到的状态，终态和只能走退货的状态返回空切片
+func nextStatuses(status string) []string {
+	next := []string{}
+	if returnOnlyStatuses[status] {
+		return next
+	}
+	for _, to := range orderTransitions[status] {
+		if !systemStatuses[to] {
+			next = append(next, to)
+		}
+	}
+	return next
+}
+
+// transitionOrder 在事务中变更订单状态并记录历史
+// 使用 UPDATE ... WHERE status = ? 做乐观并发控制，状态已被其他请求修改时同样返回 TransitionError；
+// 取消或退款时按订单项归还库存并记录流水、归还优惠券次数，取消时同时关闭未完成的支付单；
+// 发货前退款记录一笔整单退款，由调用方在事务提交后调用 processRefunds 向支付渠道退款；actorID 为 0 表示系统操作
+func transitionOrder(tx *gorm.DB, orderID uint, to, note string, actorID uint) (Order, error) {
+	var order Order
+	if err := tx.Preload("Items").First(&order, orderID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return order, errOrderNotFound
+		}
+		return order, err
+	}
+	from := order.Status
+	if !canTransition(from, to) {
+		return order, &TransitionError{From: from, To: to}
+	}
+
+	result := tx.Model(&Order{}).Where("id = ? AND status = ?", order.ID, from).Update("status", to)
+	if result.Error != nil {
+		return order, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return order, &TransitionError{From: from, To: to}
+	}
+	order.Status = to
+
+	if restockNote, ok := restockStatuses[to]; ok && (from == OrderPending || from == OrderPaid) {
+		for _, item := range order.Items {
+			_, err := adjustStock(tx, stockChange{
+				ProductID: item.ProductID,
+				VariantID: item.VariantID,
+				Delta:     item.Quantity,
+				Reason:    ReasonCancellation,
+				Note:      restockNote,
+				ActorID:   actorID,
+				OrderID:   &order.ID,
+			})
+			if err != nil {
+				return order, err
+			}
+		}
+	}
+
+	if to == OrderCancelled {
+		if err := cancelPaymentIntent(tx, order.ID); err != nil {
+			return order, err
+		}
+	}
+	if to == OrderCancelled || to == OrderRefunded {
+		if err := releaseCoupons(tx, order.ID); err != nil {
+			return order, err
+		}
+	}
+	if from == OrderPaid && to == OrderRefunded {
+		if err := recordFullRefund(tx, order); err != nil {
+			return order, err
+		}
+	}
+
+	history := OrderStatusHistory{OrderID: order.ID, FromStatus: from, ToStatus: to, Note: note}
+	return order, tx.Create(&history).Error
+}
+
+// handleUpdateOrderStatus 管理员更新订单状态，非法转换返回 409；发货前退款在状态更新提交后原路退回
+func handleUpdateOrderStatus(c *gin.Context) {
+	var req struct {
+		Status string `json:"status" binding:"required"`
+		Note   string `json:"note"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !validOrderStatus(req.Status) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "未知的订单状态: " + req.Status})
+		return
+	}
+
+	var order Order
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// 完成后的退款需要逐项入库和计算退款金额，只能走退货审批；支付状态只能由支付回调设置
+		var current Order
+		if err := tx.Select("id", "status").First(&current, parseID(c)).Error; err == nil &&
+			(returnOnlyStatuses[current.Status] || systemStatuses[req.Status]) {
+			return &TransitionError{From: current.Status, To: req.Status}
+		}
+		var err error
+		order, err = transitionOrder(tx, parseID(c), req.Status, req.Note, currentUserID(c))
+		return err
+	})
+
+	var transitionErr *TransitionError
+	switch {
+	case errors.Is(err, errOrderNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case errors.As(err, &transitionErr):
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   err.Error(),
+			"status":  transitionErr.From,
+			"allowed": nextStatuses(transitionErr.From),
+		})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// 渠道退款失败时退款保持 pending，由 runRefundProcessor 重试，状态变更不受影响
+	processRefunds(c.Request.Context(), order.ID)
+	db.Preload("Items.Product").Preload("History", orderHistoryOrder).Preload("Refunds").First(&order, order.ID)
+	c.JSON(http.StatusOK, gin.H{"message": "状态已更新", "data": order, "allowed": nextStatuses(order.Status)})
+}
+
+// handleCancelOrder 顾客取消自己的待支付订单，归还库存并关闭支付单
+func handleCancelOrder(c *gin.Context) {
+	var order Order
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Select("id").Where("id = ? AND user_id = ?", parseID(c), currentUserID(c)).First(&order).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errOrderNotFound
+			}
+			return err
+		}
+		var err error
+		order, err = transitionOrder(tx, order.ID, OrderCancelled, "顾客取消", currentUserID(c))
+		return err
+	})
+
+	var transitionErr *TransitionError
+	switch {
+	case errors.Is(err, errOrderNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case errors.As(err, &transitionErr):
+		c.JSON(http.StatusConflict, gin.H{"error": "订单状态为 " + transitionErr.From + "，不能取消", "status": transitionErr.From})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	db.Preload("Items.Product").Preload("History", orderHistoryOrder).First(&order, order.ID)
+	c.JSON(http.StatusOK, gin.H{"message": "订单已取消", "data": order})
+}
+
+// handleGetOrderHistory 获取订单状态变更记录
+func handleGetOrderHistory(c *gin.Context) {
+	var order Order
+	err := db.Preload("History", orderHistoryOrder).Where("user_id = ?", currentUserID(c)).First(&order, parseID(c)).Error
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "订单不存在"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": order.History, "status": order.Status, "allowed": nextStatuses(order.Status)})
+}
+
+// orderHistoryOrder 状态记录按时间先后排列
+func orderHistoryOrder(tx *gorm.DB) *gorm.DB {
+	return tx.Order("order_status_histories.id ASC")
+}
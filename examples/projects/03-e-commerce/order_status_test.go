@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// fakeProvider 记录退款的支付渠道，fail 不为空时退款失败
+type fakeProvider struct {
+	mu      sync.Mutex
+	refunds []string // 退款 key
+	fail    error
+}
+
+func (p *fakeProvider) Name() string { return "fake" }
+
+func (p *fakeProvider) CreateIntent(ctx context.Context, intent *PaymentIntent) error {
+	intent.ProviderRef = "pi_" + randomHex(8)
+	return nil
+}
+
+func (p *fakeProvider) Confirm(ctx context.Context, intent *PaymentIntent, scenario string) error {
+	return nil
+}
+
+func (p *fakeProvider) Refund(ctx context.Context, intent *PaymentIntent, amount Money, key string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fail != nil {
+		return p.fail
+	}
+	p.refunds = append(p.refunds, key)
+	return nil
+}
+
+// createAdmin 创建管理员，返回用户 ID 和登录令牌
+func createAdmin(t *testing.T, n int) (uint, string) {
+	t.Helper()
+	userID, token := createBuyer(t, n)
+	db.Model(&User{}).Where("id = ?", userID).Update("role", RoleAdmin)
+	return userID, token
+}
+
+func sendJSON(r *gin.Engine, method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// createPaidOrder 创建已通过在线支付的订单
+func createPaidOrder(userID uint) Order {
+	order := Order{UserID: userID, Status: OrderPaid, Subtotal: cny(900), Discount: cny(0), Shipping: cny(0),
+		Tax: cny(100), TotalPrice: cny(1000), RefundedAmount: cny(0)}
+	db.Create(&order)
+	db.Create(&PaymentIntent{OrderID: order.ID, Provider: "fake", ProviderRef: "pi_" + randomHex(8),
+		Amount: order.TotalPrice, Status: PaymentSucceeded})
+	return order
+}
+
+func TestManualStatusChanges(t *testing.T) {
+	r := setupOrderTest(t)
+	provider := &fakeProvider{}
+	payments = provider
+	buyerID, buyer := createBuyer(t, 1)
+	_, stranger := createBuyer(t, 2)
+	_, admin := createAdmin(t, 3)
+	pending := Order{UserID: buyerID, Status: OrderPending, TotalPrice: cny(1000)}
+	db.Create(&pending)
+	path := fmt.Sprintf("/api/admin/orders/%d/status", pending.ID)
+
+	// 顾客不能修改订单状态，管理员也不能手动标记为已支付
+	if w := sendJSON(r, http.MethodPatch, path, buyer, `{"status":"cancelled"}`); w.Code != http.StatusForbidden {
+		t.Errorf("顾客修改状态: %d; 期望 403", w.Code)
+	}
+	w := sendJSON(r, http.MethodPatch, path, admin, `{"status":"paid"}`)
+	var conflict struct{ Allowed []string }
+	json.Unmarshal(w.Body.Bytes(), &conflict)
+	if w.Code != http.StatusConflict || len(conflict.Allowed) != 1 || conflict.Allowed[0] != OrderCancelled {
+		t.Errorf("手动标记已支付: %d %s; 期望 409 且 allowed 只有 cancelled", w.Code, w.Body)
+	}
+
+	// 顾客只能取消自己的待支付订单
+	cancel := fmt.Sprintf("/api/orders/%d/cancel", pending.ID)
+	if w := sendJSON(r, http.MethodPost, cancel, stranger, ""); w.Code != http.StatusNotFound {
+		t.Errorf("取消他人订单: %d; 期望 404", w.Code)
+	}
+	if w := sendJSON(r, http.MethodPost, cancel, buyer, ""); w.Code != http.StatusOK {
+		t.Fatalf("取消订单: %d %s", w.Code, w.Body)
+	}
+	if w := sendJSON(r, http.MethodPost, cancel, buyer, ""); w.Code != http.StatusConflict {
+		t.Errorf("重复取消: %d; 期望 409", w.Code)
+	}
+
+	// 发货前退款在状态提交后原路退回，全额退款后支付单变为 refunded
+	paid := createPaidOrder(buyerID)
+	path = fmt.Sprintf("/api/admin/orders/%d/status", paid.ID)
+	if w := sendJSON(r, http.MethodPatch, path, admin, `{"status":"refunded"}`); w.Code != http.StatusOK {
+		t.Fatalf("退款: %d %s", w.Code, w.Body)
+	}
+	var refund Refund
+	db.Where("order_id = ?", paid.ID).First(&refund)
+	var intent PaymentIntent
+	db.Where("order_id = ?", paid.ID).First(&intent)
+	if refund.Status != RefundSucceeded || refund.Amount.Amount != 1000 || intent.Status != PaymentRefunded {
+		t.Errorf("退款 %s %v、支付单 %s; 期望 succeeded 10.00 和 refunded", refund.Status, refund.Amount, intent.Status)
+	}
+	db.First(&paid, paid.ID)
+	if paid.RefundedAmount.Amount != paid.TotalPrice.Amount {
+		t.Errorf("订单已退款金额 %v; 期望为订单总额 %v", paid.RefundedAmount, paid.TotalPrice)
+	}
+	if len(provider.refunds) != 1 || provider.refunds[0] != fmt.Sprintf("refund_%d", refund.ID) {
+		t.Errorf("渠道退款 %v; 期望一笔 refund_%d", provider.refunds, refund.ID)
+	}
+
+	// 渠道退款失败不影响状态变更，退款保持 pending 等待重试
+	provider.fail = errors.New("渠道不可用")
+	failed := createPaidOrder(buyerID)
+	path = fmt.Sprintf("/api/admin/orders/%d/status", failed.ID)
+	if w := sendJSON(r, http.MethodPatch, path, admin, `{"status":"refunded"}`); w.Code != http.StatusOK {
+		t.Fatalf("退款: %d %s", w.Code, w.Body)
+	}
+	refund = Refund{}
+	db.Where("order_id = ?", failed.ID).First(&refund)
+	if refund.Status != RefundPending || refund.FailureReason == "" {
+		t.Errorf("渠道失败后退款 %s (%q); 期望 pending 并记录原因", refund.Status, refund.FailureReason)
+	}
+	provider.fail = nil
+	if err := processRefunds(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	db.First(&refund, refund.ID)
+	intent = PaymentIntent{}
+	db.Where("order_id = ?", failed.ID).First(&intent)
+	if refund.Status != RefundSucceeded || intent.Status != PaymentRefunded || len(provider.refunds) != 2 {
+		t.Errorf("重试后退款 %s、支付单 %s、渠道退款 %d 笔; 期望 succeeded、refunded、2 笔",
+			refund.Status, intent.Status, len(provider.refunds))
+	}
+}
+
+func TestOrderTransitions(t *testing.T) {
+	r := setupOrderTest(t)
+	payments = &fakeProvider{}
+	buyerID, _ := createBuyer(t, 1)
+	_, admin := createAdmin(t, 2)
+
+	tests := []struct {
+		from, to string
+		code     int
+		allowed  []string // 409 时返回的下一步
+		restock  int      // 归还的库存
+	}{
+		{OrderPending, OrderCancelled, http.StatusOK, nil, 2},
+		{OrderPending, OrderShipped, http.StatusConflict, []string{OrderCancelled}, 0},
+		{OrderPaid, OrderShipped, http.StatusOK, nil, 0},
+		{OrderPaid, OrderRefunded, http.StatusOK, nil, 2},
+		{OrderPaid, OrderCancelled, http.StatusConflict, []string{OrderShipped, OrderRefunded}, 0},
+		{OrderShipped, OrderCompleted, http.StatusOK, nil, 0},
+		{OrderShipped, OrderRefunded, http.StatusConflict, []string{OrderCompleted}, 0},
+		{OrderCompleted, OrderRefunded, http.StatusConflict, []string{}, 0}, // 只能走退货
+		{OrderCancelled, OrderPending, http.StatusConflict, []string{}, 0},
+		{OrderRefunded, OrderShipped, http.StatusConflict, []string{}, 0},
+	}
+	for _, tt := range tests {
+		product := Product{Name: "商品", Price: cny(500)}
+		db.Create(&product)
+		order, _ := createOrderWithIntent(buyerID, tt.from, PaymentSucceeded)
+		db.Create(&OrderItem{OrderID: order.ID, ProductID: product.ID, Quantity: 2, Price: cny(500), Total: cny(1000)})
+
+		w := sendJSON(r, http.MethodPatch, fmt.Sprintf("/api/admin/orders/%d/status", order.ID), admin,
+			`{"status":"`+tt.to+`","note":"测试"}`)
+		name := tt.from + " -> " + tt.to
+		if w.Code != tt.code {
+			t.Errorf("%s: %d %s; 期望 %d", name, w.Code, w.Body, tt.code)
+			continue
+		}
+
+		var history []OrderStatusHistory
+		db.Where("order_id = ?", order.ID).Find(&history)
+		db.First(&order, order.ID)
+		db.First(&product, product.ID)
+		if product.Stock != tt.restock {
+			t.Errorf("%s: 库存 = %d; 期望 %d", name, product.Stock, tt.restock)
+		}
+		if tt.code == http.StatusOK {
+			if order.Status != tt.to || len(history) != 1 || history[0].FromStatus != tt.from ||
+				history[0].ToStatus != tt.to || history[0].Note != "测试" {
+				t.Errorf("%s: 订单 %s、历史 %+v; 期望一条 %s -> %s 的记录", name, order.Status, history, tt.from, tt.to)
+			}
+			continue
+		}
+		var resp struct {
+			Status  string
+			Allowed []string
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if resp.Status != tt.from || fmt.Sprint(resp.Allowed) != fmt.Sprint(tt.allowed) || resp.Allowed == nil {
+			t.Errorf("%s: 返回 status=%s allowed=%v; 期望 %s %v", name, resp.Status, resp.Allowed, tt.from, tt.allowed)
+		}
+		if order.Status != tt.from || len(history) != 0 {
+			t.Errorf("%s: 非法转换后订单 %s、历史 %d 条; 期望不变", name, order.Status, len(history))
+		}
+	}
+}
+
+// 读取订单后、条件更新前状态被其他请求修改时，transitionOrder 不能覆盖新状态
+func TestTransitionOrderOptimisticGuard(t *testing.T) {
+	setupOrderTest(t)
+	buyerID, _ := createBuyer(t, 1)
+	product := Product{Name: "商品", Price: cny(500)}
+	db.Create(&product)
+	order := Order{UserID: buyerID, Status: OrderPending, TotalPrice: cny(1000),
+		Items: []OrderItem{{ProductID: product.ID, Quantity: 2, Price: cny(500), Total: cny(1000)}}}
+	db.Create(&order)
+
+	// 在 transitionOrder 读取订单之后、条件更新之前，模拟支付回调抢先把订单改为 paid
+	raced := false
+	db.Callback().Query().After("gorm:query").Register("test:race", func(tx *gorm.DB) {
+		if tx.Statement.Table == "orders" && !raced {
+			raced = true
+			tx.Session(&gorm.Session{NewDB: true}).Exec("UPDATE orders SET status = ? WHERE id = ?", OrderPaid, order.ID)
+		}
+	})
+	err := db.Transaction(func(tx *gorm.DB) error {
+		_, err := transitionOrder(tx, order.ID, OrderCancelled, "", 0)
+		return err
+	})
+	db.Callback().Query().Remove("test:race")
+
+	var transitionErr *TransitionError
+	if !errors.As(err, &transitionErr) || transitionErr.From != OrderPending {
+		t.Fatalf("err = %v; 期望 pending -> cancelled 的 TransitionError", err)
+	}
+	// 模拟的修改与 transitionOrder 在同一事务中，随失败一起回滚；取消的副作用不能留下
+	var history int64
+	db.Model(&OrderStatusHistory{}).Where("order_id = ?", order.ID).Count(&history)
+	db.First(&product, product.ID)
+	if history != 0 || product.Stock != 0 {
+		t.Errorf("历史 %d 条、库存 %d; 期望 0、0", history, product.Stock)
+	}
+}
+
+func TestCancelAndRefundReleaseCoupons(t *testing.T) {
+	r := setupOrderTest(t)
+	payments = &fakeProvider{}
+	buyerID, buyer := createBuyer(t, 1)
+	_, admin := createAdmin(t, 2)
+	coupon := Coupon{Code: "ONCE", Type: CouponFixed, AmountOff: cny(100), MinSubtotal: cny(0), UsageLimit: 3, UsedCount: 3, Active: true}
+	other := Coupon{Code: "OTHER", Type: CouponFixed, AmountOff: cny(100), MinSubtotal: cny(0), UsedCount: 1, Active: true}
+	db.Create(&coupon)
+	db.Create(&other)
+
+	pending, _ := createOrderWithIntent(buyerID, OrderPending, PaymentRequiresPayment)
+	paid := createPaidOrder(buyerID)
+	shipped, _ := createOrderWithIntent(buyerID, OrderShipped, PaymentSucceeded)
+	for _, order := range []Order{pending, paid, shipped} {
+		db.Create(&OrderPromotion{OrderID: order.ID, Source: "coupon", CouponID: &coupon.ID, Code: coupon.Code, Amount: cny(100)})
+	}
+
+	if w := sendJSON(r, http.MethodPost, fmt.Sprintf("/api/orders/%d/cancel", pending.ID), buyer, ""); w.Code != http.StatusOK {
+		t.Fatalf("取消: %d %s", w.Code, w.Body)
+	}
+	path := fmt.Sprintf("/api/admin/orders/%d/status", paid.ID)
+	if w := sendJSON(r, http.MethodPatch, path, admin, `{"status":"refunded"}`); w.Code != http.StatusOK {
+		t.Fatalf("退款: %d %s", w.Code, w.Body)
+	}
+	path = fmt.Sprintf("/api/admin/orders/%d/status", shipped.ID)
+	if w := sendJSON(r, http.MethodPatch, path, admin, `{"status":"completed"}`); w.Code != http.StatusOK {
+		t.Fatalf("完成: %d %s", w.Code, w.Body)
+	}
+
+	db.First(&coupon, coupon.ID)
+	db.First(&other, other.ID)
+	if coupon.UsedCount != 1 || other.UsedCount != 1 {
+		t.Errorf("used_count = %d, %d; 期望取消和退款各归还一次为 1，其他优惠券不变为 1", coupon.UsedCount, other.UsedCount)
+	}
+}
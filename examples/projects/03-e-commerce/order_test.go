@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setupOrderTest 使用临时文件数据库（内存数据库的共享缓存不支持并发写事务排队）
+func setupOrderTest(t *testing.T) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	db = initDatabase(filepath.Join(t.TempDir(), "test.db"))
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return setupRouter()
+}
+
+// createBuyer 创建带默认收货地址的用户，返回用户 ID 和登录令牌
+func createBuyer(t *testing.T, n int) (uint, string) {
+	t.Helper()
+	user := User{Email: "buyer" + strconv.Itoa(n) + "@example.com", PasswordHash: "-"}
+	db.Create(&user)
+	db.Create(&Address{UserID: user.ID, IsDefault: true, ShippingInfo: ShippingInfo{
+		Recipient: "买家", Phone: "13800000000", Country: "CN", City: "上海", Line1: "测试路 1 号",
+	}})
+	token, _, err := generateToken(user.ID, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user.ID, token
+}
+
+func postOrder(r *gin.Engine, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/api/orders", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestConcurrentCheckoutDoesNotOversell(t *testing.T) {
+	r := setupOrderTest(t)
+
+	const stock, buyers = 10, 50
+	product := Product{Name: "限量商品", Price: NewMoney(990, "CNY"), Stock: stock}
+	db.Create(&product)
+	tokens := make([]string, buyers)
+	for i := range tokens {
+		var userID uint
+		userID, tokens[i] = createBuyer(t, i)
+		db.Create(&CartItem{UserID: userID, ProductID: product.ID, Quantity: 1})
+	}
+
+	var wg sync.WaitGroup
+	codes := make([]int, buyers)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = postOrder(r, tokens[i]).Code
+		}(i)
+	}
+	wg.Wait()
+
+	created, conflicts := 0, 0
+	for _, code := range codes {
+		switch code {
+		case http.StatusCreated:
+			created++
+		case http.StatusConflict:
+			conflicts++
+		default:
+			t.Errorf("意外的状态码 %d", code)
+		}
+	}
+	if created != stock || conflicts != buyers-stock {
+		t.Errorf("成功 %d 单、库存不足 %d 单; 期望 %d 和 %d", created, conflicts, stock, buyers-stock)
+	}
+
+	db.First(&product, product.ID)
+	if product.Stock != 0 {
+		t.Errorf("剩余库存 = %d; 期望 0", product.Stock)
+	}
+	var sold int64
+	db.Model(&OrderItem{}).Select("COALESCE(SUM(quantity), 0)").Where("product_id = ?", product.ID).Scan(&sold)
+	if sold != stock {
+		t.Errorf("订单中售出 %d 件; 期望 %d", sold, stock)
+	}
+	var sales, ledgerTotal int64
+	db.Model(&InventoryEntry{}).Where("product_id = ? AND reason = ?", product.ID, ReasonSale).Count(&sales)
+	db.Model(&InventoryEntry{}).Select("COALESCE(SUM(delta), 0)").Where("product_id = ?", product.ID).Scan(&ledgerTotal)
+	if sales != stock || ledgerTotal != -stock {
+		t.Errorf("销售流水 %d 条、合计 %d; 期望 %d 条、合计 %d", sales, ledgerTotal, stock, -stock)
+	}
+	var remaining int64
+	db.Model(&CartItem{}).Count(&remaining)
+	if remaining != buyers-stock {
+		t.Errorf("剩余购物车项 = %d; 期望 %d（失败的下单不应清空购物车）", remaining, buyers-stock)
+	}
+}
+
+func TestCheckoutRollsBackOnShortfall(t *testing.T) {
+	r := setupOrderTest(t)
+
+	plenty := Product{Name: "充足商品", Price: NewMoney(100, "CNY"), Stock: 5}
+	scarce := Product{Name: "紧缺商品", Price: NewMoney(200, "CNY"), Stock: 1}
+	db.Create(&plenty)
+	db.Create(&scarce)
+	userID, token := createBuyer(t, 1)
+	db.Create(&CartItem{UserID: userID, ProductID: plenty.ID, Quantity: 2})
+	db.Create(&CartItem{UserID: userID, ProductID: scarce.ID, Quantity: 3})
+
+	if w := postOrder(r, token); w.Code != http.StatusConflict {
+		t.Fatalf("状态码 = %d; 期望 409, body = %s", w.Code, w.Body.String())
+	}
+
+	db.First(&plenty, plenty.ID)
+	db.First(&scarce, scarce.ID)
+	if plenty.Stock != 5 || scarce.Stock != 1 {
+		t.Errorf("库存 = %d, %d; 期望回滚为 5, 1", plenty.Stock, scarce.Stock)
+	}
+	var orders, cartItems int64
+	db.Model(&Order{}).Count(&orders)
+	db.Model(&CartItem{}).Count(&cartItems)
+	if orders != 0 || cartItems != 2 {
+		t.Errorf("订单数 = %d, 购物车项 = %d; 期望 0 和 2", orders, cartItems)
+	}
+}
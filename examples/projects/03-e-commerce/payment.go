@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	webhookSecret  = flag.String("webhook-secret", "", "支付回调签名密钥，不设置时每次启动随机生成（仅适用于模拟渠道）")
+	webhookURL     = flag.String("webhook-url", "", "模拟支付渠道的回调地址，缺省为本服务的 /api/payments/webhook")
+	paymentDelay   = flag.Duration("payment-delay", 5*time.Second, "模拟渠道 delayed 场景的确认延迟")
+	unpaidTimeout  = flag.Duration("unpaid-timeout", 30*time.Minute, "未支付订单的自动取消时间")
+	cancelInterval = flag.Duration("cancel-interval", time.Minute, "扫描超时未支付订单的间隔")
+)
+
+// insecureWebhookSecret 旧版本的默认回调密钥，已随代码公开，任何人都能用它伪造支付成功回调
+const insecureWebhookSecret = "whsec_dev"
+
+// ensureWebhookSecret 启动时检查回调密钥：使用公开的旧默认值时拒绝启动；
+// 未设置时生成随机密钥，只有本进程内的模拟渠道知道，接入真实渠道时需设置为渠道提供的密钥
+func ensureWebhookSecret() error {
+	switch *webhookSecret {
+	case insecureWebhookSecret:
+		return errors.New("-webhook-secret 不能使用公开的默认值 " + insecureWebhookSecret)
+	case "":
+		*webhookSecret = randomHex(32)
+		log.Println("警告: 未设置 -webhook-secret，使用随机生成的密钥，只能接收模拟渠道的回调")
+	}
+	return nil
+}
+
+// 支付单状态
+const (
+	PaymentRequiresPayment = "requires_payment" // 已创建，等待用户支付
+	PaymentProcessing      = "processing"       // 用户已提交，等待渠道回调
+	PaymentSucceeded       = "succeeded"
+	PaymentFailed          = "failed" // 可重新发起支付
+	PaymentCancelled       = "cancelled"
+	PaymentRefunded        = "refunded" // 已全额原路退回
+)
+
+// 支付回调事件类型
+const (
+	EventPaymentSucceeded = "payment.succeeded"
+	EventPaymentFailed    = "payment.failed"
+)
+
+// PaymentProvider 支付渠道
+// CreateIntent 在渠道侧创建支付单并填写 ProviderRef；Confirm 提交支付，结果通过 webhook 异步通知；
+// Refund 原路退回 amount，可多次部分退款，渠道按 key 去重，同一 key 重试不会重复退款
+type PaymentProvider interface {
+	Name() string
+	CreateIntent(ctx context.Context, intent *PaymentIntent) error
+	Confirm(ctx context.Context, intent *PaymentIntent, scenario string) error
+	Refund(ctx context.Context, intent *PaymentIntent, amount Money, key string) error
+}
+
+// payments 当前使用的支付渠道，启动时设置
+var payments PaymentProvider
+
+// PaymentIntent 支付单，每个订单一张，支付失败后可在同一张支付单上重试
+type PaymentIntent struct {
+	ID            uint      `json:"id" gorm:"primaryKey"`
+	OrderID       uint      `json:"order_id" gorm:"uniqueIndex"`
+	Provider      string    `json:"provider"`
+	ProviderRef   string    `json:"provider_ref" gorm:"uniqueIndex"` // 渠道侧支付单号
+	Amount        Money     `json:"amount" gorm:"embedded;embeddedPrefix:amount_"`
+	Status        string    `json:"status" gorm:"index"`
+	FailureReason string    `json:"failure_reason,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// PaymentEvent 渠道回调的事件内容
+type PaymentEvent struct {
+	ID            string `json:"id"`
+	Type          string `json:"type"`
+	Created       int64  `json:"created"`
+	Intent        string `json:"intent"` // 渠道侧支付单号
+	Amount        int64  `json:"amount"`
+	Currency      string `json:"currency"`
+	FailureReason string `json:"failure_reason,omitempty"`
+}
+
+// ProcessedWebhook 已处理的回调事件，事件 ID 唯一，渠道重复投递时直接忽略
+type ProcessedWebhook struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	EventID    string    `json:"event_id" gorm:"uniqueIndex;not null"`
+	Type       string    `json:"type"`
+	Intent     string    `json:"intent"`
+	ReceivedAt time.Time `json:"received_at" gorm:"autoCreateTime"`
+}
+
+var errDuplicateEvent = errors.New("事件已处理")
+
+// defaultWebhookURL 根据监听地址推导本服务的回调地址
+func defaultWebhookURL(listen string) string {
+	if len(listen) > 0 && listen[0] == ':' {
+		listen = "127.0.0.1" + listen
+	}
+	return "http://" + listen + "/api/payments/webhook"
+}
+
+// handleCreatePayment 为待支付订单创建支付单，重复调用返回同一张支付单
+func handleCreatePayment(c *gin.Context) {
+	var intent PaymentIntent
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var order Order
+		if err := tx.Where("id = ? AND user_id = ?", parseID(c), currentUserID(c)).First(&order).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errOrderNotFound
+			}
+			return err
+		}
+		err := tx.Where("order_id = ?", order.ID).First(&intent).Error
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if order.Status != OrderPending {
+			return &TransitionError{From: order.Status, To: OrderPaid}
+		}
+		intent = PaymentIntent{
+			OrderID:  order.ID,
+			Provider: payments.Name(),
+			Amount:   order.TotalPrice,
+			Status:   PaymentRequiresPayment,
+		}
+		if err := payments.CreateIntent(c.Request.Context(), &intent); err != nil {
+			return err
+		}
+		return tx.Create(&intent).Error
+	})
+	if err != nil {
+		respondPaymentError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": intent})
+}
+
+// handleConfirmPayment 提交支付，scenario 选择模拟渠道的结果：success、decline 或 delayed
+func handleConfirmPayment(c *gin.Context) {
+	var req struct {
+		Scenario string `json:"scenario"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if req.Scenario == "" {
+		req.Scenario = ScenarioSuccess
+	}
+
+	var intent PaymentIntent
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var order Order
+		if err := tx.Where("id = ? AND user_id = ?", parseID(c), currentUserID(c)).First(&order).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errOrderNotFound
+			}
+			return err
+		}
+		if order.Status != OrderPending {
+			return &TransitionError{From: order.Status, To: OrderPaid}
+		}
+		if err := tx.Where("order_id = ?", order.ID).First(&intent).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errPaymentNotFound
+			}
+			return err
+		}
+		// 条件更新防止同一张支付单被重复提交
+		result := tx.Model(&PaymentIntent{}).
+			Where("id = ? AND status IN ?", intent.ID, []string{PaymentRequiresPayment, PaymentFailed}).
+			Updates(map[string]interface{}{"status": PaymentProcessing, "failure_reason": ""})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return &PaymentStateError{Status: intent.Status}
+		}
+		intent.Status, intent.FailureReason = PaymentProcessing, ""
+		return nil
+	})
+	if err != nil {
+		respondPaymentError(c, err)
+		return
+	}
+	// 渠道在事务提交后调用，回调到达时支付单一定已是 processing；渠道拒绝时支付单变为 failed，可重新提交
+	if err := payments.Confirm(c.Request.Context(), &intent, req.Scenario); err != nil {
+		db.Model(&PaymentIntent{}).Where("id = ? AND status = ?", intent.ID, PaymentProcessing).
+			Updates(map[string]interface{}{"status": PaymentFailed, "failure_reason": err.Error()})
+		respondPaymentError(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "支付处理中，结果以回调为准", "data": intent})
+}
+
+// handleGetPayment 查看订单的支付单
+func handleGetPayment(c *gin.Context) {
+	var intent PaymentIntent
+	err := db.Joins("JOIN orders ON orders.id = payment_intents.order_id").
+		Where("payment_intents.order_id = ? AND orders.user_id = ?", parseID(c), currentUserID(c)).
+		First(&intent).Error
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": errPaymentNotFound.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": intent})
+}
+
+var errPaymentNotFound = errors.New("支付单不存在，请先创建")
+
+// PaymentStateError 支付单当前状态不允许该操作
+type PaymentStateError struct {
+	Status string
+}
+
+func (e *PaymentStateError) Error() string {
+	return "支付单状态为 " + e.Status + "，不能重复提交"
+}
+
+// respondPaymentError 将支付相关错误映射为 HTTP 状态码
+func respondPaymentError(c *gin.Context, err error) {
+	var transitionErr *TransitionError
+	var stateErr *PaymentStateError
+	switch {
+	case errors.Is(err, errOrderNotFound), errors.Is(err, errPaymentNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.As(err, &transitionErr):
+		c.JSON(http.StatusConflict, gin.H{"error": "订单状态为 " + transitionErr.From + "，不能支付", "status": transitionErr.From})
+	case errors.As(err, &stateErr):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "status": stateErr.Status})
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+// handlePaymentWebhook 接收支付渠道回调
+// 先校验签名，再按事件 ID 去重；重复投递返回 200，渠道据此停止重试
+func handlePaymentWebhook(c *gin.Context) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := verifySignature(*webhookSecret, c.GetHeader(signatureHeader), body, time.Now()); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	var event PaymentEvent
+	if err := json.Unmarshal(body, &event); err != nil || event.ID == "" || event.Intent == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的事件"})
+		return
+	}
+
+	var orderID uint
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		orderID, err = applyPaymentEvent(tx, event)
+		return err
+	})
+	switch {
+	case errors.Is(err, errDuplicateEvent):
+		c.JSON(http.StatusOK, gin.H{"message": "事件已处理", "duplicate": true})
+	case errors.Is(err, errPaymentNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case err != nil:
+		// 返回 5xx 让渠道稍后重试
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		// 订单已取消后才到账的支付在提交后原路退回，失败时由 runRefundProcessor 重试
+		processRefunds(c.Request.Context(), orderID)
+		c.JSON(http.StatusOK, gin.H{"message": "ok"})
+	}
+}
+
+// applyPaymentEvent 在事务中处理一个回调事件，返回支付单所属的订单
+// 事件记录与状态变更在同一事务中提交，处理失败时事件不会被标记为已处理
+func applyPaymentEvent(tx *gorm.DB, event PaymentEvent) (uint, error) {
+	record := ProcessedWebhook{EventID: event.ID, Type: event.Type, Intent: event.Intent}
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return 0, errDuplicateEvent
+	}
+
+	var intent PaymentIntent
+	if err := tx.Where("provider_ref = ?", event.Intent).First(&intent).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, errPaymentNotFound
+		}
+		return 0, err
+	}
+	if intent.Status == PaymentSucceeded || intent.Status == PaymentRefunded {
+		return intent.OrderID, nil
+	}
+
+	switch event.Type {
+	case EventPaymentSucceeded:
+		if event.Amount != intent.Amount.Amount || event.Currency != intent.Amount.Currency {
+			return 0, errors.New("回调金额与支付单不一致")
+		}
+		intent.Status, intent.FailureReason = PaymentSucceeded, ""
+		if err := tx.Save(&intent).Error; err != nil {
+			return 0, err
+		}
+		order, err := transitionOrder(tx, intent.OrderID, OrderPaid, "支付成功 "+intent.ProviderRef, 0)
+		var transitionErr *TransitionError
+		if errors.As(err, &transitionErr) {
+			// 订单已超时取消，钱已扣款则记录整单退款，提交后原路退回，支付单随之变为 refunded
+			log.Printf("订单 %d 状态为 %s，支付 %s 将原路退回", intent.OrderID, transitionErr.From, intent.ProviderRef)
+			return intent.OrderID, recordFullRefund(tx, order)
+		}
+		return intent.OrderID, err
+	case EventPaymentFailed:
+		if intent.Status == PaymentCancelled {
+			return intent.OrderID, nil
+		}
+		intent.Status, intent.FailureReason = PaymentFailed, event.FailureReason
+		return intent.OrderID, tx.Save(&intent).Error
+	}
+	// 未知事件只记录，不处理
+	return intent.OrderID, nil
+}
+
+// cancelPaymentIntent 订单取消时关闭尚未成功的支付单
+func cancelPaymentIntent(tx *gorm.DB, orderID uint) error {
+	return tx.Model(&PaymentIntent{}).
+		Where("order_id = ? AND status IN ?", orderID, []string{PaymentRequiresPayment, PaymentProcessing, PaymentFailed}).
+		Update("status", PaymentCancelled).Error
+}
+
+// recordRefund 在事务中写入退款记录
+// 订单有成功的在线支付时记为 pending，由 processRefunds 在事务提交后原路退回；否则为线下退款，直接记为 succeeded
+func recordRefund(tx *gorm.DB, refund *Refund) error {
+	refund.Provider, refund.ProviderRef, refund.Status = "manual", "", RefundSucceeded
+	var intent PaymentIntent
+	err := tx.Where("order_id = ? AND status = ?", refund.OrderID, PaymentSucceeded).First(&intent).Error
+	switch {
+	case err == nil:
+		refund.Provider, refund.ProviderRef, refund.Status = intent.Provider, intent.ProviderRef, RefundPending
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		return err
+	}
+	return tx.Create(refund).Error
+}
+
+// recordFullRefund 记录整单退款（含运费）并计入订单的已退款金额：发货前退款，或订单取消后才到账的支付
+func recordFullRefund(tx *gorm.DB, order Order) error {
+	refund := Refund{OrderID: order.ID, Merchandise: order.TotalPrice.Sub(order.Tax).Sub(order.Shipping),
+		Tax: order.Tax, Amount: order.TotalPrice}
+	if err := recordRefund(tx, &refund); err != nil {
+		return err
+	}
+	return tx.Model(&Order{}).Where("id = ?", order.ID).
+		UpdateColumn("refunded_amount", order.TotalPrice.Amount).Error
+}
+
+// refundMu 串行化渠道退款，请求中的即时处理与 runRefundProcessor 不会同时提交同一笔退款
+var refundMu sync.Mutex
+
+// processRefunds 向支付渠道提交 pending 的退款，orderID 为 0 时处理所有订单
+// 失败的退款保持 pending 并记录原因，由 runRefundProcessor 重试；退款 ID 作为渠道的去重 key
+func processRefunds(ctx context.Context, orderID uint) error {
+	refundMu.Lock()
+	defer refundMu.Unlock()
+
+	query := db.Where("status = ?", RefundPending)
+	if orderID != 0 {
+		query = query.Where("order_id = ?", orderID)
+	}
+	var refunds []Refund
+	if err := query.Order("id ASC").Find(&refunds).Error; err != nil {
+		return err
+	}
+	var firstErr error
+	for _, refund := range refunds {
+		if err := processRefund(ctx, refund); err != nil {
+			log.Printf("退款 %d 失败，稍后重试: %v", refund.ID, err)
+			db.Model(&refund).Update("failure_reason", err.Error())
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// processRefund 提交一笔退款，成功后标记退款记录；累计退款达到支付金额时支付单变为 refunded
+func processRefund(ctx context.Context, refund Refund) error {
+	var intent PaymentIntent
+	if err := db.Where("provider_ref = ?", refund.ProviderRef).First(&intent).Error; err != nil {
+		return err
+	}
+	if err := payments.Refund(ctx, &intent, refund.Amount, fmt.Sprintf("refund_%d", refund.ID)); err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&refund).Updates(map[string]interface{}{
+			"status": RefundSucceeded, "failure_reason": "", "processed_at": time.Now(),
+		}).Error
+		if err != nil {
+			return err
+		}
+		var refunded int64
+		err = tx.Model(&Refund{}).Select("COALESCE(SUM(amount_amount), 0)").
+			Where("provider_ref = ? AND status = ?", intent.ProviderRef, RefundSucceeded).Scan(&refunded).Error
+		if err != nil || refunded < intent.Amount.Amount {
+			return err
+		}
+		return tx.Model(&intent).Update("status", PaymentRefunded).Error
+	})
+}
+
+// runRefundProcessor 定期重试失败的退款，直到 ctx 结束
+func runRefundProcessor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			processRefunds(ctx, 0)
+		}
+	}
+}
+
+// cancelUnpaidOrders 取消创建时间早于 before 的待支付订单，返回取消的数量
+// 每个订单单独一个事务，transitionOrder 的条件更新保证不会与支付回调冲突
+func cancelUnpaidOrders(before time.Time) (int, error) {
+	var ids []uint
+	err := db.Model(&Order{}).Where("status = ? AND created_at < ?", OrderPending, before).Pluck("id", &ids).Error
+	if err != nil {
+		return 0, err
+	}
+	cancelled := 0
+	for _, id := range ids {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			_, err := transitionOrder(tx, id, OrderCancelled, "超时未支付，自动取消", 0)
+			return err
+		})
+		var transitionErr *TransitionError
+		switch {
+		case errors.As(err, &transitionErr):
+			// 扫描后已被支付或取消
+		case err != nil:
+			return cancelled, err
+		default:
+			cancelled++
+		}
+	}
+	return cancelled, nil
+}
+
+// runUnpaidCanceller 定期取消超时未支付的订单，直到 ctx 结束
+func runUnpaidCanceller(ctx context.Context, timeout, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := cancelUnpaidOrders(now.Add(-timeout))
+			if err != nil {
+				log.Println("取消超时订单失败:", err)
+			}
+			if n > 0 {
+				log.Printf("已取消 %d 个超时未支付订单", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 模拟支付场景
+const (
+	ScenarioSuccess = "success" // 立即支付成功
+	ScenarioDecline = "decline" // 银行卡被拒
+	ScenarioDelayed = "delayed" // 延迟确认，如银行转账
+)
+
+// webhookTolerance 签名时间戳允许的最大偏差，超出视为重放
+const webhookTolerance = 5 * time.Minute
+
+// SimulatedProvider 本地模拟的支付渠道
+// 确认支付后像真实渠道一样异步回调 webhook：请求体带 HMAC-SHA256 签名，非 2xx 响应会重试
+type SimulatedProvider struct {
+	WebhookURL string
+	Secret     string
+	Delay      time.Duration // delayed 场景的确认延迟
+	Client     *http.Client
+}
+
+// NewSimulatedProvider 创建模拟支付渠道
+func NewSimulatedProvider(webhookURL, secret string, delay time.Duration) *SimulatedProvider {
+	return &SimulatedProvider{
+		WebhookURL: webhookURL,
+		Secret:     secret,
+		Delay:      delay,
+		Client:     &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Name 渠道名称
+func (p *SimulatedProvider) Name() string {
+	return "simulated"
+}
+
+// CreateIntent 生成渠道侧的支付单号
+func (p *SimulatedProvider) CreateIntent(ctx context.Context, intent *PaymentIntent) error {
+	intent.ProviderRef = "pi_" + randomHex(12)
+	return nil
+}
+
+// Confirm 模拟用户完成支付，按场景异步发送 payment.succeeded 或 payment.failed 事件
+// 与真实渠道一样，回调可能在 Confirm 返回前到达，调用方需在提交支付单状态后再调用
+func (p *SimulatedProvider) Confirm(ctx context.Context, intent *PaymentIntent, scenario string) error {
+	event := PaymentEvent{
+		ID:       "evt_" + randomHex(12),
+		Type:     EventPaymentSucceeded,
+		Created:  time.Now().Unix(),
+		Intent:   intent.ProviderRef,
+		Amount:   intent.Amount.Amount,
+		Currency: intent.Amount.Currency,
+	}
+	delay := time.Duration(0)
+	switch scenario {
+	case ScenarioSuccess:
+	case ScenarioDecline:
+		event.Type = EventPaymentFailed
+		event.FailureReason = "card_declined"
+	case ScenarioDelayed:
+		delay = p.Delay
+	default:
+		return fmt.Errorf("未知的支付场景 %q（可选 success、decline、delayed）", scenario)
+	}
+
+	go func() {
+		time.Sleep(delay)
+		if err := p.deliver(event); err != nil {
+			log.Printf("webhook %s 投递失败: %v", event.ID, err)
+		}
+	}()
+	return nil
+}
+
+// Refund 模拟退款，本地渠道直接成功；amount 小于支付金额时为部分退款
+func (p *SimulatedProvider) Refund(ctx context.Context, intent *PaymentIntent, amount Money, key string) error {
+	log.Printf("模拟渠道退款 %s: %s %s / %s", key, intent.ProviderRef, amount, intent.Amount)
+	return nil
+}
+
+// deliver 签名并投递事件，失败时按 1s、2s、4s 退避重试
+func (p *SimulatedProvider) deliver(event PaymentEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for attempt := 0; attempt < 4; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Second << (attempt - 1))
+		}
+		req, err := http.NewRequest(http.MethodPost, p.WebhookURL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(signatureHeader, signPayload(p.Secret, time.Now().Unix(), body))
+		resp, err := p.Client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			return nil
+		}
+		lastErr = fmt.Errorf("webhook 返回 %d", resp.StatusCode)
+	}
+	return lastErr
+}
+
+// signatureHeader 签名请求头，格式为 t=<unix 时间戳>,v1=<hex 签名>
+const signatureHeader = "X-Payment-Signature"
+
+// signPayload 对 "时间戳.请求体" 计算 HMAC-SHA256，时间戳参与签名以防止重放
+func signPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// verifySignature 校验签名和时间戳
+func verifySignature(secret, header string, body []byte, now time.Time) error {
+	var timestamp int64
+	var signature string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp, _ = strconv.ParseInt(value, 10, 64)
+		case "v1":
+			signature = value
+		}
+	}
+	if timestamp == 0 || signature == "" {
+		return errors.New("缺少签名")
+	}
+	if age := now.Sub(time.Unix(timestamp, 0)); age > webhookTolerance || age < -webhookTolerance {
+		return errors.New("签名已过期")
+	}
+	expected := signPayload(secret, timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(fmt.Sprintf("t=%d,v1=%s", timestamp, signature))) {
+		return errors.New("签名不匹配")
+	}
+	return nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
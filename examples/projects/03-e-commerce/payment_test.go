@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestVerifySignature(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"id":"evt_1"}`)
+	valid := signPayload("secret", now.Unix(), body)
+	tests := []struct {
+		name   string
+		secret string
+		header string
+		body   string
+		ok     bool
+	}{
+		{"有效签名", "secret", valid, string(body), true},
+		{"请求体被篡改", "secret", valid, `{"id":"evt_2"}`, false},
+		{"密钥错误", "other", valid, string(body), false},
+		{"时间戳过期", "secret", signPayload("secret", now.Add(-webhookTolerance-time.Second).Unix(), body), string(body), false},
+		{"时间戳在未来", "secret", signPayload("secret", now.Add(webhookTolerance+time.Second).Unix(), body), string(body), false},
+		{"篡改时间戳", "secret", strings.Replace(valid, fmt.Sprint(now.Unix()), fmt.Sprint(now.Unix()+1), 1), string(body), false},
+		{"缺少签名", "secret", "", string(body), false},
+	}
+	for _, tt := range tests {
+		err := verifySignature(tt.secret, tt.header, []byte(tt.body), now)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v; 期望通过 = %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestEnsureWebhookSecret(t *testing.T) {
+	old := *webhookSecret
+	t.Cleanup(func() { *webhookSecret = old })
+
+	*webhookSecret = insecureWebhookSecret
+	if ensureWebhookSecret() == nil {
+		t.Error("使用公开的默认回调密钥时应拒绝启动")
+	}
+	*webhookSecret = ""
+	if err := ensureWebhookSecret(); err != nil || len(*webhookSecret) != 64 {
+		t.Fatalf("未设置密钥: %v %q; 期望生成 32 字节的随机密钥", err, *webhookSecret)
+	}
+	// 用公开的旧默认值伪造的回调无法通过校验
+	body := []byte(`{"type":"payment.succeeded"}`)
+	if verifySignature(*webhookSecret, signPayload(insecureWebhookSecret, time.Now().Unix(), body), body, time.Now()) == nil {
+		t.Error("用 whsec_dev 签名的回调通过了校验")
+	}
+	*webhookSecret = "custom"
+	if err := ensureWebhookSecret(); err != nil || *webhookSecret != "custom" {
+		t.Errorf("自定义密钥: %v %q; 期望保持不变", err, *webhookSecret)
+	}
+}
+
+func postWebhook(r *gin.Engine, event PaymentEvent) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(event)
+	req := httptest.NewRequest(http.MethodPost, "/api/payments/webhook", strings.NewReader(string(body)))
+	req.Header.Set(signatureHeader, signPayload(*webhookSecret, time.Now().Unix(), body))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// createOrderWithIntent 创建指定状态的订单及其支付单
+func createOrderWithIntent(userID uint, status, intentStatus string) (Order, PaymentIntent) {
+	order := Order{UserID: userID, Status: status, Subtotal: cny(1000), Discount: cny(0), Shipping: cny(0),
+		Tax: cny(0), TotalPrice: cny(1000), RefundedAmount: cny(0)}
+	db.Create(&order)
+	intent := PaymentIntent{OrderID: order.ID, Provider: "fake", ProviderRef: "pi_" + randomHex(8),
+		Amount: order.TotalPrice, Status: intentStatus}
+	db.Create(&intent)
+	return order, intent
+}
+
+func succeededEvent(intent PaymentIntent) PaymentEvent {
+	return PaymentEvent{ID: "evt_" + randomHex(8), Type: EventPaymentSucceeded, Created: time.Now().Unix(),
+		Intent: intent.ProviderRef, Amount: intent.Amount.Amount, Currency: intent.Amount.Currency}
+}
+
+func TestWebhookReplayIsIdempotent(t *testing.T) {
+	r := setupOrderTest(t)
+	payments = &fakeProvider{}
+	buyerID, _ := createBuyer(t, 1)
+	order, intent := createOrderWithIntent(buyerID, OrderPending, PaymentProcessing)
+	event := succeededEvent(intent)
+
+	body, _ := json.Marshal(event)
+	req := httptest.NewRequest(http.MethodPost, "/api/payments/webhook", strings.NewReader(string(body)))
+	req.Header.Set(signatureHeader, signPayload("wrong-secret", time.Now().Unix(), body))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("错误签名: %d; 期望 401", w.Code)
+	}
+
+	if w := postWebhook(r, event); w.Code != http.StatusOK || strings.Contains(w.Body.String(), "duplicate") {
+		t.Fatalf("首次投递: %d %s", w.Code, w.Body)
+	}
+	if w := postWebhook(r, event); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"duplicate":true`) {
+		t.Errorf("重复投递: %d %s; 期望 200 且 duplicate", w.Code, w.Body)
+	}
+
+	var paid, processed int64
+	db.Model(&OrderStatusHistory{}).Where("order_id = ? AND to_status = ?", order.ID, OrderPaid).Count(&paid)
+	db.Model(&ProcessedWebhook{}).Where("event_id = ?", event.ID).Count(&processed)
+	db.First(&order, order.ID)
+	if order.Status != OrderPaid || paid != 1 || processed != 1 {
+		t.Errorf("订单 %s、paid 历史 %d 条、事件记录 %d 条; 期望 paid、1、1", order.Status, paid, processed)
+	}
+}
+
+func TestLatePaymentIsRefunded(t *testing.T) {
+	r := setupOrderTest(t)
+	provider := &fakeProvider{}
+	payments = provider
+	buyerID, _ := createBuyer(t, 1)
+	order, intent := createOrderWithIntent(buyerID, OrderCancelled, PaymentCancelled)
+
+	if w := postWebhook(r, succeededEvent(intent)); w.Code != http.StatusOK {
+		t.Fatalf("投递: %d %s", w.Code, w.Body)
+	}
+	var refund Refund
+	db.Where("order_id = ?", order.ID).First(&refund)
+	db.First(&order, order.ID)
+	db.First(&intent, intent.ID)
+	if order.Status != OrderCancelled || refund.Status != RefundSucceeded || refund.Amount.Amount != 1000 ||
+		order.RefundedAmount.Amount != 1000 || intent.Status != PaymentRefunded || len(provider.refunds) != 1 {
+		t.Errorf("订单 %s（已退 %v）、退款 %s %v、支付单 %s、渠道退款 %d 笔; 期望 cancelled（已退 10.00）、succeeded 10.00、refunded、1 笔",
+			order.Status, order.RefundedAmount, refund.Status, refund.Amount, intent.Status, len(provider.refunds))
+	}
+}
+
+// waitFor 等待异步回调的结果
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("等待%s超时", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSimulatedProviderScenarios(t *testing.T) {
+	r := setupOrderTest(t)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	payments = NewSimulatedProvider(srv.URL+"/api/payments/webhook", *webhookSecret, 200*time.Millisecond)
+	buyerID, buyer := createBuyer(t, 1)
+
+	// pay 创建支付单并按场景提交，返回订单
+	pay := func(scenario string, want int) Order {
+		t.Helper()
+		order := Order{UserID: buyerID, Status: OrderPending, TotalPrice: cny(1000)}
+		db.Create(&order)
+		if w := sendJSON(r, http.MethodPost, fmt.Sprintf("/api/orders/%d/payment", order.ID), buyer, ""); w.Code != http.StatusOK {
+			t.Fatalf("创建支付单: %d %s", w.Code, w.Body)
+		}
+		confirm := fmt.Sprintf("/api/orders/%d/payment/confirm", order.ID)
+		if w := sendJSON(r, http.MethodPost, confirm, buyer, `{"scenario":"`+scenario+`"}`); w.Code != want {
+			t.Fatalf("%s 提交支付: %d %s; 期望 %d", scenario, w.Code, w.Body, want)
+		}
+		return order
+	}
+	status := func(order Order) (string, PaymentIntent) {
+		var intent PaymentIntent
+		db.Where("order_id = ?", order.ID).First(&intent)
+		db.First(&order, order.ID)
+		return order.Status, intent
+	}
+
+	success := pay(ScenarioSuccess, http.StatusAccepted)
+	waitFor(t, "支付成功", func() bool { s, _ := status(success); return s == OrderPaid })
+
+	// 被拒后支付单为 failed，订单仍待支付，可在同一张支付单上重新提交
+	declined := pay(ScenarioDecline, http.StatusAccepted)
+	waitFor(t, "支付被拒", func() bool { _, intent := status(declined); return intent.Status == PaymentFailed })
+	if s, intent := status(declined); s != OrderPending || intent.FailureReason != "card_declined" {
+		t.Errorf("被拒后订单 %s、失败原因 %q; 期望 pending、card_declined", s, intent.FailureReason)
+	}
+	confirm := fmt.Sprintf("/api/orders/%d/payment/confirm", declined.ID)
+	if w := sendJSON(r, http.MethodPost, confirm, buyer, `{"scenario":"success"}`); w.Code != http.StatusAccepted {
+		t.Fatalf("重新提交: %d %s", w.Code, w.Body)
+	}
+	waitFor(t, "重新支付成功", func() bool { s, _ := status(declined); return s == OrderPaid })
+
+	// 延迟确认期间支付单为 processing，不能重复提交
+	delayed := pay(ScenarioDelayed, http.StatusAccepted)
+	if s, intent := status(delayed); s != OrderPending || intent.Status != PaymentProcessing {
+		t.Errorf("延迟确认期间订单 %s、支付单 %s; 期望 pending、processing", s, intent.Status)
+	}
+	confirm = fmt.Sprintf("/api/orders/%d/payment/confirm", delayed.ID)
+	if w := sendJSON(r, http.MethodPost, confirm, buyer, `{"scenario":"success"}`); w.Code != http.StatusConflict {
+		t.Errorf("处理中重复提交: %d; 期望 409", w.Code)
+	}
+	waitFor(t, "延迟确认", func() bool { s, _ := status(delayed); return s == OrderPaid })
+
+	// 渠道拒绝提交时支付单变为 failed，不会停留在 processing
+	unknown := pay("bogus", http.StatusBadRequest)
+	if _, intent := status(unknown); intent.Status != PaymentFailed {
+		t.Errorf("未知场景后支付单 %s; 期望 failed", intent.Status)
+	}
+}
+
+func TestCancelUnpaidOrders(t *testing.T) {
+	setupOrderTest(t)
+	payments = &fakeProvider{}
+	buyerID, _ := createBuyer(t, 1)
+	product := Product{Name: "库存商品", Price: cny(500)}
+	db.Create(&product)
+	now := time.Now()
+	newOrder := func(status string, age time.Duration) Order {
+		order := Order{UserID: buyerID, Status: status, TotalPrice: cny(1000), CreatedAt: now.Add(-age),
+			Items: []OrderItem{{ProductID: product.ID, Quantity: 2, Price: cny(500), Total: cny(1000)}}}
+		db.Create(&order)
+		db.Create(&PaymentIntent{OrderID: order.ID, Provider: "fake", ProviderRef: "pi_" + randomHex(8),
+			Amount: order.TotalPrice, Status: PaymentRequiresPayment})
+		return order
+	}
+	expired := newOrder(OrderPending, time.Hour)
+	fresh := newOrder(OrderPending, time.Minute)
+	paid := newOrder(OrderPaid, time.Hour)
+
+	n, err := cancelUnpaidOrders(now.Add(-30 * time.Minute))
+	if err != nil || n != 1 {
+		t.Fatalf("取消 %d 个, err = %v; 期望 1 个", n, err)
+	}
+	for _, tt := range []struct {
+		order  Order
+		status string
+		intent string
+	}{
+		{expired, OrderCancelled, PaymentCancelled},
+		{fresh, OrderPending, PaymentRequiresPayment},
+		{paid, OrderPaid, PaymentRequiresPayment},
+	} {
+		var order Order
+		var intent PaymentIntent
+		db.First(&order, tt.order.ID)
+		db.Where("order_id = ?", tt.order.ID).First(&intent)
+		if order.Status != tt.status || intent.Status != tt.intent {
+			t.Errorf("订单 %d: %s / 支付单 %s; 期望 %s / %s", order.ID, order.Status, intent.Status, tt.status, tt.intent)
+		}
+	}
+	db.First(&product, product.ID)
+	if product.Stock != 2 {
+		t.Errorf("库存 = %d; 期望归还 2 件", product.Stock)
+	}
+	if n, _ := cancelUnpaidOrders(now.Add(-30 * time.Minute)); n != 0 {
+		t.Errorf("再次扫描取消 %d 个; 期望 0", n)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var shippingFee = flag.String("shipping-fee", "0", "每单运费，满足包邮活动时免除")
+
+// 优惠来源
+const (
+	SourcePromotion = "promotion"
+	SourceCoupon    = "coupon"
+)
+
+// CouponError 优惠券不可用
+type CouponError struct {
+	Code   string
+	Reason string
+}
+
+func (e *CouponError) Error() string {
+	return fmt.Sprintf("优惠券 %s %s", e.Code, e.Reason)
+}
+
+// LineDiscount 分摊到某一行的优惠
+type LineDiscount struct {
+	Source string `json:"source"`
+	Name   string `json:"name"`
+	Amount Money  `json:"amount"`
+}
+
+// QuoteLine 报价中的一行
+type QuoteLine struct {
+	CartItemID uint           `json:"cart_item_id"`
+	ProductID  uint           `json:"product_id"`
+	VariantID  *uint          `json:"variant_id,omitempty"`
+	SKU        string         `json:"sku,omitempty"`
+	Name       string         `json:"name"`
+	UnitPrice  Money          `json:"unit_price"`
+	Quantity   int            `json:"quantity"`
+	Subtotal   Money          `json:"subtotal"` // 单价 × 数量
+	Discounts  []LineDiscount `json:"discounts"`
+	Discount   Money          `json:"discount"`
+	Total      Money          `json:"total"` // 优惠后金额，不含运费和税
+}
+
+// AppliedPromotion 实际生效的优惠
+type AppliedPromotion struct {
+	Source      string `json:"source"`
+	PromotionID *uint  `json:"promotion_id,omitempty"`
+	CouponID    *uint  `json:"coupon_id,omitempty"`
+	Code        string `json:"code,omitempty"`
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Amount      Money  `json:"amount"` // 优惠金额，包邮为免除的运费
+}
+
+// Quote 购物车报价
+type Quote struct {
+	Lines      []QuoteLine        `json:"lines"`
+	Subtotal   Money              `json:"subtotal"`
+	Discount   Money              `json:"discount"`
+	Shipping   Money              `json:"shipping"`
+	Tax        Money              `json:"tax"`
+	Total      Money              `json:"total"`
+	Promotions []AppliedPromotion `json:"promotions"`
+}
+
+// merchandise 优惠后的商品金额
+func (q *Quote) merchandise() Money {
+	total := Zero(q.Subtotal.Currency)
+	for _, line := range q.Lines {
+		total = total.Add(line.Total)
+	}
+	return total
+}
+
+// discountLine 给某一行记录优惠
+func (q *Quote) discountLine(i int, source, name string, amount Money) {
+	line := &q.Lines[i]
+	line.Discounts = append(line.Discounts, LineDiscount{Source: source, Name: name, Amount: amount})
+	line.Discount = line.Discount.Add(amount)
+	line.Total = line.Total.Sub(amount)
+}
+
+// allocate 将整单优惠按各行当前金额比例分摊到每一行，分摊之和严格等于优惠金额
+func (q *Quote) allocate(source, name string, amount Money) {
+	weights := make([]int64, len(q.Lines))
+	for i, line := range q.Lines {
+		weights[i] = line.Total.Amount
+	}
+	for i, part := range amount.Allocate(weights) {
+		if !part.IsZero() {
+			q.discountLine(i, source, name, part)
+		}
+	}
+}
+
+// applied 记录一条生效的优惠
+func (q *Quote) applied(promotion AppliedPromotion) {
+	q.Promotions = append(q.Promotions, promotion)
+	if promotion.Type != PromoFreeShipping {
+		q.Discount = q.Discount.Add(promotion.Amount)
+	}
+}
+
+// buildQuote 定价引擎：按固定顺序组合各项规则计算报价
+//  1. 买 X 送 Y：按行计算赠送件数，每行最多参与一个该类活动
+//  2. 满额阶梯优惠：每个活动取满足条件的最高一档，按比例分摊到各行
+//  3. 优惠券：每单一张，门槛按前两步之后的商品金额判断
+//  4. 包邮：优惠后的商品金额达到门槛时免运费
+//  5. 税：在优惠后的商品金额上计算，不含运费
+//
+// 百分比折扣向下舍入，税额四舍五入，见 RoundingMode
+func buildQuote(items []CartItem, promotions []Promotion, coupon *Coupon, fee Money, now time.Time) (Quote, error) {
+	code := fee.Currency
+	q := Quote{
+		Subtotal:   Zero(code),
+		Discount:   Zero(code),
+		Shipping:   Zero(code),
+		Lines:      make([]QuoteLine, 0, len(items)),
+		Promotions: []AppliedPromotion{},
+	}
+	for _, item := range items {
+		price := item.unitPrice()
+		subtotal := price.Mul(item.Quantity)
+		line := QuoteLine{
+			CartItemID: item.ID,
+			ProductID:  item.ProductID,
+			VariantID:  item.VariantID,
+			Name:       item.Product.Name,
+			UnitPrice:  price,
+			Quantity:   item.Quantity,
+			Subtotal:   subtotal,
+			Discounts:  []LineDiscount{},
+			Discount:   Zero(code),
+			Total:      subtotal,
+		}
+		if item.Variant != nil {
+			line.SKU = item.Variant.SKU
+		}
+		q.Lines = append(q.Lines, line)
+		q.Subtotal = q.Subtotal.Add(subtotal)
+	}
+
+	active := make([]Promotion, 0, len(promotions))
+	for _, promotion := range promotions {
+		if promotion.activeAt(now) {
+			active = append(active, promotion)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].ID < active[j].ID })
+
+	// 1. 买 X 送 Y
+	used := make(map[int]bool)
+	for _, promotion := range active {
+		if promotion.Type != PromoBuyXGetY {
+			continue
+		}
+		total := Zero(code)
+		for i, line := range q.Lines {
+			if used[i] || (promotion.ProductID != nil && *promotion.ProductID != line.ProductID) {
+				continue
+			}
+			free := line.Quantity / (promotion.BuyQuantity + promotion.FreeQuantity) * promotion.FreeQuantity
+			if free == 0 {
+				continue
+			}
+			amount := line.UnitPrice.Mul(free)
+			q.discountLine(i, SourcePromotion, promotion.Name, amount)
+			total = total.Add(amount)
+			used[i] = true
+		}
+		if !total.IsZero() {
+			q.applied(promotion.applied(total))
+		}
+	}
+
+	// 2. 满额阶梯优惠
+	for _, promotion := range active {
+		if promotion.Type != PromoTiered {
+			continue
+		}
+		merchandise := q.merchandise()
+		tier, ok := promotion.bestTier(merchandise)
+		if !ok {
+			continue
+		}
+		amount := tier.AmountOff.Add(merchandise.Percent(tier.PercentOff, RoundDown)).Min(merchandise)
+		if amount.IsZero() {
+			continue
+		}
+		q.allocate(SourcePromotion, promotion.Name, amount)
+		q.applied(promotion.applied(amount))
+	}
+
+	// 3. 优惠券
+	if coupon != nil {
+		merchandise := q.merchandise()
+		if err := coupon.usableAt(now, merchandise); err != nil {
+			return q, err
+		}
+		amount := coupon.discount(merchandise)
+		if !amount.IsZero() {
+			q.allocate(SourceCoupon, coupon.Code, amount)
+		}
+		q.applied(AppliedPromotion{
+			Source:   SourceCoupon,
+			CouponID: &coupon.ID,
+			Code:     coupon.Code,
+			Name:     "优惠券 " + coupon.Code,
+			Type:     coupon.Type,
+			Amount:   amount,
+		})
+	}
+
+	// 4. 运费与包邮
+	merchandise := q.merchandise()
+	if len(q.Lines) > 0 {
+		q.Shipping = fee
+	}
+	for _, promotion := range active {
+		if promotion.Type != PromoFreeShipping || q.Shipping.IsZero() || merchandise.Cmp(promotion.Threshold) < 0 {
+			continue
+		}
+		q.applied(promotion.applied(q.Shipping))
+		q.Shipping = Zero(code)
+	}
+
+	// 5. 税
+	q.Tax = merchandise.Percent(taxRate, RoundHalfUp)
+	q.Total = merchandise.Add(q.Shipping).Add(q.Tax)
+	return q, nil
+}
+
+// loadPromotions 加载所有启用的自动优惠活动
+func loadPromotions(tx *gorm.DB) ([]Promotion, error) {
+	var promotions []Promotion
+	err := tx.Where("active = ?", true).Find(&promotions).Error
+	return promotions, err
+}
+
+// loadCoupon 按优惠码加载优惠券，code 为空时返回 nil
+func loadCoupon(tx *gorm.DB, code string) (*Coupon, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == "" {
+		return nil, nil
+	}
+	var coupon Coupon
+	if err := tx.Where("code = ?", code).First(&coupon).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &CouponError{Code: code, Reason: "不存在"}
+		}
+		return nil, err
+	}
+	return &coupon, nil
+}
+
+// quoteCart 为购物车计算报价
+func quoteCart(tx *gorm.DB, items []CartItem, couponCode string) (Quote, error) {
+	fee, err := ParseMoney(*shippingFee, *currency)
+	if err != nil {
+		return Quote{}, err
+	}
+	promotions, err := loadPromotions(tx)
+	if err != nil {
+		return Quote{}, err
+	}
+	coupon, err := loadCoupon(tx, couponCode)
+	if err != nil {
+		return Quote{}, err
+	}
+	return buildQuote(items, promotions, coupon, fee, time.Now())
+}
+
+// migrateOrderPricing 为旧订单补齐优惠、运费和行金额列，旧订单没有优惠，行金额为单价 × 数量
+func migrateOrderPricing(conn *gorm.DB) error {
+	m := conn.Migrator()
+	if m.HasTable(&Order{}) && !m.HasColumn(&Order{}, "discount_amount") {
+		for _, name := range []string{"discount_amount", "discount_currency", "shipping_amount", "shipping_currency"} {
+			if err := m.AddColumn(&Order{}, name); err != nil {
+				return err
+			}
+		}
+		err := conn.Exec("UPDATE orders SET discount_currency = total_price_currency, shipping_currency = total_price_currency").Error
+		if err != nil {
+			return err
+		}
+	}
+	if m.HasTable(&OrderItem{}) && !m.HasColumn(&OrderItem{}, "discount_amount") {
+		for _, name := range []string{"discount_amount", "discount_currency", "total_amount", "total_currency"} {
+			if err := m.AddColumn(&OrderItem{}, name); err != nil {
+				return err
+			}
+		}
+		return conn.Exec("UPDATE order_items SET discount_currency = price_currency, " +
+			"total_amount = price_amount * quantity, total_currency = price_currency").Error
+	}
+	return nil
+}
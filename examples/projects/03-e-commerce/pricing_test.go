@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func cny(amount int64) Money {
+	return NewMoney(amount, "CNY")
+}
+
+func TestBuildQuote(t *testing.T) {
+	a := Product{ID: 1, Name: "A", Price: cny(3000)}
+	b := Product{ID: 2, Name: "B", Price: cny(1550)}
+	items := []CartItem{
+		{ID: 1, ProductID: a.ID, Product: a, Quantity: 3},
+		{ID: 2, ProductID: b.ID, Product: b, Quantity: 3},
+	}
+	promotions := []Promotion{
+		{ID: 1, Name: "买二送一", Type: PromoBuyXGetY, ProductID: &a.ID, BuyQuantity: 2, FreeQuantity: 1, Active: true},
+		{ID: 2, Name: "满减", Type: PromoTiered, Active: true, Tiers: []PromotionTier{
+			{Threshold: cny(10000), AmountOff: cny(1000)},
+			{Threshold: cny(20000), AmountOff: cny(3000)},
+		}},
+		{ID: 3, Name: "包邮", Type: PromoFreeShipping, Threshold: cny(9900), Active: true},
+	}
+	coupon := &Coupon{ID: 1, Code: "SAVE10", Type: CouponPercent, PercentOff: 1000, Active: true, MinSubtotal: cny(0)}
+
+	q, err := buildQuote(items, promotions, coupon, cny(1000), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 136.50 - 30.00（送一件 A）= 106.50 -> 满 100 减 10 = 96.50 -> 9 折减 9.65 = 86.85，未满 99 不包邮
+	want := map[string]int64{"subtotal": 13650, "discount": 4965, "shipping": 1000, "total": 9685}
+	got := map[string]int64{"subtotal": q.Subtotal.Amount, "discount": q.Discount.Amount, "shipping": q.Shipping.Amount, "total": q.Total.Amount}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %d; 期望 %d", k, got[k], v)
+		}
+	}
+	if len(q.Promotions) != 3 {
+		t.Errorf("生效的优惠 %d 个; 期望 3 个（包邮未达门槛不应出现）", len(q.Promotions))
+	}
+
+	// 分摊到各行的优惠之和必须等于整单优惠
+	var lineDiscounts int64
+	for _, line := range q.Lines {
+		lineDiscounts += line.Discount.Amount
+		if line.Subtotal.Amount-line.Discount.Amount != line.Total.Amount {
+			t.Errorf("行 %s 金额不一致: %v - %v != %v", line.Name, line.Subtotal, line.Discount, line.Total)
+		}
+	}
+	if lineDiscounts != q.Discount.Amount {
+		t.Errorf("行优惠之和 = %d; 期望 %d", lineDiscounts, q.Discount.Amount)
+	}
+}
+
+func TestBuildQuoteCouponRules(t *testing.T) {
+	items := []CartItem{{ID: 1, ProductID: 1, Product: Product{ID: 1, Price: cny(5000)}, Quantity: 1}}
+	past := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name   string
+		coupon Coupon
+		ok     bool
+	}{
+		{"可用", Coupon{Code: "A", Type: CouponFixed, AmountOff: cny(500), MinSubtotal: cny(0), Active: true}, true},
+		{"已过期", Coupon{Code: "B", Type: CouponFixed, AmountOff: cny(500), MinSubtotal: cny(0), Active: true, ExpiresAt: &past}, false},
+		{"已用完", Coupon{Code: "C", Type: CouponFixed, AmountOff: cny(500), MinSubtotal: cny(0), Active: true, UsageLimit: 1, UsedCount: 1}, false},
+		{"未达门槛", Coupon{Code: "D", Type: CouponFixed, AmountOff: cny(500), MinSubtotal: cny(10000), Active: true}, false},
+		{"已停用", Coupon{Code: "E", Type: CouponFixed, AmountOff: cny(500), MinSubtotal: cny(0)}, false},
+	}
+	for _, tt := range tests {
+		_, err := buildQuote(items, nil, &tt.coupon, cny(0), time.Now())
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+	}
+
+	// 固定金额券不超过商品金额
+	big := Coupon{Code: "F", Type: CouponFixed, AmountOff: cny(99900), MinSubtotal: cny(0), Active: true}
+	q, err := buildQuote(items, nil, &big, cny(0), time.Now())
+	if err != nil || q.Total.Amount != 0 {
+		t.Errorf("大额券: total = %v, err = %v; 期望 0", q.Total, err)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// 优惠券类型
+const (
+	CouponPercent = "percent" // 按比例折扣
+	CouponFixed   = "fixed"   // 固定金额减免
+)
+
+// 自动优惠活动类型
+const (
+	PromoBuyXGetY     = "buy_x_get_y"   // 买 X 送 Y
+	PromoTiered       = "tiered"        // 满额阶梯优惠
+	PromoFreeShipping = "free_shipping" // 满额包邮
+)
+
+// Coupon 优惠券
+type Coupon struct {
+	ID          uint        `json:"id" gorm:"primaryKey"`
+	Code        string      `json:"code" gorm:"uniqueIndex;not null"`
+	Type        string      `json:"type" gorm:"not null"`
+	PercentOff  BasisPoints `json:"percent_off"` // percent 类型的折扣百分比
+	AmountOff   Money       `json:"amount_off" gorm:"embedded;embeddedPrefix:amount_off_"`
+	MinSubtotal Money       `json:"min_subtotal" gorm:"embedded;embeddedPrefix:min_subtotal_"` // 使用门槛，按其他优惠之后的商品金额判断
+	UsageLimit  int         `json:"usage_limit"`                                               // 总使用次数上限，0 表示不限
+	UsedCount   int         `json:"used_count" gorm:"default:0"`
+	StartsAt    *time.Time  `json:"starts_at"`
+	ExpiresAt   *time.Time  `json:"expires_at"`
+	Active      bool        `json:"active"` // 创建时缺省为 true
+	CreatedAt   time.Time   `json:"created_at"`
+}
+
+// usableAt 校验优惠券在当前时间、当前金额下是否可用
+func (c *Coupon) usableAt(now time.Time, merchandise Money) error {
+	switch {
+	case !c.Active:
+		return &CouponError{Code: c.Code, Reason: "已停用"}
+	case c.StartsAt != nil && now.Before(*c.StartsAt):
+		return &CouponError{Code: c.Code, Reason: "尚未生效"}
+	case c.ExpiresAt != nil && !now.Before(*c.ExpiresAt):
+		return &CouponError{Code: c.Code, Reason: "已过期"}
+	case c.UsageLimit > 0 && c.UsedCount >= c.UsageLimit:
+		return &CouponError{Code: c.Code, Reason: "已被领完"}
+	case merchandise.Cmp(c.MinSubtotal) < 0:
+		return &CouponError{Code: c.Code, Reason: "需满 " + c.MinSubtotal.String() + " 才能使用"}
+	}
+	return nil
+}
+
+// discount 计算优惠券的减免金额，不超过商品金额
+func (c *Coupon) discount(merchandise Money) Money {
+	if c.Type == CouponPercent {
+		return merchandise.Percent(c.PercentOff, RoundDown)
+	}
+	return c.AmountOff.Min(merchandise)
+}
+
+// claimCoupon 在下单事务中占用一次优惠券，并发下单时由条件更新保证不超过使用上限
+func claimCoupon(tx *gorm.DB, coupon *Coupon) error {
+	result := tx.Model(&Coupon{}).
+		Where("id = ? AND (usage_limit = 0 OR used_count < usage_limit)", coupon.ID).
+		UpdateColumn("used_count", gorm.Expr("used_count + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return &CouponError{Code: coupon.Code, Reason: "已被领完"}
+	}
+	return nil
+}
+
+// releaseCoupons 订单取消或退款时归还占用的优惠券次数，与 claimCoupon 对应
+func releaseCoupons(tx *gorm.DB, orderID uint) error {
+	return tx.Model(&Coupon{}).
+		Where("used_count > 0 AND id IN (?)", tx.Model(&OrderPromotion{}).Select("coupon_id").
+			Where("order_id = ? AND coupon_id IS NOT NULL", orderID)).
+		UpdateColumn("used_count", gorm.Expr("used_count - 1")).Error
+}
+
+// PromotionTier 阶梯优惠的一档：满 Threshold 减 AmountOff 或打 PercentOff 折扣
+type PromotionTier struct {
+	Threshold  Money       `json:"threshold"`
+	AmountOff  Money       `json:"amount_off"`
+	PercentOff BasisPoints `json:"percent_off"`
+}
+
+// Promotion 自动生效的优惠活动
+type Promotion struct {
+	ID           uint            `json:"id" gorm:"primaryKey"`
+	Name         string          `json:"name" gorm:"not null"`
+	Type         string          `json:"type" gorm:"not null"`
+	ProductID    *uint           `json:"product_id"`    // buy_x_get_y 适用的商品，为空表示所有商品
+	BuyQuantity  int             `json:"buy_quantity"`  // buy_x_get_y：买 X 件
+	FreeQuantity int             `json:"free_quantity"` // buy_x_get_y：送 Y 件
+	Tiers        []PromotionTier `json:"tiers" gorm:"serializer:json"`
+	Threshold    Money           `json:"threshold" gorm:"embedded;embeddedPrefix:threshold_"` // free_shipping 包邮门槛
+	Active       bool            `json:"active"`                                              // 创建时缺省为 true
+	StartsAt     *time.Time      `json:"starts_at"`
+	EndsAt       *time.Time      `json:"ends_at"`
+	CreatedAt    time.Time       `json:"created_at"`
+}
+
+// activeAt 活动在当前时间是否生效
+func (p *Promotion) activeAt(now time.Time) bool {
+	if !p.Active || (p.StartsAt != nil && now.Before(*p.StartsAt)) || (p.EndsAt != nil && !now.Before(*p.EndsAt)) {
+		return false
+	}
+	switch p.Type {
+	case PromoBuyXGetY:
+		return p.BuyQuantity > 0 && p.FreeQuantity > 0
+	case PromoTiered:
+		return len(p.Tiers) > 0
+	}
+	return p.Type == PromoFreeShipping
+}
+
+// bestTier 返回门槛不超过商品金额的最高一档
+func (p *Promotion) bestTier(merchandise Money) (PromotionTier, bool) {
+	var best PromotionTier
+	found := false
+	for _, tier := range p.Tiers {
+		if merchandise.Cmp(tier.Threshold) < 0 {
+			continue
+		}
+		if !found || tier.Threshold.Cmp(best.Threshold) > 0 {
+			best, found = tier, true
+		}
+	}
+	return best, found
+}
+
+// applied 生成活动的生效记录
+func (p *Promotion) applied(amount Money) AppliedPromotion {
+	return AppliedPromotion{
+		Source:      SourcePromotion,
+		PromotionID: &p.ID,
+		Name:        p.Name,
+		Type:        p.Type,
+		Amount:      amount,
+	}
+}
+
+// OrderPromotion 订单实际使用的优惠，下单时按报价原样保存
+type OrderPromotion struct {
+	ID          uint   `json:"id" gorm:"primaryKey"`
+	OrderID     uint   `json:"order_id" gorm:"index"`
+	Source      string `json:"source"`
+	PromotionID *uint  `json:"promotion_id,omitempty"`
+	CouponID    *uint  `json:"coupon_id,omitempty" gorm:"index"`
+	Code        string `json:"code,omitempty"`
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Amount      Money  `json:"amount" gorm:"embedded;embeddedPrefix:amount_"`
+}
+
+// withCurrency 未指定货币的金额使用商店货币，并校验币种和符号
+func withCurrency(amounts ...*Money) error {
+	for _, m := range amounts {
+		if m.Currency == "" {
+			m.Currency = *currency
+		}
+		if err := validateCurrency(*m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleCreateCoupon 创建优惠券
+func handleCreateCoupon(c *gin.Context) {
+	coupon := Coupon{Active: true}
+	if err := c.ShouldBindJSON(&coupon); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	coupon.Code = strings.ToUpper(strings.TrimSpace(coupon.Code))
+	coupon.UsedCount = 0
+	if err := validateCoupon(&coupon); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := db.Create(&coupon).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "优惠码已存在"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"data": coupon})
+}
+
+// validateCoupon 校验优惠券参数
+func validateCoupon(coupon *Coupon) error {
+	if coupon.Code == "" {
+		return errors.New("优惠码不能为空")
+	}
+	if err := withCurrency(&coupon.AmountOff, &coupon.MinSubtotal); err != nil {
+		return err
+	}
+	switch coupon.Type {
+	case CouponPercent:
+		if coupon.PercentOff <= 0 || coupon.PercentOff > 10000 {
+			return errors.New("percent_off 必须在 0 到 100 之间")
+		}
+	case CouponFixed:
+		if coupon.AmountOff.IsZero() {
+			return errors.New("amount_off 必须大于 0")
+		}
+	default:
+		return errors.New("type 只能是 percent 或 fixed")
+	}
+	if coupon.UsageLimit < 0 {
+		return errors.New("usage_limit 不能为负数")
+	}
+	return nil
+}
+
+// handleListCoupons 获取优惠券列表
+func handleListCoupons(c *gin.Context) {
+	var coupons []Coupon
+	db.Order("id DESC").Find(&coupons)
+	c.JSON(http.StatusOK, gin.H{"data": coupons})
+}
+
+// handleCreatePromotion 创建自动优惠活动
+func handleCreatePromotion(c *gin.Context) {
+	promotion := Promotion{Active: true}
+	if err := c.ShouldBindJSON(&promotion); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validatePromotion(&promotion); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	db.Create(&promotion)
+	c.JSON(http.StatusCreated, gin.H{"data": promotion})
+}
+
+// validatePromotion 校验优惠活动参数
+func validatePromotion(promotion *Promotion) error {
+	if strings.TrimSpace(promotion.Name) == "" {
+		return errors.New("name 不能为空")
+	}
+	if err := withCurrency(&promotion.Threshold); err != nil {
+		return err
+	}
+	switch promotion.Type {
+	case PromoBuyXGetY:
+		if promotion.BuyQuantity < 1 || promotion.FreeQuantity < 1 {
+			return errors.New("buy_quantity 和 free_quantity 必须大于 0")
+		}
+	case PromoTiered:
+		if len(promotion.Tiers) == 0 {
+			return errors.New("tiers 不能为空")
+		}
+		for i := range promotion.Tiers {
+			tier := &promotion.Tiers[i]
+			if err := withCurrency(&tier.Threshold, &tier.AmountOff); err != nil {
+				return err
+			}
+			if tier.AmountOff.IsZero() == (tier.PercentOff == 0) {
+				return errors.New("每一档需且只能设置 amount_off 或 percent_off 之一")
+			}
+			if tier.PercentOff > 10000 {
+				return errors.New("percent_off 不能超过 100")
+			}
+		}
+	case PromoFreeShipping:
+	default:
+		return errors.New("type 只能是 buy_x_get_y、tiered 或 free_shipping")
+	}
+	return nil
+}
+
+// handleListPromotions 获取优惠活动列表
+func handleListPromotions(c *gin.Context) {
+	var promotions []Promotion
+	db.Order("id DESC").Find(&promotions)
+	c.JSON(http.StatusOK, gin.H{"data": promotions})
+}
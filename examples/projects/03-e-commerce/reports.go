@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// CartEvent 加购记录，用于计算加购到下单的转化率；购物车项下单后会被删除，不能直接统计
+type CartEvent struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	UserID     uint      `json:"user_id" gorm:"index"` // 游客为 0，注册或登录时改为用户 ID
+	GuestToken string    `json:"-" gorm:"index"`
+	ProductID  uint      `json:"product_id"`
+	CreatedAt  time.Time `json:"created_at" gorm:"index"`
+}
+
+// recordCartEvent 记录一次加购，失败只写日志，不影响加购
+func recordCartEvent(owner cartOwner, productID uint) {
+	event := CartEvent{UserID: owner.UserID, GuestToken: owner.Guest, ProductID: productID}
+	if err := db.Create(&event).Error; err != nil {
+		log.Printf("记录加购失败: %v", err)
+	}
+}
+
+// revenueStatuses 计入销售额的订单状态：已支付过的订单，退款另行扣除
+var revenueStatuses = []string{OrderPaid, OrderShipped, OrderCompleted, OrderPartiallyRefunded, OrderRefunded}
+
+// reportGroups 销售额的汇总粒度：SQLite 表达式与对应的 Go 格式化
+// 周以周一开始，显示为周一的日期
+var reportGroups = map[string]struct {
+	sql string
+	key func(time.Time) string
+}{
+	"day": {"strftime('%Y-%m-%d', orders.created_at, ?)", func(t time.Time) string { return t.Format("2006-01-02") }},
+	"week": {"date(orders.created_at, ?, 'weekday 0', '-6 days')", func(t time.Time) string {
+		return t.AddDate(0, 0, -(int(t.Weekday())+6)%7).Format("2006-01-02")
+	}},
+	"month": {"strftime('%Y-%m', orders.created_at, ?)", func(t time.Time) string { return t.Format("2006-01") }},
+}
+
+// reportRange 报表的时间范围 [From, To)，按 Location 的自然日划分
+type reportRange struct {
+	From, To time.Time
+	Location *time.Location
+}
+
+// parseReportRange 解析 from、to（YYYY-MM-DD，包含 to 当天）和 tz，缺省为最近 30 天和服务器时区
+func parseReportRange(c *gin.Context) (reportRange, error) {
+	loc := time.Local
+	if name := c.Query("tz"); name != "" {
+		var err error
+		if loc, err = time.LoadLocation(name); err != nil {
+			return reportRange{}, fmt.Errorf("未知的时区: %s", name)
+		}
+	}
+	now := time.Now().In(loc)
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	from := to.AddDate(0, 0, -29)
+	for param, target := range map[string]*time.Time{"from": &from, "to": &to} {
+		if raw := c.Query(param); raw != "" {
+			t, err := time.ParseInLocation("2006-01-02", raw, loc)
+			if err != nil {
+				return reportRange{}, fmt.Errorf("%s 日期格式应为 YYYY-MM-DD", param)
+			}
+			*target = t
+		}
+	}
+	if to.Before(from) {
+		return reportRange{}, errors.New("to 不能早于 from")
+	}
+	if to.Sub(from) > 3*366*24*time.Hour {
+		return reportRange{}, errors.New("时间范围不能超过 3 年")
+	}
+	return reportRange{From: from, To: to.AddDate(0, 0, 1), Location: loc}, nil
+}
+
+// offsetModifier 把数据库中的 UTC 时间换算到报表时区的 SQLite 修饰符，如 '+480 minutes'
+// 范围内有夏令时切换时按订单时间选用切换前后的偏移：CASE WHEN orders.created_at < 切换时刻 THEN ... END
+func (r reportRange) offsetModifier() clause.Expr {
+	minutes := func(t time.Time) string {
+		_, offset := t.Zone()
+		return fmt.Sprintf("%+d minutes", offset/60)
+	}
+	var sql string
+	var vars []interface{}
+	t := r.From
+	for {
+		_, end := t.ZoneBounds()
+		if end.IsZero() || !end.Before(r.To) {
+			break
+		}
+		sql += "WHEN orders.created_at < ? THEN ? "
+		vars = append(vars, end.In(time.Local), minutes(t))
+		t = end
+	}
+	if sql == "" {
+		return gorm.Expr("?", minutes(t))
+	}
+	return gorm.Expr("CASE "+sql+"ELSE ? END", append(vars, minutes(t))...)
+}
+
+// scope 限定订单创建时间在范围内，只统计商店当前货币的订单
+// 时间按数据库保存的本地时间字符串比较，可以使用 (status, created_at) 索引
+func (r reportRange) scope(tx *gorm.DB) *gorm.DB {
+	return tx.Where("orders.created_at >= ? AND orders.created_at < ? AND orders.total_price_currency = ?",
+		r.From.In(time.Local), r.To.In(time.Local), *currency)
+}
+
+// SalesPeriod 一个时间段的销售额
+type SalesPeriod struct {
+	Period            string `json:"period"`
+	Orders            int64  `json:"orders"`
+	Gross             Money  `json:"gross"`    // 订单总额
+	Refunded          Money  `json:"refunded"` // 退款
+	Net               Money  `json:"net"`      // 净销售额
+	AverageOrderValue Money  `json:"average_order_value"`
+}
+
+// fill 根据订单数和金额计算净额与客单价
+func (p *SalesPeriod) fill(gross, refunded int64) {
+	p.Gross, p.Refunded = NewMoney(gross, *currency), NewMoney(refunded, *currency)
+	p.Net = p.Gross.Sub(p.Refunded)
+	p.AverageOrderValue = Zero(*currency)
+	if p.Orders > 0 {
+		p.AverageOrderValue = p.Net.MulRatio(1, p.Orders, RoundHalfUp)
+	}
+}
+
+// handleSalesReport 按日、周或月汇总销售额，没有订单的时间段也会返回，便于画图；?format=csv 导出
+func handleSalesReport(c *gin.Context) {
+	r, err := parseReportRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	groupName := c.DefaultQuery("group", "day")
+	group, ok := reportGroups[groupName]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "group 只能为 day、week 或 month"})
+		return
+	}
+
+	var rows []struct {
+		Period   string
+		Orders   int64
+		Gross    int64
+		Refunded int64
+	}
+	err = r.scope(db.Model(&Order{})).
+		Select(group.sql+" AS period, COUNT(*) AS orders, SUM(orders.total_price_amount) AS gross, SUM(orders.refunded_amount) AS refunded",
+			r.offsetModifier()).
+		Where("orders.status IN ?", revenueStatuses).
+		Group("period").Scan(&rows).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	byPeriod := make(map[string]int, len(rows))
+	for i, row := range rows {
+		byPeriod[row.Period] = i
+	}
+	var periods []SalesPeriod
+	var total SalesPeriod
+	var totalGross, totalRefunded int64
+	for day := r.From; day.Before(r.To); day = day.AddDate(0, 0, 1) {
+		key := group.key(day)
+		if len(periods) > 0 && periods[len(periods)-1].Period == key {
+			continue
+		}
+		period := SalesPeriod{Period: key}
+		var gross, refunded int64
+		if i, ok := byPeriod[key]; ok {
+			period.Orders, gross, refunded = rows[i].Orders, rows[i].Gross, rows[i].Refunded
+		}
+		period.fill(gross, refunded)
+		periods = append(periods, period)
+		total.Orders += period.Orders
+		totalGross += gross
+		totalRefunded += refunded
+	}
+	total.fill(totalGross, totalRefunded)
+
+	if c.Query("format") == "csv" {
+		records := [][]string{{"period", "orders", "gross", "refunded", "net", "average_order_value"}}
+		for _, p := range append(periods, total) {
+			if p.Period == "" {
+				p.Period = "total"
+			}
+			records = append(records, []string{p.Period, strconv.FormatInt(p.Orders, 10),
+				p.Gross.String(), p.Refunded.String(), p.Net.String(), p.AverageOrderValue.String()})
+		}
+		writeCSV(c, "sales-"+groupName, r, records)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data":     periods,
+		"summary":  total,
+		"group":    groupName,
+		"currency": *currency,
+		"from":     r.From.Format("2006-01-02"),
+		"to":       r.To.AddDate(0, 0, -1).Format("2006-01-02"),
+	})
+}
+
+// TopProduct 商品销量排行的一行，数量和金额都已扣除退货
+type TopProduct struct {
+	ProductID uint   `json:"product_id"`
+	Name      string `json:"name"`
+	Units     int64  `json:"units"`
+	Orders    int64  `json:"orders"`
+	Revenue   Money  `json:"revenue"`
+}
+
+// handleTopProducts 热销商品，?sort=units|revenue，?limit= 默认 10；?format=csv 导出
+// 全额退款的订单不计入：发货前退款的商品未发出，退货退款的商品已全部退回
+func handleTopProducts(c *gin.Context) {
+	r, err := parseReportRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	order := map[string]string{
+		"units":   "units DESC, revenue DESC",
+		"revenue": "revenue DESC, units DESC",
+	}[c.DefaultQuery("sort", "units")]
+	if order == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort 只能为 units 或 revenue"})
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if limit < 1 || limit > 100 {
+		limit = 10
+	}
+
+	var rows []struct {
+		ProductID uint
+		Name      string
+		Units     int64
+		Orders    int64
+		Revenue   int64
+	}
+	err = r.scope(db.Table("order_items")).
+		Select("order_items.product_id, products.name, "+
+			"SUM(order_items.quantity - order_items.returned_quantity) AS units, "+
+			"COUNT(DISTINCT CASE WHEN order_items.quantity > order_items.returned_quantity THEN order_items.order_id END) AS orders, "+
+			"SUM(order_items.total_amount - order_items.refunded_amount) AS revenue").
+		Joins("JOIN orders ON orders.id = order_items.order_id").
+		Joins("LEFT JOIN products ON products.id = order_items.product_id").
+		Where("orders.status IN ?", revenueStatuses).
+		Where("orders.status <> ?", OrderRefunded).
+		Group("order_items.product_id").Having("units > 0").
+		Order(order).Limit(limit).Scan(&rows).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	products := make([]TopProduct, len(rows))
+	for i, row := range rows {
+		products[i] = TopProduct{ProductID: row.ProductID, Name: row.Name, Units: row.Units, Orders: row.Orders,
+			Revenue: NewMoney(row.Revenue, *currency)}
+	}
+	if c.Query("format") == "csv" {
+		records := [][]string{{"product_id", "name", "units", "orders", "revenue"}}
+		for _, p := range products {
+			records = append(records, []string{strconv.FormatUint(uint64(p.ProductID), 10), p.Name,
+				strconv.FormatInt(p.Units, 10), strconv.FormatInt(p.Orders, 10), p.Revenue.String()})
+		}
+		writeCSV(c, "top-products", r, records)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": products})
+}
+
+// shopperSQL 加购用户的标识：登录用户按用户 ID，游客按 Cookie 令牌
+const shopperSQL = "CASE WHEN cart_events.user_id <> 0 THEN 'u' || cart_events.user_id ELSE 'g' || cart_events.guest_token END"
+
+// handleConversionReport 加购到下单的转化率：范围内加购过的顾客中，在加购之后、范围结束前下单和完成支付的比例
+func handleConversionReport(c *gin.Context) {
+	r, err := parseReportRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	from, to := r.From.In(time.Local), r.To.In(time.Local)
+	ordered := "EXISTS (SELECT 1 FROM orders WHERE orders.user_id = cart_events.user_id AND cart_events.user_id <> 0 " +
+		"AND orders.created_at >= cart_events.created_at AND orders.created_at < @to%s)"
+	var result struct {
+		Shoppers int64
+		Ordered  int64
+		Paid     int64
+	}
+	err = db.Raw("SELECT COUNT(DISTINCT "+shopperSQL+") AS shoppers, "+
+		"COUNT(DISTINCT CASE WHEN "+fmt.Sprintf(ordered, "")+" THEN "+shopperSQL+" END) AS ordered, "+
+		"COUNT(DISTINCT CASE WHEN "+fmt.Sprintf(ordered, " AND orders.status IN @paid")+" THEN "+shopperSQL+" END) AS paid "+
+		"FROM cart_events WHERE cart_events.created_at >= @from AND cart_events.created_at < @to",
+		map[string]interface{}{"from": from, "to": to, "paid": revenueStatuses}).Scan(&result).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	rate := func(n int64) float64 {
+		if result.Shoppers == 0 {
+			return 0
+		}
+		return float64(n*10000/result.Shoppers) / 10000
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"shoppers":         result.Shoppers,
+		"ordered":          result.Ordered,
+		"paid":             result.Paid,
+		"order_conversion": rate(result.Ordered),
+		"paid_conversion":  rate(result.Paid),
+		"from":             r.From.Format("2006-01-02"),
+		"to":               r.To.AddDate(0, 0, -1).Format("2006-01-02"),
+	})
+}
+
+// writeCSV 以附件形式输出 CSV，带 BOM 以便 Excel 正确识别 UTF-8
+func writeCSV(c *gin.Context, name string, r reportRange, records [][]string) {
+	filename := fmt.Sprintf("%s_%s_%s.csv", name, r.From.Format("20060102"), r.To.AddDate(0, 0, -1).Format("20060102"))
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Status(http.StatusOK)
+	c.Writer.WriteString("\ufeff")
+	w := csv.NewWriter(c.Writer)
+	w.WriteAll(records)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 补齐空时间段时在 Go 中计算的分组键必须与 SQLite 的分组表达式一致
+func TestReportGroupKeysMatchSQLite(t *testing.T) {
+	conn := initDatabase(filepath.Join(t.TempDir(), "report.db"))
+	loc := time.FixedZone("UTC+8", 8*3600)
+	r := reportRange{From: time.Date(2026, 3, 1, 0, 0, 0, 0, loc)}
+
+	// 一周中的每一天，以及 UTC 与 UTC+8 日期不同的时刻
+	start := time.Date(2026, 3, 1, 0, 30, 0, 0, loc)
+	for i := 0; i < 10; i++ {
+		at := start.AddDate(0, 0, i)
+		for name, group := range reportGroups {
+			var got string
+			err := conn.Raw("SELECT "+group.sql+" FROM (SELECT ? AS created_at) AS orders",
+				r.offsetModifier(), at.UTC()).Scan(&got).Error
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := group.key(at); got != want {
+				t.Errorf("%s %s: SQLite = %s; Go = %s", name, at, got, want)
+			}
+		}
+	}
+}
+
+// createReportOrder 创建指定时间、状态和退款金额的订单
+// 时间与 gorm 自动填充的一样按服务器时区保存，报表按本地时间字符串比较范围
+func createReportOrder(at time.Time, status string, total, refunded int64) Order {
+	order := Order{UserID: 1, Status: status, Subtotal: cny(total), Discount: cny(0), Shipping: cny(0),
+		Tax: cny(0), TotalPrice: cny(total), RefundedAmount: cny(refunded), CreatedAt: at.In(time.Local)}
+	db.Create(&order)
+	return order
+}
+
+// salesReport 请求销售报表，返回各时间段和汇总，格式为 "时间段:订单数/总额/退款/净额/客单价"
+func salesReport(t *testing.T, r *gin.Engine, token, query string) ([]string, string) {
+	t.Helper()
+	w := sendJSON(r, http.MethodGet, "/api/admin/reports/sales?"+query, token, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: %d %s", query, w.Code, w.Body)
+	}
+	var resp struct {
+		Data    []SalesPeriod
+		Summary SalesPeriod
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	format := func(p SalesPeriod) string {
+		return fmt.Sprintf("%s:%d/%d/%d/%d/%d", p.Period, p.Orders, p.Gross.Amount, p.Refunded.Amount, p.Net.Amount, p.AverageOrderValue.Amount)
+	}
+	periods := make([]string, len(resp.Data))
+	for i, p := range resp.Data {
+		periods[i] = format(p)
+	}
+	return periods, format(resp.Summary)
+}
+
+func TestSalesReport(t *testing.T) {
+	r := setupOrderTest(t)
+	_, admin := createAdmin(t, 1)
+	shanghai, _ := time.LoadLocation("Asia/Shanghai")
+	day := func(d, hour, min int) time.Time { return time.Date(2026, 3, d, hour, min, 0, 0, shanghai) }
+
+	createReportOrder(day(2, 10, 0), OrderPaid, 1000, 0)
+	createReportOrder(day(2, 23, 30), OrderPartiallyRefunded, 1000, 300) // UTC 仍是 3 月 2 日
+	createReportOrder(day(4, 0, 30), OrderRefunded, 1000, 1000)          // UTC 是 3 月 3 日
+	createReportOrder(day(3, 12, 0), OrderPending, 1000, 0)              // 未支付
+	createReportOrder(day(3, 12, 0), OrderCancelled, 1000, 0)            // 未支付即取消
+	createReportOrder(day(5, 0, 0), OrderPaid, 1000, 0)                  // 范围之外
+	usd := createReportOrder(day(3, 12, 0), OrderPaid, 1000, 0)
+	db.Model(&usd).Update("total_price_currency", "USD") // 其他货币
+
+	periods, summary := salesReport(t, r, admin, "from=2026-03-02&to=2026-03-04&tz=Asia/Shanghai")
+	want := []string{"2026-03-02:2/2000/300/1700/850", "2026-03-03:0/0/0/0/0", "2026-03-04:1/1000/1000/0/0"}
+	if fmt.Sprint(periods) != fmt.Sprint(want) || summary != ":3/3000/1300/1700/567" {
+		t.Errorf("按日: %v %s; 期望 %v :3/3000/1300/1700/567", periods, summary, want)
+	}
+	periods, _ = salesReport(t, r, admin, "from=2026-03-02&to=2026-03-09&tz=Asia/Shanghai&group=week")
+	if want := "[2026-03-02:4/4000/1300/2700/675 2026-03-09:0/0/0/0/0]"; fmt.Sprint(periods) != want {
+		t.Errorf("按周: %v; 期望 %s", periods, want)
+	}
+
+	// 报表时区在范围内进入夏令时，切换后的订单按切换后的偏移分组
+	newYork, _ := time.LoadLocation("America/New_York")
+	createReportOrder(time.Date(2026, 3, 7, 23, 30, 0, 0, newYork), OrderPaid, 500, 0)
+	createReportOrder(time.Date(2026, 3, 9, 0, 30, 0, 0, newYork), OrderPaid, 700, 0)
+	createReportOrder(time.Date(2026, 11, 2, 0, 30, 0, 0, newYork), OrderPaid, 900, 0) // 夏令时结束之后
+	periods, _ = salesReport(t, r, admin, "from=2026-03-07&to=2026-03-09&tz=America/New_York")
+	if want := "[2026-03-07:1/500/0/500/500 2026-03-08:0/0/0/0/0 2026-03-09:1/700/0/700/700]"; fmt.Sprint(periods) != want {
+		t.Errorf("夏令时开始: %v; 期望 %s", periods, want)
+	}
+	periods, _ = salesReport(t, r, admin, "from=2026-03-07&to=2026-11-30&tz=America/New_York&group=month")
+	if want := "[2026-03:2/1200/0/1200/600 2026-04:0/0/0/0/0 2026-05:0/0/0/0/0 2026-06:0/0/0/0/0 " +
+		"2026-07:0/0/0/0/0 2026-08:0/0/0/0/0 2026-09:0/0/0/0/0 2026-10:0/0/0/0/0 2026-11:1/900/0/900/900]"; fmt.Sprint(periods) != want {
+		t.Errorf("跨两次切换按月: %v; 期望 %s", periods, want)
+	}
+	if _, summary := salesReport(t, r, admin, "from=2026-11-02&to=2026-11-02&tz=America/New_York"); summary != ":1/900/0/900/900" {
+		t.Errorf("夏令时结束后: %s; 期望 :1/900/0/900/900", summary)
+	}
+
+	for _, query := range []string{"group=year", "tz=Mars/Base", "from=2026-3-1", "from=2026-03-05&to=2026-03-01", "from=2020-01-01&to=2026-01-01"} {
+		if w := sendJSON(r, http.MethodGet, "/api/admin/reports/sales?"+query, admin, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d; 期望 400", query, w.Code)
+		}
+	}
+}
+
+func TestSalesReportCSV(t *testing.T) {
+	r := setupOrderTest(t)
+	_, admin := createAdmin(t, 1)
+	shanghai, _ := time.LoadLocation("Asia/Shanghai")
+	createReportOrder(time.Date(2026, 3, 2, 10, 0, 0, 0, shanghai), OrderCompleted, 1000, 250)
+
+	w := sendJSON(r, http.MethodGet, "/api/admin/reports/sales?from=2026-03-02&to=2026-03-03&tz=Asia/Shanghai&format=csv", admin, "")
+	if got := w.Header().Get("Content-Disposition"); got != `attachment; filename="sales-day_20260302_20260303.csv"` {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+	body := w.Body.String()
+	if !strings.HasPrefix(body, "\ufeff") {
+		t.Fatal("CSV 缺少 UTF-8 BOM")
+	}
+	records, err := csv.NewReader(strings.NewReader(strings.TrimPrefix(body, "\ufeff"))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[[period orders gross refunded net average_order_value] [2026-03-02 1 10.00 2.50 7.50 7.50] " +
+		"[2026-03-03 0 0.00 0.00 0.00 0.00] [total 1 10.00 2.50 7.50 7.50]]"
+	if fmt.Sprint(records) != want {
+		t.Errorf("CSV = %v; 期望 %s", records, want)
+	}
+}
+
+func TestTopProducts(t *testing.T) {
+	r := setupOrderTest(t)
+	_, admin := createAdmin(t, 1)
+	at := time.Now()
+	products := []Product{{Name: "咖啡豆"}, {Name: "滤纸"}, {Name: "磨豆机"}}
+	for i := range products {
+		products[i].Price = cny(100)
+		db.Create(&products[i])
+	}
+	item := func(order Order, product, quantity int, total int64, returned int, refunded int64) {
+		db.Create(&OrderItem{OrderID: order.ID, ProductID: products[product].ID, Quantity: quantity, Price: cny(total / int64(quantity)),
+			Discount: cny(0), Total: cny(total), ReturnedQuantity: returned, Refunded: cny(refunded)})
+	}
+	// 咖啡豆 3 件退 1 件，滤纸全部退回，磨豆机 1 件
+	order := createReportOrder(at, OrderPartiallyRefunded, 8500, 1500)
+	item(order, 0, 3, 3000, 1, 1000)
+	item(order, 1, 1, 500, 1, 500)
+	item(order, 2, 1, 5000, 0, 0)
+	// 滤纸 2 件
+	order = createReportOrder(at, OrderCompleted, 1000, 0)
+	item(order, 1, 2, 1000, 0, 0)
+	// 全额退款和未支付的订单不计入
+	item(createReportOrder(at, OrderRefunded, 5000, 5000), 0, 5, 5000, 0, 0)
+	item(createReportOrder(at, OrderPending, 5000, 0), 0, 5, 5000, 0, 0)
+
+	top := func(query string) string {
+		w := sendJSON(r, http.MethodGet, "/api/admin/reports/top-products?"+query, admin, "")
+		var resp struct{ Data []TopProduct }
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		var rows []string
+		for _, p := range resp.Data {
+			rows = append(rows, fmt.Sprintf("%s:%d/%d/%d", p.Name, p.Units, p.Orders, p.Revenue.Amount))
+		}
+		return strings.Join(rows, " ")
+	}
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", "咖啡豆:2/1/2000 滤纸:2/1/1000 磨豆机:1/1/5000"},
+		{"sort=revenue", "磨豆机:1/1/5000 咖啡豆:2/1/2000 滤纸:2/1/1000"},
+		{"sort=revenue&limit=1", "磨豆机:1/1/5000"},
+	}
+	for _, tt := range tests {
+		if got := top(tt.query); got != tt.want {
+			t.Errorf("%q: %s; 期望 %s", tt.query, got, tt.want)
+		}
+	}
+	if w := sendJSON(r, http.MethodGet, "/api/admin/reports/top-products?sort=name", admin, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("sort=name: %d; 期望 400", w.Code)
+	}
+
+	w := sendJSON(r, http.MethodGet, "/api/admin/reports/top-products?format=csv&limit=1", admin, "")
+	records, _ := csv.NewReader(strings.NewReader(strings.TrimPrefix(w.Body.String(), "\ufeff"))).ReadAll()
+	if want := fmt.Sprintf("[[product_id name units orders revenue] [%d 咖啡豆 2 1 20.00]]", products[0].ID); fmt.Sprint(records) != want {
+		t.Errorf("CSV = %v; 期望 %s", records, want)
+	}
+}
+
+func TestConversionReport(t *testing.T) {
+	r := setupOrderTest(t)
+	_, admin := createAdmin(t, 100)
+	now := time.Now()
+	event := func(userID uint, guest string, at time.Time) {
+		db.Create(&CartEvent{UserID: userID, GuestToken: guest, ProductID: 1, CreatedAt: at})
+	}
+	order := func(userID uint, status string, at time.Time) {
+		db.Create(&Order{UserID: userID, Status: status, TotalPrice: cny(1000), CreatedAt: at})
+	}
+	// 1 号加购两次后下单并支付，2 号下单未支付，3 号只在加购之前下过单，游客只加购
+	event(1, "", now.Add(-3*time.Hour))
+	event(1, "", now.Add(-2*time.Hour))
+	order(1, OrderPaid, now.Add(-time.Hour))
+	event(2, "", now.Add(-2*time.Hour))
+	order(2, OrderPending, now.Add(-time.Hour))
+	order(3, OrderPaid, now.Add(-3*time.Hour))
+	event(3, "", now.Add(-2*time.Hour))
+	event(0, "guest", now.Add(-2*time.Hour))
+	// 范围之外的加购不计入
+	event(4, "", now.AddDate(0, 0, -40))
+	order(4, OrderPaid, now.Add(-time.Hour))
+
+	w := sendJSON(r, http.MethodGet, "/api/admin/reports/conversion", admin, "")
+	var resp struct {
+		Shoppers, Ordered, Paid int64
+		OrderConversion         float64 `json:"order_conversion"`
+		PaidConversion          float64 `json:"paid_conversion"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Shoppers != 4 || resp.Ordered != 2 || resp.Paid != 1 || resp.OrderConversion != 0.5 || resp.PaidConversion != 0.25 {
+		t.Errorf("转化率 %s; 期望 4 人加购、2 人下单、1 人支付", w.Body)
+	}
+
+	// 范围内没有加购时转化率为 0
+	w = sendJSON(r, http.MethodGet, "/api/admin/reports/conversion?from=2020-01-01&to=2020-01-31", admin, "")
+	if !strings.Contains(w.Body.String(), `"shoppers":0`) || !strings.Contains(w.Body.String(), `"order_conversion":0`) {
+		t.Errorf("没有加购: %s", w.Body)
+	}
+}
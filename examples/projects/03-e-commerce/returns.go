@@ -0,0 +1,447 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var returnWindow = flag.Duration("return-window", 30*24*time.Hour, "订单完成后可申请退货的期限")
+
+// 退货申请状态
+const (
+	ReturnRequested = "requested" // 待审核
+	ReturnApproved  = "approved"  // 已同意，已退款并入库
+	ReturnRejected  = "rejected"  // 已拒绝
+)
+
+// ReturnRequest 退货申请（RMA），一次申请可包含同一订单的多个订单项
+type ReturnRequest struct {
+	ID         uint         `json:"id" gorm:"primaryKey"`
+	OrderID    uint         `json:"order_id" gorm:"index"`
+	UserID     uint         `json:"user_id" gorm:"index"`
+	Status     string       `json:"status" gorm:"default:requested;index"`
+	Reason     string       `json:"reason"`
+	Items      []ReturnItem `json:"items" gorm:"foreignKey:ReturnID"`
+	Refund     Money        `json:"refund" gorm:"embedded;embeddedPrefix:refund_"` // 同意后的退款总额，含税
+	ReviewNote string       `json:"review_note,omitempty"`
+	ReviewedBy *uint        `json:"reviewed_by,omitempty"`
+	ReviewedAt *time.Time   `json:"reviewed_at,omitempty"`
+	CreatedAt  time.Time    `json:"created_at"`
+}
+
+// ReturnItem 退货申请中的一行
+type ReturnItem struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	ReturnID    uint       `json:"return_id" gorm:"index"`
+	OrderItemID uint       `json:"order_item_id" gorm:"index"`
+	OrderItem   *OrderItem `json:"order_item,omitempty" gorm:"foreignKey:OrderItemID"`
+	Quantity    int        `json:"quantity"`
+	Amount      Money      `json:"amount" gorm:"embedded;embeddedPrefix:amount_"` // 同意后该行退回的商品金额，不含税
+}
+
+// 退款状态
+const (
+	RefundPending   = "pending"   // 已记账，等待支付渠道退款
+	RefundSucceeded = "succeeded" // 渠道已退款，或线下退款
+)
+
+// Refund 退款记录，每次同意退货或发货前退款产生一条
+// 记录与订单变更在同一事务中写入，渠道退款由 processRefunds 在事务提交后进行
+type Refund struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`
+	OrderID       uint       `json:"order_id" gorm:"index"`
+	ReturnID      *uint      `json:"return_id" gorm:"index"` // 发货前整单退款时为空
+	Merchandise   Money      `json:"merchandise" gorm:"embedded;embeddedPrefix:merchandise_"`
+	Tax           Money      `json:"tax" gorm:"embedded;embeddedPrefix:tax_"`
+	Amount        Money      `json:"amount" gorm:"embedded;embeddedPrefix:amount_"` // 商品金额 + 税，整单退款时含运费
+	Provider      string     `json:"provider"`                                      // 原路退回的支付渠道，没有在线支付时为 manual
+	ProviderRef   string     `json:"provider_ref,omitempty"`
+	Status        string     `json:"status" gorm:"not null;default:succeeded;index"` // 旧记录在审核时已同步退款
+	FailureReason string     `json:"failure_reason,omitempty"`                       // 最近一次渠道退款失败的原因
+	ProcessedAt   *time.Time `json:"processed_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+var (
+	errReturnNotFound = errors.New("退货申请不存在")
+	errReturnReviewed = errors.New("退货申请已审核")
+)
+
+// returnLine 一次退货中某个订单项的退货数量
+type returnLine struct {
+	Item     OrderItem
+	Quantity int
+}
+
+// refundQuote 一次退货的退款金额
+type refundQuote struct {
+	Lines       []Money // 与 returnLine 一一对应的商品金额
+	Merchandise Money
+	Tax         Money
+	Total       Money
+}
+
+// quoteReturnRefund 计算退货退款金额
+// 按累计数量计算：某行累计退回 k 件时，累计退款为 Total × k / 数量（向下取整），本次退款为前后之差，
+// 因此分几次退完与一次退完的金额相同，全部退完时恰好等于该行优惠后金额；
+// 税额按同样方式在订单商品金额上按比例累计计算，全部退完时等于订单税额。运费不退
+func quoteReturnRefund(order Order, lines []returnLine) refundQuote {
+	code := order.TotalPrice.Currency
+	merchandise, refunded := Zero(code), Zero(code)
+	for _, item := range order.Items {
+		merchandise = merchandise.Add(item.Total)
+		refunded = refunded.Add(item.Refunded)
+	}
+
+	q := refundQuote{Lines: make([]Money, len(lines)), Merchandise: Zero(code)}
+	for i, line := range lines {
+		n := int64(line.Item.Quantity)
+		before := line.Item.Total.MulRatio(int64(line.Item.ReturnedQuantity), n, RoundDown)
+		after := line.Item.Total.MulRatio(int64(line.Item.ReturnedQuantity+line.Quantity), n, RoundDown)
+		q.Lines[i] = after.Sub(before)
+		q.Merchandise = q.Merchandise.Add(q.Lines[i])
+	}
+
+	q.Tax = Zero(code)
+	if !merchandise.IsZero() {
+		taxBefore := order.Tax.MulRatio(refunded.Amount, merchandise.Amount, RoundDown)
+		taxAfter := order.Tax.MulRatio(refunded.Add(q.Merchandise).Amount, merchandise.Amount, RoundDown)
+		q.Tax = taxAfter.Sub(taxBefore)
+	}
+	q.Total = q.Merchandise.Add(q.Tax)
+	return q
+}
+
+// returnDeadline 订单的退货截止时间：最近一次完成时间 + 退货期限
+func returnDeadline(tx *gorm.DB, orderID uint) (time.Time, error) {
+	var history OrderStatusHistory
+	err := tx.Where("order_id = ? AND to_status = ?", orderID, OrderCompleted).Order("id DESC").First(&history).Error
+	if err != nil {
+		return time.Time{}, err
+	}
+	return history.CreatedAt.Add(*returnWindow), nil
+}
+
+// pendingReturnQuantities 各订单项在待审核申请中的数量，防止重复申请超出可退数量
+func pendingReturnQuantities(tx *gorm.DB, orderID uint) (map[uint]int, error) {
+	var rows []struct {
+		OrderItemID uint
+		Quantity    int
+	}
+	err := tx.Model(&ReturnItem{}).
+		Select("return_items.order_item_id, SUM(return_items.quantity) AS quantity").
+		Joins("JOIN return_requests ON return_requests.id = return_items.return_id").
+		Where("return_requests.order_id = ? AND return_requests.status = ?", orderID, ReturnRequested).
+		Group("return_items.order_item_id").Scan(&rows).Error
+	pending := make(map[uint]int, len(rows))
+	for _, row := range rows {
+		pending[row.OrderItemID] = row.Quantity
+	}
+	return pending, err
+}
+
+// handleCreateReturn 对已完成订单的部分订单项申请退货
+func handleCreateReturn(c *gin.Context) {
+	var req struct {
+		Items []struct {
+			OrderItemID uint `json:"order_item_id" binding:"required"`
+			Quantity    int  `json:"quantity" binding:"required"`
+		} `json:"items" binding:"required"`
+		Reason string `json:"reason" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.Items) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请选择要退货的商品"})
+		return
+	}
+
+	var rma ReturnRequest
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var order Order
+		if err := tx.Preload("Items").Where("user_id = ?", currentUserID(c)).First(&order, parseID(c)).Error; err != nil {
+			return errOrderNotFound
+		}
+		if order.Status != OrderCompleted && order.Status != OrderPartiallyRefunded {
+			return &ReturnError{"订单完成后才能申请退货"}
+		}
+		deadline, err := returnDeadline(tx, order.ID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &ReturnError{"订单没有完成记录，无法申请退货"}
+		}
+		if err != nil {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return &ReturnError{"已超过退货期限 " + deadline.Format("2006-01-02 15:04")}
+		}
+		pending, err := pendingReturnQuantities(tx, order.ID)
+		if err != nil {
+			return err
+		}
+
+		items := make(map[uint]OrderItem, len(order.Items))
+		for _, item := range order.Items {
+			items[item.ID] = item
+		}
+		rma = ReturnRequest{OrderID: order.ID, UserID: order.UserID, Status: ReturnRequested,
+			Reason: strings.TrimSpace(req.Reason), Refund: Zero(order.TotalPrice.Currency)}
+		requested := make(map[uint]int)
+		for _, line := range req.Items {
+			item, ok := items[line.OrderItemID]
+			if !ok {
+				return &ReturnError{"订单中没有该商品"}
+			}
+			requested[item.ID] += line.Quantity
+			if line.Quantity < 1 || item.ReturnedQuantity+pending[item.ID]+requested[item.ID] > item.Quantity {
+				return &ReturnError{"退货数量超出可退数量"}
+			}
+			rma.Items = append(rma.Items, ReturnItem{OrderItemID: item.ID, Quantity: line.Quantity, Amount: Zero(item.Total.Currency)})
+		}
+		return tx.Create(&rma).Error
+	})
+
+	var returnErr *ReturnError
+	switch {
+	case errors.Is(err, errOrderNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.As(err, &returnErr):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusCreated, gin.H{"data": rma})
+	}
+}
+
+// ReturnError 退货申请不符合规则
+type ReturnError struct {
+	Reason string
+}
+
+func (e *ReturnError) Error() string {
+	return e.Reason
+}
+
+// handleListOrderReturns 订单的退货申请及退款记录
+func handleListOrderReturns(c *gin.Context) {
+	var order Order
+	if err := db.Where("user_id = ?", currentUserID(c)).First(&order, parseID(c)).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "订单不存在"})
+		return
+	}
+	var returns []ReturnRequest
+	db.Preload("Items").Where("order_id = ?", order.ID).Order("id DESC").Find(&returns)
+	var refunds []Refund
+	db.Where("order_id = ?", order.ID).Order("id ASC").Find(&refunds)
+	c.JSON(http.StatusOK, gin.H{"data": returns, "refunds": refunds, "refunded_amount": order.RefundedAmount})
+}
+
+// handleAdminListReturns 管理员查看退货申请，默认只看待审核的
+func handleAdminListReturns(c *gin.Context) {
+	status := c.DefaultQuery("status", ReturnRequested)
+	page, pageSize := pagination(c)
+	query := db.Model(&ReturnRequest{})
+	if status != "all" {
+		query = query.Where("status = ?", status)
+	}
+	var total int64
+	query.Count(&total)
+	var returns []ReturnRequest
+	query.Preload("Items.OrderItem").Order("id ASC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&returns)
+	c.JSON(http.StatusOK, gin.H{
+		"data":      returns,
+		"page":      page,
+		"page_size": pageSize,
+		"total":     total,
+	})
+}
+
+// reviewReturn 将待审核的申请标记为 status，已被审核时返回 errReturnReviewed
+func reviewReturn(tx *gorm.DB, id uint, status, note string, reviewer uint) (ReturnRequest, error) {
+	var rma ReturnRequest
+	if err := tx.Preload("Items").First(&rma, id).Error; err != nil {
+		return rma, errReturnNotFound
+	}
+	now := time.Now()
+	result := tx.Model(&ReturnRequest{}).Where("id = ? AND status = ?", id, ReturnRequested).Updates(map[string]interface{}{
+		"status":      status,
+		"review_note": note,
+		"reviewed_by": reviewer,
+		"reviewed_at": now,
+	})
+	if result.Error != nil {
+		return rma, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return rma, errReturnReviewed
+	}
+	rma.Status, rma.ReviewNote, rma.ReviewedBy, rma.ReviewedAt = status, note, &reviewer, &now
+	return rma, nil
+}
+
+// approveReturn 同意退货：商品入库、计算退款并记录、更新订单已退金额和状态
+// 渠道退款不在事务中进行，由调用方在提交后调用 processRefunds，事务回滚时不会产生实际退款
+func approveReturn(c *gin.Context, tx *gorm.DB, rma *ReturnRequest) error {
+	var order Order
+	if err := tx.Preload("Items").First(&order, rma.OrderID).Error; err != nil {
+		return err
+	}
+	items := make(map[uint]OrderItem, len(order.Items))
+	for _, item := range order.Items {
+		items[item.ID] = item
+	}
+	lines := make([]returnLine, len(rma.Items))
+	for i, ri := range rma.Items {
+		lines[i] = returnLine{Item: items[ri.OrderItemID], Quantity: ri.Quantity}
+	}
+	quote := quoteReturnRefund(order, lines)
+
+	for i, ri := range rma.Items {
+		result := tx.Model(&OrderItem{}).
+			Where("id = ? AND returned_quantity + ? <= quantity", ri.OrderItemID, ri.Quantity).
+			Updates(map[string]interface{}{
+				"returned_quantity": gorm.Expr("returned_quantity + ?", ri.Quantity),
+				"refunded_amount":   gorm.Expr("refunded_amount + ?", quote.Lines[i].Amount),
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return &ReturnError{"退货数量超出可退数量"}
+		}
+		if err := tx.Model(&rma.Items[i]).Updates(map[string]interface{}{
+			"amount_amount": quote.Lines[i].Amount, "amount_currency": quote.Lines[i].Currency,
+		}).Error; err != nil {
+			return err
+		}
+		rma.Items[i].Amount = quote.Lines[i]
+		_, err := adjustStock(tx, stockChange{
+			ProductID: lines[i].Item.ProductID,
+			VariantID: lines[i].Item.VariantID,
+			Delta:     ri.Quantity,
+			Reason:    ReasonReturn,
+			Note:      "退货入库",
+			ActorID:   currentUserID(c),
+			OrderID:   &order.ID,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	refund := Refund{OrderID: order.ID, ReturnID: &rma.ID, Merchandise: quote.Merchandise, Tax: quote.Tax, Amount: quote.Total}
+	if err := recordRefund(tx, &refund); err != nil {
+		return err
+	}
+	rma.Refund = quote.Total
+	if err := tx.Model(rma).Updates(map[string]interface{}{
+		"refund_amount": quote.Total.Amount, "refund_currency": quote.Total.Currency,
+	}).Error; err != nil {
+		return err
+	}
+	err := tx.Model(&Order{}).Where("id = ?", order.ID).
+		UpdateColumn("refunded_amount", gorm.Expr("refunded_amount + ?", quote.Total.Amount)).Error
+	if err != nil {
+		return err
+	}
+
+	// 所有商品都已退回时订单变为 refunded，否则为 partially_refunded
+	var remaining int64
+	tx.Model(&OrderItem{}).Where("order_id = ? AND returned_quantity < quantity", order.ID).Count(&remaining)
+	target := OrderPartiallyRefunded
+	if remaining == 0 {
+		target = OrderRefunded
+	}
+	if target == order.Status {
+		return nil
+	}
+	_, err = transitionOrder(tx, order.ID, target, fmt.Sprintf("退货 #%d", rma.ID), currentUserID(c))
+	return err
+}
+
+// handleReviewReturn 管理员审核退货申请，status 为 approved 或 rejected，拒绝时必须填写原因
+func handleReviewReturn(status string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Note string `json:"note"`
+		}
+		if c.Request.ContentLength > 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		if status == ReturnRejected && strings.TrimSpace(req.Note) == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "请填写拒绝原因"})
+			return
+		}
+
+		var rma ReturnRequest
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			rma, err = reviewReturn(tx, parseID(c), status, strings.TrimSpace(req.Note), currentUserID(c))
+			if err != nil || status == ReturnRejected {
+				return err
+			}
+			return approveReturn(c, tx, &rma)
+		})
+
+		var returnErr *ReturnError
+		switch {
+		case errors.Is(err, errReturnNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, errReturnReviewed), errors.As(err, &returnErr):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		default:
+			if status == ReturnApproved {
+				// 渠道退款失败时退款保持 pending，由 runRefundProcessor 重试
+				processRefunds(c.Request.Context(), rma.OrderID)
+			}
+			c.JSON(http.StatusOK, gin.H{"data": rma})
+		}
+	}
+}
+
+// migrateOrderRefunds 为旧订单补齐已退款金额列，币种与订单一致，并补记整单退款的金额
+func migrateOrderRefunds(conn *gorm.DB) error {
+	m := conn.Migrator()
+	if m.HasTable(&Order{}) && !m.HasColumn(&Order{}, "refunded_amount") {
+		for _, name := range []string{"refunded_amount", "refunded_currency"} {
+			if err := m.AddColumn(&Order{}, name); err != nil {
+				return err
+			}
+		}
+		if err := conn.Exec("UPDATE orders SET refunded_currency = total_price_currency").Error; err != nil {
+			return err
+		}
+	}
+	if m.HasTable(&OrderItem{}) && !m.HasColumn(&OrderItem{}, "refunded_amount") {
+		for _, name := range []string{"refunded_amount", "refunded_currency"} {
+			if err := m.AddColumn(&OrderItem{}, name); err != nil {
+				return err
+			}
+		}
+		if err := conn.Exec("UPDATE order_items SET refunded_currency = total_currency").Error; err != nil {
+			return err
+		}
+	}
+	// 旧版本的整单退款只写退款记录，没有计入订单的已退款金额；已取消订单的退款只可能是整单退款
+	if m.HasTable(&Order{}) && m.HasTable(&Refund{}) {
+		return conn.Exec(`UPDATE orders SET refunded_amount = total_price_amount
+			WHERE refunded_amount = 0 AND (status = ? OR (status = ? AND id IN (SELECT order_id FROM refunds)))`,
+			OrderRefunded, OrderCancelled).Error
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestQuoteReturnRefund(t *testing.T) {
+	// 3 件共 100.00（优惠分摊后无法整除），1 件 50.00，税 13% = 19.50
+	order := Order{
+		TotalPrice: cny(16950),
+		Tax:        cny(1950),
+		Items: []OrderItem{
+			{ID: 1, Quantity: 3, Total: cny(10000), Refunded: cny(0)},
+			{ID: 2, Quantity: 1, Total: cny(5000), Refunded: cny(0)},
+		},
+	}
+
+	// 分三次退完第一行，再退第二行，累计退款必须等于商品金额 + 税额
+	var total, merchandise, tax int64
+	for _, step := range []struct {
+		item int
+		want int64 // 本次商品金额
+	}{{0, 3333}, {0, 3333}, {0, 3334}, {1, 5000}} {
+		item := order.Items[step.item]
+		q := quoteReturnRefund(order, []returnLine{{Item: item, Quantity: 1}})
+		if q.Lines[0].Amount != step.want {
+			t.Errorf("订单项 %d 退 1 件 = %d; 期望 %d", item.ID, q.Lines[0].Amount, step.want)
+		}
+		if q.Total.Amount != q.Merchandise.Amount+q.Tax.Amount {
+			t.Errorf("退款 %v != 商品 %v + 税 %v", q.Total, q.Merchandise, q.Tax)
+		}
+		order.Items[step.item].ReturnedQuantity++
+		order.Items[step.item].Refunded = order.Items[step.item].Refunded.Add(q.Lines[0])
+		merchandise += q.Merchandise.Amount
+		tax += q.Tax.Amount
+		total += q.Total.Amount
+	}
+	if merchandise != 15000 || tax != 1950 || total != 16950 {
+		t.Errorf("累计退款 商品 %d 税 %d 合计 %d; 期望 15000 1950 16950", merchandise, tax, total)
+	}
+
+	// 一次退完与分次退完金额相同
+	order.Items[0].ReturnedQuantity, order.Items[0].Refunded = 0, cny(0)
+	order.Items[1].ReturnedQuantity, order.Items[1].Refunded = 0, cny(0)
+	q := quoteReturnRefund(order, []returnLine{{Item: order.Items[0], Quantity: 3}, {Item: order.Items[1], Quantity: 1}})
+	if q.Total.Amount != 16950 {
+		t.Errorf("一次退完 = %v; 期望 169.50", q.Total)
+	}
+}
+
+func TestApproveReturnRefundsAfterCommit(t *testing.T) {
+	r := setupOrderTest(t)
+	provider := &fakeProvider{fail: errors.New("渠道不可用")}
+	payments = provider
+	buyerID, buyer := createBuyer(t, 1)
+	_, admin := createAdmin(t, 2)
+	product := Product{Name: "退货商品", Price: cny(1000)}
+	db.Create(&product)
+	order := Order{UserID: buyerID, Status: OrderCompleted, Subtotal: cny(2000), Discount: cny(0), Shipping: cny(0),
+		Tax: cny(0), TotalPrice: cny(2000), RefundedAmount: cny(0), Items: []OrderItem{
+			{ProductID: product.ID, Quantity: 2, Price: cny(1000), Discount: cny(0), Total: cny(2000), Refunded: cny(0)},
+		}}
+	db.Create(&order)
+	db.Create(&OrderStatusHistory{OrderID: order.ID, FromStatus: OrderShipped, ToStatus: OrderCompleted})
+	db.Create(&PaymentIntent{OrderID: order.ID, Provider: "fake", ProviderRef: "pi_return", Amount: cny(2000), Status: PaymentSucceeded})
+
+	body := fmt.Sprintf(`{"items":[{"order_item_id":%d,"quantity":1}],"reason":"尺码不合适"}`, order.Items[0].ID)
+	if w := sendJSON(r, http.MethodPost, fmt.Sprintf("/api/orders/%d/returns", order.ID), buyer, body); w.Code != http.StatusCreated {
+		t.Fatalf("申请退货: %d %s", w.Code, w.Body)
+	}
+
+	// 渠道退款失败不回滚审核：商品已入库，退款保持 pending
+	if w := sendJSON(r, http.MethodPost, "/api/admin/returns/1/approve", admin, ""); w.Code != http.StatusOK {
+		t.Fatalf("同意退货: %d %s", w.Code, w.Body)
+	}
+	var refund Refund
+	db.Where("order_id = ?", order.ID).First(&refund)
+	db.First(&product, product.ID)
+	db.First(&order, order.ID)
+	if refund.Status != RefundPending || refund.Amount.Amount != 1000 || product.Stock != 1 || order.Status != OrderPartiallyRefunded {
+		t.Errorf("退款 %s %v、库存 %d、订单 %s; 期望 pending 10.00、1、partially_refunded",
+			refund.Status, refund.Amount, product.Stock, order.Status)
+	}
+
+	// 重试成功后部分退款不改变支付单状态
+	provider.fail = nil
+	if err := processRefunds(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	db.First(&refund, refund.ID)
+	var intent PaymentIntent
+	db.Where("order_id = ?", order.ID).First(&intent)
+	if refund.Status != RefundSucceeded || intent.Status != PaymentSucceeded || len(provider.refunds) != 1 {
+		t.Errorf("重试后退款 %s、支付单 %s、渠道退款 %d 笔; 期望 succeeded、succeeded、1 笔",
+			refund.Status, intent.Status, len(provider.refunds))
+	}
+}
+
+func TestMigrateFullRefundAmounts(t *testing.T) {
+	setupOrderTest(t)
+	tests := []struct {
+		name     string
+		status   string
+		refunded int64 // 迁移前的已退款金额
+		refund   bool  // 是否有旧版本写入的整单退款记录
+		want     int64
+	}{
+		{"发货前整单退款", OrderRefunded, 0, true, 1000},
+		{"取消后到账的支付", OrderCancelled, 0, true, 1000},
+		{"未支付就取消", OrderCancelled, 0, false, 0},
+		{"部分退货", OrderPartiallyRefunded, 300, false, 300},
+	}
+	orders := make([]Order, len(tests))
+	for i, tt := range tests {
+		orders[i] = Order{Status: tt.status, Subtotal: cny(1000), Discount: cny(0), Shipping: cny(0), Tax: cny(0),
+			TotalPrice: cny(1000), RefundedAmount: cny(tt.refunded)}
+		db.Create(&orders[i])
+		if tt.refund {
+			db.Create(&Refund{OrderID: orders[i].ID, Merchandise: cny(1000), Tax: cny(0), Amount: cny(1000), Status: RefundSucceeded})
+		}
+	}
+
+	// 迁移可以重复执行
+	for i := 0; i < 2; i++ {
+		if err := migrateOrderRefunds(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, tt := range tests {
+		var order Order
+		db.First(&order, orders[i].ID)
+		if order.RefundedAmount.Amount != tt.want {
+			t.Errorf("%s: 已退款 %d; 期望 %d", tt.name, order.RefundedAmount.Amount, tt.want)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Review 商品评价，每个用户对每个商品只能评价一次
+type Review struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	ProductID    uint      `json:"product_id" gorm:"uniqueIndex:idx_review_product_user"`
+	UserID       uint      `json:"user_id" gorm:"uniqueIndex:idx_review_product_user;index"`
+	Author       string    `json:"author,omitempty" gorm:"->;-:migration"` // 评价者昵称，列表查询时关联 users 表读取
+	OrderID      uint      `json:"order_id"`                               // 购买凭证：包含该商品的已完成订单
+	Rating       int       `json:"rating"`                                 // 1-5 星
+	Title        string    `json:"title"`
+	Body         string    `json:"body"`
+	HelpfulCount int       `json:"helpful_count" gorm:"not null;default:0"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// ReviewVote “有帮助”投票，每个用户对每条评价只能投一次
+type ReviewVote struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	ReviewID  uint      `json:"review_id" gorm:"uniqueIndex:idx_vote_review_user"`
+	UserID    uint      `json:"user_id" gorm:"uniqueIndex:idx_vote_review_user"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// reviewSorts 评价排序方式
+var reviewSorts = map[string]string{
+	"helpful": "reviews.helpful_count DESC, reviews.created_at DESC, reviews.id DESC",
+	"newest":  "reviews.created_at DESC, reviews.id DESC",
+	"highest": "reviews.rating DESC, reviews.created_at DESC, reviews.id DESC",
+	"lowest":  "reviews.rating ASC, reviews.created_at DESC, reviews.id DESC",
+}
+
+var (
+	errNotVerifiedBuyer = errors.New("只有购买并完成订单的用户才能评价该商品")
+	errReviewExists     = errors.New("已经评价过该商品，可以修改原评价")
+	errReviewNotFound   = errors.New("评价不存在")
+	errOwnReview        = errors.New("不能给自己的评价投票")
+	errProductNotFound  = errors.New("商品不存在")
+)
+
+// reviewInput 创建和修改评价的请求
+type reviewInput struct {
+	Rating int    `json:"rating" binding:"required"`
+	Title  string `json:"title"`
+	Body   string `json:"body"`
+}
+
+// normalize 校验评分和长度，去掉首尾空白
+func (in *reviewInput) normalize() error {
+	in.Title, in.Body = strings.TrimSpace(in.Title), strings.TrimSpace(in.Body)
+	switch {
+	case in.Rating < 1 || in.Rating > 5:
+		return errors.New("评分必须是 1 到 5 星")
+	case utf8.RuneCountInString(in.Title) > 100:
+		return errors.New("标题不能超过 100 个字")
+	case utf8.RuneCountInString(in.Body) > 5000:
+		return errors.New("内容不能超过 5000 字")
+	}
+	return nil
+}
+
+// verifiedPurchase 用户包含该商品的最近一个已完成订单，没有时返回 errNotVerifiedBuyer
+// 部分退货的订单仍算已完成；全部退货的订单不算
+func verifiedPurchase(tx *gorm.DB, userID, productID uint) (uint, error) {
+	var orderIDs []uint
+	err := tx.Model(&Order{}).
+		Joins("JOIN order_items ON order_items.order_id = orders.id").
+		Where("orders.user_id = ? AND order_items.product_id = ? AND orders.status IN ?",
+			userID, productID, []string{OrderCompleted, OrderPartiallyRefunded}).
+		Order("orders.id DESC").Limit(1).Pluck("orders.id", &orderIDs).Error
+	if err != nil {
+		return 0, err
+	}
+	if len(orderIDs) == 0 {
+		return 0, errNotVerifiedBuyer
+	}
+	return orderIDs[0], nil
+}
+
+// refreshProductRating 在同一事务中重新计算商品的评分缓存
+func refreshProductRating(tx *gorm.DB, productID uint) error {
+	return tx.Model(&Product{}).Where("id = ?", productID).Updates(map[string]interface{}{
+		"rating_count": gorm.Expr("(SELECT COUNT(*) FROM reviews WHERE product_id = ?)", productID),
+		"rating_average": gorm.Expr("COALESCE((SELECT ROUND(AVG(rating), 2) FROM reviews WHERE product_id = ?), 0)",
+			productID),
+	}).Error
+}
+
+// handleCreateReview 发表评价，只有买过该商品并已完成订单的用户可以评价
+func handleCreateReview(c *gin.Context) {
+	var in reviewInput
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := in.normalize(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	review := Review{ProductID: parseID(c), UserID: currentUserID(c), Rating: in.Rating, Title: in.Title, Body: in.Body}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Select("id").First(&Product{}, review.ProductID).Error; err != nil {
+			return errProductNotFound
+		}
+		orderID, err := verifiedPurchase(tx, review.UserID, review.ProductID)
+		if err != nil {
+			return err
+		}
+		review.OrderID = orderID
+		var existing int64
+		tx.Model(&Review{}).Where("product_id = ? AND user_id = ?", review.ProductID, review.UserID).Count(&existing)
+		if existing > 0 {
+			return errReviewExists
+		}
+		if err := tx.Create(&review).Error; err != nil {
+			return err
+		}
+		return refreshProductRating(tx, review.ProductID)
+	})
+	if err != nil {
+		respondReviewError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"data": review})
+}
+
+// respondReviewError 将评价相关错误映射为 HTTP 状态码
+func respondReviewError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errProductNotFound), errors.Is(err, errReviewNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, errOwnReview):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, errNotVerifiedBuyer):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, errReviewExists):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// handleListReviews 商品评价列表，?sort=helpful|newest|highest|lowest，?rating= 按星级筛选
+// 同时返回评分汇总和各星级数量
+func handleListReviews(c *gin.Context) {
+	var product Product
+	if err := db.First(&product, parseID(c)).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "商品不存在"})
+		return
+	}
+	order := reviewSorts[c.DefaultQuery("sort", "helpful")]
+	if order == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort 只能是 helpful、newest、highest 或 lowest"})
+		return
+	}
+	page, pageSize := pagination(c)
+
+	query := db.Model(&Review{}).Where("reviews.product_id = ?", product.ID)
+	if raw := c.Query("rating"); raw != "" {
+		rating, err := strconv.Atoi(raw)
+		if err != nil || rating < 1 || rating > 5 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "rating 必须是 1 到 5"})
+			return
+		}
+		query = query.Where("reviews.rating = ?", rating)
+	}
+	var total int64
+	query.Count(&total)
+	var reviews []Review
+	query.Select("reviews.*, users.name AS author").Joins("LEFT JOIN users ON users.id = reviews.user_id").
+		Order(order).Offset((page - 1) * pageSize).Limit(pageSize).Find(&reviews)
+
+	var counts []struct {
+		Rating int
+		Count  int
+	}
+	db.Model(&Review{}).Select("rating, COUNT(*) AS count").Where("product_id = ?", product.ID).Group("rating").Scan(&counts)
+	distribution := map[int]int{1: 0, 2: 0, 3: 0, 4: 0, 5: 0}
+	for _, row := range counts {
+		distribution[row.Rating] = row.Count
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":      reviews,
+		"page":      page,
+		"page_size": pageSize,
+		"total":     total,
+		"rating": gin.H{
+			"average":      product.RatingAverage,
+			"count":        product.RatingCount,
+			"distribution": distribution,
+		},
+	})
+}
+
+// findOwnReview 查找当前用户自己的评价
+func findOwnReview(tx *gorm.DB, c *gin.Context) (Review, error) {
+	var review Review
+	if err := tx.Where("id = ? AND user_id = ?", parseID(c), currentUserID(c)).First(&review).Error; err != nil {
+		return review, errReviewNotFound
+	}
+	return review, nil
+}
+
+// handleUpdateReview 修改自己的评价
+func handleUpdateReview(c *gin.Context) {
+	var in reviewInput
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := in.normalize(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var review Review
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if review, err = findOwnReview(tx, c); err != nil {
+			return err
+		}
+		review.Rating, review.Title, review.Body = in.Rating, in.Title, in.Body
+		if err := tx.Model(&review).Select("rating", "title", "body").Updates(&review).Error; err != nil {
+			return err
+		}
+		return refreshProductRating(tx, review.ProductID)
+	})
+	if err != nil {
+		respondReviewError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": review})
+}
+
+// handleDeleteReview 删除自己的评价及其投票
+func handleDeleteReview(c *gin.Context) {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		review, err := findOwnReview(tx, c)
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("review_id = ?", review.ID).Delete(&ReviewVote{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&review).Error; err != nil {
+			return err
+		}
+		return refreshProductRating(tx, review.ProductID)
+	})
+	if err != nil {
+		respondReviewError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "已删除"})
+}
+
+// handleVoteReview 标记评价“有帮助”，重复投票不重复计数，不能给自己的评价投票
+func handleVoteReview(c *gin.Context) {
+	var review Review
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&review, parseID(c)).Error; err != nil {
+			return errReviewNotFound
+		}
+		if review.UserID == currentUserID(c) {
+			return errOwnReview
+		}
+		vote := ReviewVote{ReviewID: review.ID, UserID: currentUserID(c)}
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&vote)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		review.HelpfulCount++
+		return tx.Model(&review).UpdateColumn("helpful_count", gorm.Expr("helpful_count + 1")).Error
+	})
+	if err != nil {
+		respondReviewError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": review})
+}
+
+// handleUnvoteReview 取消“有帮助”投票
+func handleUnvoteReview(c *gin.Context) {
+	var review Review
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&review, parseID(c)).Error; err != nil {
+			return errReviewNotFound
+		}
+		result := tx.Where("review_id = ? AND user_id = ?", review.ID, currentUserID(c)).Delete(&ReviewVote{})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		review.HelpfulCount--
+		return tx.Model(&review).UpdateColumn("helpful_count", gorm.Expr("helpful_count - 1")).Error
+	})
+	if err != nil {
+		respondReviewError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": review})
+}
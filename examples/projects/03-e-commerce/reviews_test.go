@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func postReview(r *gin.Engine, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/api/products/1/reviews", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestReviewsRequireCompletedPurchase(t *testing.T) {
+	r := setupOrderTest(t)
+	product := Product{Name: "评价商品", Price: NewMoney(990, "CNY")}
+	db.Create(&product)
+	buyers := make([]string, 3)
+	for i := range buyers {
+		userID, token := createBuyer(t, i)
+		buyers[i] = token
+		// 第一位买家的订单未完成，其余两位已完成
+		status := OrderCompleted
+		if i == 0 {
+			status = OrderShipped
+		}
+		db.Create(&Order{UserID: userID, Status: status, TotalPrice: NewMoney(990, "CNY"), Items: []OrderItem{
+			{ProductID: product.ID, Quantity: 1, Price: NewMoney(990, "CNY"), Total: NewMoney(990, "CNY")},
+		}})
+	}
+	_, stranger := createBuyer(t, 99)
+
+	for _, token := range []string{stranger, buyers[0]} {
+		if w := postReview(r, token, `{"rating":5}`); w.Code != http.StatusForbidden {
+			t.Errorf("未完成购买的用户评价: %d %s; 期望 403", w.Code, w.Body)
+		}
+	}
+	for i, rating := range []string{"5", "2"} {
+		if w := postReview(r, buyers[i+1], `{"rating":`+rating+`}`); w.Code != http.StatusCreated {
+			t.Fatalf("已购买用户评价: %d %s", w.Code, w.Body)
+		}
+	}
+	if w := postReview(r, buyers[1], `{"rating":1}`); w.Code != http.StatusConflict {
+		t.Errorf("重复评价: %d; 期望 409", w.Code)
+	}
+
+	db.First(&product, product.ID)
+	if product.RatingCount != 2 || product.RatingAverage != 3.5 {
+		t.Errorf("评分缓存 = %v (%d 条); 期望 3.5 (2 条)", product.RatingAverage, product.RatingCount)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	jwtSecret      = flag.String("jwt-secret", "", "JWT 签名密钥，不设置时每次启动随机生成；多节点部署时各节点必须相同")
+	tokenTTL       = flag.Duration("token-ttl", 24*time.Hour, "登录令牌有效期")
+	allowedOrigins = flag.String("allowed-origins", "http://localhost:8080", "允许建立 WebSocket 连接的页面来源，逗号分隔，* 表示不限制")
+)
+
+// insecureJWTSecret 旧版本的默认密钥，已随代码公开，任何人都能用它伪造令牌
+const insecureJWTSecret = "change-me-in-production"
+
+// ensureJWTSecret 启动时检查签名密钥：使用公开的旧默认值时拒绝启动；
+// 未设置时生成随机密钥，重启后已签发的令牌全部失效。多节点部署时各节点的随机密钥不同，
+// 一个节点签发的令牌无法连接其他节点，因此设置了 -redis-addr 时必须显式指定
+func ensureJWTSecret() error {
+	switch *jwtSecret {
+	case insecureJWTSecret:
+		return errors.New("-jwt-secret 不能使用公开的默认值 " + insecureJWTSecret)
+	case "":
+		if *redisAddr != "" {
+			return errors.New("多节点部署（-redis-addr）时必须为所有节点设置相同的 -jwt-secret")
+		}
+		*jwtSecret = randomHex(32)
+		log.Println("警告: 未设置 -jwt-secret，使用随机生成的密钥，重启后需要重新登录")
+	}
+	return nil
+}
+
+// randomHex 生成 n 字节的随机数并编码为十六进制
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// wsTokenProtocol 浏览器无法为 WebSocket 设置请求头，可通过子协议传递令牌：
+// Sec-WebSocket-Protocol: bearer, <token>，服务端只回应 bearer，不回显令牌
+const wsTokenProtocol = "bearer"
+
+// Claims JWT 声明
+type Claims struct {
+	UserID uint `json:"user_id"`
+	jwt.RegisteredClaims
+}
+
+// generateToken 签发登录令牌
+func generateToken(userID uint, now time.Time) (string, time.Time, error) {
+	expiresAt := now.Add(*tokenTTL)
+	claims := Claims{
+		UserID: userID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(*jwtSecret))
+	return token, expiresAt, err
+}
+
+// verifyToken 校验令牌并确认用户仍然存在，只接受 HS256 签名
+func verifyToken(tokenString string) (uint, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(*jwtSecret), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return 0, err
+	}
+	if claims.UserID == 0 || db.Select("id").First(&User{}, claims.UserID).Error != nil {
+		return 0, errors.New("用户不存在")
+	}
+	return claims.UserID, nil
+}
+
+// requestToken 读取令牌：Authorization: Bearer <token>、子协议 bearer, <token> 或 ?token=
+// 查询参数会出现在访问日志中，仅作为无法使用前两种方式的客户端的兜底
+func requestToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	if protocols := websocketProtocols(r); len(protocols) == 2 && protocols[0] == wsTokenProtocol {
+		return protocols[1]
+	}
+	return r.URL.Query().Get("token")
+}
+
+// websocketProtocols 解析 Sec-WebSocket-Protocol 请求头
+func websocketProtocols(r *http.Request) []string {
+	var protocols []string
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(header, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				protocols = append(protocols, p)
+			}
+		}
+	}
+	return protocols
+}
+
+// checkOrigin 校验 WebSocket 握手的 Origin，防止其他站点的页面借用户的身份建立连接
+// 没有 Origin 的请求来自非浏览器客户端，不受同源策略约束，直接放行
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	for _, allowed := range strings.Split(*allowedOrigins, ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "*" || strings.EqualFold(allowed, u.Scheme+"://"+u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// authRequired 认证中间件，成功时设置 user_id
+func authRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := requestToken(c.Request)
+		if token == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "未授权"})
+			c.Abort()
+			return
+		}
+		userID, err := verifyToken(token)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "无效的 token"})
+			c.Abort()
+			return
+		}
+		c.Set("user_id", userID)
+		c.Next()
+	}
+}
+
+// currentUserID 获取当前登录用户 ID
+func currentUserID(c *gin.Context) uint {
+	return c.GetUint("user_id")
+}
+
+// handleSignup 注册用户，返回登录令牌
+func handleSignup(c *gin.Context) {
+	var req struct {
+		Username string `json:"username" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// bcrypt 只使用前 72 字节
+	if len(req.Password) < 8 || len(req.Password) > 72 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "密码长度需在 8 到 72 个字符之间"})
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "密码处理失败"})
+		return
+	}
+	user := User{Username: strings.TrimSpace(req.Username), PasswordHash: string(hash)}
+	if err := db.Create(&user).Error; err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "用户名已存在"})
+		return
+	}
+	respondWithToken(c, http.StatusCreated, user)
+}
+
+// handleLogin 登录，用户名不存在和密码错误返回相同的提示
+func handleLogin(c *gin.Context) {
+	var req struct {
+		Username string `json:"username" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var user User
+	err := db.Where("username = ?", strings.TrimSpace(req.Username)).First(&user).Error
+	if err != nil || bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)) != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "用户名或密码错误"})
+		return
+	}
+	respondWithToken(c, http.StatusOK, user)
+}
+
+// respondWithToken 签发令牌并返回用户信息
+func respondWithToken(c *gin.Context, status int, user User) {
+	token, expiresAt, err := generateToken(user.ID, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "生成 token 失败"})
+		return
+	}
+	c.JSON(status, gin.H{"token": token, "expires_at": expiresAt, "data": user})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// setFlag 临时修改 flag 的值，测试结束后恢复
+func setFlag(t *testing.T, p *string, value string) {
+	old := *p
+	*p = value
+	t.Cleanup(func() { *p = old })
+}
+
+func TestCheckOrigin(t *testing.T) {
+	setFlag(t, allowedOrigins, "http://localhost:8080, https://chat.example.com")
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true}, // 非浏览器客户端
+		{"http://localhost:8080", true},
+		{"HTTPS://Chat.Example.com", true},
+		{"https://chat.example.com/path", true},
+		{"http://localhost:3000", false},
+		{"http://chat.example.com", false},
+		{"https://evil.example", false},
+		{"null", false},
+		{"://bad", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := checkOrigin(r); got != tt.want {
+			t.Errorf("checkOrigin(%q) = %v; 期望 %v", tt.origin, got, tt.want)
+		}
+	}
+
+	setFlag(t, allowedOrigins, "*")
+	r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	r.Header.Set("Origin", "https://evil.example")
+	if !checkOrigin(r) {
+		t.Error("允许列表为 * 时应放行任意来源")
+	}
+}
+
+func TestRequestToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		auth     string
+		protocol string
+		query    string
+		want     string
+	}{
+		{"Authorization 请求头", "Bearer h", "", "", "h"},
+		{"Bearer 不区分大小写", "bearer  h ", "", "", "h"},
+		{"请求头优先", "Bearer h", "bearer, p", "?token=q", "h"},
+		{"子协议", "", "bearer, p", "?token=q", "p"},
+		{"其他认证方式", "Basic abc", "bearer, p", "", "p"},
+		{"只有 bearer 子协议", "", "bearer", "", ""},
+		{"多余的子协议", "", "bearer, p, x", "?token=q", "q"},
+		{"不认识的子协议", "", "chat, p", "", ""},
+		{"查询参数", "", "", "?token=q", "q"},
+		{"没有令牌", "", "", "", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/ws"+tt.query, nil)
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		if tt.protocol != "" {
+			r.Header.Set("Sec-WebSocket-Protocol", tt.protocol)
+		}
+		if got := requestToken(r); got != tt.want {
+			t.Errorf("%s: requestToken = %q; 期望 %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEnsureJWTSecret(t *testing.T) {
+	setFlag(t, redisAddr, "")
+	setFlag(t, jwtSecret, insecureJWTSecret)
+	if ensureJWTSecret() == nil {
+		t.Error("使用公开的默认密钥时应拒绝启动")
+	}
+
+	*jwtSecret = ""
+	if err := ensureJWTSecret(); err != nil || len(*jwtSecret) != 64 {
+		t.Errorf("未设置密钥: %v %q; 期望生成 32 字节的随机密钥", err, *jwtSecret)
+	}
+
+	*jwtSecret = "custom"
+	if err := ensureJWTSecret(); err != nil || *jwtSecret != "custom" {
+		t.Errorf("自定义密钥: %v %q; 期望保持不变", err, *jwtSecret)
+	}
+
+	*jwtSecret = ""
+	*redisAddr = "localhost:6379"
+	if ensureJWTSecret() == nil || *jwtSecret != "" {
+		t.Error("多节点部署时未设置密钥应拒绝启动")
+	}
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setFlag(t, allowedOrigins, "http://localhost:8080")
+	db = initDatabase(filepath.Join(t.TempDir(), "chat.db"))
+	hub = startHub(t, nil)
+	user := User{Username: "alice"}
+	db.Create(&user)
+	token, _, err := generateToken(user.ID, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(setupRouter())
+	t.Cleanup(srv.Close)
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	rejected := []struct {
+		name   string
+		header http.Header
+		code   int
+	}{
+		{"没有令牌", http.Header{"Origin": {"http://localhost:8080"}}, http.StatusUnauthorized},
+		{"无效令牌", http.Header{"Sec-WebSocket-Protocol": {"bearer, invalid"}}, http.StatusUnauthorized},
+		{"其他站点的页面", http.Header{"Origin": {"https://evil.example"}, "Authorization": {"Bearer " + token}}, http.StatusForbidden},
+	}
+	for _, tt := range rejected {
+		conn, resp, err := websocket.DefaultDialer.Dial(wsURL, tt.header)
+		if err == nil {
+			conn.Close()
+			t.Errorf("%s: 握手成功; 期望被拒绝", tt.name)
+			continue
+		}
+		if resp == nil || resp.StatusCode != tt.code {
+			t.Errorf("%s: %v; 期望状态码 %d", tt.name, err, tt.code)
+		}
+	}
+
+	// 浏览器通过子协议携带令牌，服务端只回显 bearer，令牌不会出现在响应中
+	conn, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{
+		"Origin":                 {"http://localhost:8080"},
+		"Sec-WebSocket-Protocol": {wsTokenProtocol + ", " + token},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != wsTokenProtocol || conn.Subprotocol() != wsTokenProtocol {
+		t.Errorf("响应子协议 %q; 期望 %q", got, wsTokenProtocol)
+	}
+	conn.Close()
+
+	// 等待服务端处理完断开，避免其读取全局 db 时与后续测试竞争
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var u User
+		db.First(&u, user.ID)
+		if !u.Online && u.LastSeenAt != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("连接关闭后用户仍在线")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
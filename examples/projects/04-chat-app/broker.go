@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Event 经 broker 在节点间广播的事件，Delivery 与 Membership 只有一个非空
+type Event struct {
+	Delivery   *delivery   `json:"delivery,omitempty"`
+	Membership *membership `json:"membership,omitempty"`
+}
+
+// Broker 节点间的事件总线：Hub 把投递和成员变化发布到 broker，再把订阅到的事件应用到本节点的连接上，
+// 因此连接在不同节点上的用户也能在同一个聊天室聊天
+type Broker interface {
+	// Publish 发布事件，所有订阅者（包括发布者所在节点）都会按发布顺序收到
+	Publish(e Event) error
+	// Subscribe 订阅事件，返回的通道在 broker 关闭后关闭
+	Subscribe() (<-chan Event, error)
+	// Close 关闭 broker 及所有订阅
+	Close() error
+}
+
+var errBrokerClosed = errors.New("broker 已关闭")
+
+// memoryBroker 进程内 broker，用于单节点部署和测试
+type memoryBroker struct {
+	mu     sync.Mutex
+	subs   []chan Event
+	closed bool
+}
+
+// newMemoryBroker 创建进程内 broker
+func newMemoryBroker() *memoryBroker {
+	return &memoryBroker{}
+}
+
+// Publish 依次写入每个订阅通道，通道已满时等待，保证不丢失、不乱序
+func (b *memoryBroker) Publish(e Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return errBrokerClosed
+	}
+	for _, sub := range b.subs {
+		sub <- e
+	}
+	return nil
+}
+
+func (b *memoryBroker) Subscribe() (<-chan Event, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, errBrokerClosed
+	}
+	sub := make(chan Event, 256)
+	b.subs = append(b.subs, sub)
+	return sub, nil
+}
+
+func (b *memoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.closed = true
+		for _, sub := range b.subs {
+			close(sub)
+		}
+	}
+	return nil
+}
+
+// redisBroker 基于 Redis 发布订阅的 broker，多个节点连接同一个 Redis 和频道即可互通
+// Redis 发布订阅不持久化，节点断线期间的事件会丢失，客户端可以通过历史接口补齐消息
+type redisBroker struct {
+	client  *redis.Client
+	channel string
+
+	mu   sync.Mutex
+	subs []*redis.PubSub
+}
+
+// newRedisBroker 连接 Redis，连接失败时返回错误
+func newRedisBroker(addr, channel string) (*redisBroker, error) {
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &redisBroker{client: client, channel: channel}, nil
+}
+
+func (b *redisBroker) Publish(e Event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+	defer cancel()
+	return b.client.Publish(ctx, b.channel, payload).Err()
+}
+
+// Subscribe 等待 Redis 确认订阅后返回，之后发布的事件都能收到；连接断开时 go-redis 会自动重新订阅
+func (b *redisBroker) Subscribe() (<-chan Event, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pubsub := b.client.Subscribe(ctx, b.channel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	b.mu.Lock()
+	b.subs = append(b.subs, pubsub)
+	b.mu.Unlock()
+
+	events := make(chan Event, 256)
+	go func() {
+		defer close(events)
+		for msg := range pubsub.Channel() {
+			var e Event
+			if err := json.Unmarshal([]byte(msg.Payload), &e); err != nil {
+				log.Println("无法解析 broker 事件:", err)
+				continue
+			}
+			events <- e
+		}
+	}()
+	return events, nil
+}
+
+func (b *redisBroker) Close() error {
+	b.mu.Lock()
+	for _, pubsub := range b.subs {
+		pubsub.Close()
+	}
+	b.subs = nil
+	b.mu.Unlock()
+	return b.client.Close()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// testTwoNodes 两个节点各自连接 newBroker 返回的 broker，用户分布在不同节点上
+func testTwoNodes(t *testing.T, newBroker func() Broker) {
+	// 各节点共用同一个数据库
+	db = initDatabase(filepath.Join(t.TempDir(), "chat.db"))
+	nodeA := startHub(t, newBroker())
+	nodeB := startHub(t, newBroker())
+
+	alice := testClient(nodeA, 1, 10)
+	bobPhone := testClient(nodeA, 2)
+	bobLaptop := testClient(nodeB, 2)
+	carol := testClient(nodeB, 3, 10)
+
+	// 聊天室消息到达所有节点上的在线成员
+	nodeA.publish(Event{Delivery: &delivery{RoomID: 10, Data: []byte("room10")}})
+	expectReceived(t, "alice", alice, "room10")
+	expectReceived(t, "carol", carol, "room10")
+	expectReceived(t, "bob 手机", bobPhone)
+	expectReceived(t, "bob 电脑", bobLaptop)
+
+	// 私聊到达接收者在各节点上的所有连接
+	nodeB.publish(Event{Delivery: &delivery{UserIDs: []uint{3, 2}, Data: []byte("dm")}})
+	expectReceived(t, "bob 手机", bobPhone, "dm")
+	expectReceived(t, "bob 电脑", bobLaptop, "dm")
+	expectReceived(t, "carol", carol, "dm")
+	expectReceived(t, "alice", alice)
+
+	// 在一个节点上加入聊天室，对用户在其他节点上的连接同样生效
+	nodeA.publish(Event{Membership: &membership{UserID: 2, RoomID: 10, Join: true}})
+	nodeA.publish(Event{Membership: &membership{UserID: 3, RoomID: 10, Join: false}})
+	nodeB.publish(Event{Delivery: &delivery{RoomID: 10, Data: []byte("after")}})
+	expectReceived(t, "alice", alice, "after")
+	expectReceived(t, "bob 手机", bobPhone, "after")
+	expectReceived(t, "bob 电脑", bobLaptop, "after")
+	expectReceived(t, "carol", carol)
+}
+
+func TestMemoryBrokerNodes(t *testing.T) {
+	broker := newMemoryBroker()
+	defer broker.Close()
+	testTwoNodes(t, func() Broker { return broker })
+}
+
+func TestRedisBrokerNodes(t *testing.T) {
+	server := miniredis.RunT(t)
+	testTwoNodes(t, func() Broker {
+		broker, err := newRedisBroker(server.Addr(), "chat:test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { broker.Close() })
+		return broker
+	})
+}
+
+func TestBrokerClose(t *testing.T) {
+	broker := newMemoryBroker()
+	events, _ := broker.Subscribe()
+	broker.Close()
+	if _, ok := <-events; ok {
+		t.Error("关闭后订阅通道应关闭")
+	}
+	if err := broker.Publish(Event{}); err != errBrokerClosed {
+		t.Errorf("关闭后发布返回 %v; 期望 %v", err, errBrokerClosed)
+	}
+}
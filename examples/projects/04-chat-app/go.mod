@@ -3,8 +3,12 @@ module go-study/examples/projects/04-chat-app
 go 1.21
 
 require (
+	github.com/alicebob/miniredis/v2 v2.31.1
 	github.com/gin-gonic/gin v1.9.1
+	github.com/golang-jwt/jwt/v5 v5.2.0
 	github.com/gorilla/websocket v1.5.1
+	github.com/redis/go-redis/v9 v9.5.1
+	golang.org/x/crypto v0.9.0
 	gorm.io/driver/sqlite v1.5.4
 	gorm.io/gorm v1.25.5
 )
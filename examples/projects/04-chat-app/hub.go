@@ -0,0 +1,306 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 连接参数，测试中会缩短
+var (
+	writeWait      = 10 * time.Second  // 单次写入的超时时间
+	pongWait       = 60 * time.Second  // 超过该时间没有收到 pong 或任何帧即断开
+	pingPeriod     = pongWait * 9 / 10 // ping 间隔，必须小于 pongWait
+	maxMessageSize = int64(16 * 1024)  // 客户端单条消息的最大字节数，超出时以 1009 关闭连接
+	sendBufferSize = 256               // 每个连接的发送缓冲，写满即视为慢消费者被断开
+	maxBatchFrames = 64                // 一条 WebSocket 消息最多合并的帧数
+)
+
+// Client WebSocket 客户端，同一用户可以有多个连接（多设备）
+type Client struct {
+	ID   uint // 握手时认证的用户 ID
+	Conn *websocket.Conn
+	Send chan []byte
+	Hub  *Hub
+
+	// evicted 因发送缓冲已满被 hub 断开，由 hub 在关闭 Send 之前写入，writePump 在 Send 关闭后读取
+	evicted bool
+}
+
+// delivery 一条待投递的消息：RoomID 非 0 时投递给聊天室的在线成员，否则投递给 UserIDs 的所有连接
+type delivery struct {
+	RoomID  uint   `json:"room_id,omitempty"`
+	UserIDs []uint `json:"user_ids,omitempty"`
+	Data    []byte `json:"data"`
+}
+
+// membership 用户加入或退出聊天室
+type membership struct {
+	UserID uint `json:"user_id"`
+	RoomID uint `json:"room_id"`
+	Join   bool `json:"join"`
+}
+
+// reply 只发给某个连接的帧，不经过 broker
+type reply struct {
+	Client *Client
+	Data   []byte
+}
+
+// Hub 管理本节点的连接和路由，节点间通过 broker 同步投递和成员变化
+// users 和 rooms 只在 run 中修改，其他 goroutine 通过 mu 读取
+type Hub struct {
+	users      map[uint]map[*Client]bool // 用户 → 该用户在本节点的所有连接
+	rooms      map[uint]map[uint]bool    // 聊天室 → 本节点的在线成员
+	userRooms  map[uint]map[uint]bool    // 在线用户 → 已加入的聊天室，用户最后一个连接断开时据此退出 rooms
+	broker     Broker
+	events     <-chan Event
+	replies    chan reply
+	register   chan *Client
+	unregister chan *Client
+	mu         sync.RWMutex
+}
+
+// newHub 创建 Hub 并订阅 broker，需要启动 run
+func newHub(broker Broker) (*Hub, error) {
+	events, err := broker.Subscribe()
+	if err != nil {
+		return nil, err
+	}
+	return &Hub{
+		users:      make(map[uint]map[*Client]bool),
+		rooms:      make(map[uint]map[uint]bool),
+		userRooms:  make(map[uint]map[uint]bool),
+		broker:     broker,
+		events:     events,
+		replies:    make(chan reply),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+	}, nil
+}
+
+// run 处理本节点的连接变化和 broker 事件，broker 关闭后退出
+func (h *Hub) run() {
+	for {
+		select {
+		case client := <-h.register:
+			// 用户在本节点的第一个连接在这里加载聊天室：之前提交的加入、退出已包含在结果中，
+			// 之后发布的成员变化在登记完成后才会被处理，不会丢失；查询时不持有锁
+			var rooms []uint
+			if h.users[client.ID] == nil {
+				rooms = userRooms(client.ID)
+			}
+			h.mu.Lock()
+			h.addClient(client, rooms)
+			h.mu.Unlock()
+
+		case client := <-h.unregister:
+			h.mu.Lock()
+			h.removeClient(client)
+			h.mu.Unlock()
+
+		case r := <-h.replies:
+			// 连接已注销（Send 已关闭）时丢弃
+			h.mu.Lock()
+			if h.users[r.Client.ID][r.Client] {
+				h.send(r.Client, r.Data)
+			}
+			h.mu.Unlock()
+
+		case e, ok := <-h.events:
+			if !ok {
+				return
+			}
+			h.mu.Lock()
+			h.apply(e)
+			h.mu.Unlock()
+		}
+	}
+}
+
+// publish 将事件发布到 broker，所有节点（包括本节点）收到后各自投递给本地连接
+func (h *Hub) publish(e Event) {
+	if err := h.broker.Publish(e); err != nil {
+		log.Println("发布事件失败:", err)
+	}
+}
+
+// apply 应用 broker 事件
+func (h *Hub) apply(e Event) {
+	if m := e.Membership; m != nil {
+		if m.Join {
+			h.joinRoom(m.UserID, m.RoomID)
+		} else {
+			h.leaveRoom(m.UserID, m.RoomID)
+		}
+	}
+	if e.Delivery != nil {
+		h.deliver(*e.Delivery)
+	}
+}
+
+// addClient 登记连接，用户的第一个连接上线时加入 rooms 中的聊天室
+func (h *Hub) addClient(client *Client, rooms []uint) {
+	if h.users[client.ID] == nil {
+		h.users[client.ID] = make(map[*Client]bool)
+		h.userRooms[client.ID] = make(map[uint]bool)
+	}
+	h.users[client.ID][client] = true
+	for _, roomID := range rooms {
+		h.joinRoom(client.ID, roomID)
+	}
+}
+
+// removeClient 注销连接并关闭 Send，用户的最后一个连接断开时退出所有聊天室
+func (h *Hub) removeClient(client *Client) {
+	clients := h.users[client.ID]
+	if !clients[client] {
+		return
+	}
+	delete(clients, client)
+	close(client.Send)
+	if len(clients) > 0 {
+		return
+	}
+	for roomID := range h.userRooms[client.ID] {
+		h.leaveRoom(client.ID, roomID)
+	}
+	delete(h.users, client.ID)
+	delete(h.userRooms, client.ID)
+}
+
+// joinRoom 本节点的在线用户加入聊天室，其他用户在下次连接时从数据库加载
+func (h *Hub) joinRoom(userID, roomID uint) {
+	if h.userRooms[userID] == nil {
+		return
+	}
+	h.userRooms[userID][roomID] = true
+	if h.rooms[roomID] == nil {
+		h.rooms[roomID] = make(map[uint]bool)
+	}
+	h.rooms[roomID][userID] = true
+}
+
+// leaveRoom 用户退出聊天室
+func (h *Hub) leaveRoom(userID, roomID uint) {
+	delete(h.userRooms[userID], roomID)
+	delete(h.rooms[roomID], userID)
+	if len(h.rooms[roomID]) == 0 {
+		delete(h.rooms, roomID)
+	}
+}
+
+// deliver 投递到目标用户的每个连接，发送缓冲已满的连接被断开
+func (h *Hub) deliver(d delivery) {
+	targets := d.UserIDs
+	if d.RoomID != 0 {
+		targets = make([]uint, 0, len(h.rooms[d.RoomID]))
+		for userID := range h.rooms[d.RoomID] {
+			targets = append(targets, userID)
+		}
+	}
+	seen := make(map[uint]bool, len(targets))
+	for _, userID := range targets {
+		if seen[userID] {
+			continue
+		}
+		seen[userID] = true
+		for client := range h.users[userID] {
+			h.send(client, d.Data)
+		}
+	}
+}
+
+// send 非阻塞写入连接的发送缓冲，已满时断开该连接：慢消费者不能拖慢 hub 和其他连接，
+// 客户端重连后可以通过历史接口补齐错过的消息
+func (h *Hub) send(client *Client, data []byte) {
+	select {
+	case client.Send <- data:
+	default:
+		log.Printf("用户 %d 的连接发送缓冲已满，断开连接", client.ID)
+		client.evicted = true
+		h.removeClient(client)
+	}
+}
+
+// readPump 读取客户端发来的帧，协议见 protocol.go
+// 每个连接只有一个 readPump，超过 pongWait 没有收到 pong 或任何帧时读取超时，连接被注销
+func (c *Client) readPump() {
+	defer func() {
+		c.Hub.unregister <- c
+		c.Conn.Close()
+	}()
+
+	c.Conn.SetReadLimit(maxMessageSize)
+	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.Conn.SetPongHandler(func(string) error {
+		return c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		_, frame, err := c.Conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("用户 %d 的连接异常断开: %v", c.ID, err)
+			}
+			break
+		}
+		c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+		c.handleFrame(frame)
+	}
+}
+
+// writePump 将 Send 中的帧写入连接并定期发送 ping
+// 每个连接只有一个 writePump，它是唯一的写入者；Send 被 hub 关闭后发送关闭帧并退出
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.Conn.Close()
+	}()
+
+	for {
+		select {
+		case frame, ok := <-c.Send:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				c.Conn.WriteMessage(websocket.CloseMessage, c.closeMessage())
+				return
+			}
+			if err := c.writeBatch(frame); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writeBatch 将 first 和 Send 中已排队的帧合并为一条 WebSocket 消息，帧之间以换行分隔
+func (c *Client) writeBatch(first []byte) error {
+	w, err := c.Conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+	w.Write(first)
+	// 只有 writePump 读取 Send，len 大于 0 时读取不会阻塞
+	for i := 1; i < maxBatchFrames && len(c.Send) > 0; i++ {
+		w.Write([]byte{'\n'})
+		w.Write(<-c.Send)
+	}
+	return w.Close()
+}
+
+// closeMessage 连接被 hub 注销时发送的关闭帧
+func (c *Client) closeMessage() []byte {
+	if c.evicted {
+		return websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "slow consumer")
+	}
+	return websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startHub 创建并启动 Hub，broker 为 nil 时使用单独的进程内 broker
+func startHub(t *testing.T, broker Broker) *Hub {
+	t.Helper()
+	if broker == nil {
+		memory := newMemoryBroker()
+		t.Cleanup(func() { memory.Close() })
+		broker = memory
+	}
+	h, err := newHub(broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go h.run()
+	return h
+}
+
+// testClient 不带 WebSocket 连接的客户端，直接从 Send 读取投递结果
+// rooms 写入数据库的成员关系，由 hub 在用户上线时加载
+func testClient(h *Hub, userID uint, rooms ...uint) *Client {
+	for _, roomID := range rooms {
+		db.Where(RoomMember{RoomID: roomID, UserID: userID}).FirstOrCreate(&RoomMember{})
+	}
+	c := &Client{ID: userID, Send: make(chan []byte, 8), Hub: h}
+	h.register <- c
+	return c
+}
+
+// received 读取客户端已收到的消息，等待 hub 处理完之前发出的投递
+func received(c *Client) []string {
+	var got []string
+	for {
+		select {
+		case data := <-c.Send:
+			got = append(got, string(data))
+		case <-time.After(50 * time.Millisecond):
+			return got
+		}
+	}
+}
+
+func expectReceived(t *testing.T, name string, c *Client, want ...string) {
+	t.Helper()
+	got := received(c)
+	if len(got) != len(want) {
+		t.Errorf("%s 收到 %q; 期望 %q", name, got, want)
+		return
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("%s 收到 %q; 期望 %q", name, got, want)
+			return
+		}
+	}
+}
+
+func TestHubRoutesByRoomAndRecipient(t *testing.T) {
+	db = initDatabase(filepath.Join(t.TempDir(), "chat.db"))
+	h := startHub(t, nil)
+
+	alicePhone := testClient(h, 1, 10)
+	aliceLaptop := testClient(h, 1, 10)
+	bob := testClient(h, 2, 10, 20)
+	carol := testClient(h, 3, 20)
+	dave := testClient(h, 4)
+
+	// 聊天室消息只到达在线成员的所有连接
+	h.publish(Event{Delivery: &delivery{RoomID: 10, Data: []byte("room10")}})
+	expectReceived(t, "alice 手机", alicePhone, "room10")
+	expectReceived(t, "alice 电脑", aliceLaptop, "room10")
+	expectReceived(t, "bob", bob, "room10")
+	expectReceived(t, "carol", carol)
+	expectReceived(t, "dave", dave)
+
+	// 私聊只到达双方的所有连接
+	h.publish(Event{Delivery: &delivery{UserIDs: []uint{2, 1}, Data: []byte("dm")}})
+	expectReceived(t, "alice 手机", alicePhone, "dm")
+	expectReceived(t, "alice 电脑", aliceLaptop, "dm")
+	expectReceived(t, "bob", bob, "dm")
+	expectReceived(t, "carol", carol)
+
+	// 加入和退出聊天室对用户的所有连接生效
+	h.publish(Event{Membership: &membership{UserID: 4, RoomID: 10, Join: true}})
+	h.publish(Event{Membership: &membership{UserID: 1, RoomID: 10, Join: false}})
+	h.publish(Event{Delivery: &delivery{RoomID: 10, Data: []byte("after")}})
+	expectReceived(t, "alice 手机", alicePhone)
+	expectReceived(t, "alice 电脑", aliceLaptop)
+	expectReceived(t, "bob", bob, "after")
+	expectReceived(t, "dave", dave, "after")
+
+	// 一个设备断开后另一个设备仍能收到；最后一个设备断开后用户离开聊天室
+	h.unregister <- alicePhone
+	h.publish(Event{Delivery: &delivery{UserIDs: []uint{1}, Data: []byte("dm2")}})
+	expectReceived(t, "alice 电脑", aliceLaptop, "dm2")
+	h.unregister <- bob
+	h.publish(Event{Delivery: &delivery{RoomID: 20, Data: []byte("room20")}})
+	expectReceived(t, "carol", carol, "room20")
+	if _, ok := <-bob.Send; ok {
+		t.Error("断开的连接应关闭 Send")
+	}
+	h.mu.RLock()
+	if h.rooms[20][2] || h.users[2] != nil {
+		t.Error("bob 断开后仍在 hub 中")
+	}
+	h.mu.RUnlock()
+}
+
+func TestRegisterLoadsRooms(t *testing.T) {
+	db = initDatabase(filepath.Join(t.TempDir(), "chat.db"))
+	h := startHub(t, nil)
+	db.Create(&[]Room{{Name: "general"}, {Name: "random"}})
+	db.Create(&RoomMember{RoomID: 2, UserID: 1})
+
+	// 连接登记之前（用户在本节点还不在线）发生的加入和退出，由 hub 登记时从数据库加载
+	if _, err := addRoomMember(h, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeRoomMember(h, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	alice := testClient(h, 1)
+	h.publish(Event{Delivery: &delivery{RoomID: 1, Data: []byte("general")}})
+	h.publish(Event{Delivery: &delivery{RoomID: 2, Data: []byte("random")}})
+	expectReceived(t, "alice", alice, "general")
+
+	// 登记之后的成员变化通过事件生效，第二个连接沿用已加载的聊天室
+	aliceLaptop := testClient(h, 1)
+	addRoomMember(h, 1, 2)
+	removeRoomMember(h, 1, 1)
+	h.publish(Event{Delivery: &delivery{RoomID: 1, Data: []byte("general")}})
+	h.publish(Event{Delivery: &delivery{RoomID: 2, Data: []byte("random")}})
+	expectReceived(t, "alice", alice, "random")
+	expectReceived(t, "alice 电脑", aliceLaptop, "random")
+}
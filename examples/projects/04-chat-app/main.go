@@ -2,10 +2,13 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"flag"
 	"log"
 	"net/http"
-	"sync"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -16,19 +19,23 @@ import (
 
 // User 用户模型
 type User struct {
-	ID       uint   `json:"id" gorm:"primaryKey"`
-	Username string `json:"username" gorm:"unique;not null"`
-	Online   bool   `json:"online" gorm:"default:false"`
+	ID           uint       `json:"id" gorm:"primaryKey"`
+	Username     string     `json:"username" gorm:"unique;not null"`
+	PasswordHash string     `json:"-"`
+	Online       bool       `json:"online" gorm:"default:false"`
+	Connections  int        `json:"-" gorm:"not null;default:0"` // 所有节点上的连接数，大于 0 即在线
+	LastSeenAt   *time.Time `json:"last_seen_at"`                // 最后一次连接或断开的时间
 }
 
 // Message 消息模型
 type Message struct {
 	ID        uint      `json:"id" gorm:"primaryKey"`
-	FromID    uint      `json:"from_id"`
+	FromID    uint      `json:"from_id" gorm:"uniqueIndex:idx_message_client"`
 	ToID      uint      `json:"to_id"`   // 0 表示群组消息
 	RoomID    uint      `json:"room_id"` // 0 表示私聊
 	Content   string    `json:"content" gorm:"type:text"`
-	Type      string    `json:"type" gorm:"default:text"` // text, image, file
+	Type      string    `json:"type" gorm:"default:text"`                                  // text, image, file
+	ClientID  *string   `json:"client_id,omitempty" gorm:"uniqueIndex:idx_message_client"` // WebSocket send 帧的 id，用于重发去重；HTTP 发送的消息为 NULL
 	CreatedAt time.Time `json:"created_at"`
 }
 
@@ -39,120 +46,44 @@ type Room struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
-// Client WebSocket 客户端
-type Client struct {
-	ID   uint
-	Conn *websocket.Conn
-	Send chan []byte
-	Hub  *Hub
-}
-
-// Hub 管理所有客户端
-type Hub struct {
-	clients    map[*Client]bool
-	broadcast  chan []byte
-	register   chan *Client
-	unregister chan *Client
-	mu         sync.RWMutex
-}
-
 var (
 	db       *gorm.DB
 	upgrader = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
-	}
-	hub = &Hub{
-		clients:    make(map[*Client]bool),
-		broadcast:  make(chan []byte),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
+		CheckOrigin:  checkOrigin,
+		Subprotocols: []string{wsTokenProtocol},
 	}
+	hub *Hub
+
+	dbPath       = flag.String("db", "chat.db", "SQLite 数据库文件")
+	addr         = flag.String("addr", ":8080", "监听地址")
+	redisAddr    = flag.String("redis-addr", "", "Redis 地址，设置后通过 Redis 发布订阅与其他节点互通，为空时只在本进程内投递")
+	redisChannel = flag.String("redis-channel", "chat:events", "节点间事件使用的 Redis 频道")
 )
 
-func init() {
-	var err error
-	db, err = gorm.Open(sqlite.Open("chat.db"), &gorm.Config{})
+// initDatabase 初始化数据库并自动迁移
+func initDatabase(path string) *gorm.DB {
+	conn, err := gorm.Open(sqlite.Open(path+"?_busy_timeout=5000"), &gorm.Config{})
 	if err != nil {
 		log.Fatal("连接数据库失败:", err)
 	}
-
-	db.AutoMigrate(&User{}, &Message{}, &Room{})
-}
-
-func (h *Hub) run() {
-	for {
-		select {
-		case client := <-h.register:
-			h.mu.Lock()
-			h.clients[client] = true
-			h.mu.Unlock()
-
-		case client := <-h.unregister:
-			h.mu.Lock()
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.Send)
-			}
-			h.mu.Unlock()
-
-		case message := <-h.broadcast:
-			h.mu.RLock()
-			for client := range h.clients {
-				select {
-				case client.Send <- message:
-				default:
-					close(client.Send)
-					delete(h.clients, client)
-				}
-			}
-			h.mu.RUnlock()
-		}
+	if err := migrateMessageClientIndex(conn); err != nil {
+		log.Fatal("数据库迁移失败:", err)
 	}
-}
-
-func (c *Client) readPump() {
-	defer func() {
-		c.Hub.unregister <- c
-		c.Conn.Close()
-	}()
-
-	for {
-		_, message, err := c.Conn.ReadMessage()
-		if err != nil {
-			break
-		}
-
-		var msg Message
-		if err := json.Unmarshal(message, &msg); err != nil {
-			continue
-		}
-
-		msg.FromID = c.ID
-		msg.CreatedAt = time.Now()
-		db.Create(&msg)
-
-		// 广播消息
-		c.Hub.broadcast <- message
+	if err := conn.AutoMigrate(&User{}, &Message{}, &Room{}, &RoomMember{}, &Node{}, &NodeConnection{}); err != nil {
+		log.Fatal("数据库迁移失败:", err)
 	}
+	return conn
 }
 
-func (c *Client) writePump() {
-	defer c.Conn.Close()
-
-	for {
-		select {
-		case message, ok := <-c.Send:
-			if !ok {
-				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-			c.Conn.WriteMessage(websocket.TextMessage, message)
-		}
+// newBroker 根据 -redis-addr 选择 broker
+func newBroker() (Broker, error) {
+	if *redisAddr == "" {
+		return newMemoryBroker(), nil
 	}
+	return newRedisBroker(*redisAddr, *redisChannel)
 }
 
+// handleWebSocket 升级为 WebSocket 连接，需放在 authRequired 之后，未认证的请求不会升级
 func handleWebSocket(c *gin.Context) {
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
@@ -160,97 +91,106 @@ func handleWebSocket(c *gin.Context) {
 		return
 	}
 
-	userID := uint(1) // 简化处理，实际应从认证获取
+	userID := currentUserID(c)
 	client := &Client{
 		ID:   userID,
 		Conn: conn,
-		Send: make(chan []byte, 256),
+		Send: make(chan []byte, sendBufferSize),
 		Hub:  hub,
 	}
 
 	client.Hub.register <- client
-
-	// 更新用户在线状态
-	db.Model(&User{}).Where("id = ?", userID).Update("online", true)
+	connected(client.Hub, userID)
 
 	go client.writePump()
-	go client.readPump()
+	go func() {
+		client.readPump()
+		disconnected(client.Hub, userID)
+	}()
 }
 
-func main() {
-	go hub.run()
-
+// setupRouter 注册所有路由
+func setupRouter() *gin.Engine {
 	r := gin.Default()
 
-	// 用户管理
-	r.POST("/api/users", func(c *gin.Context) {
-		var user User
-		if err := c.ShouldBindJSON(&user); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-		db.Create(&user)
-		c.JSON(http.StatusCreated, gin.H{"data": user})
-	})
+	// 用户注册与登录
+	r.POST("/api/users", handleSignup)
+	r.POST("/api/login", handleLogin)
 
-	// WebSocket 连接
-	r.GET("/ws", handleWebSocket)
+	// WebSocket 连接：握手时校验令牌和来源
+	r.GET("/ws", authRequired(), handleWebSocket)
 
-	// 发送消息
-	r.POST("/api/messages", func(c *gin.Context) {
-		var msg Message
-		if err := c.ShouldBindJSON(&msg); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-		msg.FromID = 1 // 简化处理
-		msg.CreatedAt = time.Now()
-		db.Create(&msg)
+	api := r.Group("/api", authRequired())
+	{
+		// 消息
+		api.POST("/messages", handleSendMessage)
+		api.GET("/messages", handleListMessages)
 
-		// 通过 WebSocket 发送
-		msgJSON, _ := json.Marshal(msg)
-		hub.broadcast <- msgJSON
+		// 聊天室
+		api.POST("/rooms", handleCreateRoom)
+		api.GET("/rooms", handleListRooms)
+		api.POST("/rooms/:id/join", handleJoinRoom)
+		api.POST("/rooms/:id/leave", handleLeaveRoom)
+		api.GET("/rooms/:id/members", handleListRoomMembers)
 
-		c.JSON(http.StatusCreated, gin.H{"data": msg})
-	})
+		// 在线状态
+		api.GET("/presence", handlePresence)
+	}
 
-	// 获取消息历史
-	r.GET("/api/messages", func(c *gin.Context) {
-		var messages []Message
-		toID := c.Query("to_id")
-		roomID := c.Query("room_id")
+	return r
+}
 
-		query := db
-		if toID != "" {
-			query = query.Where("(from_id = ? AND to_id = ?) OR (from_id = ? AND to_id = ?)", 1, toID, toID, 1)
-		}
-		if roomID != "" {
-			query = query.Where("room_id = ?", roomID)
-		}
+func main() {
+	flag.Parse()
+	if err := ensureJWTSecret(); err != nil {
+		log.Fatal(err)
+	}
+	db = initDatabase(*dbPath)
 
-		query.Order("created_at DESC").Limit(50).Find(&messages)
-		c.JSON(http.StatusOK, gin.H{"data": messages})
-	})
+	broker, err := newBroker()
+	if err != nil {
+		log.Fatal("连接 broker 失败:", err)
+	}
+	defer broker.Close()
+	if *redisAddr == "" {
+		// 单节点部署时上次运行的连接都已断开；多节点时其他节点的连接仍然有效，由心跳超时清除
+		resetPresence()
+	}
+	if hub, err = newHub(broker); err != nil {
+		log.Fatal("订阅 broker 失败:", err)
+	}
+	go hub.run()
 
-	// 创建聊天室
-	r.POST("/api/rooms", func(c *gin.Context) {
-		var room Room
-		if err := c.ShouldBindJSON(&room); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-		db.Create(&room)
-		c.JSON(http.StatusCreated, gin.H{"data": room})
-	})
+	// 登记本节点后再接受连接，之后定期刷新心跳并清除崩溃节点遗留的在线状态
+	if _, err := heartbeat(time.Now()); err != nil {
+		log.Fatal("登记节点失败:", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go runNode(ctx, hub)
+
+	srv := &http.Server{Addr: *addr, Handler: setupRouter()}
+	go func() {
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+		<-sigChan
+
+		log.Println("收到关闭信号，开始优雅关闭...")
+		shutdownCtx, done := context.WithTimeout(context.Background(), 5*time.Second)
+		defer done()
+		srv.Shutdown(shutdownCtx)
+	}()
 
-	// 获取聊天室列表
-	r.GET("/api/rooms", func(c *gin.Context) {
-		var rooms []Room
-		db.Find(&rooms)
-		c.JSON(http.StatusOK, gin.H{"data": rooms})
-	})
+	log.Println("聊天应用启动在", *addr)
+	log.Println("WebSocket 连接: ws://localhost" + *addr + "/ws（需携带登录令牌）")
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 
-	log.Println("聊天应用启动在 :8080")
-	log.Println("WebSocket 连接: ws://localhost:8080/ws")
-	r.Run(":8080")
+	// 已升级的 WebSocket 连接不受 Shutdown 影响，随进程退出断开；主动清除本节点的连接数，
+	// 其他节点不必等到心跳超时，相关用户立即收到下线通知
+	cancel()
+	if err := removeNode(hub, nodeID, time.Now()); err != nil {
+		log.Println("清除本节点在线状态失败:", err)
+	}
+	log.Println("服务已关闭")
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var (
+	errInvalidTarget = errors.New("消息必须指定 room_id 或 to_id 其中之一")
+	errEmptyContent  = errors.New("消息内容不能为空")
+	errNotMember     = errors.New("不是该聊天室成员")
+	errUnknownUser   = errors.New("接收者不存在")
+	errInvalidType   = errors.New("消息类型只能是 text、image 或 file")
+)
+
+// messageTypes 支持的消息类型
+var messageTypes = map[string]bool{"text": true, "image": true, "file": true}
+
+// validateMessage 校验消息目标：聊天室消息要求发送者是成员，私聊要求接收者存在
+func validateMessage(msg *Message) error {
+	msg.Content = strings.TrimSpace(msg.Content)
+	if msg.Type == "" {
+		msg.Type = "text"
+	}
+	switch {
+	case msg.Content == "":
+		return errEmptyContent
+	case !messageTypes[msg.Type]:
+		return errInvalidType
+	case (msg.RoomID == 0) == (msg.ToID == 0):
+		return errInvalidTarget
+	case msg.RoomID != 0 && !isRoomMember(msg.FromID, msg.RoomID):
+		return errNotMember
+	case msg.ToID != 0 && db.Select("id").First(&User{}, msg.ToID).Error != nil:
+		return errUnknownUser
+	}
+	return nil
+}
+
+// migrateMessageClientIndex 将旧版本的普通索引 idx_message_client 改为唯一索引：
+// HTTP 发送的消息 client_id 由空字符串改为 NULL，不参与唯一约束；并发重发留下的重复消息
+// 只保留最早一条的 client_id；最后删除旧索引，由 AutoMigrate 重建为唯一索引
+func migrateMessageClientIndex(conn *gorm.DB) error {
+	var unique []bool
+	if err := conn.Raw(`SELECT "unique" FROM pragma_index_list('messages') WHERE name = 'idx_message_client'`).Scan(&unique).Error; err != nil {
+		return err
+	}
+	if len(unique) == 0 || unique[0] {
+		return nil
+	}
+	return conn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("UPDATE messages SET client_id = NULL WHERE client_id = ''").Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(`UPDATE messages SET client_id = NULL WHERE client_id IS NOT NULL AND id NOT IN
+			(SELECT MIN(id) FROM messages WHERE client_id IS NOT NULL GROUP BY from_id, client_id)`).Error; err != nil {
+			return err
+		}
+		return tx.Exec("DROP INDEX idx_message_client").Error
+	})
+}
+
+// deliverMessage 通过 h 将已保存的消息以 message 帧投递给聊天室的在线成员，或私聊双方的所有连接
+func deliverMessage(h *Hub, msg Message) {
+	d := delivery{RoomID: msg.RoomID, Data: encodeFrame(FrameMessage, "", msg)}
+	if msg.RoomID == 0 {
+		d.UserIDs = []uint{msg.FromID, msg.ToID}
+	}
+	h.publish(Event{Delivery: &d})
+}
+
+// handleSendMessage 通过 HTTP 发送消息
+func handleSendMessage(c *gin.Context) {
+	var msg Message
+	if err := c.ShouldBindJSON(&msg); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	msg.ID, msg.ClientID = 0, nil
+	msg.FromID = currentUserID(c)
+	msg.CreatedAt = time.Now()
+	if err := validateMessage(&msg); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errNotMember) {
+			status = http.StatusForbidden
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if err := db.Create(&msg).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存消息失败"})
+		return
+	}
+
+	// 保存成功后才通过 WebSocket 发送
+	deliverMessage(hub, msg)
+
+	c.JSON(http.StatusCreated, gin.H{"data": msg})
+}
+
+// handleListMessages 获取与某个用户的私聊记录或某个聊天室的消息，聊天室消息只有成员可以查看
+func handleListMessages(c *gin.Context) {
+	var messages []Message
+	toID := c.Query("to_id")
+	roomID := c.Query("room_id")
+	userID := currentUserID(c)
+
+	query := db
+	switch {
+	case toID != "":
+		query = query.Where("room_id = 0 AND ((from_id = ? AND to_id = ?) OR (from_id = ? AND to_id = ?))", userID, toID, toID, userID)
+	case roomID != "":
+		var member int64
+		db.Model(&RoomMember{}).Where("room_id = ? AND user_id = ?", roomID, userID).Count(&member)
+		if member == 0 {
+			c.JSON(http.StatusForbidden, gin.H{"error": errNotMember.Error()})
+			return
+		}
+		query = query.Where("room_id = ?", roomID)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": errInvalidTarget.Error()})
+		return
+	}
+
+	query.Order("created_at DESC").Limit(50).Find(&messages)
+	c.JSON(http.StatusOK, gin.H{"data": messages})
+}
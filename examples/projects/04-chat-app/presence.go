@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxPresenceQuery 一次最多查询的用户数
+const maxPresenceQuery = 100
+
+// Node 运行中的节点，定期刷新心跳；心跳超时的节点视为已崩溃
+type Node struct {
+	ID          string    `gorm:"primaryKey"`
+	HeartbeatAt time.Time `gorm:"index"` // UTC，不同时区的节点之间可以直接比较
+}
+
+// NodeConnection 用户在某个节点上的连接数，users.connections 为各节点之和
+// 节点崩溃后其他节点据此扣减它遗留的连接数
+type NodeConnection struct {
+	NodeID      string `gorm:"primaryKey"`
+	UserID      uint   `gorm:"primaryKey"`
+	Connections int    `gorm:"not null"`
+}
+
+var (
+	// nodeID 本进程的节点 ID，每次启动随机生成
+	nodeID = randomHex(8)
+	// nodeHeartbeat 刷新心跳的间隔，心跳超过 nodeTTL 未刷新的节点由其他节点清除
+	nodeHeartbeat = 10 * time.Second
+	nodeTTL       = 30 * time.Second
+)
+
+// updateConnections 调整用户在本节点上的连接数，同时调整所有节点的合计并刷新 online 和 last_seen_at
+// 返回调整后的合计；本节点的连接数已为 0 时的减少被忽略，changed 为 false
+func updateConnections(userID uint, delta int, now time.Time) (n int, changed bool, err error) {
+	var user User
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var result *gorm.DB
+		if delta > 0 {
+			result = tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "node_id"}, {Name: "user_id"}},
+				DoUpdates: clause.Assignments(map[string]interface{}{"connections": gorm.Expr("node_connections.connections + excluded.connections")}),
+			}).Create(&NodeConnection{NodeID: nodeID, UserID: userID, Connections: delta})
+		} else {
+			// 本节点被判定崩溃时连接数已被其他节点清除，之后的断开不再重复扣减
+			result = tx.Model(&NodeConnection{}).
+				Where("node_id = ? AND user_id = ? AND connections >= ?", nodeID, userID, -delta).
+				Update("connections", gorm.Expr("connections + ?", delta))
+		}
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected > 0 {
+			result = tx.Model(&User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+				"connections":  gorm.Expr("MAX(connections + ?, 0)", delta),
+				"online":       gorm.Expr("connections + ? > 0", delta),
+				"last_seen_at": now,
+			})
+			if result.Error != nil {
+				return result.Error
+			}
+			changed = result.RowsAffected > 0
+		}
+		if err := tx.Where("node_id = ? AND user_id = ? AND connections <= 0", nodeID, userID).Delete(&NodeConnection{}).Error; err != nil {
+			return err
+		}
+		return tx.Select("connections").First(&user, userID).Error
+	})
+	return user.Connections, changed, err
+}
+
+// resetPresence 清除上次运行遗留的连接数，只能在单节点部署启动时调用
+func resetPresence() {
+	db.Where("1 = 1").Delete(&NodeConnection{})
+	db.Where("1 = 1").Delete(&Node{})
+	db.Model(&User{}).Where("connections > 0 OR online").
+		Updates(map[string]interface{}{"connections": 0, "online": false})
+}
+
+// heartbeat 刷新本节点的心跳，本节点的记录不存在时重新登记，registered 为 true
+func heartbeat(now time.Time) (registered bool, err error) {
+	result := db.Model(&Node{}).Where("id = ?", nodeID).Update("heartbeat_at", now.UTC())
+	if result.Error != nil || result.RowsAffected > 0 {
+		return false, result.Error
+	}
+	return true, db.Create(&Node{ID: nodeID, HeartbeatAt: now.UTC()}).Error
+}
+
+// removeNode 删除节点并扣减它遗留的连接数，连接数降为 0 的用户通知相关用户下线
+func removeNode(h *Hub, id string, now time.Time) error {
+	var offline []uint
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// 先写入以取得写锁，多个节点同时清除同一节点时依次执行，后执行的读到的已是清除后的数据
+		if err := tx.Where("id = ?", id).Delete(&Node{}).Error; err != nil {
+			return err
+		}
+		var conns []NodeConnection
+		if err := tx.Where("node_id = ?", id).Find(&conns).Error; err != nil {
+			return err
+		}
+		for _, c := range conns {
+			err := tx.Model(&User{}).Where("id = ?", c.UserID).Updates(map[string]interface{}{
+				"connections":  gorm.Expr("MAX(connections - ?, 0)", c.Connections),
+				"online":       gorm.Expr("connections - ? > 0", c.Connections),
+				"last_seen_at": now,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("node_id = ?", id).Delete(&NodeConnection{}).Error; err != nil {
+			return err
+		}
+		userIDs := make([]uint, len(conns))
+		for i, c := range conns {
+			userIDs[i] = c.UserID
+		}
+		return tx.Model(&User{}).Where("id IN ? AND connections = 0", userIDs).Pluck("id", &offline).Error
+	})
+	if err != nil {
+		return err
+	}
+	for _, userID := range offline {
+		publishPresence(h, userID, false, now)
+	}
+	return nil
+}
+
+// sweepStaleNodes 清除心跳超时的节点，以及没有节点记录的连接数（节点被清除后才断开又重连的情况）
+func sweepStaleNodes(h *Hub, now time.Time) error {
+	var stale []string
+	err := db.Raw(`SELECT id FROM nodes WHERE heartbeat_at < ? AND id <> ?
+		UNION SELECT node_id FROM node_connections WHERE node_id NOT IN (SELECT id FROM nodes) AND node_id <> ?`,
+		now.UTC().Add(-nodeTTL), nodeID, nodeID).Scan(&stale).Error
+	if err != nil {
+		return err
+	}
+	for _, id := range stale {
+		if err := removeNode(h, id, now); err != nil {
+			return err
+		}
+		log.Printf("已清除心跳超时的节点 %s 遗留的连接", id)
+	}
+	return nil
+}
+
+// runNode 定期刷新本节点的心跳并清除崩溃节点遗留的连接数，ctx 取消后退出
+// 启动时需要先调用 heartbeat 登记本节点，再开始接受连接
+func runNode(ctx context.Context, h *Hub) {
+	ticker := time.NewTicker(nodeHeartbeat)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		if registered, err := heartbeat(now); err != nil {
+			log.Println("刷新节点心跳失败:", err)
+		} else if registered {
+			// 心跳中断超过 nodeTTL，已被其他节点清除，此前建立的连接不再计入在线状态
+			log.Println("警告: 本节点曾被判定为崩溃，部分已有连接的在线状态可能不准确")
+		}
+		if err := sweepStaleNodes(h, now); err != nil {
+			log.Println("清除崩溃节点失败:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// presenceAudience 需要知道用户在线状态的人：同一聊天室的成员和有过私聊的用户
+func presenceAudience(userID uint) []uint {
+	var ids []uint
+	db.Raw(`SELECT user_id FROM room_members
+		WHERE room_id IN (SELECT room_id FROM room_members WHERE user_id = ?) AND user_id <> ?
+		UNION SELECT to_id FROM messages WHERE from_id = ? AND room_id = 0 AND to_id <> ?
+		UNION SELECT from_id FROM messages WHERE to_id = ? AND room_id = 0 AND from_id <> ?`,
+		userID, userID, userID, userID, userID, userID).Scan(&ids)
+	return ids
+}
+
+// publishPresence 通知相关用户的所有连接
+func publishPresence(h *Hub, userID uint, online bool, lastSeen time.Time) {
+	audience := presenceAudience(userID)
+	if len(audience) == 0 {
+		return
+	}
+	payload := PresencePayload{UserID: userID, Online: online}
+	if !online {
+		payload.LastSeenAt = &lastSeen
+	}
+	h.publish(Event{Delivery: &delivery{UserIDs: audience, Data: encodeFrame(FramePresence, "", payload)}})
+}
+
+// connected 记录一个新连接，用户的第一个连接上线时通知相关用户
+func connected(h *Hub, userID uint) {
+	now := time.Now()
+	n, changed, err := updateConnections(userID, 1, now)
+	if err != nil {
+		log.Printf("更新用户 %d 的在线状态失败: %v", userID, err)
+		return
+	}
+	if changed && n == 1 {
+		publishPresence(h, userID, true, now)
+	}
+}
+
+// disconnected 记录连接断开，用户的最后一个连接断开时通知相关用户
+func disconnected(h *Hub, userID uint) {
+	now := time.Now()
+	n, changed, err := updateConnections(userID, -1, now)
+	if err != nil {
+		log.Printf("更新用户 %d 的在线状态失败: %v", userID, err)
+		return
+	}
+	if changed && n == 0 {
+		publishPresence(h, userID, false, now)
+	}
+}
+
+// handlePresence 查询用户在线状态，user_ids 为逗号分隔的用户 ID
+// 与 presence 帧的范围相同，只返回自己、同一聊天室的成员和有过私聊的用户，其他用户不出现在结果中
+func handlePresence(c *gin.Context) {
+	userID := currentUserID(c)
+	var ids []uint
+	for _, s := range strings.Split(c.Query("user_ids"), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "无效的用户 ID: " + s})
+			return
+		}
+		ids = append(ids, uint(id))
+	}
+	if len(ids) == 0 || len(ids) > maxPresenceQuery {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user_ids 需要 1-100 个用户 ID"})
+		return
+	}
+
+	visible := map[uint]bool{userID: true}
+	for _, id := range presenceAudience(userID) {
+		visible[id] = true
+	}
+	allowed := ids[:0]
+	for _, id := range ids {
+		if visible[id] {
+			allowed = append(allowed, id)
+		}
+	}
+	users := []User{}
+	if len(allowed) > 0 {
+		db.Where("id IN ?", allowed).Order("id").Find(&users)
+	}
+	data := make([]PresencePayload, len(users))
+	for i, user := range users {
+		data[i] = PresencePayload{UserID: user.ID, Online: user.Online, LastSeenAt: user.LastSeenAt}
+	}
+	c.JSON(http.StatusOK, gin.H{"data": data})
+}
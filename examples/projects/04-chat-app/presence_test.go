@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// expectPresence 检查客户端收到的 presence 帧
+func expectPresence(t *testing.T, name string, c *Client, want ...bool) {
+	t.Helper()
+	frames := decodeFrames(t, c)
+	if len(frames) != len(want) {
+		t.Fatalf("%s 收到 %+v; 期望 %d 个 presence 帧", name, frames, len(want))
+	}
+	for i, f := range frames {
+		var p PresencePayload
+		json.Unmarshal(f.Data, &p)
+		if f.Type != FramePresence || p.Online != want[i] || (!p.Online && p.LastSeenAt == nil) {
+			t.Errorf("%s 收到 %s %+v; 期望 online=%v", name, f.Type, p, want[i])
+		}
+	}
+}
+
+func TestPresenceCountsConnections(t *testing.T) {
+	db = initDatabase(filepath.Join(t.TempDir(), "chat.db"))
+	users := []User{{Username: "alice"}, {Username: "bob"}, {Username: "carol"}, {Username: "dave"}}
+	db.Create(&users)
+	alice, bob, carol, dave := users[0].ID, users[1].ID, users[2].ID, users[3].ID
+	db.Create(&Room{Name: "general"})
+	db.Create(&[]RoomMember{{RoomID: 1, UserID: alice}, {RoomID: 1, UserID: bob}})
+	db.Create(&Message{FromID: carol, ToID: alice, Content: "hi"})
+
+	h := startHub(t, nil)
+	bobConn := testClient(h, bob)
+	carolConn := testClient(h, carol)
+	daveConn := testClient(h, dave)
+
+	// 第一个连接上线时通知聊天室成员和私聊过的用户，第二个连接不再通知
+	connected(h, alice)
+	connected(h, alice)
+	expectPresence(t, "bob", bobConn, true)
+	expectPresence(t, "carol", carolConn, true)
+	expectPresence(t, "dave", daveConn)
+
+	// 还有连接时仍然在线
+	disconnected(h, alice)
+	expectPresence(t, "bob", bobConn)
+	var user User
+	db.First(&user, alice)
+	if !user.Online || user.Connections != 1 {
+		t.Errorf("断开一个连接后 online=%v connections=%d; 期望 true 1", user.Online, user.Connections)
+	}
+
+	// 最后一个连接断开时下线并记录最后在线时间
+	disconnected(h, alice)
+	expectPresence(t, "bob", bobConn, false)
+	expectPresence(t, "carol", carolConn, false)
+	expectPresence(t, "dave", daveConn)
+	user = User{}
+	db.First(&user, alice)
+	if user.Online || user.Connections != 0 || user.LastSeenAt == nil {
+		t.Errorf("全部断开后 online=%v connections=%d last_seen_at=%v", user.Online, user.Connections, user.LastSeenAt)
+	}
+
+	// 多余的断开不会使连接数变为负数
+	disconnected(h, alice)
+	connected(h, alice)
+	expectPresence(t, "bob", bobConn, true)
+}
+
+func TestSweepStaleNodes(t *testing.T) {
+	db = initDatabase(filepath.Join(t.TempDir(), "chat.db"))
+	users := []User{{Username: "alice"}, {Username: "bob"}, {Username: "carol"}}
+	db.Create(&users)
+	alice, bob, carol := users[0].ID, users[1].ID, users[2].ID
+	db.Create(&Room{Name: "general"})
+	db.Create(&[]RoomMember{{RoomID: 1, UserID: alice}, {RoomID: 1, UserID: bob}, {RoomID: 1, UserID: carol}})
+	h := startHub(t, nil)
+	carolConn := testClient(h, carol)
+
+	// 另一个节点上有 alice 和 bob 的连接，之后该节点崩溃，心跳不再刷新
+	now := time.Now()
+	self := nodeID
+	nodeID = "crashed"
+	heartbeat(now.Add(-2 * nodeTTL))
+	connected(h, alice)
+	connected(h, bob)
+	connected(h, bob)
+	nodeID = self
+	heartbeat(now)
+	connected(h, alice)
+	expectPresence(t, "carol", carolConn, true, true)
+
+	if err := sweepStaleNodes(h, now); err != nil {
+		t.Fatal(err)
+	}
+	expectPresence(t, "carol", carolConn, false)
+	var got []User
+	db.Order("id").Find(&got)
+	if !got[0].Online || got[0].Connections != 1 || got[1].Online || got[1].Connections != 0 {
+		t.Errorf("清除后 alice online=%v connections=%d、bob online=%v connections=%d; 期望 true 1、false 0",
+			got[0].Online, got[0].Connections, got[1].Online, got[1].Connections)
+	}
+	var nodes, conns int64
+	db.Model(&Node{}).Count(&nodes)
+	db.Model(&NodeConnection{}).Where("node_id = ?", "crashed").Count(&conns)
+	if nodes != 1 || conns != 0 {
+		t.Errorf("清除后剩余 %d 个节点、崩溃节点的连接记录 %d 条; 期望 1、0", nodes, conns)
+	}
+
+	// 心跳正常的节点不会被清除；本节点关闭时主动清除自己的连接
+	if err := sweepStaleNodes(h, now.Add(nodeTTL/2)); err != nil {
+		t.Fatal(err)
+	}
+	expectPresence(t, "carol", carolConn)
+	if err := removeNode(h, nodeID, now); err != nil {
+		t.Fatal(err)
+	}
+	expectPresence(t, "carol", carolConn, false)
+
+	// 节点被清除后才断开的连接不会重复扣减
+	disconnected(h, alice)
+	expectPresence(t, "carol", carolConn)
+	var user User
+	db.First(&user, alice)
+	if user.Online || user.Connections != 0 {
+		t.Errorf("重复断开后 online=%v connections=%d; 期望 false 0", user.Online, user.Connections)
+	}
+}
+
+func TestTyping(t *testing.T) {
+	db = initDatabase(filepath.Join(t.TempDir(), "chat.db"))
+	users := []User{{Username: "alice"}, {Username: "bob"}, {Username: "carol"}, {Username: "dave"}}
+	db.Create(&users)
+	alice, bob, carol, dave := users[0].ID, users[1].ID, users[2].ID, users[3].ID
+	db.Create(&Room{Name: "general"})
+	db.Create(&[]RoomMember{{RoomID: 1, UserID: alice}, {RoomID: 1, UserID: bob}})
+
+	h := startHub(t, nil)
+	aliceConn := testClient(h, alice, 1)
+	bobConn := testClient(h, bob, 1)
+	carolConn := testClient(h, carol)
+	daveConn := testClient(h, dave)
+
+	// 只转发给目标聊天室的成员或私聊对象，user_id 由服务端填写
+	expectTyping := func(name string, c *Client, want *TypingPayload) {
+		t.Helper()
+		frames := decodeFrames(t, c)
+		if want == nil {
+			if len(frames) != 0 {
+				t.Errorf("%s 收到 %+v; 期望没有帧", name, frames)
+			}
+			return
+		}
+		var got TypingPayload
+		if len(frames) == 1 && frames[0].Type == FrameTyping {
+			json.Unmarshal(frames[0].Data, &got)
+		}
+		if got != *want {
+			t.Errorf("%s 收到 %+v; 期望 typing %+v", name, frames, *want)
+		}
+	}
+	aliceConn.handleFrame([]byte(`{"v":1,"type":"typing","data":{"room_id":1,"user_id":4,"typing":true}}`))
+	expectTyping("bob", bobConn, &TypingPayload{RoomID: 1, UserID: alice, Typing: true})
+	expectTyping("carol", carolConn, nil)
+	expectTyping("dave", daveConn, nil)
+	received(aliceConn)
+
+	aliceConn.handleFrame([]byte(fmt.Sprintf(`{"v":1,"type":"typing","data":{"to_id":%d,"typing":false}}`, dave)))
+	expectTyping("dave", daveConn, &TypingPayload{ToID: dave, UserID: alice})
+	expectTyping("bob", bobConn, nil)
+	expectTyping("carol", carolConn, nil)
+	expectTyping("alice", aliceConn, nil)
+
+	// 规则与发送消息相同，不是成员或对象不存在时回复错误
+	expectError(t, carolConn, `{"v":1,"type":"typing","data":{"room_id":1,"typing":true}}`, "", ErrCodeForbidden)
+	expectError(t, carolConn, `{"v":1,"type":"typing","data":{"to_id":99,"typing":true}}`, "", ErrCodeNotFound)
+	expectError(t, carolConn, `{"v":1,"type":"typing","data":{"typing":true}}`, "", ErrCodeInvalid)
+	expectTyping("bob", bobConn, nil)
+	expectTyping("alice", aliceConn, nil)
+}
+
+func TestPresenceQuery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db = initDatabase(filepath.Join(t.TempDir(), "chat.db"))
+	users := []User{{Username: "alice", Online: true}, {Username: "bob"}, {Username: "carol"}, {Username: "dave"}}
+	db.Create(&users)
+	alice, bob, carol := users[0].ID, users[1].ID, users[2].ID
+	db.Create(&Room{Name: "general"})
+	db.Create(&[]RoomMember{{RoomID: 1, UserID: alice}, {RoomID: 1, UserID: bob}})
+	db.Create(&Message{FromID: carol, ToID: alice, Content: "hi"})
+	token, _, err := generateToken(alice, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := setupRouter()
+	query := func(ids string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/presence?user_ids="+ids, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// 自己、聊天室成员和私聊过的用户可见，无关和不存在的用户不返回
+	w := query("1,2,3,4,99")
+	var resp struct{ Data []PresencePayload }
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	var got []uint
+	for _, p := range resp.Data {
+		got = append(got, p.UserID)
+	}
+	if w.Code != http.StatusOK || fmt.Sprint(got) != fmt.Sprint([]uint{alice, bob, carol}) || !resp.Data[0].Online {
+		t.Errorf("查询结果 %d %s; 期望 alice（在线）、bob、carol", w.Code, w.Body)
+	}
+	if w := query("4"); w.Code != http.StatusOK || w.Body.String() != `{"data":[]}` {
+		t.Errorf("只查询无关用户: %d %s; 期望空列表", w.Code, w.Body)
+	}
+
+	hundred := strings.TrimSuffix(strings.Repeat("1,", maxPresenceQuery), ",")
+	if w := query(hundred); w.Code != http.StatusOK {
+		t.Errorf("查询 %d 个用户: %d; 期望 200", maxPresenceQuery, w.Code)
+	}
+	for _, ids := range []string{"", ",", "1,x", "-1", hundred + ",2"} {
+		if w := query(ids); w.Code != http.StatusBadRequest {
+			t.Errorf("user_ids=%q: %d; 期望 400", ids, w.Code)
+		}
+	}
+}
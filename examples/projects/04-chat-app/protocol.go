@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm/clause"
+)
+
+// protocolVersion WebSocket 协议版本，客户端每一帧都要带上 v
+const protocolVersion = 1
+
+// 帧类型
+const (
+	FrameSend     = "send"     // 客户端 → 服务端：发送消息，服务端回 ack
+	FrameMessage  = "message"  // 服务端 → 客户端：新消息
+	FrameAck      = "ack"      // 服务端 → 客户端：请求已处理，id 与请求相同
+	FrameError    = "error"    // 服务端 → 客户端：请求被拒绝，id 与请求相同
+	FrameTyping   = "typing"   // 双向：正在输入
+	FramePresence = "presence" // 服务端 → 客户端：上线 / 下线
+	FrameJoin     = "join"     // 客户端 → 服务端：加入聊天室，服务端回 ack
+	FrameLeave    = "leave"    // 客户端 → 服务端：退出聊天室，服务端回 ack
+)
+
+// 错误码
+const (
+	ErrCodeBadFrame    = "bad_frame"           // 不是合法的 JSON 帧或缺少 id
+	ErrCodeVersion     = "unsupported_version" // 协议版本不支持
+	ErrCodeUnknownType = "unknown_type"        // 未知的帧类型
+	ErrCodeInvalid     = "invalid"             // 内容校验失败
+	ErrCodeForbidden   = "forbidden"           // 不是聊天室成员
+	ErrCodeNotFound    = "not_found"           // 聊天室或接收者不存在
+	ErrCodeInternal    = "internal"            // 服务端错误
+)
+
+// maxClientIDLength 客户端消息 ID 的最大长度
+const maxClientIDLength = 64
+
+// Envelope 所有 WebSocket 帧的外层结构
+type Envelope struct {
+	V    int             `json:"v"`
+	Type string          `json:"type"`
+	ID   string          `json:"id,omitempty"` // 客户端生成的请求 ID，ack 和 error 原样带回
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// SendPayload send 帧的内容，room_id 与 to_id 必须且只能指定一个
+type SendPayload struct {
+	RoomID  uint   `json:"room_id"`
+	ToID    uint   `json:"to_id"`
+	Content string `json:"content"`
+	Type    string `json:"type"`
+}
+
+// AckPayload ack 帧的内容：send 的 ack 带回保存后的消息 ID 和服务端时间
+type AckPayload struct {
+	MessageID uint       `json:"message_id,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	RoomID    uint       `json:"room_id,omitempty"`
+	Duplicate bool       `json:"duplicate,omitempty"` // 重发的消息已保存过，未重复投递
+}
+
+// ErrorPayload error 帧的内容
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// TypingPayload typing 帧的内容，user_id 由服务端填写
+type TypingPayload struct {
+	RoomID uint `json:"room_id"`
+	ToID   uint `json:"to_id"`
+	UserID uint `json:"user_id"`
+	Typing bool `json:"typing"`
+}
+
+// PresencePayload presence 帧的内容，也是在线状态查询接口的返回值；last_seen_at 为最后在线时间
+type PresencePayload struct {
+	UserID     uint       `json:"user_id"`
+	Online     bool       `json:"online"`
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
+}
+
+// RoomPayload join / leave 帧的内容
+type RoomPayload struct {
+	RoomID uint `json:"room_id"`
+}
+
+// encodeFrame 编码服务端发出的帧
+func encodeFrame(frameType, id string, data interface{}) []byte {
+	payload, _ := json.Marshal(data)
+	frame, _ := json.Marshal(Envelope{V: protocolVersion, Type: frameType, ID: id, Data: payload})
+	return frame
+}
+
+// errorCode 将校验错误映射为错误码
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, errNotMember):
+		return ErrCodeForbidden
+	case errors.Is(err, errUnknownUser), errors.Is(err, errRoomNotFound):
+		return ErrCodeNotFound
+	case errors.Is(err, errInvalidTarget), errors.Is(err, errEmptyContent), errors.Is(err, errInvalidType):
+		return ErrCodeInvalid
+	}
+	return ErrCodeInternal
+}
+
+// reply 只发给当前连接，经由 hub 投递，连接已被注销时丢弃
+func (c *Client) reply(frame []byte) {
+	c.Hub.replies <- reply{Client: c, Data: frame}
+}
+
+// replyError 回复 error 帧
+func (c *Client) replyError(id, code, message string) {
+	c.reply(encodeFrame(FrameError, id, ErrorPayload{Code: code, Message: message}))
+}
+
+// handleFrame 处理客户端发来的一帧，出错时在同一连接上回复 error 帧
+func (c *Client) handleFrame(raw []byte) {
+	var env Envelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		c.replyError("", ErrCodeBadFrame, "无法解析的帧: "+err.Error())
+		return
+	}
+	if env.V != protocolVersion {
+		c.replyError(env.ID, ErrCodeVersion, "仅支持协议版本 1")
+		return
+	}
+	// 需要 ack 的请求必须带 id，用于关联回复和去重
+	if env.Type != FrameTyping && (env.ID == "" || utf8.RuneCountInString(env.ID) > maxClientIDLength) {
+		c.replyError(env.ID, ErrCodeBadFrame, "id 不能为空且不能超过 64 个字符")
+		return
+	}
+
+	var err error
+	switch env.Type {
+	case FrameSend:
+		err = c.handleSend(env)
+	case FrameTyping:
+		err = c.handleTyping(env)
+	case FrameJoin, FrameLeave:
+		err = c.handleMembership(env)
+	default:
+		c.replyError(env.ID, ErrCodeUnknownType, "未知的帧类型: "+env.Type)
+		return
+	}
+	if err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+			c.replyError(env.ID, ErrCodeBadFrame, "data 格式错误: "+err.Error())
+			return
+		}
+		c.replyError(env.ID, errorCode(err), err.Error())
+	}
+}
+
+// handleSend 保存并投递消息，然后回复 ack；同一发送者重发相同 id 时只回复 ack
+func (c *Client) handleSend(env Envelope) error {
+	var payload SendPayload
+	if err := json.Unmarshal(env.Data, &payload); err != nil {
+		return err
+	}
+	msg := Message{
+		FromID:    c.ID,
+		ToID:      payload.ToID,
+		RoomID:    payload.RoomID,
+		Content:   payload.Content,
+		Type:      payload.Type,
+		ClientID:  &env.ID,
+		CreatedAt: time.Now(),
+	}
+	if err := validateMessage(&msg); err != nil {
+		return err
+	}
+	// 唯一索引保证并发重发时只有一次插入成功，其余按重复处理
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&msg)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		var existing Message
+		if err := db.Where("from_id = ? AND client_id = ?", c.ID, env.ID).First(&existing).Error; err != nil {
+			return err
+		}
+		c.reply(encodeFrame(FrameAck, env.ID, AckPayload{MessageID: existing.ID, CreatedAt: &existing.CreatedAt, Duplicate: true}))
+		return nil
+	}
+	deliverMessage(c.Hub, msg)
+	c.reply(encodeFrame(FrameAck, env.ID, AckPayload{MessageID: msg.ID, CreatedAt: &msg.CreatedAt}))
+	return nil
+}
+
+// handleTyping 转发正在输入状态，规则与消息相同，不保存也不回复 ack
+func (c *Client) handleTyping(env Envelope) error {
+	var payload TypingPayload
+	if err := json.Unmarshal(env.Data, &payload); err != nil {
+		return err
+	}
+	payload.UserID = c.ID
+	// 借用消息校验规则，内容仅用于通过非空检查
+	if err := validateMessage(&Message{FromID: c.ID, RoomID: payload.RoomID, ToID: payload.ToID, Content: FrameTyping}); err != nil {
+		return err
+	}
+	d := delivery{RoomID: payload.RoomID, Data: encodeFrame(FrameTyping, "", payload)}
+	if payload.RoomID == 0 {
+		d.UserIDs = []uint{payload.ToID}
+	}
+	c.Hub.publish(Event{Delivery: &d})
+	return nil
+}
+
+// handleMembership 加入或退出聊天室，与 HTTP 接口效果相同
+func (c *Client) handleMembership(env Envelope) error {
+	var payload RoomPayload
+	if err := json.Unmarshal(env.Data, &payload); err != nil {
+		return err
+	}
+	var err error
+	if env.Type == FrameJoin {
+		_, err = addRoomMember(c.Hub, c.ID, payload.RoomID)
+	} else {
+		err = removeRoomMember(c.Hub, c.ID, payload.RoomID)
+	}
+	if err != nil {
+		return err
+	}
+	c.reply(encodeFrame(FrameAck, env.ID, AckPayload{RoomID: payload.RoomID}))
+	return nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// frameTypes 按类型索引收到的帧，message 与 ack 的先后顺序不保证
+func frameTypes(frames []Envelope) map[string]Envelope {
+	byType := make(map[string]Envelope, len(frames))
+	for _, f := range frames {
+		byType[f.Type] = f
+	}
+	return byType
+}
+
+// decodeFrames 解析客户端收到的所有帧
+func decodeFrames(t *testing.T, c *Client) []Envelope {
+	t.Helper()
+	var frames []Envelope
+	for _, raw := range received(c) {
+		var env Envelope
+		if err := json.Unmarshal([]byte(raw), &env); err != nil {
+			t.Fatalf("无法解析服务端帧 %s: %v", raw, err)
+		}
+		frames = append(frames, env)
+	}
+	return frames
+}
+
+func expectError(t *testing.T, c *Client, raw, id, code string) {
+	t.Helper()
+	c.handleFrame([]byte(raw))
+	frames := decodeFrames(t, c)
+	if len(frames) != 1 || frames[0].Type != FrameError || frames[0].ID != id {
+		t.Fatalf("%s: 收到 %+v; 期望 id=%q 的 error 帧", raw, frames, id)
+	}
+	var payload ErrorPayload
+	json.Unmarshal(frames[0].Data, &payload)
+	if payload.Code != code {
+		t.Errorf("%s: 错误码 %q; 期望 %q", raw, payload.Code, code)
+	}
+}
+
+func TestProtocolSendAckAndErrors(t *testing.T) {
+	db = initDatabase(filepath.Join(t.TempDir(), "chat.db"))
+	alice, bob := User{Username: "alice"}, User{Username: "bob"}
+	db.Create(&alice)
+	db.Create(&bob)
+	room := Room{Name: "general"}
+	db.Create(&room)
+
+	h := startHub(t, nil)
+	aliceConn := testClient(h, alice.ID)
+	bobConn := testClient(h, bob.ID)
+
+	expectError(t, aliceConn, `not json`, "", ErrCodeBadFrame)
+	expectError(t, aliceConn, `{"v":2,"type":"send","id":"m0"}`, "m0", ErrCodeVersion)
+	expectError(t, aliceConn, `{"v":1,"type":"shout","id":"m0"}`, "m0", ErrCodeUnknownType)
+	expectError(t, aliceConn, `{"v":1,"type":"send","data":{"to_id":2,"content":"hi"}}`, "", ErrCodeBadFrame)
+	expectError(t, aliceConn, `{"v":1,"type":"send","id":"m1","data":{"room_id":1,"content":"hi"}}`, "m1", ErrCodeForbidden)
+	expectError(t, aliceConn, `{"v":1,"type":"send","id":"m1","data":{"to_id":99,"content":"hi"}}`, "m1", ErrCodeNotFound)
+	expectError(t, aliceConn, `{"v":1,"type":"send","id":"m1","data":{"to_id":2,"content":"  "}}`, "m1", ErrCodeInvalid)
+	expectError(t, aliceConn, `{"v":1,"type":"send","id":"m1","data":{"to_id":"bob"}}`, "m1", ErrCodeBadFrame)
+	if got := received(bobConn); len(got) != 0 {
+		t.Fatalf("被拒绝的请求不应投递: %q", got)
+	}
+
+	// 发送者由连接决定，data 中的 from_id 被忽略
+	send := `{"v":1,"type":"send","id":"m2","data":{"to_id":2,"from_id":2,"content":"hi bob"}}`
+	aliceConn.handleFrame([]byte(send))
+	frames := decodeFrames(t, aliceConn)
+	byType := frameTypes(frames)
+	if len(frames) != 2 || byType[FrameMessage].Data == nil || byType[FrameAck].ID != "m2" {
+		t.Fatalf("发送者收到 %+v; 期望 message 和 ack", frames)
+	}
+	var ack AckPayload
+	json.Unmarshal(byType[FrameAck].Data, &ack)
+	var saved Message
+	db.First(&saved, ack.MessageID)
+	if saved.FromID != alice.ID || saved.ClientID == nil || *saved.ClientID != "m2" || ack.CreatedAt == nil || !ack.CreatedAt.Equal(saved.CreatedAt) {
+		t.Errorf("ack %+v 与保存的消息 %+v 不一致", ack, saved)
+	}
+	bobFrames := decodeFrames(t, bobConn)
+	if len(bobFrames) != 1 || bobFrames[0].Type != FrameMessage {
+		t.Fatalf("bob 收到 %+v; 期望一条 message", bobFrames)
+	}
+
+	// 重发相同 id 只回复 ack，不重复保存和投递
+	aliceConn.handleFrame([]byte(send))
+	frames = decodeFrames(t, aliceConn)
+	var dup AckPayload
+	if len(frames) == 1 && frames[0].Type == FrameAck {
+		json.Unmarshal(frames[0].Data, &dup)
+	}
+	if !dup.Duplicate || dup.MessageID != ack.MessageID {
+		t.Errorf("重发收到 %+v; 期望原消息的 ack", frames)
+	}
+	expectReceived(t, "bob", bobConn)
+
+	// 通过 join 帧加入聊天室后可以发送聊天室消息
+	aliceConn.handleFrame([]byte(`{"v":1,"type":"join","id":"j1","data":{"room_id":1}}`))
+	if frames := decodeFrames(t, aliceConn); len(frames) != 1 || frames[0].Type != FrameAck || frames[0].ID != "j1" {
+		t.Fatalf("join 收到 %+v; 期望 ack", frames)
+	}
+	aliceConn.handleFrame([]byte(`{"v":1,"type":"send","id":"m3","data":{"room_id":1,"content":"hello room"}}`))
+	if frames := decodeFrames(t, aliceConn); len(frames) != 2 || frameTypes(frames)[FrameAck].ID != "m3" {
+		t.Errorf("聊天室消息收到 %+v; 期望 message 和 ack", frames)
+	}
+}
+
+func TestSendDedupConcurrent(t *testing.T) {
+	db = initDatabase(filepath.Join(t.TempDir(), "chat.db"))
+	alice, bob := User{Username: "alice"}, User{Username: "bob"}
+	db.Create(&alice)
+	db.Create(&bob)
+	h := startHub(t, nil)
+
+	// 同一用户的多个连接同时重发相同 id，只有一次插入成功
+	conns := make([]*Client, 4)
+	for i := range conns {
+		conns[i] = testClient(h, alice.ID)
+	}
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			c.handleFrame([]byte(`{"v":1,"type":"send","id":"m1","data":{"to_id":2,"content":"hi"}}`))
+		}(c)
+	}
+	wg.Wait()
+
+	acks, duplicates := map[uint]bool{}, 0
+	for _, c := range conns {
+		for _, f := range decodeFrames(t, c) {
+			if f.Type != FrameAck || f.ID != "m1" {
+				continue
+			}
+			var ack AckPayload
+			json.Unmarshal(f.Data, &ack)
+			acks[ack.MessageID] = true
+			if ack.Duplicate {
+				duplicates++
+			}
+		}
+	}
+	var saved int64
+	db.Model(&Message{}).Where("from_id = ? AND client_id = ?", alice.ID, "m1").Count(&saved)
+	if saved != 1 || len(acks) != 1 || duplicates != len(conns)-1 {
+		t.Errorf("保存 %d 条、ack 指向 %d 条消息、重复 %d 次; 期望 1、1、%d", saved, len(acks), duplicates, len(conns)-1)
+	}
+
+	// 不同发送者可以使用相同的 id，HTTP 发送的消息没有 client_id，互不冲突
+	testClient(h, bob.ID).handleFrame([]byte(`{"v":1,"type":"send","id":"m1","data":{"to_id":1,"content":"hi"}}`))
+	db.Create(&[]Message{{FromID: alice.ID, ToID: bob.ID, Content: "http 1"}, {FromID: alice.ID, ToID: bob.ID, Content: "http 2"}})
+	var total, withoutID int64
+	db.Model(&Message{}).Count(&total)
+	db.Model(&Message{}).Where("client_id IS NULL").Count(&withoutID)
+	if total != 4 || withoutID != 2 {
+		t.Errorf("共 %d 条、没有 client_id 的 %d 条; 期望 4、2", total, withoutID)
+	}
+}
+
+func TestMigrateMessageClientIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.db")
+	old, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 旧版本的普通索引：HTTP 消息的 client_id 为空字符串，并发重发可能留下重复消息
+	type legacyMessage struct {
+		ID       uint
+		FromID   uint   `gorm:"index:idx_message_client"`
+		ClientID string `gorm:"index:idx_message_client"`
+	}
+	if err := old.Table("messages").AutoMigrate(&legacyMessage{}); err != nil {
+		t.Fatal(err)
+	}
+	old.Exec(`INSERT INTO messages (id, from_id, client_id) VALUES (1, 1, ''), (2, 1, ''), (3, 1, 'm1'), (4, 1, 'm1'), (5, 2, 'm1')`)
+	if sqlDB, err := old.DB(); err == nil {
+		sqlDB.Close()
+	}
+
+	db = initDatabase(path)
+	var ids []string
+	for _, m := range func() (ms []Message) { db.Order("id").Find(&ms); return }() {
+		id := "-"
+		if m.ClientID != nil {
+			id = *m.ClientID
+		}
+		ids = append(ids, fmt.Sprint(m.ID, ":", id))
+	}
+	if got := strings.Join(ids, " "); got != "1:- 2:- 3:m1 4:- 5:m1" {
+		t.Errorf("迁移后 %s; 期望 1:- 2:- 3:m1 4:- 5:m1", got)
+	}
+	var unique []bool
+	db.Raw(`SELECT "unique" FROM pragma_index_list('messages') WHERE name = 'idx_message_client'`).Scan(&unique)
+	if len(unique) != 1 || !unique[0] {
+		t.Errorf("idx_message_client unique=%v; 期望唯一索引", unique)
+	}
+	dup := "m1"
+	if err := db.Create(&Message{FromID: 1, ClientID: &dup}).Error; err == nil {
+		t.Error("迁移后仍能插入重复的 client_id")
+	}
+}
+
+func TestSendMessageHTTP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db = initDatabase(filepath.Join(t.TempDir(), "chat.db"))
+	hub = startHub(t, nil)
+	alice, bob := User{Username: "alice"}, User{Username: "bob"}
+	db.Create(&alice)
+	db.Create(&bob)
+	bobConn := testClient(hub, bob.ID)
+	token, _, err := generateToken(alice.ID, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := setupRouter()
+	post := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/api/messages", strings.NewReader(fmt.Sprintf(`{"to_id":%d,"content":"hi"}`, bob.ID)))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := post(); code != http.StatusCreated {
+		t.Fatalf("发送消息: %d; 期望 201", code)
+	}
+	if frames := decodeFrames(t, bobConn); len(frames) != 1 || frames[0].Type != FrameMessage {
+		t.Fatalf("bob 收到 %+v; 期望一条 message", frames)
+	}
+
+	// 保存失败时返回 500，不投递未保存的消息
+	db.Callback().Create().Before("gorm:create").Register("test:fail", func(tx *gorm.DB) {
+		tx.AddError(errors.New("磁盘已满"))
+	})
+	if code := post(); code != http.StatusInternalServerError {
+		t.Errorf("保存失败: %d; 期望 500", code)
+	}
+	expectReceived(t, "bob", bobConn)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMain(m *testing.M) {
+	// 缩短连接参数，读写协程启动前设置，避免与其读取产生竞争
+	writeWait = time.Second
+	pongWait = 300 * time.Millisecond
+	pingPeriod = 100 * time.Millisecond
+	maxMessageSize = 1024
+	os.Exit(m.Run())
+}
+
+// dialPair 建立一对 WebSocket 连接，返回服务端和客户端两端
+func dialPair(t *testing.T) (server, client *websocket.Conn) {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(srv.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return <-conns, client
+}
+
+// startClient 在 h 中注册一个真实连接并启动读写协程
+func startClient(t *testing.T, h *Hub, userID uint) *websocket.Conn {
+	server, client := dialPair(t)
+	c := &Client{ID: userID, Conn: server, Send: make(chan []byte, sendBufferSize), Hub: h}
+	h.register <- c
+	go c.writePump()
+	go c.readPump()
+	return client
+}
+
+func online(h *Hub, userID uint) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.users[userID]) > 0
+}
+
+// expectClose 读取直到连接关闭，检查关闭码
+func expectClose(t *testing.T, conn *websocket.Conn, code int) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, code) {
+			t.Errorf("连接以 %v 结束; 期望关闭码 %d", err, code)
+		}
+		return
+	}
+}
+
+func TestWritePumpBatchesQueuedFrames(t *testing.T) {
+	server, client := dialPair(t)
+	c := &Client{Conn: server, Send: make(chan []byte, 8)}
+	c.Send <- []byte(`{"n":1}`)
+	c.Send <- []byte(`{"n":2}`)
+	c.Send <- []byte(`{"n":3}`)
+	close(c.Send)
+	go c.writePump()
+
+	_, data, err := client.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "{\"n\":1}\n{\"n\":2}\n{\"n\":3}"; string(data) != want {
+		t.Errorf("收到 %q; 期望合并为 %q", data, want)
+	}
+	expectClose(t, client, websocket.CloseNormalClosure)
+}
+
+func TestSlowConsumerEviction(t *testing.T) {
+	db = initDatabase(filepath.Join(t.TempDir(), "chat.db"))
+	h := startHub(t, nil)
+	slow := testClient(h, 1, 10)
+	db.Create(&RoomMember{RoomID: 10, UserID: 2})
+	fast := &Client{ID: 2, Send: make(chan []byte, 64), Hub: h}
+	h.register <- fast
+
+	// 投递与注销并发进行，被断开的连接只关闭一次 Send
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < cap(slow.Send)+4; i++ {
+			h.publish(Event{Delivery: &delivery{RoomID: 10, Data: []byte("x")}})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		h.unregister <- slow
+	}()
+	wg.Wait()
+
+	for range slow.Send {
+	}
+	if online(h, 1) {
+		t.Error("慢消费者应被移出 hub")
+	}
+	if got := len(received(fast)); got != cap(slow.Send)+4 {
+		t.Errorf("正常连接收到 %d 条; 期望 %d 条", got, cap(slow.Send)+4)
+	}
+}
+
+func TestEvictedClientReceivesTryAgainLater(t *testing.T) {
+	db = initDatabase(filepath.Join(t.TempDir(), "chat.db"))
+	h := startHub(t, nil)
+	server, client := dialPair(t)
+	c := &Client{ID: 1, Conn: server, Send: make(chan []byte, 1), Hub: h}
+	h.register <- c
+	h.publish(Event{Delivery: &delivery{UserIDs: []uint{1}, Data: []byte("first")}})
+	h.publish(Event{Delivery: &delivery{UserIDs: []uint{1}, Data: []byte("overflow")}})
+	// 缓冲中有帧且用户已离线，说明 overflow 触发了断开
+	for len(c.Send) == 0 || online(h, 1) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// 缓冲中已有的帧仍会写出，随后以 1013 关闭
+	go c.writePump()
+	if _, data, err := client.ReadMessage(); err != nil || string(data) != "first" {
+		t.Fatalf("收到 %q, %v; 期望 first", data, err)
+	}
+	expectClose(t, client, websocket.CloseTryAgainLater)
+}
+
+func TestKeepalive(t *testing.T) {
+	db = initDatabase(filepath.Join(t.TempDir(), "chat.db"))
+	h := startHub(t, nil)
+
+	// 持续读取的客户端会自动回复 pong，保持在线
+	alive := startClient(t, h, 1)
+	go func() {
+		for {
+			if _, _, err := alive.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	// 不读取的客户端不会回复 pong，超过 pongWait 后被断开
+	startClient(t, h, 2)
+
+	time.Sleep(3 * pongWait)
+	if !online(h, 1) {
+		t.Error("回复 pong 的连接被断开")
+	}
+	if online(h, 2) {
+		t.Error("不回复 pong 的连接应被断开")
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	db = initDatabase(filepath.Join(t.TempDir(), "chat.db"))
+	h := startHub(t, nil)
+	client := startClient(t, h, 1)
+
+	client.WriteMessage(websocket.TextMessage, make([]byte, maxMessageSize+1))
+	expectClose(t, client, websocket.CloseMessageTooBig)
+	deadline := time.Now().Add(time.Second)
+	for online(h, 1) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if online(h, 1) {
+		t.Error("超出大小限制的连接应被注销")
+	}
+}
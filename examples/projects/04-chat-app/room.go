@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// RoomMember 聊天室成员，只有成员能收发该聊天室的消息
+type RoomMember struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	RoomID    uint      `json:"room_id" gorm:"uniqueIndex:idx_room_member"`
+	UserID    uint      `json:"user_id" gorm:"uniqueIndex:idx_room_member;index"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// errRoomNotFound 聊天室不存在
+var errRoomNotFound = errors.New("聊天室不存在")
+
+// parseID 解析路径中的 :id 参数，无效时返回 0
+func parseID(c *gin.Context) uint {
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+	return uint(id)
+}
+
+// isRoomMember 判断用户是否为聊天室成员
+func isRoomMember(userID, roomID uint) bool {
+	var count int64
+	db.Model(&RoomMember{}).Where("room_id = ? AND user_id = ?", roomID, userID).Count(&count)
+	return count > 0
+}
+
+// userRooms 用户已加入的聊天室
+func userRooms(userID uint) []uint {
+	var rooms []uint
+	db.Model(&RoomMember{}).Where("user_id = ?", userID).Pluck("room_id", &rooms)
+	return rooms
+}
+
+// addRoomMember 加入聊天室，已加入时直接返回；用户的所有在线连接立即开始接收该聊天室的消息
+func addRoomMember(h *Hub, userID, roomID uint) (RoomMember, error) {
+	member := RoomMember{RoomID: roomID, UserID: userID}
+	if db.Select("id").First(&Room{}, roomID).Error != nil {
+		return member, errRoomNotFound
+	}
+	if err := db.Where(member).FirstOrCreate(&member).Error; err != nil {
+		return member, err
+	}
+	h.publish(Event{Membership: &membership{UserID: userID, RoomID: roomID, Join: true}})
+	return member, nil
+}
+
+// removeRoomMember 退出聊天室，未加入时也视为成功
+func removeRoomMember(h *Hub, userID, roomID uint) error {
+	if err := db.Where("room_id = ? AND user_id = ?", roomID, userID).Delete(&RoomMember{}).Error; err != nil {
+		return err
+	}
+	h.publish(Event{Membership: &membership{UserID: userID, RoomID: roomID, Join: false}})
+	return nil
+}
+
+// handleCreateRoom 创建聊天室，创建者自动加入
+func handleCreateRoom(c *gin.Context) {
+	var room Room
+	if err := c.ShouldBindJSON(&room); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	room.ID, room.Name = 0, strings.TrimSpace(room.Name)
+	if room.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "聊天室名称不能为空"})
+		return
+	}
+	userID := currentUserID(c)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&room).Error; err != nil {
+			return err
+		}
+		return tx.Create(&RoomMember{RoomID: room.ID, UserID: userID}).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	hub.publish(Event{Membership: &membership{UserID: userID, RoomID: room.ID, Join: true}})
+	c.JSON(http.StatusCreated, gin.H{"data": room})
+}
+
+// handleListRooms 获取聊天室列表，joined 表示当前用户是否已加入
+func handleListRooms(c *gin.Context) {
+	var rooms []Room
+	db.Find(&rooms)
+	joined := make(map[uint]bool)
+	for _, id := range userRooms(currentUserID(c)) {
+		joined[id] = true
+	}
+	data := make([]gin.H, len(rooms))
+	for i, room := range rooms {
+		data[i] = gin.H{"id": room.ID, "name": room.Name, "created_at": room.CreatedAt, "joined": joined[room.ID]}
+	}
+	c.JSON(http.StatusOK, gin.H{"data": data})
+}
+
+// handleJoinRoom 加入聊天室，已加入时直接返回成功
+func handleJoinRoom(c *gin.Context) {
+	member, err := addRoomMember(hub, currentUserID(c), parseID(c))
+	if errors.Is(err, errRoomNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": member})
+}
+
+// handleLeaveRoom 退出聊天室
+func handleLeaveRoom(c *gin.Context) {
+	if err := removeRoomMember(hub, currentUserID(c), parseID(c)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "已退出"})
+}
+
+// handleListRoomMembers 聊天室成员列表，只有成员可以查看
+func handleListRoomMembers(c *gin.Context) {
+	roomID := parseID(c)
+	if !isRoomMember(currentUserID(c), roomID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": errNotMember.Error()})
+		return
+	}
+	var users []User
+	db.Joins("JOIN room_members ON room_members.user_id = users.id").
+		Where("room_members.room_id = ?", roomID).Order("users.id").Find(&users)
+	c.JSON(http.StatusOK, gin.H{"data": users})
+}